@@ -5,17 +5,39 @@ import (
 	"strings"
 	"time"
 
+	"sql/token"
 	"sql/tools"
 )
 
 // Query represents a collection of ordered statements.
 type Query struct {
 	Statements Statements
+
+	// Comments found in the query string, in source order.
+	// Only populated when the parser is asked to keep comments.
+	Comments Comments
 }
 
-// String returns a string representation of the query.
+// String returns a string representation of the query. Statements are
+// separated by ";\n" with no trailing semicolon, and a query without
+// statements is "", so the result parses back to the same statements.
 func (q *Query) String() string { return q.Statements.String() }
 
+// Comment represents a line ("-- ...") or block ("/* ... */") comment.
+type Comment struct {
+	// Text of the comment, including its delimiters.
+	Text string
+
+	// Position of the first character of the comment.
+	Pos token.Pos
+}
+
+// String returns the text of the comment.
+func (c *Comment) String() string { return c.Text }
+
+// Comments represents a list of comments.
+type Comments []*Comment
+
 // Statements represents a list of statements.
 type Statements []Statement
 
@@ -35,7 +57,8 @@ type Field struct {
 }
 
 // Name returns the name of the field. Returns alias, if set.
-// Otherwise, uses the function name or variable name.
+// Otherwise, uses the function name or variable name. The name of a call
+// with a single variable argument includes it, such as "max_value".
 func (f *Field) Name() string {
 	// Return alias, if set.
 	if f.Alias != "" {
@@ -45,6 +68,11 @@ func (f *Field) Name() string {
 	// Return the function name or variable name, if available.
 	switch expr := f.Expr.(type) {
 	case *Call:
+		if len(expr.Args) == 1 {
+			if ref, ok := expr.Args[0].(*VarRef); ok {
+				return expr.Name + "_" + ref.Val
+			}
+		}
 		return expr.Name
 	case *BinaryExpr:
 		return expr.Name()
@@ -105,10 +133,10 @@ func (a Fields) FieldExprByName(name string) (int, Expr) {
 		for i, f := range a {
 			if f.Name() == name {
 				return i, f.Expr
-			} else if call, ok := f.Expr.(*Call); ok && (call.Name == "top" || call.Name == "bottom") && len(call.Args) > 2 {
-				for _, arg := range call.Args[1 : len(call.Args)-1] {
-					if arg, ok := arg.(*VarRef); ok && arg.Val == name {
-						return i, arg
+			} else if call, ok := f.Expr.(*Call); ok {
+				for _, tag := range call.SelectorTags() {
+					if tag.Val == name {
+						return i, &tag
 					}
 				}
 			}
@@ -186,8 +214,13 @@ func (a Dimensions) Normalize() (time.Duration, []string) {
 	for _, dim := range a {
 		switch expr := dim.Expr.(type) {
 		case *Call:
-			lit, _ := expr.Args[0].(*DurationLiteral)
-			dur = lit.Val
+			// Only time(<duration>) is an interval. Other calls are
+			// not valid dimensions and are ignored.
+			if len(expr.Args) > 0 {
+				if lit, ok := expr.Args[0].(*DurationLiteral); ok {
+					dur = lit.Val
+				}
+			}
 		case *VarRef:
 			tags = append(tags, expr.Val)
 		}
@@ -0,0 +1,162 @@
+package ast
+
+import (
+	"reflect"
+	"strings"
+
+	"sql/token"
+)
+
+// SimplifyCondition returns a simplified copy of a condition. It is purely
+// syntactic:
+//
+//   - true is removed from AND and false from OR,
+//   - x AND false is false and x OR true is true,
+//   - identical operands of the same AND or OR are kept once,
+//   - parentheses that do not change the meaning are removed.
+//
+// The input is not modified, but the result may share nodes with it.
+func SimplifyCondition(expr Expr) Expr {
+	expr, _ = simplifyCondition(expr, false)
+	return expr
+}
+
+// SimplifyConditionDetect simplifies a condition like SimplifyCondition and
+// also detects contradictions: an AND that compares the same VarRef for
+// equality with two different literals of the same kind, such as
+// host = 'a' AND host = 'b', can never be true and is replaced with false.
+// Comparisons of time are left alone, since different strings can be the
+// same time.
+func SimplifyConditionDetect(expr Expr) (simplified Expr, contradictionDetected bool) {
+	return simplifyCondition(expr, true)
+}
+
+func simplifyCondition(expr Expr, detect bool) (Expr, bool) {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		return simplifyCondition(e.Expr, detect)
+	case *BinaryExpr:
+		if e.Op == token.AND || e.Op == token.OR {
+			return simplifyLogical(e.Op, e, detect)
+		}
+	}
+	return expr, false
+}
+
+// simplifyLogical simplifies a chain of op, which is AND or OR.
+func simplifyLogical(op token.Token, expr Expr, detect bool) (Expr, bool) {
+	// The literal that decides the chain, false for AND and true for OR,
+	// and the one that has no effect on it.
+	isAbsorbing, isIdentity := isFalseLiteral, isTrueLiteral
+	if op == token.OR {
+		isAbsorbing, isIdentity = isTrueLiteral, isFalseLiteral
+	}
+
+	var operands []Expr
+	var contradiction bool
+	seen := make(map[string]bool)
+	for _, operand := range logicalOperands(op, expr, nil) {
+		operand, c := simplifyCondition(operand, detect)
+		contradiction = contradiction || c
+
+		if isAbsorbing(operand) {
+			return &BooleanLiteral{Val: op == token.OR}, contradiction
+		} else if isIdentity(operand) {
+			continue
+		}
+
+		if s := operand.String(); !seen[s] {
+			seen[s] = true
+			operands = append(operands, operand)
+		}
+	}
+
+	if detect && op == token.AND && hasConflictingEqualities(operands) {
+		return &BooleanLiteral{Val: false}, true
+	}
+
+	if len(operands) == 0 {
+		return &BooleanLiteral{Val: op == token.AND}, contradiction
+	} else if len(operands) == 1 {
+		// The operand is all that is left of the chain, so it needs no
+		// parentheses.
+		return operands[0], contradiction
+	}
+	result := parenthesize(op, operands[0])
+	for _, operand := range operands[1:] {
+		result = &BinaryExpr{Op: op, LHS: result, RHS: parenthesize(op, operand)}
+	}
+	return result, contradiction
+}
+
+// logicalOperands appends the operands of a chain of op to a, looking
+// through parentheses.
+func logicalOperands(op token.Token, expr Expr, a []Expr) []Expr {
+	for {
+		paren, ok := expr.(*ParenExpr)
+		if !ok {
+			break
+		}
+		expr = paren.Expr
+	}
+	if e, ok := expr.(*BinaryExpr); ok && e.Op == op {
+		a = logicalOperands(op, e.LHS, a)
+		return logicalOperands(op, e.RHS, a)
+	}
+	return append(a, expr)
+}
+
+// parenthesize wraps an operand of op in parentheses if it binds less tightly.
+func parenthesize(op token.Token, expr Expr) Expr {
+	if e, ok := expr.(*BinaryExpr); ok && e.Op.Precedence() < op.Precedence() {
+		return &ParenExpr{Expr: expr}
+	}
+	return expr
+}
+
+// hasConflictingEqualities returns true if two of the operands compare the
+// same VarRef for equality with different literals of the same kind.
+func hasConflictingEqualities(operands []Expr) bool {
+	values := make(map[string]Literal)
+	for _, operand := range operands {
+		ref, lit, ok := equality(operand)
+		if !ok {
+			continue
+		}
+		key := ref.String()
+		if prev, ok := values[key]; !ok {
+			values[key] = lit
+		} else if sameKind(prev, lit) && prev.String() != lit.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// equality returns the VarRef and literal of a comparison like host = 'a',
+// written either way around. Comparisons of time are ignored.
+func equality(expr Expr) (*VarRef, Literal, bool) {
+	e, ok := expr.(*BinaryExpr)
+	if !ok || e.Op != token.EQ {
+		return nil, nil, false
+	}
+	ref, ok := e.LHS.(*VarRef)
+	lit, ok2 := e.RHS.(Literal)
+	if !ok || !ok2 {
+		ref, ok = e.RHS.(*VarRef)
+		lit, ok2 = e.LHS.(Literal)
+	}
+	if !ok || !ok2 || strings.EqualFold(ref.Val, "time") {
+		return nil, nil, false
+	}
+	switch lit.(type) {
+	case *StringLiteral, *IntegerLiteral, *UnsignedLiteral, *NumberLiteral, *BooleanLiteral:
+		return ref, lit, true
+	}
+	return nil, nil, false
+}
+
+// sameKind returns true if two literals have the same type.
+func sameKind(a, b Literal) bool {
+	return reflect.TypeOf(a) == reflect.TypeOf(b)
+}
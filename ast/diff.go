@@ -0,0 +1,186 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DiffKind is the kind of a Difference between two nodes.
+type DiffKind int
+
+const (
+	// DiffMissing is a node of the first tree missing in the second.
+	DiffMissing DiffKind = iota
+	// DiffExtra is a node of the second tree missing in the first.
+	DiffExtra
+	// DiffValue is a value, or a node of a different type, that differs.
+	DiffValue
+)
+
+// String returns the string representation of the kind.
+func (k DiffKind) String() string {
+	switch k {
+	case DiffMissing:
+		return "missing node"
+	case DiffExtra:
+		return "extra node"
+	case DiffValue:
+		return "value mismatch"
+	}
+	return fmt.Sprintf("DiffKind(%d)", int(k))
+}
+
+// Difference is a difference between two trees. Path leads to the differing
+// node or value, as in WalkWithPath, and A and B are the string
+// representations of both sides, or "" for a missing side.
+type Difference struct {
+	Path []PathElem
+	Kind DiffKind
+	A, B string
+}
+
+// String returns the string representation of the difference.
+func (d *Difference) String() string {
+	path := FormatPath(d.Path)
+	if path == "" {
+		path = "(root)"
+	}
+	switch d.Kind {
+	case DiffMissing:
+		return fmt.Sprintf("%s: missing %s", path, d.A)
+	case DiffExtra:
+		return fmt.Sprintf("%s: extra %s", path, d.B)
+	}
+	return fmt.Sprintf("%s: %s != %s", path, d.A, d.B)
+}
+
+// FormatDiff returns the differences one per line.
+func FormatDiff(diffs []Difference) string {
+	lines := make([]string, len(diffs))
+	for i := range diffs {
+		lines[i] = diffs[i].String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Diff returns the differences between two trees, in depth-first order.
+// Nodes are compared field by field, lists element by element, and a node
+// whose type differs is reported as a whole. Nil and empty lists are equal.
+func Diff(a, b Node) []Difference {
+	var d differ
+	d.diff(nil, a, b)
+	return d.diffs
+}
+
+var nodeType = reflect.TypeOf((*Node)(nil)).Elem()
+
+type differ struct {
+	path  []PathElem
+	diffs []Difference
+}
+
+// add records a difference at the current path, followed by elem if any.
+func (d *differ) add(kind DiffKind, a, b string, elem *PathElem) {
+	path := make([]PathElem, len(d.path), len(d.path)+1)
+	copy(path, d.path)
+	if elem != nil {
+		path = append(path, *elem)
+	}
+	d.diffs = append(d.diffs, Difference{Path: path, Kind: kind, A: a, B: b})
+}
+
+// diff compares two nodes at the current path.
+func (d *differ) diff(parent *PathElem, a, b Node) {
+	if parent != nil {
+		d.path = append(d.path, *parent)
+		defer func() { d.path = d.path[:len(d.path)-1] }()
+	}
+
+	switch aNil, bNil := isNilNode(a), isNilNode(b); {
+	case aNil && bNil:
+		return
+	case bNil:
+		d.add(DiffMissing, a.String(), "", nil)
+		return
+	case aNil:
+		d.add(DiffExtra, "", b.String(), nil)
+		return
+	}
+
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		d.add(DiffValue, a.String(), b.String(), nil)
+		return
+	}
+
+	// A regex is compared by its pattern, whether it is compiled yet or not.
+	if re, ok := a.(*RegexLiteral); ok {
+		if re.String() != b.String() {
+			d.add(DiffValue, a.String(), b.String(), nil)
+		}
+		return
+	}
+
+	va, vb := reflect.Indirect(reflect.ValueOf(a)), reflect.Indirect(reflect.ValueOf(b))
+	switch va.Kind() {
+	case reflect.Slice:
+		d.diffSlice(a, "", va, vb)
+	case reflect.Struct:
+		// The settings of a select statement are compared through its
+		// options, which list all of them.
+		sa, ok := a.(*SelectStatement)
+		d.diffFields(a, va, vb, !ok)
+		if ok {
+			oa, ob := sa.Options(), b.(*SelectStatement).Options()
+			d.diffFields(a, reflect.ValueOf(oa), reflect.ValueOf(ob), true)
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			d.add(DiffValue, a.String(), b.String(), nil)
+		}
+	}
+}
+
+// diffFields compares the exported fields of two structs held by parent,
+// only comparing the fields that are not nodes if values is true.
+func (d *differ) diffFields(parent Node, a, b reflect.Value, values bool) {
+	for i := 0; i < a.NumField(); i++ {
+		f := a.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fa, fb := a.Field(i), b.Field(i)
+		switch {
+		case f.Type.Implements(nodeType):
+			d.diff(&PathElem{Parent: parent, Field: f.Name, Index: -1}, asNode(fa), asNode(fb))
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Implements(nodeType):
+			d.diffSlice(parent, f.Name, fa, fb)
+		case values && !reflect.DeepEqual(fa.Interface(), fb.Interface()):
+			d.add(DiffValue, fmt.Sprint(fa.Interface()), fmt.Sprint(fb.Interface()), &PathElem{Parent: parent, Field: f.Name, Index: -1})
+		}
+	}
+}
+
+// diffSlice compares two lists of nodes held by field of parent, or by
+// parent itself if field is "".
+func (d *differ) diffSlice(parent Node, field string, a, b reflect.Value) {
+	for i := 0; i < a.Len() || i < b.Len(); i++ {
+		var na, nb Node
+		if i < a.Len() {
+			na = asNode(a.Index(i))
+		}
+		if i < b.Len() {
+			nb = asNode(b.Index(i))
+		}
+		d.diff(&PathElem{Parent: parent, Field: field, Index: i}, na, nb)
+	}
+}
+
+// asNode returns the node held by v, which may be a nil interface.
+func asNode(v reflect.Value) Node {
+	if v.Kind() == reflect.Interface && v.IsNil() {
+		return nil
+	}
+	n, _ := v.Interface().(Node)
+	return n
+}
@@ -18,12 +18,16 @@ type Expr interface {
 	expr()
 }
 
-func (*BinaryExpr) expr() {}
-func (*Call) expr()       {}
-func (*Distinct) expr()   {}
-func (*ParenExpr) expr()  {}
-func (*VarRef) expr()     {}
-func (*Wildcard) expr()   {}
+func (*BinaryExpr) expr()     {}
+func (*Call) expr()           {}
+func (*Distinct) expr()       {}
+func (*FieldAccess) expr()    {}
+func (*NotExpr) expr()        {}
+func (*ParenExpr) expr()      {}
+func (*QuantifiedExpr) expr() {}
+func (*SubqueryExpr) expr()   {}
+func (*VarRef) expr()         {}
+func (*Wildcard) expr()       {}
 
 func (*BooleanLiteral) expr()  {}
 func (*BoundParameter) expr()  {}
@@ -38,24 +42,38 @@ func (*StringLiteral) expr()   {}
 func (*TimeLiteral) expr()     {}
 
 // ExprNames returns a list of non-"time" field names from an expression.
+// Each reference is listed once, sorted by Val, then by Type, as VarRefs.
 func ExprNames(expr Expr) []VarRef {
-	m := make(map[VarRef]struct{})
-	for _, ref := range walkRefs(expr) {
-		if ref.Val == "time" {
-			continue
-		}
-		m[ref] = struct{}{}
-	}
+	return ExprRefs(expr, false)
+}
 
-	a := make([]VarRef, 0, len(m))
-	for k := range m {
-		a = append(a, k)
-	}
+// ExprRefs returns the references of an expression, once each, sorted by
+// Val, then by Type. References with the same Val and different Types are
+// distinct. References to "time" are only included if includeTime is true.
+func ExprRefs(expr Expr, includeTime bool) []VarRef {
+	a := FirstAppearanceRefs(expr, includeTime)
 	sort.Sort(VarRefs(a))
-
 	return a
 }
 
+// FirstAppearanceRefs returns the references of an expression like
+// ExprRefs, but in the order they first appear in it.
+func FirstAppearanceRefs(expr Expr, includeTime bool) []VarRef {
+	a := walkRefs(expr)
+	if a == nil {
+		return make([]VarRef, 0)
+	} else if includeTime {
+		return a
+	}
+	refs := a[:0]
+	for _, ref := range a {
+		if ref.Val != "time" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
 // walkNames will walk the Expr and return the identifier names used.
 func walkNames(exp Expr) []string {
 	switch expr := exp.(type) {
@@ -76,23 +94,55 @@ func walkNames(exp Expr) []string {
 		return ret
 	case *ParenExpr:
 		return walkNames(expr.Expr)
+	case *FieldAccess:
+		return walkNames(expr.Base)
+	case *NotExpr:
+		return walkNames(expr.Expr)
 	}
 
 	return nil
 }
 
-// walkRefs will walk the Expr and return the var refs used.
+// walkRefs will walk the Expr and return the var refs used, once each, in
+// the order they first appear.
 func walkRefs(exp Expr) []VarRef {
-	refs := make(map[VarRef]struct{})
+	// Most expressions reference a few names, so the list is scanned for
+	// duplicates and a map is only allocated once it grows longer.
+	const maxScan = 16
+	var a []VarRef
+	var seen map[VarRef]struct{}
+	add := func(ref *VarRef) {
+		if seen != nil {
+			if _, ok := seen[*ref]; ok {
+				return
+			}
+			seen[*ref] = struct{}{}
+		} else {
+			for i := range a {
+				if a[i] == *ref {
+					return
+				}
+			}
+			if len(a) == maxScan {
+				seen = make(map[VarRef]struct{}, 2*maxScan)
+				for _, ref := range a {
+					seen[ref] = struct{}{}
+				}
+				seen[*ref] = struct{}{}
+			}
+		}
+		a = append(a, *ref)
+	}
+
 	var walk func(exp Expr)
 	walk = func(exp Expr) {
 		switch expr := exp.(type) {
 		case *VarRef:
-			refs[*expr] = struct{}{}
+			add(expr)
 		case *Call:
 			for _, expr := range expr.Args {
 				if ref, ok := expr.(*VarRef); ok {
-					refs[*ref] = struct{}{}
+					add(ref)
 				}
 			}
 		case *BinaryExpr:
@@ -100,15 +150,13 @@ func walkRefs(exp Expr) []VarRef {
 			walk(expr.RHS)
 		case *ParenExpr:
 			walk(expr.Expr)
+		case *FieldAccess:
+			walk(expr.Base)
+		case *NotExpr:
+			walk(expr.Expr)
 		}
 	}
 	walk(exp)
-
-	// Turn the map into a slice.
-	a := make([]VarRef, 0, len(refs))
-	for ref := range refs {
-		a = append(a, ref)
-	}
 	return a
 }
 
@@ -142,9 +190,98 @@ type BinaryExpr struct {
 
 // String returns a string representation of the binary expression.
 func (e *BinaryExpr) String() string {
+	if e.isNegation() {
+		return "-" + e.RHS.String()
+	}
 	return fmt.Sprintf("%s %s %s", e.LHS.String(), e.Op.String(), e.RHS.String())
 }
 
+// isNegation returns true if the expression is the "-1 * x" the parser
+// builds for a negated variable, call or parenthesized expression.
+// It is written back as "-x" so that it binds the same way when it is
+// the RHS of another operator.
+func (e *BinaryExpr) isNegation() bool {
+	if lhs, ok := e.LHS.(*IntegerLiteral); !ok || e.Op != token.MUL || lhs.Val != -1 {
+		return false
+	}
+	switch e.RHS.(type) {
+	case *VarRef, *Call, *ParenExpr, *FieldAccess:
+		return true
+	}
+	return false
+}
+
+// ParenthesizeExpr returns a copy of expr in which the operands of binary
+// expressions are wrapped in a ParenExpr where they would otherwise bind
+// differently once printed, such as a + b in (a + b) * c or b - c in
+// a - (b - c). The String of the copy parses back to the copy itself, which
+// matters for trees that were built rather than parsed. Parentheses that
+// are already there are kept, and the copy shares the other nodes of expr.
+func ParenthesizeExpr(expr Expr) Expr {
+	switch expr := expr.(type) {
+	case *BinaryExpr:
+		if expr.isNegation() {
+			return &BinaryExpr{Op: expr.Op, LHS: expr.LHS, RHS: ParenthesizeExpr(expr.RHS)}
+		}
+		prec := expr.Op.Precedence()
+		lhs, rhs := ParenthesizeExpr(expr.LHS), ParenthesizeExpr(expr.RHS)
+		if bindsLess(lhs, prec) || isNotOperand(lhs, prec) {
+			lhs = &ParenExpr{Expr: lhs}
+		}
+		// Operators of the same precedence group from the left, so the
+		// RHS needs parentheses for those too.
+		if bindsLess(rhs, prec+1) || isNotOperand(rhs, prec) {
+			rhs = &ParenExpr{Expr: rhs}
+		}
+		return &BinaryExpr{Op: expr.Op, LHS: lhs, RHS: rhs}
+	case *ParenExpr:
+		return &ParenExpr{Expr: ParenthesizeExpr(expr.Expr)}
+	case *NotExpr:
+		operand := ParenthesizeExpr(expr.Expr)
+		if e, ok := operand.(*BinaryExpr); ok && !e.isNegation() {
+			operand = &ParenExpr{Expr: operand}
+		}
+		return &NotExpr{Expr: operand}
+	case *Call:
+		args := make([]Expr, len(expr.Args))
+		for i, arg := range expr.Args {
+			args[i] = ParenthesizeExpr(arg)
+		}
+		return &Call{Name: expr.Name, Args: args}
+	case *QuantifiedExpr:
+		vals := make([]Expr, len(expr.Vals))
+		for i, val := range expr.Vals {
+			vals[i] = ParenthesizeExpr(val)
+		}
+		return &QuantifiedExpr{Op: expr.Op, Vals: vals}
+	case *FieldAccess:
+		// The keys bind more tightly than any operator, including the
+		// "-" and "!" prefixes, so only a plain operand is left bare.
+		base := ParenthesizeExpr(expr.Base)
+		switch base.(type) {
+		case *BinaryExpr, *NotExpr:
+			base = &ParenExpr{Expr: base}
+		}
+		return &FieldAccess{Base: base, Path: expr.Path}
+	}
+	return expr
+}
+
+// bindsLess returns true if expr is a binary expression, other than a
+// negation, whose operator binds less tightly than the precedence prec.
+func bindsLess(expr Expr, prec int) bool {
+	e, ok := expr.(*BinaryExpr)
+	return ok && !e.isNegation() && e.Op.Precedence() < prec
+}
+
+// isNotOperand returns true if expr is a negation with "!" that is an
+// operand of an operator of precedence prec that binds more tightly than AND,
+// since the negation would extend over the operator once printed.
+func isNotOperand(expr Expr, prec int) bool {
+	_, ok := expr.(*NotExpr)
+	return ok && prec > token.AND.Precedence()
+}
+
 // Name returns the name of a binary expression by concatenating
 // the variables in the binary expression with underscores.
 func (e *BinaryExpr) Name() string {
@@ -170,6 +307,8 @@ func (v *binaryExprNameVisitor) Visit(n Node) Visitor {
 
 // Call represents a function call.
 type Call struct {
+	// Name of the function as it was written. Built-in functions
+	// are matched regardless of case.
 	Name string
 	Args []Expr
 }
@@ -186,7 +325,8 @@ func (c *Call) String() string {
 	return fmt.Sprintf("%s(%s)", c.Name, strings.Join(str, ", "))
 }
 
-// Distinct represents a DISTINCT expression.
+// Distinct represents a DISTINCT expression. The parser does not return it:
+// "DISTINCT x" is parsed as the call distinct(x), as returned by NewCall.
 type Distinct struct {
 	// Identifier following DISTINCT
 	Val string
@@ -194,7 +334,7 @@ type Distinct struct {
 
 // String returns a string representation of the expression.
 func (d *Distinct) String() string {
-	return fmt.Sprintf("DISTINCT %s", d.Val)
+	return fmt.Sprintf("DISTINCT %s", tools.QuoteIdent(d.Val))
 }
 
 // NewCall returns a new call expression from this expressions.
@@ -207,6 +347,36 @@ func (d *Distinct) NewCall() *Call {
 	}
 }
 
+// FieldAccess represents the access to a member of a structured field, such
+// as payload->'status'. Each element of Path is the key of a member of the
+// previous one.
+type FieldAccess struct {
+	Base Expr
+	Path []string
+}
+
+// String returns a string representation of the access.
+func (e *FieldAccess) String() string {
+	var buf strings.Builder
+	_, _ = buf.WriteString(e.Base.String())
+	for _, key := range e.Path {
+		_, _ = buf.WriteString("->")
+		_, _ = buf.WriteString(tools.QuoteString(key))
+	}
+	return buf.String()
+}
+
+// NotExpr represents the logical negation of an expression, written with a
+// "!" prefix, such as !(host = 'a'). It binds less tightly than comparisons
+// and arithmetic, and more tightly than AND and OR, so !a = b AND c negates
+// a = b only.
+type NotExpr struct {
+	Expr Expr
+}
+
+// String returns a string representation of the negation.
+func (e *NotExpr) String() string { return "!" + e.Expr.String() }
+
 // ParenExpr represents a parenthesized expression.
 type ParenExpr struct {
 	Expr Expr
@@ -215,15 +385,48 @@ type ParenExpr struct {
 // String returns a string representation of the parenthesized expression.
 func (e *ParenExpr) String() string { return fmt.Sprintf("(%s)", e.Expr.String()) }
 
+// SubqueryExpr represents a subquery used as an operand of a comparison,
+// such as the right side of value > (SELECT mean(value) FROM cpu).
+type SubqueryExpr struct {
+	Statement *SelectStatement
+}
+
+// String returns a string representation of the subquery.
+func (e *SubqueryExpr) String() string { return fmt.Sprintf("(%s)", e.Statement.String()) }
+
+// QuantifiedExpr represents ANY(...) or ALL(...) as the right side of a
+// comparison. host = ANY('a', 'b') is true if host equals any of the values,
+// and host != ALL('a', 'b') is true if host differs from all of them.
+type QuantifiedExpr struct {
+	Op   token.Token // ANY or ALL
+	Vals []Expr
+}
+
+// String returns a string representation of the expression.
+func (e *QuantifiedExpr) String() string {
+	str := make([]string, len(e.Vals))
+	for i, v := range e.Vals {
+		str[i] = v.String()
+	}
+	return fmt.Sprintf("%s(%s)", e.Op, strings.Join(str, ", "))
+}
+
 // VarRef represents a reference to a variable.
 type VarRef struct {
 	Val  string
 	Type DataType
+
+	// System is true for a reference to a system field, written as "@name".
+	System bool
 }
 
 // String returns a string representation of the variable reference.
 func (r *VarRef) String() string {
-	buf := bytes.NewBufferString(tools.QuoteIdent(r.Val))
+	var buf bytes.Buffer
+	if r.System {
+		buf.WriteString("@")
+	}
+	buf.WriteString(tools.QuoteIdent(r.Val))
 	if r.Type != Unknown {
 		buf.WriteString("::")
 		buf.WriteString(r.Type.String())
@@ -241,8 +444,10 @@ func (a VarRefs) Len() int { return len(a) }
 func (a VarRefs) Less(i, j int) bool {
 	if a[i].Val != a[j].Val {
 		return a[i].Val < a[j].Val
+	} else if a[i].Type != a[j].Type {
+		return a[i].Type < a[j].Type
 	}
-	return a[i].Type < a[j].Type
+	return !a[i].System && a[j].System
 }
 
 // Swap implements sort.Interface.
@@ -257,19 +462,71 @@ func (a VarRefs) Strings() []string {
 	return s
 }
 
-// Wildcard represents a wild card expression.
+// TypeConflict returns two references of refs to the same name whose types
+// cannot both hold, such as value::float and value::integer, or false if
+// there are none. References without a type conflict with none, and
+// ::field only conflicts with ::tag. The references are grouped by name by
+// sorting a copy of them.
+func TypeConflict(refs []VarRef) (a, b VarRef, ok bool) {
+	sorted := make(VarRefs, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Type != Unknown {
+			sorted = append(sorted, ref)
+		}
+	}
+	sort.Sort(sorted)
+
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && sorted[end].Val == sorted[start].Val {
+			end++
+		}
+		for i := start; i < end; i++ {
+			for j := i + 1; j < end; j++ {
+				if a, b := sorted[i], sorted[j]; a.System == b.System && typesConflict(a.Type, b.Type) {
+					return a, b, true
+				}
+			}
+		}
+		start = end
+	}
+	return VarRef{}, VarRef{}, false
+}
+
+// typesConflict returns true if a reference cannot have both explicit types.
+func typesConflict(a, b DataType) bool {
+	if a == b {
+		return false
+	} else if a == AnyField || b == AnyField {
+		return a == Tag || b == Tag
+	}
+	return true
+}
+
+// Wildcard represents a wild card expression. Except lists the names it
+// does not select, as in "* EXCEPT(a, b)", which only a field may have.
 type Wildcard struct {
-	Type token.Token
+	Type   token.Token
+	Except []string
 }
 
 // String returns a string representation of the wildcard.
 func (e *Wildcard) String() string {
+	var s string
 	switch e.Type {
 	case token.FIELD:
-		return "*::field"
+		s = "*::field"
 	case token.TAG:
-		return "*::tag"
+		s = "*::tag"
 	default:
-		return "*"
+		s = "*"
+	}
+	if len(e.Except) == 0 {
+		return s
+	}
+	names := make([]string, len(e.Except))
+	for i, name := range e.Except {
+		names[i] = tools.QuoteIdent(name)
 	}
+	return fmt.Sprintf("%s EXCEPT(%s)", s, strings.Join(names, ", "))
 }
@@ -0,0 +1,311 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// functionKind classifies a built-in function.
+type functionKind int
+
+const (
+	// aggregateFunction computes a value from all the points of an interval.
+	aggregateFunction functionKind = iota + 1
+	// selectorFunction returns some of the points of an interval.
+	selectorFunction
+	// timeFunction returns a time relative to now, such as today.
+	timeFunction
+	// transformationFunction computes a value from consecutive points, or
+	// from consecutive intervals of an aggregate, such as derivative.
+	transformationFunction
+)
+
+// function describes a built-in function.
+type function struct {
+	kind     functionKind
+	args     int               // number of arguments, or 0 if it is not checked
+	params   []param           // the arguments, checked if set
+	validate func(*Call) error // validates the arguments, if set
+}
+
+// param describes an argument of a built-in function.
+type param struct {
+	name     string          // the kind of argument expected, used in errors
+	optional bool            // whether it may be omitted, if it comes last
+	valid    func(Expr) bool // returns true if an argument is of this kind
+}
+
+// Arguments of transformations.
+var (
+	transformedParam = param{name: "field or aggregate", valid: isTransformable}
+	intervalParam    = param{name: "positive duration", optional: true, valid: isPositiveDuration}
+	windowParam      = param{name: "integer greater than 1", valid: isWindow}
+)
+
+// functions is the registry of built-in functions, keyed by lowercase name.
+var functions = map[string]function{
+	"count":    {kind: aggregateFunction},
+	"distinct": {kind: aggregateFunction},
+	"integral": {kind: aggregateFunction},
+	"mean":     {kind: aggregateFunction},
+	"median":   {kind: aggregateFunction},
+	"mode":     {kind: aggregateFunction},
+	"spread":   {kind: aggregateFunction},
+	"stddev":   {kind: aggregateFunction},
+	"sum":      {kind: aggregateFunction},
+
+	"bottom":     {kind: selectorFunction, validate: validateTopBottom},
+	"first":      {kind: selectorFunction, args: 1},
+	"last":       {kind: selectorFunction, args: 1},
+	"max":        {kind: selectorFunction, args: 1},
+	"min":        {kind: selectorFunction, args: 1},
+	"percentile": {kind: selectorFunction},
+	"sample":     {kind: selectorFunction},
+	"top":        {kind: selectorFunction, validate: validateTopBottom},
+
+	"today":     {kind: timeFunction, validate: validateNoArgs},
+	"tomorrow":  {kind: timeFunction, validate: validateNoArgs},
+	"yesterday": {kind: timeFunction, validate: validateNoArgs},
+
+	"cumulative_sum":          {kind: transformationFunction, params: []param{transformedParam}},
+	"derivative":              {kind: transformationFunction, params: []param{transformedParam, intervalParam}},
+	"difference":              {kind: transformationFunction, params: []param{transformedParam}},
+	"elapsed":                 {kind: transformationFunction, params: []param{transformedParam, intervalParam}},
+	"moving_average":          {kind: transformationFunction, params: []param{transformedParam, windowParam}},
+	"non_negative_derivative": {kind: transformationFunction, params: []param{transformedParam, intervalParam}},
+	"non_negative_difference": {kind: transformationFunction, params: []param{transformedParam}},
+}
+
+// IsAggregate returns true if the call is to a built-in aggregate function,
+// such as mean or sum.
+func (c *Call) IsAggregate() bool {
+	return functions[strings.ToLower(c.Name)].kind == aggregateFunction
+}
+
+// IsSelector returns true if the call is to a built-in selector function,
+// such as max or top.
+func (c *Call) IsSelector() bool {
+	return functions[strings.ToLower(c.Name)].kind == selectorFunction
+}
+
+// IsTransformation returns true if the call is to a built-in transformation,
+// such as derivative or moving_average.
+func (c *Call) IsTransformation() bool {
+	return functions[strings.ToLower(c.Name)].kind == transformationFunction
+}
+
+// ValidateArgs returns an error if the call is to a built-in function with
+// the wrong number or kind of arguments.
+func (c *Call) ValidateArgs() error {
+	fn := functions[strings.ToLower(c.Name)]
+	if fn.args > 0 && len(c.Args) != fn.args {
+		return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", c.Name, fn.args, len(c.Args))
+	} else if fn.params != nil {
+		return validateParams(c, fn.params)
+	} else if fn.validate != nil {
+		return fn.validate(c)
+	}
+	return nil
+}
+
+// CallError is an error of a call to a built-in function found by
+// ValidateCalls. It names the call, so that the error can be reported where
+// the call is.
+type CallError struct {
+	Call    *Call
+	Message string
+}
+
+// Error returns the message of the error.
+func (e *CallError) Error() string {
+	return e.Message
+}
+
+// ValidateCalls returns a *CallError for the first call of the fields or of
+// the WHERE clause of the statement that does not suit its function or the
+// statement. The arguments of each call are validated by ValidateArgs. With
+// GROUP BY time, a transformation applies to an aggregate or a selector of
+// each interval, and without it, to the points of a field. A transformation
+// cannot apply to another one, nor to a scalar function such as abs. The
+// WHERE clause applies to each point, so it cannot call an aggregate, a
+// selector or a transformation. The calls of subqueries are validated with
+// their own statement.
+func (s *SelectStatement) ValidateCalls() error {
+	grouped := s.groupedByTime()
+	var err error
+	Walk(callVisitor(func(call *Call) {
+		if err == nil {
+			err = validateFieldCall(call, grouped)
+		}
+	}), s.Fields)
+	Walk(callVisitor(func(call *Call) {
+		if err != nil {
+			return
+		} else if err = call.ValidateArgs(); err != nil {
+			err = &CallError{Call: call, Message: err.Error()}
+		} else if kind := functions[strings.ToLower(call.Name)].kind; kind != 0 && kind != timeFunction {
+			err = &CallError{Call: call, Message: fmt.Sprintf("%s is not allowed in WHERE", call.Name)}
+		}
+	}), s.Condition)
+	return err
+}
+
+// validateFieldCall validates a call of the fields of a statement, which is
+// grouped by time or not.
+func validateFieldCall(call *Call, grouped bool) error {
+	if err := call.ValidateArgs(); err != nil {
+		return &CallError{Call: call, Message: err.Error()}
+	} else if !call.IsTransformation() {
+		return nil
+	}
+	switch arg, _ := call.Args[0].(*Call); {
+	case arg != nil && arg.IsTransformation():
+		return &CallError{Call: arg, Message: fmt.Sprintf("cannot nest %s in %s", arg.Name, call.Name)}
+	case arg != nil && !arg.IsAggregate() && !arg.IsSelector():
+		return &CallError{Call: call, Message: fmt.Sprintf("expected field or aggregate as first argument of %s, found %s", call.Name, arg)}
+	case grouped && arg == nil:
+		return &CallError{Call: call, Message: fmt.Sprintf("aggregate function required inside the call to %s", call.Name)}
+	case !grouped && arg != nil:
+		return &CallError{Call: call, Message: fmt.Sprintf("%s of an aggregate requires GROUP BY time", call.Name)}
+	}
+	return nil
+}
+
+// callVisitor calls a function for each call, but not for the calls of
+// subqueries, which are validated with their own statement.
+type callVisitor func(*Call)
+
+func (fn callVisitor) Visit(n Node) Visitor {
+	switch n := n.(type) {
+	case *SubqueryExpr:
+		return nil
+	case *Call:
+		fn(n)
+	}
+	return fn
+}
+
+// groupedByTime returns true if the statement groups by time intervals.
+func (s *SelectStatement) groupedByTime() bool {
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*Call); ok && strings.EqualFold(call.Name, "time") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateParams validates the arguments of a call against the parameters
+// of its function.
+func validateParams(c *Call, params []param) error {
+	required := len(params)
+	for required > 0 && params[required-1].optional {
+		required--
+	}
+	if n := len(c.Args); n < required || n > len(params) {
+		expected := fmt.Sprint(required)
+		if required < len(params) {
+			expected = fmt.Sprintf("%d or %d", required, len(params))
+		}
+		return fmt.Errorf("invalid number of arguments for %s, expected %s, got %d", c.Name, expected, n)
+	}
+	for i, arg := range c.Args {
+		if !params[i].valid(arg) {
+			return fmt.Errorf("expected %s as %s argument of %s, found %s", params[i].name, ordinals[i], c.Name, arg)
+		}
+	}
+	return nil
+}
+
+// ordinals names the position of an argument in errors.
+var ordinals = []string{"first", "second", "third"}
+
+// isTransformable returns true if expr is a field or a call. Which calls can
+// be transformed depends on the statement, which the parser checks.
+func isTransformable(expr Expr) bool {
+	switch expr.(type) {
+	case *VarRef, *Call:
+		return true
+	}
+	return false
+}
+
+// isPositiveDuration returns true if expr is a duration greater than zero.
+func isPositiveDuration(expr Expr) bool {
+	d, ok := expr.(*DurationLiteral)
+	return ok && d.Val > 0
+}
+
+// isWindow returns true if expr is a number of points of a moving window,
+// which is an integer greater than 1.
+func isWindow(expr Expr) bool {
+	n, ok := expr.(*IntegerLiteral)
+	return ok && n.Val > 1
+}
+
+// SelectorTags returns the tag keys of a call to top or bottom, such as host
+// in top(value, host, 3), or nil for other calls and for calls whose
+// arguments are not of the form top(field, [tag, ...], count).
+func (c *Call) SelectorTags() []VarRef {
+	tags, _, err := selectorArgs(c)
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// SelectorN returns the number of points selected by a call to top or
+// bottom, such as 3 in top(value, host, 3). It returns false for other calls
+// and for calls whose arguments are not of the form
+// top(field, [tag, ...], count).
+func (c *Call) SelectorN() (int64, bool) {
+	_, n, err := selectorArgs(c)
+	return n, err == nil
+}
+
+// isTopBottom returns true if the call is to top or bottom.
+func isTopBottom(c *Call) bool {
+	return strings.EqualFold(c.Name, "top") || strings.EqualFold(c.Name, "bottom")
+}
+
+// selectorArgs returns the tag keys and the count of a call of the form
+// top(field, [tag, ...], count), where count is a positive integer, or an
+// error if the call is not to top or bottom or is not of this form.
+func selectorArgs(c *Call) ([]VarRef, int64, error) {
+	if !isTopBottom(c) {
+		return nil, 0, fmt.Errorf("%s is not top or bottom", c.Name)
+	} else if len(c.Args) < 2 {
+		return nil, 0, fmt.Errorf("invalid number of arguments for %s, expected at least 2, got %d", c.Name, len(c.Args))
+	}
+	if _, ok := c.Args[0].(*VarRef); !ok {
+		return nil, 0, fmt.Errorf("expected field as first argument of %s, found %s", c.Name, c.Args[0])
+	}
+	var tags []VarRef
+	for _, arg := range c.Args[1 : len(c.Args)-1] {
+		ref, ok := arg.(*VarRef)
+		if !ok {
+			return nil, 0, fmt.Errorf("expected tag key as argument of %s, found %s", c.Name, arg)
+		}
+		tags = append(tags, *ref)
+	}
+	lit, ok := c.Args[len(c.Args)-1].(*IntegerLiteral)
+	if !ok || lit.Val <= 0 {
+		return nil, 0, fmt.Errorf("expected positive integer as last argument of %s, found %s", c.Name, c.Args[len(c.Args)-1])
+	}
+	return tags, lit.Val, nil
+}
+
+// validateTopBottom validates a call of the form top(field, [tag, ...], count),
+// where count is a positive integer.
+func validateTopBottom(c *Call) error {
+	_, _, err := selectorArgs(c)
+	return err
+}
+
+// validateNoArgs validates a call to a function that takes no arguments.
+func validateNoArgs(c *Call) error {
+	if len(c.Args) != 0 {
+		return fmt.Errorf("invalid number of arguments for %s, expected 0, got %d", c.Name, len(c.Args))
+	}
+	return nil
+}
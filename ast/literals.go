@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"sql/tools"
@@ -44,7 +45,15 @@ type NumberLiteral struct {
 }
 
 // String returns a string representation of the literal.
-func (l *NumberLiteral) String() string { return strconv.FormatFloat(l.Val, 'f', 3, 64) }
+// At least three decimals are written so the value never reads back as an
+// integer, and more are written if they are needed to read back the same value.
+func (l *NumberLiteral) String() string {
+	s := strconv.FormatFloat(l.Val, 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i == -1 || len(s)-i-1 < 3 {
+		return strconv.FormatFloat(l.Val, 'f', 3, 64)
+	}
+	return s
+}
 
 // IntegerLiteral represents an integer literal.
 type IntegerLiteral struct {
@@ -92,12 +101,16 @@ func isFalseLiteral(expr Expr) bool {
 	return false
 }
 
-// ListLiteral represents a list of tag key literals.
+// ListLiteral represents a list of tag key literals, such as the RHS of IN.
+// The values are names whether they were written as identifiers or strings,
+// so host IN (a) and host IN ('a') give the same list.
 type ListLiteral struct {
 	Vals []string
 }
 
-// String returns a string representation of the literal.
+// String returns a string representation of the literal. Each value is
+// printed as an identifier, quoted where it needs to be, so a value written
+// as a string such as '2000-01-01' is printed as "2000-01-01".
 func (s *ListLiteral) String() string {
 	var buf strings.Builder
 	_, _ = buf.WriteString("(")
@@ -111,6 +124,16 @@ func (s *ListLiteral) String() string {
 	return buf.String()
 }
 
+// Contains returns true if s is one of the values of the list.
+func (s *ListLiteral) Contains(v string) bool {
+	for _, val := range s.Vals {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
 // StringLiteral represents a string literal.
 type StringLiteral struct {
 	Val string
@@ -171,16 +194,56 @@ func (l *DurationLiteral) String() string { return tools.FormatDuration(l.Val) }
 // RegexLiteral represents a regular expression.
 type RegexLiteral struct {
 	Val *regexp.Regexp
+
+	// Pattern is the source of a regex that is not compiled yet. If Val is
+	// nil, Regexp compiles Pattern on first use and sets Val.
+	Pattern string
+
+	mu  sync.Mutex
+	err error
+}
+
+// Regexp returns the compiled regex, compiling Pattern if it is not compiled
+// yet. An invalid Pattern is reported by every call.
+func (r *RegexLiteral) Regexp() (*regexp.Regexp, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Val == nil && r.err == nil {
+		r.Val, r.err = regexp.Compile(r.Pattern)
+	}
+	return r.Val, r.err
+}
+
+// clone returns a copy of the literal, which is compiled only if r is. The
+// copy shares the compiled regex, which is safe for concurrent use, so that
+// regexes shared through a regex cache stay shared.
+func (r *RegexLiteral) clone() *RegexLiteral {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Val != nil {
+		return &RegexLiteral{Val: r.Val}
+	}
+	return &RegexLiteral{Pattern: r.Pattern}
 }
 
 // String returns a string representation of the literal.
 func (r *RegexLiteral) String() string {
-	if r.Val != nil {
-		return fmt.Sprintf("/%s/", strings.Replace(r.Val.String(), `/`, `\/`, -1))
+	if pattern := r.pattern(); pattern != "" {
+		return fmt.Sprintf("/%s/", strings.Replace(pattern, `/`, `\/`, -1))
 	}
 	return ""
 }
 
+// pattern returns the source text of the regex, whether it is compiled or not.
+func (r *RegexLiteral) pattern() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Val != nil {
+		return r.Val.String()
+	}
+	return r.Pattern
+}
+
 // NilLiteral represents a nil literal.
 // This is not available to the query language itself. It's only used internally.
 type NilLiteral struct{}
@@ -11,12 +11,32 @@ type Node interface {
 func (*Query) node()     {}
 func (Statements) node() {}
 
-func (*SelectStatement) node() {}
+func (*CreateContinuousQueryStatement) node()   {}
+func (*CreateTimeToLiveStatement) node()        {}
+func (*CreateUserStatement) node()              {}
+func (*DropTimeToLiveStatement) node()          {}
+func (*DropUserStatement) node()                {}
+func (*InsertStatement) node()                  {}
+func (*KillQueryStatement) node()               {}
+func (*SelectStatement) node()                  {}
+func (*SetPasswordUserStatement) node()         {}
+func (*ShowFieldKeyCardinalityStatement) node() {}
+func (*ShowGrantsForUserStatement) node()       {}
+func (*ShowQueriesStatement) node()             {}
+func (*ShowTagKeyCardinalityStatement) node()   {}
+func (*ShowTimeToLivesStatement) node()         {}
+func (*UnionStatement) node()                   {}
+func (*With) node()                             {}
+func (*PointField) node()                       {}
 
-func (*Metric) node()   {}
-func (*SubQuery) node() {}
-func (Sources) node()   {}
-func (Metrics) node()   {}
+func (*Metric) node()        {}
+func (*SubQuery) node()      {}
+func (*UnionSubQuery) node() {}
+func (*CTERef) node()        {}
+func (*SubqueryExpr) node()  {}
+func (*Join) node()          {}
+func (Sources) node()        {}
+func (Metrics) node()        {}
 
 func (*Target) node()    {}
 func (*Field) node()     {}
@@ -38,9 +58,12 @@ func (*ListLiteral) node()     {}
 func (*StringLiteral) node()   {}
 func (*TimeLiteral) node()     {}
 
-func (*BinaryExpr) node() {}
-func (*Call) node()       {}
-func (*Distinct) node()   {}
-func (*ParenExpr) node()  {}
-func (*VarRef) node()     {}
-func (*Wildcard) node()   {}
+func (*BinaryExpr) node()     {}
+func (*Call) node()           {}
+func (*FieldAccess) node()    {}
+func (*Distinct) node()       {}
+func (*NotExpr) node()        {}
+func (*ParenExpr) node()      {}
+func (*QuantifiedExpr) node() {}
+func (*VarRef) node()         {}
+func (*Wildcard) node()       {}
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"sql/tools"
@@ -15,8 +16,11 @@ type Source interface {
 	source()
 }
 
-func (*Metric) source()   {}
-func (*SubQuery) source() {}
+func (*Metric) source()        {}
+func (*SubQuery) source()      {}
+func (*UnionSubQuery) source() {}
+func (*Join) source()          {}
+func (*CTERef) source()        {}
 
 // Metric represents a single metric used as a datasource.
 type Metric struct {
@@ -31,11 +35,12 @@ type Metric struct {
 	SystemIterator string
 }
 
-// Clone returns a deep clone of the Metric.
+// Clone returns a deep clone of the Metric. The compiled regex, if any, is
+// shared with the clone.
 func (m *Metric) Clone() *Metric {
 	var regexp *RegexLiteral
-	if m.Regex != nil && m.Regex.Val != nil {
-		regexp = &RegexLiteral{Val: m.Regex.Val.Copy()}
+	if m.Regex != nil {
+		regexp = m.Regex.clone()
 	}
 	return &Metric{
 		Database:       m.Database,
@@ -47,6 +52,37 @@ func (m *Metric) Clone() *Metric {
 	}
 }
 
+// Equal returns true if both metrics read the same data: they have the same
+// database, time to live, name, system iterator and regex pattern. IsTarget
+// is ignored. Two nil metrics are equal.
+func (m *Metric) Equal(other *Metric) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.Database == other.Database &&
+		m.TimeToLive == other.TimeToLive &&
+		m.Name == other.Name &&
+		m.SystemIterator == other.SystemIterator &&
+		(m.Regex == nil) == (other.Regex == nil) &&
+		(m.Regex == nil || m.Regex.pattern() == other.Regex.pattern())
+}
+
+// Key returns a string that is the same for metrics that are Equal and
+// differs otherwise, to be used as a map key. It is "" for a nil metric.
+func (m *Metric) Key() string {
+	if m == nil {
+		return ""
+	}
+	parts := []string{m.Database, m.TimeToLive, m.Name, m.SystemIterator}
+	for i, s := range parts {
+		parts[i] = strconv.Quote(s)
+	}
+	if m.Regex != nil {
+		parts = append(parts, "/"+strconv.Quote(m.Regex.pattern()))
+	}
+	return strings.Join(parts, ".")
+}
+
 // String returns a string representation of the metric.
 func (m *Metric) String() string {
 	var buf strings.Builder
@@ -69,6 +105,10 @@ func (m *Metric) String() string {
 		_, _ = buf.WriteString(tools.QuoteIdent(m.SystemIterator))
 	} else if m.Regex != nil {
 		_, _ = buf.WriteString(m.Regex.String())
+	} else if !m.IsTarget {
+		// An empty source name must be quoted to be read back.
+		// An empty target name is written by Target as ":METRIC".
+		_, _ = buf.WriteString(`""`)
 	}
 
 	return buf.String()
@@ -84,6 +124,41 @@ func (s *SubQuery) String() string {
 	return fmt.Sprintf("(%s)", s.Statement.String())
 }
 
+// UnionSubQuery is a source with a UnionStatement as the backing store.
+type UnionSubQuery struct {
+	Statement *UnionStatement
+}
+
+// String returns a string representation of the subquery.
+func (s *UnionSubQuery) String() string {
+	return fmt.Sprintf("(%s)", s.Statement.String())
+}
+
+// CTERef is a source that refers by name to a statement defined by WITH.
+// Statement is the statement of the With of the same name, which is not
+// walked from here since it is walked as part of the With.
+type CTERef struct {
+	Name      string
+	Statement *SelectStatement
+}
+
+// String returns a string representation of the reference.
+func (r *CTERef) String() string {
+	return tools.QuoteIdent(r.Name)
+}
+
+// Join is a source that joins two sources on a condition. Only inner joins
+// are supported.
+type Join struct {
+	Left, Right Source
+	On          Expr
+}
+
+// String returns a string representation of the join.
+func (j *Join) String() string {
+	return fmt.Sprintf("%s JOIN %s ON %s", j.Left, j.Right, j.On)
+}
+
 // Sources represents a list of sources.
 type Sources []Source
 
@@ -111,6 +186,16 @@ func (a Sources) Metrics() []*Metric {
 			mms = append(mms, src)
 		case *SubQuery:
 			mms = append(mms, src.Statement.Sources.Metrics()...)
+		case *UnionSubQuery:
+			for _, stmt := range src.Statement.Statements {
+				mms = append(mms, stmt.Sources.Metrics()...)
+			}
+		case *CTERef:
+			if src.Statement != nil {
+				mms = append(mms, src.Statement.Sources.Metrics()...)
+			}
+		case *Join:
+			mms = append(mms, Sources{src.Left, src.Right}.Metrics()...)
 		}
 	}
 	return mms
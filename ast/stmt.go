@@ -2,12 +2,32 @@ package ast
 
 import (
 	"fmt"
+	"math"
+	"regexp/syntax"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"sql/token"
+	"sql/tools"
 )
 
+var _ Statement = &CreateContinuousQueryStatement{}
+var _ Statement = &CreateTimeToLiveStatement{}
+var _ Statement = &CreateUserStatement{}
+var _ Statement = &DropTimeToLiveStatement{}
+var _ Statement = &DropUserStatement{}
+var _ Statement = &InsertStatement{}
+var _ Statement = &KillQueryStatement{}
 var _ Statement = &SelectStatement{}
+var _ Statement = &SetPasswordUserStatement{}
+var _ Statement = &ShowFieldKeyCardinalityStatement{}
+var _ Statement = &ShowGrantsForUserStatement{}
+var _ Statement = &ShowQueriesStatement{}
+var _ Statement = &ShowTagKeyCardinalityStatement{}
+var _ Statement = &ShowTimeToLivesStatement{}
+var _ Statement = &UnionStatement{}
 
 // Statement represents a single command in CnosQL.
 type Statement interface {
@@ -17,10 +37,27 @@ type Statement interface {
 	stmt()
 }
 
-func (*SelectStatement) stmt() {}
+func (*CreateContinuousQueryStatement) stmt()   {}
+func (*CreateTimeToLiveStatement) stmt()        {}
+func (*CreateUserStatement) stmt()              {}
+func (*DropTimeToLiveStatement) stmt()          {}
+func (*DropUserStatement) stmt()                {}
+func (*InsertStatement) stmt()                  {}
+func (*KillQueryStatement) stmt()               {}
+func (*SelectStatement) stmt()                  {}
+func (*SetPasswordUserStatement) stmt()         {}
+func (*ShowFieldKeyCardinalityStatement) stmt() {}
+func (*ShowGrantsForUserStatement) stmt()       {}
+func (*ShowQueriesStatement) stmt()             {}
+func (*ShowTagKeyCardinalityStatement) stmt()   {}
+func (*ShowTimeToLivesStatement) stmt()         {}
+func (*UnionStatement) stmt()                   {}
 
 // SelectStatement represents a command for extracting data from the database.
 type SelectStatement struct {
+	// Named statements defined by WITH, which sources may refer to by name.
+	CTEs []*With
+
 	// Expressions returned from the selection.
 	Fields Fields
 
@@ -55,6 +92,7 @@ type SelectStatement struct {
 	groupByInterval time.Duration
 
 	// Whether it's a query for raw data values (i.e. not an aggregate).
+	// See IsRawQuery.
 	IsRawQuery bool
 
 	// What fill option the select statement uses, if any.
@@ -80,11 +118,426 @@ type SelectStatement struct {
 
 	// Removes duplicate rows from raw queries.
 	Dedupe bool
+
+	// Names of the bound parameters used in the statement and its subqueries,
+	// in order of first use. Recorded by the parser before substitution.
+	BoundParams []string
+}
+
+// StatementOptions holds the settings of a SelectStatement that are not
+// nodes, and so are not visited by Walk. Each field is the field of the same
+// name of the statement.
+type StatementOptions struct {
+	Limit       int
+	Offset      int
+	SLimit      int
+	SOffset     int
+	IsRawQuery  bool
+	Fill        FillOption
+	FillValue   interface{}
+	Location    *time.Location
+	TimeAlias   string
+	OmitTime    bool
+	StripName   bool
+	EmitName    string
+	Dedupe      bool
+	BoundParams []string
+}
+
+// Options returns the settings of the statement that are not nodes. The
+// result does not share BoundParams with the statement.
+func (s *SelectStatement) Options() StatementOptions {
+	return StatementOptions{
+		Limit:       s.Limit,
+		Offset:      s.Offset,
+		SLimit:      s.SLimit,
+		SOffset:     s.SOffset,
+		IsRawQuery:  s.IsRawQuery,
+		Fill:        s.Fill,
+		FillValue:   s.FillValue,
+		Location:    s.Location,
+		TimeAlias:   s.TimeAlias,
+		OmitTime:    s.OmitTime,
+		StripName:   s.StripName,
+		EmitName:    s.EmitName,
+		Dedupe:      s.Dedupe,
+		BoundParams: copyStrings(s.BoundParams),
+	}
+}
+
+// SetOptions sets the settings of the statement that are not nodes, such as
+// after rewriting its nodes.
+func (s *SelectStatement) SetOptions(opts StatementOptions) {
+	s.Limit = opts.Limit
+	s.Offset = opts.Offset
+	s.SLimit = opts.SLimit
+	s.SOffset = opts.SOffset
+	s.IsRawQuery = opts.IsRawQuery
+	s.Fill = opts.Fill
+	s.FillValue = opts.FillValue
+	s.Location = opts.Location
+	s.TimeAlias = opts.TimeAlias
+	s.OmitTime = opts.OmitTime
+	s.StripName = opts.StripName
+	s.EmitName = opts.EmitName
+	s.Dedupe = opts.Dedupe
+	s.BoundParams = copyStrings(opts.BoundParams)
+}
+
+// copyStrings returns a copy of a, or nil if a is nil.
+func copyStrings(a []string) []string {
+	if a == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(a)), a...)
+}
+
+// Dependencies represents everything a statement reads from.
+type Dependencies struct {
+	// Field references, excluding "time".
+	Fields []VarRef
+
+	// Tag references.
+	Tags []VarRef
+
+	// Source metrics, including those of subqueries in FROM and in
+	// conditions.
+	Metrics []*Metric
+
+	// Names of the bound parameters used.
+	Params []string
+}
+
+// Dependencies returns the field and tag references, source metrics and
+// bound parameter names of the statement and all of its subqueries.
+// Each list is deduplicated and sorted.
+func (s *SelectStatement) Dependencies() *Dependencies {
+	refs := make(map[VarRef]struct{})
+	sources := s.Sources.Metrics()
+	WalkFunc(s, func(n Node) {
+		switch n := n.(type) {
+		case *VarRef:
+			refs[*n] = struct{}{}
+		case *Distinct:
+			refs[VarRef{Val: n.Val}] = struct{}{}
+		case *SubqueryExpr:
+			sources = append(sources, n.Statement.Sources.Metrics()...)
+		}
+	})
+
+	deps := &Dependencies{}
+	for ref := range refs {
+		if ref.Type == Tag {
+			deps.Tags = append(deps.Tags, ref)
+		} else if ref.Val != "time" {
+			deps.Fields = append(deps.Fields, ref)
+		}
+	}
+	sort.Sort(VarRefs(deps.Fields))
+	sort.Sort(VarRefs(deps.Tags))
+
+	metrics := make(map[string]*Metric)
+	for _, m := range sources {
+		metrics[m.String()] = m
+	}
+	for _, m := range metrics {
+		deps.Metrics = append(deps.Metrics, m)
+	}
+	sort.Slice(deps.Metrics, func(i, j int) bool {
+		return deps.Metrics[i].String() < deps.Metrics[j].String()
+	})
+
+	deps.Params = append(deps.Params, s.BoundParams...)
+	sort.Strings(deps.Params)
+
+	return deps
+}
+
+// RewriteRegexConditions rewrites the regex comparisons of the WHERE clause
+// whose pattern only matches a single string, such as host =~ /^a$/, into
+// comparisons of equality, such as host = 'a'. An unanchored pattern such as
+// /a/ matches more than one string and is left alone. The conditions of
+// subqueries are rewritten too.
+func (s *SelectStatement) RewriteRegexConditions() {
+	WalkFunc(s, func(n Node) {
+		if stmt, ok := n.(*SelectStatement); ok {
+			rewriteRegexConditions(stmt.Condition)
+		}
+	})
+}
+
+func rewriteRegexConditions(expr Expr) {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		rewriteRegexConditions(e.Expr)
+	case *NotExpr:
+		rewriteRegexConditions(e.Expr)
+	case *BinaryExpr:
+		if e.Op != token.EQREGEX && e.Op != token.NEQREGEX {
+			rewriteRegexConditions(e.LHS)
+			rewriteRegexConditions(e.RHS)
+			return
+		}
+		re, ok := e.RHS.(*RegexLiteral)
+		if !ok {
+			return
+		}
+		if lit, ok := literalPattern(re.pattern()); ok {
+			if e.Op == token.EQREGEX {
+				e.Op = token.EQ
+			} else {
+				e.Op = token.NEQ
+			}
+			e.RHS = &StringLiteral{Val: lit}
+		}
+	}
+}
+
+// literalPattern returns the only string a regex pattern matches, if it is
+// anchored at both ends and has no metacharacters in between.
+func literalPattern(pattern string) (string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || len(re.Sub) > 3 {
+		return "", false
+	}
+	first, last := re.Sub[0], re.Sub[len(re.Sub)-1]
+	if first.Op != syntax.OpBeginText || last.Op != syntax.OpEndText {
+		return "", false
+	}
+	if len(re.Sub) == 2 {
+		return "", true
+	}
+	if lit := re.Sub[1]; lit.Op == syntax.OpLiteral && lit.Flags&syntax.FoldCase == 0 {
+		return string(lit.Rune), true
+	}
+	return "", false
+}
+
+// CTENames returns the names of the statements defined by WITH, in order.
+// A source of the statement named like one of them refers to it, as a
+// CTERef.
+func (s *SelectStatement) CTENames() []string {
+	var names []string
+	for _, cte := range s.CTEs {
+		names = append(names, cte.Name)
+	}
+	return names
+}
+
+// FieldNames returns the names of the fields and tags the statement selects,
+// deduplicated and sorted. Time and wildcards are not included, nor are the
+// names used by subqueries.
+func (s *SelectStatement) FieldNames() []string {
+	return nodeNames(s.Fields)
+}
+
+// ConditionNames returns the names of the fields and tags the WHERE clause
+// of the statement filters on, deduplicated and sorted. Time is not
+// included, nor are the names used by subqueries.
+func (s *SelectStatement) ConditionNames() []string {
+	return nodeNames(s.Condition)
+}
+
+// RewriteFields returns a copy of the statement in which each wildcard field
+// is replaced with the fields and tags it selects, sorted by name: those of
+// fields for *::field, of tags for *::tag and of both for *. The names
+// excluded by the EXCEPT of a wildcard are dropped, and it is an error to
+// exclude a name the wildcard does not select. The copy shares the other
+// nodes of the statement.
+func (s *SelectStatement) RewriteFields(fields, tags []string) (*SelectStatement, error) {
+	other := *s
+	other.Fields = make(Fields, 0, len(s.Fields))
+	for _, f := range s.Fields {
+		wc, ok := f.Expr.(*Wildcard)
+		if !ok {
+			other.Fields = append(other.Fields, f)
+			continue
+		}
+
+		var refs []VarRef
+		if wc.Type != token.TAG {
+			for _, name := range fields {
+				refs = append(refs, VarRef{Val: name})
+			}
+		}
+		if wc.Type != token.FIELD {
+			for _, name := range tags {
+				refs = append(refs, VarRef{Val: name, Type: Tag})
+			}
+		}
+		sort.Sort(VarRefs(refs))
+
+		except := make(map[string]bool, len(wc.Except))
+		for _, name := range wc.Except {
+			except[name] = false
+		}
+		for _, ref := range refs {
+			if _, ok := except[ref.Val]; ok {
+				except[ref.Val] = true
+				continue
+			}
+			ref := ref
+			other.Fields = append(other.Fields, &Field{Expr: &ref})
+		}
+		for _, name := range wc.Except {
+			if !except[name] {
+				return nil, fmt.Errorf("EXCEPT name %s is not selected by %s", name, &Wildcard{Type: wc.Type})
+			}
+		}
+	}
+	other.IsRawQuery = IsRawQuery(other.Fields)
+	return &other, nil
+}
+
+// IsRawQuery returns true if fields select raw data values, which is when
+// none of them calls an aggregate or a selector, such as mean or top, even
+// as the argument of another function. Scalar functions such as abs keep
+// the fields raw, and subqueries compared in a field are not considered.
+// The parser sets SelectStatement.IsRawQuery with it, and statements built
+// or rewritten otherwise should too.
+func IsRawQuery(fields Fields) bool {
+	raw := true
+	Walk(rawQueryVisitor{raw: &raw}, fields)
+	return raw
+}
+
+// rawQueryVisitor clears raw when it visits an aggregate or a selector.
+type rawQueryVisitor struct {
+	raw *bool
+}
+
+func (v rawQueryVisitor) Visit(n Node) Visitor {
+	switch n := n.(type) {
+	case *SubqueryExpr:
+		return nil
+	case *Call:
+		if n.IsAggregate() || n.IsSelector() {
+			*v.raw = false
+			return nil
+		}
+	}
+	return v
+}
+
+// CoerceFillValue converts the number of fill(), if any, to the type of the
+// aggregates it fills, which is Float, Integer or Unsigned, so that the
+// engine does not have to convert it. It returns an error if the number
+// cannot be converted without loss, such as 1.5 to an integer, or if values
+// of the type cannot be filled with a number. Unknown keeps the number as
+// parsed.
+func (s *SelectStatement) CoerceFillValue(target DataType) error {
+	if s.Fill != NumberFill || target == Unknown {
+		return nil
+	}
+
+	var v interface{}
+	var ok bool
+	switch target {
+	case Float:
+		v, ok = fillFloat(s.FillValue)
+	case Integer:
+		v, ok = fillInteger(s.FillValue)
+	case Unsigned:
+		v, ok = fillUnsigned(s.FillValue)
+	default:
+		return fmt.Errorf("cannot fill %s values with a number", target)
+	}
+	if !ok {
+		return fmt.Errorf("cannot convert fill(%v) to %s without loss", s.FillValue, target)
+	}
+	s.FillValue = v
+	return nil
+}
+
+// maxExactFloat is the largest integer up to which every integer is exactly
+// a float64.
+const maxExactFloat = 1 << 53
+
+// fillFloat converts a fill value to a float64 without loss.
+func fillFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), v >= -maxExactFloat && v <= maxExactFloat
+	case uint64:
+		return float64(v), v <= maxExactFloat
+	}
+	return 0, false
+}
+
+// fillInteger converts a fill value to an int64 without loss.
+func fillInteger(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// fillUnsigned converts a fill value to a uint64 without loss.
+func fillUnsigned(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	case float64:
+		if v != math.Trunc(v) || v < 0 || v >= math.MaxUint64 {
+			return 0, false
+		}
+		return uint64(v), true
+	}
+	return 0, false
+}
+
+// nodeNames returns the sorted names of the references in node, other than
+// time, without descending into subqueries.
+func nodeNames(node Node) []string {
+	v := nodeNamesVisitor{names: make(map[string]struct{})}
+	Walk(&v, node)
+
+	var a []string
+	for name := range v.names {
+		a = append(a, name)
+	}
+	sort.Strings(a)
+	return a
+}
+
+type nodeNamesVisitor struct {
+	names map[string]struct{}
+}
+
+func (v *nodeNamesVisitor) Visit(n Node) Visitor {
+	switch n := n.(type) {
+	case *SubqueryExpr:
+		return nil
+	case *VarRef:
+		if n.Val != "time" {
+			v.names[n.Val] = struct{}{}
+		}
+	case *Distinct:
+		v.names[n.Val] = struct{}{}
+	}
+	return v
 }
 
 // String returns a string representation of the select statement.
 func (s *SelectStatement) String() string {
 	var buf strings.Builder
+	writeCTEs(&buf, s.CTEs)
 	_, _ = buf.WriteString("SELECT ")
 	_, _ = buf.WriteString(s.Fields.String())
 
@@ -108,7 +561,11 @@ func (s *SelectStatement) String() string {
 	case NoFill:
 		_, _ = buf.WriteString(" fill(none)")
 	case NumberFill:
-		_, _ = buf.WriteString(fmt.Sprintf(" fill(%v)", s.FillValue))
+		if v, ok := s.FillValue.(float64); ok {
+			_, _ = fmt.Fprintf(&buf, " fill(%s)", (&NumberLiteral{Val: v}).String())
+		} else {
+			_, _ = fmt.Fprintf(&buf, " fill(%v)", s.FillValue)
+		}
 	case LinearFill:
 		_, _ = buf.WriteString(" fill(linear)")
 	case PreviousFill:
@@ -136,3 +593,534 @@ func (s *SelectStatement) String() string {
 	}
 	return buf.String()
 }
+
+// With is a statement named by a WITH clause, also known as a common table
+// expression, such as t in WITH t AS (SELECT ...) SELECT ... FROM t. The
+// parser makes each source named like it, in the statement and in the
+// statements named after it, a CTERef to it.
+type With struct {
+	Name      string
+	Statement *SelectStatement
+}
+
+// String returns a string representation of the named statement.
+func (w *With) String() string {
+	return fmt.Sprintf("%s AS (%s)", tools.QuoteIdent(w.Name), w.Statement)
+}
+
+// writeCTEs writes the WITH clause defining ctes, followed by a space, if
+// there are any.
+func writeCTEs(buf *strings.Builder, ctes []*With) {
+	if len(ctes) == 0 {
+		return
+	}
+	_, _ = buf.WriteString("WITH ")
+	for i, cte := range ctes {
+		if i > 0 {
+			_, _ = buf.WriteString(", ")
+		}
+		_, _ = buf.WriteString(cte.String())
+	}
+	_, _ = buf.WriteString(" ")
+}
+
+// ShowTimeToLivesStatement represents a command for listing the time to
+// lives of a database.
+type ShowTimeToLivesStatement struct {
+	// Name of the database, or "" for the default database.
+	Database string
+}
+
+// String returns a string representation of the statement.
+func (s *ShowTimeToLivesStatement) String() string {
+	if s.Database == "" {
+		return "SHOW TIME TO LIVES"
+	}
+	return "SHOW TIME TO LIVES ON " + tools.QuoteIdent(s.Database)
+}
+
+// CreateTimeToLiveStatement represents a command for creating a time to live,
+// which is how long the data of a database is kept.
+type CreateTimeToLiveStatement struct {
+	// Name of the time to live.
+	Name string
+
+	// Name of the database.
+	Database string
+
+	// How long data is kept, or zero to keep it forever.
+	Duration time.Duration
+
+	// How much time a shard covers, or zero if not given.
+	ShardDuration time.Duration
+
+	// Whether this is the default time to live of the database.
+	Default bool
+}
+
+// String returns a string representation of the statement.
+func (s *CreateTimeToLiveStatement) String() string {
+	var buf strings.Builder
+	_, _ = buf.WriteString("CREATE TIME TO LIVE ")
+	_, _ = buf.WriteString(tools.QuoteIdent(s.Name))
+	_, _ = buf.WriteString(" ON ")
+	_, _ = buf.WriteString(tools.QuoteIdent(s.Database))
+	_, _ = buf.WriteString(" DURATION ")
+	if s.Duration == 0 {
+		_, _ = buf.WriteString("INF")
+	} else {
+		_, _ = buf.WriteString(tools.FormatDuration(s.Duration))
+	}
+	if s.ShardDuration != 0 {
+		_, _ = buf.WriteString(" SHARD DURATION ")
+		_, _ = buf.WriteString(tools.FormatDuration(s.ShardDuration))
+	}
+	if s.Default {
+		_, _ = buf.WriteString(" DEFAULT")
+	}
+	return buf.String()
+}
+
+// InsertStatement represents a command for writing a point, which is written
+// in line protocol:
+//
+//	INSERT [INTO db[.ttl]] metric[,tag=value...] field=value[,field=value...] [timestamp]
+type InsertStatement struct {
+	// Name of the database and of its time to live, or "" for the defaults.
+	Database   string
+	TimeToLive string
+
+	// Name of the metric of the point.
+	Metric string
+
+	// Tags of the point. The parser sorts them by key, as they are printed.
+	Tags []PointTag
+
+	// Fields of the point, in the order they were written.
+	Fields []*PointField
+
+	// Timestamp of the point, or nil for the time it is written.
+	Timestamp *int64
+}
+
+// String returns a string representation of the statement. The point is
+// written in canonical form, with its tags sorted by key.
+func (s *InsertStatement) String() string {
+	var buf strings.Builder
+	_, _ = buf.WriteString("INSERT ")
+	if s.Database != "" {
+		_, _ = buf.WriteString("INTO ")
+		if s.TimeToLive != "" {
+			_, _ = buf.WriteString(tools.QuoteIdent(s.Database, s.TimeToLive))
+		} else {
+			_, _ = buf.WriteString(tools.QuoteIdent(s.Database))
+		}
+		_ = buf.WriteByte(' ')
+	}
+
+	_, _ = buf.WriteString(escapePointKey(s.Metric))
+	tags := make([]PointTag, len(s.Tags))
+	copy(tags, s.Tags)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	for _, tag := range tags {
+		_ = buf.WriteByte(',')
+		_, _ = buf.WriteString(escapePointKey(tag.Key))
+		_ = buf.WriteByte('=')
+		_, _ = buf.WriteString(escapePointKey(tag.Value))
+	}
+
+	for i, f := range s.Fields {
+		if i == 0 {
+			_ = buf.WriteByte(' ')
+		} else {
+			_ = buf.WriteByte(',')
+		}
+		_, _ = buf.WriteString(f.String())
+	}
+
+	if s.Timestamp != nil {
+		_ = buf.WriteByte(' ')
+		_, _ = buf.WriteString(strconv.FormatInt(*s.Timestamp, 10))
+	}
+	return buf.String()
+}
+
+// PointTag is a tag of a point written by an InsertStatement.
+type PointTag struct {
+	Key, Value string
+}
+
+// PointField is a field of a point written by an InsertStatement. Its value
+// is an *IntegerLiteral, a *NumberLiteral, a *StringLiteral or a
+// *BooleanLiteral.
+type PointField struct {
+	Key   string
+	Value Literal
+}
+
+// String returns the field as written in line protocol.
+func (f *PointField) String() string {
+	var value string
+	switch v := f.Value.(type) {
+	case *IntegerLiteral:
+		value = strconv.FormatInt(v.Val, 10) + "i"
+	case *NumberLiteral:
+		value = strconv.FormatFloat(v.Val, 'f', -1, 64)
+	case *StringLiteral:
+		value = `"` + pointStringReplacer.Replace(v.Val) + `"`
+	case *BooleanLiteral:
+		value = strconv.FormatBool(v.Val)
+	default:
+		value = f.Value.String()
+	}
+	return escapePointKey(f.Key) + "=" + value
+}
+
+var (
+	// Escapes the metric, tag keys and values and field keys of a point.
+	pointKeyReplacer = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+	// Escapes the string field values of a point.
+	pointStringReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// escapePointKey escapes the metric, a tag key or value, or a field key of
+// a point.
+func escapePointKey(s string) string {
+	return pointKeyReplacer.Replace(s)
+}
+
+// DropTimeToLiveStatement represents a command for dropping a time to live.
+type DropTimeToLiveStatement struct {
+	// Name of the time to live.
+	Name string
+
+	// Name of the database.
+	Database string
+}
+
+// String returns a string representation of the statement.
+func (s *DropTimeToLiveStatement) String() string {
+	return "DROP TIME TO LIVE " + tools.QuoteIdent(s.Name) + " ON " + tools.QuoteIdent(s.Database)
+}
+
+// CardinalityOptions are the options shared by the statements that count
+// keys: "[EXACT] CARDINALITY [ON db] [FROM sources] [WHERE condition]
+// [GROUP BY dimensions] [LIMIT n] [OFFSET n]".
+type CardinalityOptions struct {
+	// Whether the count is exact rather than estimated.
+	Exact bool
+
+	// Name of the database, or "" for the default database.
+	Database string
+
+	// Metrics the keys are counted in, or nil for all of them.
+	Sources Sources
+
+	// An expression evaluated on the series.
+	Condition Expr
+
+	// Expressions the counts are grouped by.
+	Dimensions Dimensions
+
+	// Maximum number of rows to return, and number of rows to skip.
+	Limit, Offset int
+}
+
+// format writes the options after the name of a statement.
+func (o *CardinalityOptions) format(buf *strings.Builder) {
+	if o.Exact {
+		_, _ = buf.WriteString(" EXACT")
+	}
+	_, _ = buf.WriteString(" CARDINALITY")
+	if o.Database != "" {
+		_, _ = buf.WriteString(" ON ")
+		_, _ = buf.WriteString(tools.QuoteIdent(o.Database))
+	}
+	if len(o.Sources) > 0 {
+		_, _ = buf.WriteString(" FROM ")
+		_, _ = buf.WriteString(o.Sources.String())
+	}
+	if o.Condition != nil {
+		_, _ = buf.WriteString(" WHERE ")
+		_, _ = buf.WriteString(o.Condition.String())
+	}
+	if len(o.Dimensions) > 0 {
+		_, _ = buf.WriteString(" GROUP BY ")
+		_, _ = buf.WriteString(o.Dimensions.String())
+	}
+	if o.Limit > 0 {
+		_, _ = fmt.Fprintf(buf, " LIMIT %d", o.Limit)
+	}
+	if o.Offset > 0 {
+		_, _ = fmt.Fprintf(buf, " OFFSET %d", o.Offset)
+	}
+}
+
+// ShowTagKeyCardinalityStatement represents a command for counting the tag
+// keys.
+type ShowTagKeyCardinalityStatement struct {
+	CardinalityOptions
+}
+
+// String returns a string representation of the statement.
+func (s *ShowTagKeyCardinalityStatement) String() string {
+	var buf strings.Builder
+	_, _ = buf.WriteString("SHOW TAG KEY")
+	s.format(&buf)
+	return buf.String()
+}
+
+// ShowFieldKeyCardinalityStatement represents a command for counting the
+// field keys.
+type ShowFieldKeyCardinalityStatement struct {
+	CardinalityOptions
+}
+
+// String returns a string representation of the statement.
+func (s *ShowFieldKeyCardinalityStatement) String() string {
+	var buf strings.Builder
+	_, _ = buf.WriteString("SHOW FIELD KEY")
+	s.format(&buf)
+	return buf.String()
+}
+
+// UnionStatement represents the union of the results of SELECT statements,
+// joined in order. Its ORDER BY, LIMIT and OFFSET apply to the union as a
+// whole, so its statements have none.
+type UnionStatement struct {
+	// Named statements defined by WITH for all the statements of the union,
+	// which their sources may refer to by name.
+	CTEs []*With
+
+	Statements []*SelectStatement
+
+	// Whether duplicate rows are kept when joining each statement after
+	// the first, so All[i] is for Statements[i+1].
+	All []bool
+
+	// Fields to sort results by.
+	SortFields SortFields
+
+	// Maximum number of rows to be returned. Unlimited if zero.
+	Limit int
+
+	// Returns rows starting at an offset from the first row.
+	Offset int
+}
+
+// CTENames returns the names of the statements defined by WITH, in order.
+// A source of any statement of the union named like one of them refers to
+// it, as a CTERef.
+func (s *UnionStatement) CTENames() []string {
+	var names []string
+	for _, cte := range s.CTEs {
+		names = append(names, cte.Name)
+	}
+	return names
+}
+
+// String returns a string representation of the union.
+func (s *UnionStatement) String() string {
+	var buf strings.Builder
+	writeCTEs(&buf, s.CTEs)
+	for i, stmt := range s.Statements {
+		if i > 0 {
+			if s.All[i-1] {
+				_, _ = buf.WriteString(" UNION ALL ")
+			} else {
+				_, _ = buf.WriteString(" UNION ")
+			}
+		}
+		_, _ = buf.WriteString(stmt.String())
+	}
+	if len(s.SortFields) > 0 {
+		_, _ = buf.WriteString(" ORDER BY ")
+		_, _ = buf.WriteString(s.SortFields.String())
+	}
+	if s.Limit > 0 {
+		_, _ = fmt.Fprintf(&buf, " LIMIT %d", s.Limit)
+	}
+	if s.Offset > 0 {
+		_, _ = fmt.Fprintf(&buf, " OFFSET %d", s.Offset)
+	}
+	return buf.String()
+}
+
+// Validate returns an error if a statement of the union selects a different
+// number of fields than the first one. A statement with a wildcard is
+// compatible with any other.
+func (s *UnionStatement) Validate() error {
+	if len(s.Statements) == 0 || hasWildcard(s.Statements[0].Fields) {
+		return nil
+	}
+	first := s.Statements[0].Fields
+	for _, stmt := range s.Statements[1:] {
+		if hasWildcard(stmt.Fields) {
+			continue
+		}
+		if len(first) != len(stmt.Fields) {
+			return fmt.Errorf("UNION sides have different numbers of fields: %d and %d", len(first), len(stmt.Fields))
+		}
+	}
+	return nil
+}
+
+// hasWildcard returns true if one of the fields is a wildcard.
+func hasWildcard(fields Fields) bool {
+	for _, f := range fields {
+		if _, ok := f.Expr.(*Wildcard); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateContinuousQueryStatement represents a command for creating a
+// continuous query, which runs a SELECT INTO statement periodically.
+type CreateContinuousQueryStatement struct {
+	// Name of the continuous query.
+	Name string
+
+	// Name of the database the continuous query runs on.
+	Database string
+
+	// How often the query runs, and how much time it covers each time, or
+	// zero for the interval of its GROUP BY time().
+	ResampleEvery time.Duration
+	ResampleFor   time.Duration
+
+	// The statement run, which has a target.
+	Source *SelectStatement
+}
+
+// String returns a string representation of the statement.
+func (s *CreateContinuousQueryStatement) String() string {
+	var buf strings.Builder
+	_, _ = buf.WriteString("CREATE CONTINUOUS QUERY ")
+	_, _ = buf.WriteString(tools.QuoteIdent(s.Name))
+	_, _ = buf.WriteString(" ON ")
+	_, _ = buf.WriteString(tools.QuoteIdent(s.Database))
+
+	if s.ResampleEvery != 0 || s.ResampleFor != 0 {
+		_, _ = buf.WriteString(" RESAMPLE")
+		if s.ResampleEvery != 0 {
+			_, _ = buf.WriteString(" EVERY ")
+			_, _ = buf.WriteString(tools.FormatDuration(s.ResampleEvery))
+		}
+		if s.ResampleFor != 0 {
+			_, _ = buf.WriteString(" FOR ")
+			_, _ = buf.WriteString(tools.FormatDuration(s.ResampleFor))
+		}
+	}
+
+	_, _ = buf.WriteString(" BEGIN ")
+	_, _ = buf.WriteString(s.Source.String())
+	_, _ = buf.WriteString(" END")
+	return buf.String()
+}
+
+// ShowQueriesStatement represents a command for listing the running queries.
+type ShowQueriesStatement struct{}
+
+// String returns a string representation of the statement.
+func (s *ShowQueriesStatement) String() string {
+	return "SHOW QUERIES"
+}
+
+// KillQueryStatement represents a command for killing a running query.
+type KillQueryStatement struct {
+	// The id of the query, as listed by SHOW QUERIES.
+	QueryID uint64
+
+	// The host running the query, or "" for the local host.
+	Host string
+}
+
+// String returns a string representation of the statement.
+func (s *KillQueryStatement) String() string {
+	if s.Host == "" {
+		return "KILL QUERY " + strconv.FormatUint(s.QueryID, 10)
+	}
+	return "KILL QUERY " + strconv.FormatUint(s.QueryID, 10) + " ON " + tools.QuoteIdent(s.Host)
+}
+
+// redacted replaces passwords in RedactedString.
+const redacted = "[REDACTED]"
+
+// CreateUserStatement represents a command for creating a new user.
+type CreateUserStatement struct {
+	// Name of the user to be created.
+	Name string
+
+	// User's password.
+	Password string
+
+	// User's admin privilege.
+	Admin bool
+}
+
+// String returns a string representation of the statement, including the
+// password. Use RedactedString to log it.
+func (s *CreateUserStatement) String() string {
+	return s.format(tools.QuoteString(s.Password))
+}
+
+// RedactedString returns a string representation of the statement with the
+// password replaced by [REDACTED].
+func (s *CreateUserStatement) RedactedString() string {
+	return s.format(redacted)
+}
+
+func (s *CreateUserStatement) format(password string) string {
+	str := "CREATE USER " + tools.QuoteIdent(s.Name) + " WITH PASSWORD " + password
+	if s.Admin {
+		str += " WITH ALL PRIVILEGES"
+	}
+	return str
+}
+
+// DropUserStatement represents a command for dropping a user.
+type DropUserStatement struct {
+	// Name of the user to drop.
+	Name string
+}
+
+// String returns a string representation of the statement.
+func (s *DropUserStatement) String() string {
+	return "DROP USER " + tools.QuoteIdent(s.Name)
+}
+
+// SetPasswordUserStatement represents a command for changing the password
+// of a user.
+type SetPasswordUserStatement struct {
+	// Name of the user.
+	Name string
+
+	// New password.
+	Password string
+}
+
+// String returns a string representation of the statement, including the
+// password. Use RedactedString to log it.
+func (s *SetPasswordUserStatement) String() string {
+	return "SET PASSWORD FOR " + tools.QuoteIdent(s.Name) + " = " + tools.QuoteString(s.Password)
+}
+
+// RedactedString returns a string representation of the statement with the
+// password replaced by [REDACTED].
+func (s *SetPasswordUserStatement) RedactedString() string {
+	return "SET PASSWORD FOR " + tools.QuoteIdent(s.Name) + " = " + redacted
+}
+
+// ShowGrantsForUserStatement represents a command for listing the privileges
+// of a user.
+type ShowGrantsForUserStatement struct {
+	// Name of the user.
+	Name string
+}
+
+// String returns a string representation of the statement.
+func (s *ShowGrantsForUserStatement) String() string {
+	return "SHOW GRANTS FOR " + tools.QuoteIdent(s.Name)
+}
@@ -0,0 +1,130 @@
+package ast
+
+// StatementType returns a stable name for the type of a statement, which is
+// the keywords it starts with, such as "SELECT" or "SHOW QUERIES", or
+// "UNION" for a union. It returns "" for a nil statement.
+func StatementType(stmt Statement) string {
+	switch stmt.(type) {
+	case *CreateContinuousQueryStatement:
+		return "CREATE CONTINUOUS QUERY"
+	case *CreateTimeToLiveStatement:
+		return "CREATE TIME TO LIVE"
+	case *CreateUserStatement:
+		return "CREATE USER"
+	case *DropTimeToLiveStatement:
+		return "DROP TIME TO LIVE"
+	case *DropUserStatement:
+		return "DROP USER"
+	case *InsertStatement:
+		return "INSERT"
+	case *KillQueryStatement:
+		return "KILL QUERY"
+	case *SelectStatement:
+		return "SELECT"
+	case *SetPasswordUserStatement:
+		return "SET PASSWORD"
+	case *ShowFieldKeyCardinalityStatement:
+		return "SHOW FIELD KEY CARDINALITY"
+	case *ShowGrantsForUserStatement:
+		return "SHOW GRANTS"
+	case *ShowQueriesStatement:
+		return "SHOW QUERIES"
+	case *ShowTagKeyCardinalityStatement:
+		return "SHOW TAG KEY CARDINALITY"
+	case *ShowTimeToLivesStatement:
+		return "SHOW TIME TO LIVES"
+	case *UnionStatement:
+		return "UNION"
+	}
+	return ""
+}
+
+// AsCreateContinuousQuery returns stmt as a *CreateContinuousQueryStatement, if it is one.
+func AsCreateContinuousQuery(stmt Statement) (*CreateContinuousQueryStatement, bool) {
+	s, ok := stmt.(*CreateContinuousQueryStatement)
+	return s, ok
+}
+
+// AsCreateTimeToLive returns stmt as a *CreateTimeToLiveStatement, if it is one.
+func AsCreateTimeToLive(stmt Statement) (*CreateTimeToLiveStatement, bool) {
+	s, ok := stmt.(*CreateTimeToLiveStatement)
+	return s, ok
+}
+
+// AsCreateUser returns stmt as a *CreateUserStatement, if it is one.
+func AsCreateUser(stmt Statement) (*CreateUserStatement, bool) {
+	s, ok := stmt.(*CreateUserStatement)
+	return s, ok
+}
+
+// AsDropTimeToLive returns stmt as a *DropTimeToLiveStatement, if it is one.
+func AsDropTimeToLive(stmt Statement) (*DropTimeToLiveStatement, bool) {
+	s, ok := stmt.(*DropTimeToLiveStatement)
+	return s, ok
+}
+
+// AsDropUser returns stmt as a *DropUserStatement, if it is one.
+func AsDropUser(stmt Statement) (*DropUserStatement, bool) {
+	s, ok := stmt.(*DropUserStatement)
+	return s, ok
+}
+
+// AsInsert returns stmt as a *InsertStatement, if it is one.
+func AsInsert(stmt Statement) (*InsertStatement, bool) {
+	s, ok := stmt.(*InsertStatement)
+	return s, ok
+}
+
+// AsKillQuery returns stmt as a *KillQueryStatement, if it is one.
+func AsKillQuery(stmt Statement) (*KillQueryStatement, bool) {
+	s, ok := stmt.(*KillQueryStatement)
+	return s, ok
+}
+
+// AsSelect returns stmt as a *SelectStatement, if it is one.
+func AsSelect(stmt Statement) (*SelectStatement, bool) {
+	s, ok := stmt.(*SelectStatement)
+	return s, ok
+}
+
+// AsSetPasswordUser returns stmt as a *SetPasswordUserStatement, if it is one.
+func AsSetPasswordUser(stmt Statement) (*SetPasswordUserStatement, bool) {
+	s, ok := stmt.(*SetPasswordUserStatement)
+	return s, ok
+}
+
+// AsShowFieldKeyCardinality returns stmt as a *ShowFieldKeyCardinalityStatement, if it is one.
+func AsShowFieldKeyCardinality(stmt Statement) (*ShowFieldKeyCardinalityStatement, bool) {
+	s, ok := stmt.(*ShowFieldKeyCardinalityStatement)
+	return s, ok
+}
+
+// AsShowGrantsForUser returns stmt as a *ShowGrantsForUserStatement, if it is one.
+func AsShowGrantsForUser(stmt Statement) (*ShowGrantsForUserStatement, bool) {
+	s, ok := stmt.(*ShowGrantsForUserStatement)
+	return s, ok
+}
+
+// AsShowQueries returns stmt as a *ShowQueriesStatement, if it is one.
+func AsShowQueries(stmt Statement) (*ShowQueriesStatement, bool) {
+	s, ok := stmt.(*ShowQueriesStatement)
+	return s, ok
+}
+
+// AsShowTagKeyCardinality returns stmt as a *ShowTagKeyCardinalityStatement, if it is one.
+func AsShowTagKeyCardinality(stmt Statement) (*ShowTagKeyCardinalityStatement, bool) {
+	s, ok := stmt.(*ShowTagKeyCardinalityStatement)
+	return s, ok
+}
+
+// AsShowTimeToLives returns stmt as a *ShowTimeToLivesStatement, if it is one.
+func AsShowTimeToLives(stmt Statement) (*ShowTimeToLivesStatement, bool) {
+	s, ok := stmt.(*ShowTimeToLivesStatement)
+	return s, ok
+}
+
+// AsUnion returns stmt as a *UnionStatement, if it is one.
+func AsUnion(stmt Statement) (*UnionStatement, bool) {
+	s, ok := stmt.(*UnionStatement)
+	return s, ok
+}
@@ -0,0 +1,136 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Substitute returns a copy of the statement, including its subqueries, in
+// which every BoundParameter is replaced with a copy of its expression in
+// params. The parser substitutes parameters while parsing, so this is for
+// statements built with BoundParameter nodes. parser.Substitute binds Go
+// values, such as numbers and strings, like the parameters of the parser.
+//
+// Since an expression may be a call, such as mean(value), the IsRawQuery of
+// the copied statements is set again. Compiled regexes are shared with the
+// copy, and a node reached more than once, such as the statement of a CTERef,
+// is copied once. The expression of a parameter is copied again for each
+// place it is used, and the bound parameters in it are kept as they are.
+func (s *SelectStatement) Substitute(params map[string]Expr) (*SelectStatement, error) {
+	sub := &substituter{params: params, copies: make(map[interface{}]reflect.Value)}
+	v := sub.copy(reflect.ValueOf(s))
+	if sub.err != nil {
+		return nil, sub.err
+	}
+	stmt := v.Interface().(*SelectStatement)
+	WalkFunc(stmt, func(n Node) {
+		if s, ok := n.(*SelectStatement); ok {
+			s.IsRawQuery = IsRawQuery(s.Fields)
+		}
+	})
+	return stmt, nil
+}
+
+// astPkgPath is the package path of the nodes that are copied. Pointers to
+// other types, such as *time.Location, are shared by the copy.
+var astPkgPath = reflect.TypeOf(Query{}).PkgPath()
+
+// substituter copies a tree while replacing its bound parameters, and
+// records the first error found.
+type substituter struct {
+	params map[string]Expr
+	err    error
+
+	// Whether bound parameters are copied as they are rather than replaced,
+	// as they are in the expression of a parameter.
+	keepParams bool
+
+	// Copies of the pointers copied so far, so that a node reached more than
+	// once, such as the statement of a CTERef and of its With, is copied
+	// once.
+	copies map[interface{}]reflect.Value
+}
+
+// copy returns a deep copy of v, with bound parameters replaced.
+func (s *substituter) copy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || v.Type().Elem().PkgPath() != astPkgPath {
+			return v
+		} else if c, ok := s.copies[v.Interface()]; ok {
+			return c
+		}
+		switch n := v.Interface().(type) {
+		case *BoundParameter:
+			if !s.keepParams {
+				return s.bind(n)
+			}
+		case *RegexLiteral:
+			return reflect.ValueOf(n.clone())
+		}
+		c := reflect.New(v.Type().Elem())
+		s.copies[v.Interface()] = c
+		c.Elem().Set(s.copy(v.Elem()))
+		return c
+
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				c.Field(i).Set(s.copy(v.Field(i)))
+			}
+		}
+		return c
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		e := s.copy(v.Elem())
+		if !e.IsValid() {
+			return reflect.Zero(v.Type())
+		} else if !e.Type().AssignableTo(v.Type()) {
+			s.fail(fmt.Errorf("cannot use %s in place of a %s", e.Interface(), v.Type().Name()))
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(e)
+		return c
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(s.copy(v.Index(i)))
+		}
+		return c
+	}
+	return v
+}
+
+// bind returns a copy of the expression of a bound parameter, or an invalid
+// value after recording an error.
+func (s *substituter) bind(bp *BoundParameter) reflect.Value {
+	expr, ok := s.params[bp.Name]
+	if !ok || expr == nil {
+		s.fail(fmt.Errorf("missing parameter: %s", bp.Name))
+		return reflect.Value{}
+	}
+	// The expression is copied apart from the tree, so that each place of
+	// the parameter gets its own copy, and a parameter in it, such as the
+	// parameter itself, is not replaced again.
+	value := &substituter{copies: make(map[interface{}]reflect.Value), keepParams: true}
+	c := value.copy(reflect.ValueOf(expr))
+	if value.err != nil {
+		s.fail(value.err)
+	}
+	return c
+}
+
+func (s *substituter) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
@@ -0,0 +1,261 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sql/token"
+)
+
+// TimeRange returns the time range selected by the comparisons of time in
+// the WHERE clause, with now() evaluated as the current time. The range of a
+// statement whose sources are all subqueries is also bounded by theirs. A
+// zero Min or Max means that side is not bounded.
+func (s *SelectStatement) TimeRange() TimeRange {
+	return s.TimeRangeAt(time.Now())
+}
+
+// TimeRangeAt returns the time range selected by the statement like
+// TimeRange, with now() evaluated as now.
+func (s *SelectStatement) TimeRangeAt(now time.Time) TimeRange {
+	tr := conditionTimeRange(s.Condition, s.Location, now)
+
+	var sources TimeRange
+	for i, src := range s.Sources {
+		var r TimeRange
+		switch src := src.(type) {
+		case *SubQuery:
+			r = src.Statement.TimeRangeAt(now)
+		case *CTERef:
+			if src.Statement == nil {
+				return tr
+			}
+			r = src.Statement.TimeRangeAt(now)
+		case *UnionSubQuery:
+			for j, stmt := range src.Statement.Statements {
+				if j == 0 {
+					r = stmt.TimeRangeAt(now)
+				} else {
+					r = unionTimeRange(r, stmt.TimeRangeAt(now))
+				}
+			}
+		default:
+			return tr
+		}
+		if i == 0 {
+			sources = r
+		} else {
+			sources = unionTimeRange(sources, r)
+		}
+	}
+	return tr.Intersect(sources)
+}
+
+// RequireTimeRange returns an error if the statement does not select a lower
+// bound of time, so that it would scan the whole history.
+func (s *SelectStatement) RequireTimeRange() error {
+	if s.TimeRange().Min.IsZero() {
+		return errors.New("time must have a lower bound, such as time > now() - 1h")
+	}
+	return nil
+}
+
+// HasTimeFilter returns true if the WHERE clause of the statement compares
+// time, whether or not the comparison bounds it, such as time IN (...) or
+// !(time < now() - 1h), which select no time range. Use TimeRange for the
+// range selected. The conditions of subqueries are not considered.
+func (s *SelectStatement) HasTimeFilter() bool {
+	return hasTimeComparison(s.Condition)
+}
+
+// EnsureTimeRange restricts the statement to the default time range def if
+// the time range it selects, as returned by TimeRange, has no lower bound,
+// and leaves an explicit lower bound intact otherwise. The statement is then
+// restricted to each of limits, such as a hard maximum range, so that its
+// range is their intersection with the one it selects. A zero Min or Max
+// leaves that side unbounded. The restrictions are added to the WHERE clause
+// as comparisons of time.
+func (s *SelectStatement) EnsureTimeRange(def TimeRange, limits ...TimeRange) {
+	if s.TimeRange().Min.IsZero() {
+		s.Condition = andTimeRange(s.Condition, def)
+	}
+	for _, limit := range limits {
+		s.Condition = andTimeRange(s.Condition, limit)
+	}
+}
+
+// hasTimeComparison returns true if a condition compares time.
+func hasTimeComparison(expr Expr) bool {
+	switch expr := expr.(type) {
+	case *ParenExpr:
+		return hasTimeComparison(expr.Expr)
+	case *NotExpr:
+		return hasTimeComparison(expr.Expr)
+	case *BinaryExpr:
+		if expr.Op == token.AND || expr.Op == token.OR {
+			return hasTimeComparison(expr.LHS) || hasTimeComparison(expr.RHS)
+		}
+		return isTimeRef(expr.LHS) || isTimeRef(expr.RHS)
+	}
+	return false
+}
+
+// andTimeRange returns a condition that also restricts time to tr.
+func andTimeRange(cond Expr, tr TimeRange) Expr {
+	var bounds []Expr
+	if !tr.Min.IsZero() {
+		bounds = append(bounds, &BinaryExpr{Op: token.GTE, LHS: &VarRef{Val: "time"}, RHS: &TimeLiteral{Val: tr.Min}})
+	}
+	if !tr.Max.IsZero() {
+		bounds = append(bounds, &BinaryExpr{Op: token.LTE, LHS: &VarRef{Val: "time"}, RHS: &TimeLiteral{Val: tr.Max}})
+	}
+	for _, bound := range bounds {
+		if cond == nil {
+			cond = bound
+		} else {
+			cond = &BinaryExpr{Op: token.AND, LHS: parenthesize(token.AND, cond), RHS: bound}
+		}
+	}
+	return cond
+}
+
+// EvalTimeExpr returns the time an expression compared with time evaluates
+// to, such as now() - 1h or '2000-01-01'. Strings and the start of days are
+// in loc, or in UTC if loc is nil. Besides now(), the functions today(),
+// yesterday() and tomorrow() evaluate to the start of that day. They are
+// not keywords, so a bare today is a reference like any other identifier.
+func EvalTimeExpr(expr Expr, now time.Time, loc *time.Location) (time.Time, error) {
+	t, ok := timeValue(expr, loc, now)
+	if !ok {
+		return time.Time{}, fmt.Errorf("cannot evaluate %s as a time", expr)
+	}
+	return t, nil
+}
+
+// relativeDays are the days of the time functions relative to today.
+var relativeDays = map[string]int{
+	"today":     0,
+	"tomorrow":  1,
+	"yesterday": -1,
+}
+
+// startOfDay returns the start of the day of now in loc, moved by days.
+func startOfDay(now time.Time, loc *time.Location, days int) time.Time {
+	if loc == nil {
+		loc = time.UTC
+	}
+	y, m, d := now.In(loc).Date()
+	return time.Date(y, m, d+days, 0, 0, 0, 0, loc)
+}
+
+// conditionTimeRange returns the time range selected by the comparisons of
+// time in a condition.
+func conditionTimeRange(expr Expr, loc *time.Location, now time.Time) TimeRange {
+	switch expr := expr.(type) {
+	case *ParenExpr:
+		return conditionTimeRange(expr.Expr, loc, now)
+	case *BinaryExpr:
+		switch expr.Op {
+		case token.AND:
+			return conditionTimeRange(expr.LHS, loc, now).Intersect(conditionTimeRange(expr.RHS, loc, now))
+		case token.OR:
+			return unionTimeRange(conditionTimeRange(expr.LHS, loc, now), conditionTimeRange(expr.RHS, loc, now))
+		}
+
+		// Put the time reference on the left.
+		op, lhs, rhs := expr.Op, expr.LHS, expr.RHS
+		if !isTimeRef(lhs) {
+			switch op {
+			case token.LT:
+				op = token.GT
+			case token.LTE:
+				op = token.GTE
+			case token.GT:
+				op = token.LT
+			case token.GTE:
+				op = token.LTE
+			}
+			lhs, rhs = rhs, lhs
+		}
+		if !isTimeRef(lhs) {
+			return TimeRange{}
+		}
+		t, ok := timeValue(rhs, loc, now)
+		if !ok {
+			return TimeRange{}
+		}
+
+		switch op {
+		case token.EQ:
+			return TimeRange{Min: t, Max: t}
+		case token.GT, token.GTE:
+			return TimeRange{Min: t}
+		case token.LT, token.LTE:
+			return TimeRange{Max: t}
+		}
+	}
+	return TimeRange{}
+}
+
+// unionTimeRange returns the smallest time range that contains a and b.
+func unionTimeRange(a, b TimeRange) TimeRange {
+	if a.Min.IsZero() || b.Min.IsZero() {
+		a.Min = time.Time{}
+	} else if b.Min.Before(a.Min) {
+		a.Min = b.Min
+	}
+	if a.Max.IsZero() || b.Max.IsZero() {
+		a.Max = time.Time{}
+	} else if b.Max.After(a.Max) {
+		a.Max = b.Max
+	}
+	return a
+}
+
+// isTimeRef returns true if expr refers to the time column.
+func isTimeRef(expr Expr) bool {
+	ref, ok := expr.(*VarRef)
+	return ok && !ref.System && strings.EqualFold(ref.Val, "time")
+}
+
+// timeValue returns the time an expression compared with time evaluates to.
+func timeValue(expr Expr, loc *time.Location, now time.Time) (time.Time, bool) {
+	switch expr := expr.(type) {
+	case *ParenExpr:
+		return timeValue(expr.Expr, loc, now)
+	case *TimeLiteral:
+		return expr.Val, true
+	case *StringLiteral:
+		if lit, err := expr.ToTimeLiteral(loc); err == nil {
+			return lit.Val, true
+		}
+	case *IntegerLiteral:
+		return time.Unix(0, expr.Val), true
+	case *NumberLiteral:
+		return time.Unix(0, int64(expr.Val)), true
+	case *Call:
+		if len(expr.Args) != 0 {
+			break
+		}
+		name := strings.ToLower(expr.Name)
+		if name == "now" {
+			return now, true
+		} else if days, ok := relativeDays[name]; ok {
+			return startOfDay(now, loc, days), true
+		}
+	case *BinaryExpr:
+		if d, ok := expr.RHS.(*DurationLiteral); ok && (expr.Op == token.ADD || expr.Op == token.SUB) {
+			t, ok := timeValue(expr.LHS, loc, now)
+			if !ok {
+				return time.Time{}, false
+			}
+			if expr.Op == token.SUB {
+				return t.Add(-d.Val), true
+			}
+			return t.Add(d.Val), true
+		}
+	}
+	return time.Time{}, false
+}
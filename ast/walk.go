@@ -1,14 +1,21 @@
 package ast
 
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
 // Visitor can be called by Walk to traverse an AST hierarchy.
 // The Visit() function is called once per node.
 type Visitor interface {
 	Visit(Node) Visitor
 }
 
-// Walk traverses a node hierarchy in depth-first order.
+// Walk traverses a node hierarchy in depth-first order. Nil nodes, including
+// nil pointers such as a missing Target or a nil entry of Fields, are skipped.
 func Walk(v Visitor, node Node) {
-	if node == nil {
+	if isNilNode(node) {
 		return
 	}
 
@@ -45,10 +52,24 @@ func Walk(v Visitor, node Node) {
 	case *ParenExpr:
 		Walk(v, n.Expr)
 
+	case *FieldAccess:
+		Walk(v, n.Base)
+
+	case *NotExpr:
+		Walk(v, n.Expr)
+
+	case *QuantifiedExpr:
+		for _, expr := range n.Vals {
+			Walk(v, expr)
+		}
+
 	case *Query:
 		Walk(v, n.Statements)
 
 	case *SelectStatement:
+		for _, cte := range n.CTEs {
+			Walk(v, cte)
+		}
 		Walk(v, n.Fields)
 		Walk(v, n.Target)
 		Walk(v, n.Dimensions)
@@ -69,16 +90,67 @@ func Walk(v Visitor, node Node) {
 	case *SubQuery:
 		Walk(v, n.Statement)
 
+	case *SubqueryExpr:
+		Walk(v, n.Statement)
+
+	case *With:
+		Walk(v, n.Statement)
+
+	case *CreateContinuousQueryStatement:
+		Walk(v, n.Source)
+
+	case *InsertStatement:
+		for _, f := range n.Fields {
+			Walk(v, f)
+		}
+
+	case *ShowTagKeyCardinalityStatement:
+		Walk(v, n.Sources)
+		Walk(v, n.Condition)
+		Walk(v, n.Dimensions)
+
+	case *ShowFieldKeyCardinalityStatement:
+		Walk(v, n.Sources)
+		Walk(v, n.Condition)
+		Walk(v, n.Dimensions)
+
+	case *PointField:
+		Walk(v, n.Value)
+
+	case *UnionStatement:
+		for _, cte := range n.CTEs {
+			Walk(v, cte)
+		}
+		for _, s := range n.Statements {
+			Walk(v, s)
+		}
+		Walk(v, n.SortFields)
+
+	case *UnionSubQuery:
+		Walk(v, n.Statement)
+
+	case *Join:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+		Walk(v, n.On)
+
 	case Statements:
 		for _, s := range n {
 			Walk(v, s)
 		}
 
 	case *Target:
-		if n != nil {
-			Walk(v, n.Metric)
-		}
+		Walk(v, n.Metric)
+	}
+}
+
+// isNilNode returns true if node is nil or a nil pointer.
+func isNilNode(node Node) bool {
+	if node == nil {
+		return true
 	}
+	rv := reflect.ValueOf(node)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
 }
 
 // WalkFunc traverses a node hierarchy in depth-first order.
@@ -89,3 +161,208 @@ func WalkFunc(node Node, fn func(Node)) {
 type walkFuncVisitor func(Node)
 
 func (fn walkFuncVisitor) Visit(n Node) Visitor { fn(n); return fn }
+
+// NodeCount returns the number of nodes in a node hierarchy, as visited by
+// Walk, including the statements of subqueries. With Depth, it can be used to
+// refuse queries that are too complex to evaluate.
+func NodeCount(node Node) int {
+	var n int
+	WalkFunc(node, func(Node) { n++ })
+	return n
+}
+
+// Depth returns the depth of a node hierarchy, as visited by Walk. A single
+// node has a depth of 1 and a nil node a depth of 0.
+func Depth(node Node) int {
+	var max int
+	Walk(&depthVisitor{max: &max}, node)
+	return max
+}
+
+// depthVisitor records the deepest level reached in max.
+type depthVisitor struct {
+	depth int
+	max   *int
+}
+
+func (v *depthVisitor) Visit(n Node) Visitor {
+	depth := v.depth + 1
+	if depth > *v.max {
+		*v.max = depth
+	}
+	return &depthVisitor{depth: depth, max: v.max}
+}
+
+// PathElem is a step from a parent node to one of its children. Field is the
+// name of the field of Parent holding the child, or "" if Parent is itself a
+// list such as Fields. Index is the index of the child in that list, or -1.
+type PathElem struct {
+	Parent Node
+	Field  string
+	Index  int
+}
+
+// FormatPath returns the string representation of a path, such as
+// "Sources[0].Statement.Condition".
+func FormatPath(path []PathElem) string {
+	var buf strings.Builder
+	for _, e := range path {
+		if e.Field != "" {
+			if buf.Len() > 0 {
+				_ = buf.WriteByte('.')
+			}
+			_, _ = buf.WriteString(e.Field)
+		}
+		if e.Index >= 0 {
+			_, _ = fmt.Fprintf(&buf, "[%d]", e.Index)
+		}
+	}
+	return buf.String()
+}
+
+// WalkWithPath traverses a node hierarchy in depth-first order like Walk,
+// calling fn with each node and the path from node to it. The children of a
+// node are skipped if fn returns false. The path is only valid during the
+// call to fn and must be copied to be kept.
+func WalkWithPath(node Node, fn func(path []PathElem, n Node) bool) {
+	w := pathWalker{fn: fn}
+	w.walk(node)
+}
+
+type pathWalker struct {
+	fn   func(path []PathElem, n Node) bool
+	path []PathElem
+}
+
+func (w *pathWalker) walk(node Node) {
+	if isNilNode(node) || !w.fn(w.path, node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *BinaryExpr:
+		w.child(n, "LHS", -1, n.LHS)
+		w.child(n, "RHS", -1, n.RHS)
+
+	case *Call:
+		for i, expr := range n.Args {
+			w.child(n, "Args", i, expr)
+		}
+
+	case *Dimension:
+		w.child(n, "Expr", -1, n.Expr)
+
+	case Dimensions:
+		for i, c := range n {
+			w.child(n, "", i, c)
+		}
+
+	case *Field:
+		w.child(n, "Expr", -1, n.Expr)
+
+	case Fields:
+		for i, c := range n {
+			w.child(n, "", i, c)
+		}
+
+	case *ParenExpr:
+		w.child(n, "Expr", -1, n.Expr)
+
+	case *FieldAccess:
+		w.child(n, "Base", -1, n.Base)
+
+	case *NotExpr:
+		w.child(n, "Expr", -1, n.Expr)
+
+	case *QuantifiedExpr:
+		for i, expr := range n.Vals {
+			w.child(n, "Vals", i, expr)
+		}
+
+	case *Query:
+		w.child(n, "Statements", -1, n.Statements)
+
+	case *SelectStatement:
+		for i, cte := range n.CTEs {
+			w.child(n, "CTEs", i, cte)
+		}
+		w.child(n, "Fields", -1, n.Fields)
+		w.child(n, "Target", -1, n.Target)
+		w.child(n, "Dimensions", -1, n.Dimensions)
+		w.child(n, "Sources", -1, n.Sources)
+		w.child(n, "Condition", -1, n.Condition)
+		w.child(n, "SortFields", -1, n.SortFields)
+
+	case SortFields:
+		for i, sf := range n {
+			w.child(n, "", i, sf)
+		}
+
+	case Sources:
+		for i, s := range n {
+			w.child(n, "", i, s)
+		}
+
+	case *SubQuery:
+		w.child(n, "Statement", -1, n.Statement)
+
+	case *SubqueryExpr:
+		w.child(n, "Statement", -1, n.Statement)
+
+	case *With:
+		w.child(n, "Statement", -1, n.Statement)
+
+	case *CreateContinuousQueryStatement:
+		w.child(n, "Source", -1, n.Source)
+
+	case *InsertStatement:
+		for i, f := range n.Fields {
+			w.child(n, "Fields", i, f)
+		}
+
+	case *ShowTagKeyCardinalityStatement:
+		w.child(n, "Sources", -1, n.Sources)
+		w.child(n, "Condition", -1, n.Condition)
+		w.child(n, "Dimensions", -1, n.Dimensions)
+
+	case *ShowFieldKeyCardinalityStatement:
+		w.child(n, "Sources", -1, n.Sources)
+		w.child(n, "Condition", -1, n.Condition)
+		w.child(n, "Dimensions", -1, n.Dimensions)
+
+	case *PointField:
+		w.child(n, "Value", -1, n.Value)
+
+	case *UnionStatement:
+		for i, cte := range n.CTEs {
+			w.child(n, "CTEs", i, cte)
+		}
+		for i, s := range n.Statements {
+			w.child(n, "Statements", i, s)
+		}
+		w.child(n, "SortFields", -1, n.SortFields)
+
+	case *UnionSubQuery:
+		w.child(n, "Statement", -1, n.Statement)
+
+	case *Join:
+		w.child(n, "Left", -1, n.Left)
+		w.child(n, "Right", -1, n.Right)
+		w.child(n, "On", -1, n.On)
+
+	case Statements:
+		for i, s := range n {
+			w.child(n, "", i, s)
+		}
+
+	case *Target:
+		w.child(n, "Metric", -1, n.Metric)
+	}
+}
+
+// child walks the child of parent reached through field and index.
+func (w *pathWalker) child(parent Node, field string, index int, node Node) {
+	w.path = append(w.path, PathElem{Parent: parent, Field: field, Index: index})
+	w.walk(node)
+	w.path = w.path[:len(w.path)-1]
+}
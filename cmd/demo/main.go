@@ -73,10 +73,19 @@ func Walk(v ast.Visitor, node ast.Node, leaveFn func(ast.Node)) {
 	case *ast.ParenExpr:
 		Walk(v, n.Expr, leaveFn)
 
+	case *ast.FieldAccess:
+		Walk(v, n.Base, leaveFn)
+
+	case *ast.NotExpr:
+		Walk(v, n.Expr, leaveFn)
+
 	case *ast.Query:
 		Walk(v, n.Statements, leaveFn)
 
 	case *ast.SelectStatement:
+		for _, cte := range n.CTEs {
+			Walk(v, cte, leaveFn)
+		}
 		Walk(v, n.Fields, leaveFn)
 		Walk(v, n.Target, leaveFn)
 		Walk(v, n.Dimensions, leaveFn)
@@ -97,6 +106,50 @@ func Walk(v ast.Visitor, node ast.Node, leaveFn func(ast.Node)) {
 	case *ast.SubQuery:
 		Walk(v, n.Statement, leaveFn)
 
+	case *ast.SubqueryExpr:
+		Walk(v, n.Statement, leaveFn)
+
+	case *ast.With:
+		Walk(v, n.Statement, leaveFn)
+
+	case *ast.CreateContinuousQueryStatement:
+		Walk(v, n.Source, leaveFn)
+
+	case *ast.InsertStatement:
+		for _, f := range n.Fields {
+			Walk(v, f, leaveFn)
+		}
+
+	case *ast.ShowTagKeyCardinalityStatement:
+		Walk(v, n.Sources, leaveFn)
+		Walk(v, n.Condition, leaveFn)
+		Walk(v, n.Dimensions, leaveFn)
+
+	case *ast.ShowFieldKeyCardinalityStatement:
+		Walk(v, n.Sources, leaveFn)
+		Walk(v, n.Condition, leaveFn)
+		Walk(v, n.Dimensions, leaveFn)
+
+	case *ast.PointField:
+		Walk(v, n.Value, leaveFn)
+
+	case *ast.UnionStatement:
+		for _, cte := range n.CTEs {
+			Walk(v, cte, leaveFn)
+		}
+		for _, s := range n.Statements {
+			Walk(v, s, leaveFn)
+		}
+		Walk(v, n.SortFields, leaveFn)
+
+	case *ast.UnionSubQuery:
+		Walk(v, n.Statement, leaveFn)
+
+	case *ast.Join:
+		Walk(v, n.Left, leaveFn)
+		Walk(v, n.Right, leaveFn)
+		Walk(v, n.On, leaveFn)
+
 	case ast.Statements:
 		for _, s := range n {
 			Walk(v, s, leaveFn)
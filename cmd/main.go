@@ -1,16 +1,143 @@
+// Command main checks the statements of a file, or of stdin, and prints one
+// JSON line per statement, so that stored queries can be linted in CI.
+//
+// Usage:
+//
+//	main [-params JSON] [file]
+//
+// Passwords are printed as [REDACTED]. The rules that a statement breaks but
+// that are not enforced, such as a WITH name shadowing a metric, are printed
+// as its warnings.
+//
+// It exits with status 1 if any statement cannot be parsed, and with status 2
+// if the input cannot be read or the parameters cannot be bound.
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+
 	"sql/parser"
 )
 
+// result is the JSON line printed for a statement.
+type result struct {
+	OK          bool         `json:"ok"`
+	Error       *resultError `json:"error,omitempty"`
+	Normalized  string       `json:"normalized,omitempty"`
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	Warnings    []string     `json:"warnings,omitempty"`
+}
+
+// resultError describes a statement that cannot be parsed. Line and Char
+// start at 1 and are relative to the whole input. They are omitted if the
+// error has no position.
+type resultError struct {
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	Char    int    `json:"char,omitempty"`
+	Code    string `json:"code"`
+}
+
+// redacter is a statement with secrets, such as passwords, that are not
+// printed.
+type redacter interface {
+	RedactedString() string
+}
+
+// Error codes.
+const (
+	codeSyntax  = "syntax"  // a *parser.ParseError
+	codeInvalid = "invalid" // any other error, such as an unknown time zone
+)
+
 func main() {
-	stmt := "select * from ma"
-	q, err := parser.ParseQuery(stmt)
-	if err != nil {
-		fmt.Printf("ERR: %s", err)
-	} else {
-		fmt.Println(q)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command and returns its exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("main", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	params := fs.String("params", "", "bound parameters as a JSON object, such as '{\"host\": \"a\"}'")
+	if err := fs.Parse(args); err != nil {
+		return 2
 	}
+
+	r := stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		defer f.Close()
+		r = f
+	}
+
+	p := parser.NewParser(r)
+	if *params != "" {
+		var m map[string]interface{}
+		d := json.NewDecoder(strings.NewReader(*params))
+		d.UseNumber()
+		if err := d.Decode(&m); err != nil {
+			fmt.Fprintf(stderr, "invalid -params: %s\n", err)
+			return 2
+		}
+		if err := p.SetParams(m); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+
+	status := 0
+	enc := json.NewEncoder(stdout)
+	enc.SetEscapeHTML(false)
+	for {
+		stmt, err := p.ParseNext()
+		if err == io.EOF {
+			return status
+		}
+
+		var res result
+		if err != nil {
+			res.Error = newResultError(err)
+			status = 1
+		} else {
+			res.OK = true
+			res.Normalized = stmt.String()
+			if r, ok := stmt.(redacter); ok {
+				res.Normalized = r.RedactedString()
+			}
+			res.Fingerprint = fingerprint(res.Normalized)
+			for _, w := range p.Warnings() {
+				res.Warnings = append(res.Warnings, w.Error())
+			}
+		}
+		if err := enc.Encode(&res); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+}
+
+// newResultError returns the description of a parse error.
+func newResultError(err error) *resultError {
+	if e, ok := err.(*parser.ParseError); ok {
+		return &resultError{Message: e.Error(), Line: e.Pos.Line + 1, Char: e.Pos.Char + 1, Code: codeSyntax}
+	}
+	return &resultError{Message: err.Error(), Code: codeInvalid}
+}
+
+// fingerprint returns a short hash of a normalized statement, which is the
+// same for statements that only differ in formatting.
+func fingerprint(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:8])
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Ensure the statements of the fixture files are reported as in the
+// corresponding .jsonl files.
+func TestRun(t *testing.T) {
+	var tests = []struct {
+		args   []string
+		stdin  string
+		out    string
+		status int
+		stderr string
+	}{
+		{args: []string{"-params", `{"host": "server01"}`, "valid.sql"}, out: "valid.jsonl"},
+		{args: []string{"-params", `{"host": "server01"}`, "invalid.sql"}, out: "invalid.jsonl", status: 1},
+		{args: []string{"-params", `{"host": "server01"}`}, stdin: "invalid.sql", out: "invalid.jsonl", status: 1},
+		{args: []string{"-params", `{"host": "server01"}`, "-"}, stdin: "valid.sql", out: "valid.jsonl"},
+		{args: []string{"-params", `{"x": [[1]]}`, "valid.sql"}, status: 2, stderr: "cannot bind parameters: $x: bound list parameter value cannot contain a list\n"},
+		{args: []string{"-params", `[]`, "valid.sql"}, status: 2, stderr: "invalid -params: json: cannot unmarshal array into Go value of type map[string]interface {}\n"},
+		{args: []string{"missing.sql"}, status: 2, stderr: "open testdata/missing.sql: no such file or directory\n"},
+	}
+
+	for i, tt := range tests {
+		args := append([]string(nil), tt.args...)
+		if n := len(args); n > 0 && strings.HasSuffix(args[n-1], ".sql") {
+			args[n-1] = filepath.Join("testdata", args[n-1])
+		}
+
+		var stdin []byte
+		if tt.stdin != "" {
+			stdin = mustReadFile(t, filepath.Join("testdata", tt.stdin))
+		}
+		var exp []byte
+		if tt.out != "" {
+			exp = mustReadFile(t, filepath.Join("testdata", tt.out))
+		}
+
+		var stdout, stderr bytes.Buffer
+		status := run(args, bytes.NewReader(stdin), &stdout, &stderr)
+		if status != tt.status {
+			t.Errorf("%d. %v: status mismatch: exp=%d got=%d (%s)", i, tt.args, tt.status, status, stderr.String())
+		} else if stderr.String() != tt.stderr {
+			t.Errorf("%d. %v: stderr mismatch:\n  exp=%s\n  got=%s", i, tt.args, tt.stderr, stderr.String())
+		} else if !bytes.Equal(stdout.Bytes(), exp) {
+			t.Errorf("%d. %v: output mismatch:\n  exp=%s\n  got=%s", i, tt.args, exp, stdout.String())
+		}
+	}
+}
+
+func mustReadFile(tb testing.TB, name string) []byte {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
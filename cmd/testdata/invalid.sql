@@ -0,0 +1,7 @@
+SELECT value FROM cpu;
+
+SELECT FROM cpu;
+SELECT value FROM cpu WHERE host =~ $host;
+SELECT value, host = 'a' FROM cpu;
+SELECT value FROM cpu tz('Nowhere/City');
+SELECT a FROM b c
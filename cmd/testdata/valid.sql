@@ -0,0 +1,7 @@
+-- Dashboard queries.
+SELECT mean(value) FROM cpu WHERE host = $host GROUP BY time(1m);
+select   mean(value)
+from cpu where host = $host group by time(1m);
+SELECT value FROM mem LIMIT 10;
+CREATE USER "ops admin" WITH PASSWORD 's3cr3t' WITH ALL PRIVILEGES;
+WITH cpu AS (SELECT value FROM cpu) SELECT max(value) FROM cpu
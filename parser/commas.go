@@ -0,0 +1,91 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"sql/token"
+	"sql/tools"
+)
+
+// SetAllowTrailingCommas sets whether a list of fields, dimensions, sources,
+// names or call arguments may end with a comma, as in "SELECT a, b, FROM m",
+// which query templates often generate. By default, such a comma is an
+// error that names the token after it. It must be called before parsing.
+func (p *Parser) SetAllowTrailingCommas(allow bool) {
+	p.allowTrailingCommas = allow
+}
+
+// WithAllowTrailingCommas allows lists to end with a comma.
+// See SetAllowTrailingCommas.
+func WithAllowTrailingCommas() Option {
+	return func(p *Parser) error {
+		p.SetAllowTrailingCommas(true)
+		return nil
+	}
+}
+
+// listEnd returns true if the token after the comma of a list ends the list.
+// word is true if the token is a bare identifier, and call is true if it is
+// an identifier immediately followed by "(".
+type listEnd func(tok token.Token, lit string, word, call bool) bool
+
+// endsWith returns a listEnd for a list followed by one of toks, or by
+// fill(), tz() or UNION if clauses is true.
+func endsWith(clauses bool, toks ...token.Token) listEnd {
+	return func(tok token.Token, lit string, word, call bool) bool {
+		if clauses && call && (strings.EqualFold(lit, "fill") || strings.EqualFold(lit, "tz")) {
+			return true
+		} else if clauses && word && strings.EqualFold(lit, "UNION") {
+			return true
+		}
+		for _, end := range toks {
+			if tok == end {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// The tokens that end the lists of fields, dimensions, sources, call
+// arguments and names.
+var (
+	fieldsEnd     = endsWith(false, token.FROM, token.INTO, token.RPAREN, token.SEMICOLON, token.EOF)
+	dimensionsEnd = endsWith(true, token.ORDER, token.LIMIT, token.OFFSET, token.SLIMIT, token.SOFFSET, token.RPAREN, token.SEMICOLON, token.EOF)
+	sourcesEnd    = endsWith(true, token.WHERE, token.GROUP, token.ORDER, token.LIMIT, token.OFFSET, token.SLIMIT, token.SOFFSET, token.RPAREN, token.SEMICOLON, token.EOF)
+	argsEnd       = endsWith(false, token.RPAREN)
+	identsEnd     = endsWith(false, token.RPAREN, token.SEMICOLON, token.EOF)
+)
+
+// trailingComma returns true if the comma at pos, which was just scanned,
+// ends its list, which is when the token after it is an end of the list.
+// That token is not consumed. A trailing comma is an error unless trailing
+// commas are allowed.
+func (p *Parser) trailingComma(pos token.Pos, end listEnd) (bool, error) {
+	// A regex that follows is only scanned as one from the input, so it
+	// must not be scanned here. It does not end a list anyway.
+	if tools.IsWhitespace(p.s.Peek()) {
+		p.consumeWhitespace()
+	}
+	if p.s.Peek() == '/' {
+		return false, nil
+	}
+
+	_, tok, lit := p.ScanIgnoreWhitespace()
+	word, call := false, false
+	if tok == token.IDENT {
+		word = p.s.Raw() == lit
+		_, tok0, _ := p.scan()
+		call = tok0 == token.LPAREN
+		p.s.Unscan()
+	}
+	p.s.Unscan()
+
+	if !end(tok, lit, word, call) {
+		return false, nil
+	} else if !p.allowTrailingCommas {
+		return false, &ParseError{Message: fmt.Sprintf("trailing comma before %s", tokstr(tok, lit)), Pos: pos}
+	}
+	return true, nil
+}
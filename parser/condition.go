@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"sql/ast"
+	"sql/token"
+)
+
+// conditionSchema restricts the references and calls of a condition parsed
+// by ParseCondition.
+type conditionSchema struct {
+	allowed   map[string]ast.DataType
+	allowTime bool
+}
+
+// ParseCondition parses a standalone condition, such as the WHERE clause of
+// an alert rule, whose variables must all be in allowed. Each reference gets
+// the type declared in allowed. References to time are rejected unless
+// WithTimeInCondition is given, and now() is the only function allowed.
+func ParseCondition(s string, allowed map[string]ast.DataType, opts ...Option) (ast.Expr, error) {
+	p, err := newParser(s, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.condition == nil {
+		p.condition = &conditionSchema{}
+	}
+	p.condition.allowed = allowed
+
+	expr, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if pos, tok, lit := p.ScanIgnoreWhitespace(); tok != token.EOF {
+		return nil, newParseError(tokstr(tok, lit), []string{"operator", "EOF"}, pos)
+	}
+	return expr, nil
+}
+
+// WithTimeInCondition allows references to time in a condition parsed by
+// ParseCondition.
+func WithTimeInCondition() Option {
+	return func(p *Parser) error {
+		if p.condition == nil {
+			p.condition = &conditionSchema{}
+		}
+		p.condition.allowTime = true
+		return nil
+	}
+}
+
+// checkConditionRef returns an error for a reference that a condition does
+// not allow, and sets the type of the reference otherwise.
+func (p *Parser) checkConditionRef(ref *ast.VarRef) error {
+	if p.condition == nil || p.condition.allowed == nil {
+		return nil
+	}
+
+	if strings.EqualFold(ref.Val, "time") && !ref.System {
+		if !p.condition.allowTime {
+			return errors.New("time is not allowed in the condition")
+		}
+		ref.Type = ast.Time
+		return nil
+	}
+
+	typ, ok := p.condition.allowed[ref.Val]
+	if !ok || ref.System {
+		return fmt.Errorf("unknown identifier %s", ref)
+	}
+	if ref.Type != ast.Unknown && ref.Type != typ && !(ref.Type == ast.AnyField && typ != ast.Tag) {
+		return fmt.Errorf("cannot cast %s to %s, it is declared as %s", ref.Val, ref.Type, typ)
+	}
+	ref.Type = typ
+	return nil
+}
+
+// checkConditionCall returns an error for a call that a condition does not
+// allow.
+func (p *Parser) checkConditionCall(name string) error {
+	if p.condition == nil || p.condition.allowed == nil || strings.EqualFold(name, "now") {
+		return nil
+	}
+	return fmt.Errorf("function %s is not allowed in the condition, only now() is", name)
+}
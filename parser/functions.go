@@ -0,0 +1,26 @@
+package parser
+
+import (
+	"sql/ast"
+	"sql/token"
+)
+
+// recordCall records the position of a call, so that the errors of its
+// statement can be reported where the call is.
+func (p *Parser) recordCall(call *ast.Call, pos token.Pos) {
+	if p.callPos == nil {
+		p.callPos = make(map[*ast.Call]token.Pos)
+	}
+	p.callPos[call] = pos
+}
+
+// checkCalls returns an error for the first call of stmt that does not suit
+// its function or the statement, where the call is. See
+// ast.SelectStatement.ValidateCalls.
+func (p *Parser) checkCalls(stmt *ast.SelectStatement) error {
+	err := stmt.ValidateCalls()
+	if e, ok := err.(*ast.CallError); ok {
+		return &ParseError{Message: e.Message, Pos: p.callPos[e.Call]}
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package parser
+
+import (
+	"fmt"
+
+	"sql/token"
+)
+
+// SetMaxFields sets the maximum number of fields of a SELECT statement, to
+// cap the cost of a query. A field past the limit is a ParseError at its
+// position. There is no limit by default or if n is not positive.
+// It must be called before parsing.
+func (p *Parser) SetMaxFields(n int) {
+	p.maxFields = n
+}
+
+// WithMaxFields sets the maximum number of fields. See SetMaxFields.
+func WithMaxFields(n int) Option {
+	return func(p *Parser) error {
+		p.SetMaxFields(n)
+		return nil
+	}
+}
+
+// SetMaxDimensions sets the maximum number of dimensions of the GROUP BY
+// clause of a statement, to cap the cost of a query. A dimension past the
+// limit is a ParseError at its position. There is no limit by default or if
+// n is not positive. It must be called before parsing.
+func (p *Parser) SetMaxDimensions(n int) {
+	p.maxDimensions = n
+}
+
+// WithMaxDimensions sets the maximum number of dimensions.
+// See SetMaxDimensions.
+func WithMaxDimensions(n int) Option {
+	return func(p *Parser) error {
+		p.SetMaxDimensions(n)
+		return nil
+	}
+}
+
+// SetMaxListLength sets the maximum number of values of the list of ANY or
+// ALL, such as host = ANY('a', 'b'), including the values of bound lists,
+// and of the list of IN, such as host IN ('a', 'b'). A
+// value past the limit is a ParseError at its position, or at the position
+// of its bound list. There is no limit by default or if n is not positive.
+// It must be called before parsing.
+func (p *Parser) SetMaxListLength(n int) {
+	p.maxListLength = n
+}
+
+// WithMaxListLength sets the maximum number of values of a list.
+// See SetMaxListLength.
+func WithMaxListLength(n int) Option {
+	return func(p *Parser) error {
+		p.SetMaxListLength(n)
+		return nil
+	}
+}
+
+// checkListLength returns an error at pos if a list of op has n values and
+// there cannot be that many.
+func (p *Parser) checkListLength(op token.Token, n int, pos token.Pos) error {
+	if p.maxListLength > 0 && n > p.maxListLength {
+		return &ParseError{Message: fmt.Sprintf("too many values for %s, expected at most %d", op, p.maxListLength), Pos: pos}
+	}
+	return nil
+}
+
+// checkLimit returns an error at the next item of a list of n items if
+// there cannot be more than max, unless max is not positive.
+func (p *Parser) checkLimit(what string, n, max int) error {
+	if max <= 0 || n < max {
+		return nil
+	}
+	pos, _, _ := p.ScanIgnoreWhitespace()
+	return &ParseError{Message: fmt.Sprintf("too many %s, expected at most %d", what, max), Pos: pos}
+}
@@ -1,13 +1,19 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"encoding/json"
+	"sql/ast"
+	"sql/scanner"
 	"sql/token"
+	"sql/tools"
 )
 
 // Value represents a value that can be bound
@@ -33,6 +39,10 @@ type (
 	// IntegerValue is an integer literal.
 	IntegerValue int64
 
+	// UnsignedValue is an unsigned integer literal.
+	// It is parsed as an integer literal if it fits in an int64.
+	UnsignedValue uint64
+
 	// BooleanValue is a boolean literal.
 	BooleanValue bool
 
@@ -42,8 +52,79 @@ type (
 	// ErrorValue is a special value that returns an error during parsing
 	// when it is used.
 	ErrorValue string
+
+	// ListValue is a list of values, used as in host = ANY($hosts).
+	ListValue []Value
 )
 
+// checkParamName returns an error if no query can reference a bound
+// parameter with this name. Any other name can be written as $"name".
+func checkParamName(name string) error {
+	if name == "" {
+		return errors.New(`empty bound parameter name, use $name or $"name"`)
+	} else if !utf8.ValidString(name) {
+		return errors.New("bound parameter name is not valid UTF-8")
+	}
+	return nil
+}
+
+// BoundParameterNames returns the distinct names of the bound parameters
+// referenced by a query, in order of first appearance. The query is only
+// scanned, so no parameter needs to be set and the query does not need to be
+// valid, but a string or a regex that cannot be scanned is an error.
+//
+// As for the parser, a '/' starts a regex where an operand may start, and is
+// a division after one, so that "$a / $b" references both parameters.
+func BoundParameterNames(s string) ([]string, error) {
+	sc := scanner.NewScanner(strings.NewReader(s))
+	var names []string
+	seen := make(map[string]bool)
+	prev := token.ILLEGAL
+	for {
+		var pos token.Pos
+		var tok token.Token
+		var lit string
+		if sc.Peek() == '/' && !endsOperand(prev) {
+			pos, tok, lit = sc.ScanRegex()
+		} else {
+			pos, tok, lit = sc.Scan()
+		}
+
+		switch tok {
+		case token.EOF:
+			return names, nil
+		case token.WS, token.COMMENT:
+			continue
+		case token.BADSTRING:
+			return nil, &ParseError{Message: "bad string", Pos: pos}
+		case token.BADESCAPE:
+			return nil, &ParseError{Message: fmt.Sprintf("bad escape: %s", lit), Pos: pos}
+		case token.BADREGEX:
+			return nil, &ParseError{Message: fmt.Sprintf("bad regex: %s", lit), Pos: pos}
+		case token.BOUNDPARAM:
+			k := strings.TrimPrefix(lit, "$")
+			if err := checkParamName(k); err != nil {
+				return nil, &ParseError{Message: err.Error(), Pos: pos}
+			} else if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+		prev = tok
+	}
+}
+
+// endsOperand returns true if a token can be the last token of an operand,
+// so that a '/' after it is a division.
+func endsOperand(tok token.Token) bool {
+	switch tok {
+	case token.IDENT, token.BOUNDPARAM, token.SYSREF, token.NUMBER, token.INTEGER,
+		token.DURATIONVAL, token.STRING, token.REGEX, token.TRUE, token.FALSE, token.RPAREN:
+		return true
+	}
+	return false
+}
+
 // BindValue will bind an interface value to its cnosql value.
 // This method of binding values only supports literals.
 func BindValue(v interface{}) Value {
@@ -58,20 +139,83 @@ func BindValue(v interface{}) Value {
 	switch v := v.(type) {
 	case float64:
 		return NumberValue(v)
+	case float32:
+		return NumberValue(v)
 	case int64:
 		return IntegerValue(v)
+	case int:
+		return IntegerValue(v)
+	case int32:
+		return IntegerValue(v)
+	case uint64:
+		return UnsignedValue(v)
+	case uint:
+		return UnsignedValue(v)
 	case string:
 		return StringValue(v)
 	case bool:
 		return BooleanValue(v)
 	case map[string]interface{}:
 		return bindObjectValue(v)
+	case []interface{}:
+		return bindListValue(v)
 	default:
 		s := fmt.Sprintf("unable to bind parameter with type %T", v)
 		return ErrorValue(s)
 	}
 }
 
+// Substitute returns a copy of stmt, including its subqueries, in which every
+// BoundParameter is replaced with its value in params, bound like the
+// parameters set with SetParams, such as {"identifier": "host"} for a
+// reference to host. A value that is already an expression, such as
+// mean(value), is used as-is. The options apply to the values bound, such as
+// WithRegexCache to the regexes. See ast.SelectStatement.Substitute.
+func Substitute(stmt *ast.SelectStatement, params map[string]interface{}, opts ...Option) (*ast.SelectStatement, error) {
+	p, err := newParser("", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := make(map[string]ast.Expr, len(params))
+	for k, v := range params {
+		if expr, ok := v.(ast.Expr); ok {
+			exprs[k] = expr
+			continue
+		}
+		var expr ast.Expr
+		switch v := BindValue(v).(type) {
+		case ErrorValue:
+			err = errors.New(string(v))
+		case ListValue:
+			err = fmt.Errorf("list parameter $%s must be used in ANY or ALL", k)
+		default:
+			expr, err = p.valueExpr(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to bind parameter %s: %s", k, err)
+		}
+		exprs[k] = expr
+	}
+	return stmt.Substitute(exprs)
+}
+
+// bindListValue will bind a list to a value.
+func bindListValue(a []interface{}) Value {
+	list := make(ListValue, len(a))
+	for i, v := range a {
+		switch v := BindValue(v).(type) {
+		case ErrorValue:
+			return v
+		case ListValue:
+			return ErrorValue("bound list parameter value cannot contain a list")
+		default:
+			list[i] = v
+		}
+	}
+	return list
+}
+
 // bindObjectValue will bind an object to a value.
 func bindObjectValue(m map[string]interface{}) Value {
 	if len(m) != 1 {
@@ -123,35 +267,41 @@ func bindObjectValue(m map[string]interface{}) Value {
 			return ErrorValue("number literal must be a float value")
 		}
 	case "int", "integer":
-		i, ok := v.(int64)
+		i, ok := toInt64(v)
 		if !ok {
 			return ErrorValue("integer literal must be an integer value")
 		}
 		return IntegerValue(i)
+	case "unsigned":
+		u, ok := toUint64(v)
+		if !ok {
+			return ErrorValue("unsigned literal must be an unsigned integer value")
+		}
+		return UnsignedValue(u)
 	case "duration":
-		switch d := v.(type) {
-		case string:
+		if d, ok := v.(string); ok {
 			return DurationValue(d)
-		case int64:
-			return DurationValue(FormatDuration(time.Duration(d)))
-		default:
-			return ErrorValue("duration literal must be a string or integer value")
+		} else if d, ok := toInt64(v); ok {
+			return DurationValue(tools.FormatDuration(time.Duration(d)))
 		}
+		return ErrorValue("duration literal must be a string or integer value")
 	default:
 		return ErrorValue(fmt.Sprintf("unknown bind object type: %s", k))
 	}
 }
 
-func (v Identifier) TokenType() token.Token   { return token.IDENT }
-func (v Identifier) Value() string            { return string(v) }
-func (v StringValue) TokenType() token.Token  { return token.STRING }
-func (v StringValue) Value() string           { return string(v) }
-func (v RegexValue) TokenType() token.Token   { return token.REGEX }
-func (v RegexValue) Value() string            { return string(v) }
-func (v NumberValue) TokenType() token.Token  { return token.NUMBER }
-func (v NumberValue) Value() string           { return strconv.FormatFloat(float64(v), 'f', -1, 64) }
-func (v IntegerValue) TokenType() token.Token { return token.INTEGER }
-func (v IntegerValue) Value() string          { return strconv.FormatInt(int64(v), 10) }
+func (v Identifier) TokenType() token.Token    { return token.IDENT }
+func (v Identifier) Value() string             { return string(v) }
+func (v StringValue) TokenType() token.Token   { return token.STRING }
+func (v StringValue) Value() string            { return string(v) }
+func (v RegexValue) TokenType() token.Token    { return token.REGEX }
+func (v RegexValue) Value() string             { return string(v) }
+func (v NumberValue) TokenType() token.Token   { return token.NUMBER }
+func (v NumberValue) Value() string            { return strconv.FormatFloat(float64(v), 'f', -1, 64) }
+func (v IntegerValue) TokenType() token.Token  { return token.INTEGER }
+func (v IntegerValue) Value() string           { return strconv.FormatInt(int64(v), 10) }
+func (v UnsignedValue) TokenType() token.Token { return token.INTEGER }
+func (v UnsignedValue) Value() string          { return strconv.FormatUint(uint64(v), 10) }
 func (v BooleanValue) TokenType() token.Token {
 	if v {
 		return token.TRUE
@@ -159,12 +309,68 @@ func (v BooleanValue) TokenType() token.Token {
 		return token.FALSE
 	}
 }
-func (v BooleanValue) Value() string           { return "" }
+func (v BooleanValue) Value() string           { return strconv.FormatBool(bool(v)) }
 func (v DurationValue) TokenType() token.Token { return token.DURATIONVAL }
 func (v DurationValue) Value() string          { return string(v) }
 func (e ErrorValue) TokenType() token.Token    { return token.BOUNDPARAM }
 func (e ErrorValue) Value() string             { return string(e) }
 
+// TokenType returns BOUNDPARAM since a list is not a single token. The
+// parser expands it where a list is expected.
+func (v ListValue) TokenType() token.Token { return token.BOUNDPARAM }
+func (v ListValue) Value() string {
+	str := make([]string, len(v))
+	for i, v := range v {
+		str[i] = v.Value()
+	}
+	return "(" + strings.Join(str, ", ") + ")"
+}
+
+// toInt64 converts an integer, or a float64 with an integral value as decoded
+// from JSON into an interface{}, to an int64. It returns false if v is not an
+// integer or does not fit in an int64.
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint:
+		return int64(v), uint64(v) <= math.MaxInt64
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// toUint64 converts a non-negative integer, or a float64 with a non-negative
+// integral value as decoded from JSON into an interface{}, to a uint64.
+// It returns false if v is not such a value or does not fit in a uint64.
+func toUint64(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return v, true
+	case uint:
+		return uint64(v), true
+	case float64:
+		if v != math.Trunc(v) || v < 0 || v >= math.MaxUint64 {
+			return 0, false
+		}
+		return uint64(v), true
+	}
+	if i, ok := toInt64(v); ok && i >= 0 {
+		return uint64(i), true
+	}
+	return 0, false
+}
+
 func jsonNumberToValue(v json.Number) (interface{}, error) {
 	if strings.Contains(string(v), ".") {
 		f, err := v.Float64()
@@ -175,6 +381,10 @@ func jsonNumberToValue(v json.Number) (interface{}, error) {
 	} else {
 		i, err := v.Int64()
 		if err != nil {
+			// The number may be too large to fit into an int64.
+			if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+				return u, nil
+			}
 			return nil, err
 		}
 		return i, nil
@@ -6,6 +6,7 @@ import (
 	"io"
 	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +21,62 @@ import (
 type Parser struct {
 	s      scanner.Scanner
 	params map[string]Value
+
+	// Whether bound parameters without a value are parsed as nodes.
+	deferBoundParams bool
+
+	keepComments bool
+	comments     ast.Comments
+
+	// Names of the bound parameters read so far, including repeats.
+	boundParams []string
+
+	// Names of the substituted bound parameters by position.
+	bound map[token.Pos]string
+
+	// Whether the last statement ended with its line, as an INSERT may, so
+	// that no semicolon needs to come before the next one.
+	lineEnded bool
+
+	policy               Policy
+	disallowRegexSources bool
+	regexCache           *RegexCache
+	lazyRegex            bool
+	condition            *conditionSchema
+
+	// The maximum numbers of fields and dimensions, if positive.
+	maxFields     int
+	maxDimensions int
+
+	// The maximum number of values of a list, if positive.
+	maxListLength int
+
+	// Whether lists may end with a comma.
+	allowTrailingCommas bool
+
+	// Whether operand types are checked, and the positions of the operators
+	// parsed so far to report errors at.
+	strictTypes bool
+	opPos       map[*ast.BinaryExpr]token.Pos
+
+	// Positions of the references with a cast parsed so far to report
+	// conflicting casts at.
+	castPos map[*ast.VarRef]token.Pos
+
+	// Positions of the calls parsed so far to report errors at.
+	callPos map[*ast.Call]token.Pos
+
+	// Policy violations found in the current statement and the nesting
+	// depth of the subquery being parsed.
+	violations Violations
+	depth      int
+
+	// Warnings found in the current statement.
+	warnings Violations
+
+	// Statements named by the WITH clause of the current statement so far,
+	// which sources may refer to by name.
+	ctes map[string]*ast.SelectStatement
 }
 
 // NewParser returns a new instance of Parser.
@@ -27,63 +84,811 @@ func NewParser(r io.Reader) *Parser {
 	return &Parser{s: scanner.NewScanner(r)}
 }
 
-// SetParams sets the parameters that will be used for any bound parameter substitutions.
-func (p *Parser) SetParams(params map[string]interface{}) {
-	p.params = make(map[string]Value, len(params))
-	for name, param := range params {
-		p.params[name] = BindValue(param)
+// SetParams sets the parameters that will be used for any bound parameter substitutions.
+// It can be called more than once. The parameters are merged with the ones that
+// were set before, and a parameter that was already set is replaced.
+//
+// A parameter is referenced as $name, where name is a bare identifier, or as
+// $"name" to use any other name, such as $"my param" for "my param". Quoted
+// names use the same escapes as quoted identifiers.
+//
+// It returns an error naming every parameter that cannot be bound, whether or
+// not the query uses it. The other parameters are still set, and using a
+// parameter that cannot be bound is also an error when the query is parsed.
+// A name that no query can reference, such as "", is not set.
+func (p *Parser) SetParams(params map[string]interface{}) error {
+	if p.params == nil {
+		p.params = make(map[string]Value, len(params))
+	}
+
+	var errs []string
+	for name, param := range params {
+		if err := checkParamName(name); err != nil {
+			errs = append(errs, fmt.Sprintf("$%s: %s", tools.QuoteIdent(name), err))
+			continue
+		}
+		v := BindValue(param)
+		if _, ok := v.(ErrorValue); ok {
+			errs = append(errs, fmt.Sprintf("$%s: %s", tools.QuoteIdent(name), v.Value()))
+		}
+		p.params[name] = v
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("cannot bind parameters: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SetDeferBoundParams sets whether a bound parameter without a value, such as
+// $x in "WHERE v > $x", is parsed as an ast.BoundParameter rather than
+// reported as a missing parameter. A statement parsed once this way can be
+// bound later with Substitute. Parameters that have a value are still
+// substituted while parsing. It must be called before parsing.
+func (p *Parser) SetDeferBoundParams(deferred bool) {
+	p.deferBoundParams = deferred
+}
+
+// SetKeepComments sets whether comments are collected while parsing.
+// Collected comments are returned in the Comments of the parsed Query.
+func (p *Parser) SetKeepComments(keep bool) {
+	p.keepComments = keep
+}
+
+// AllowKeywordAsIdent makes the keyword tok non-reserved for this parser, so
+// that it can be used as an identifier, such as a field named "metric".
+// Where the grammar expects the keyword, as in ":METRIC" or "::field", it is
+// still accepted. Keywords that start a clause, such as FROM or WHERE, are
+// ambiguous as identifiers and should stay reserved.
+// It must be called before parsing.
+func (p *Parser) AllowKeywordAsIdent(tok token.Token) {
+	p.s.AllowKeywordAsIdent(tok)
+}
+
+// SetInternIdents makes the parser share the string of identifiers written
+// the same way, such as "value" or "host" repeated across statements, which
+// saves allocations on input with much repetition. At most n distinct
+// identifiers are kept, for as long as the parser is, so n should be small
+// when parsing untrusted input with a long-lived parser. It must be called
+// before parsing.
+func (p *Parser) SetInternIdents(n int) {
+	p.s.InternIdents(n)
+}
+
+// Option configures a Parser created by ParseQuery, ParseStatement or ParseExpr.
+// An option that returns an error stops the parse.
+type Option func(p *Parser) error
+
+// WithParams sets the parameters used for bound parameter substitutions.
+// See SetParams.
+func WithParams(params map[string]interface{}) Option {
+	return func(p *Parser) error { return p.SetParams(params) }
+}
+
+// WithDeferBoundParams makes bound parameters without a value parsed as nodes.
+// See SetDeferBoundParams.
+func WithDeferBoundParams() Option {
+	return func(p *Parser) error {
+		p.SetDeferBoundParams(true)
+		return nil
+	}
+}
+
+// WithKeywordsAsIdents makes the keywords non-reserved. See AllowKeywordAsIdent.
+func WithKeywordsAsIdents(toks ...token.Token) Option {
+	return func(p *Parser) error {
+		for _, tok := range toks {
+			p.AllowKeywordAsIdent(tok)
+		}
+		return nil
+	}
+}
+
+// WithInternIdents makes the parser share the string of identifiers written
+// the same way. See SetInternIdents.
+func WithInternIdents(n int) Option {
+	return func(p *Parser) error {
+		p.SetInternIdents(n)
+		return nil
+	}
+}
+
+// WithPolicy sets the policy that parsed statements must follow. See SetPolicy.
+func WithPolicy(policy Policy) Option {
+	return func(p *Parser) error {
+		p.SetPolicy(policy)
+		return nil
+	}
+}
+
+// ParseQuery parses a query string and returns its AST representation.
+func ParseQuery(s string, opts ...Option) (*ast.Query, error) {
+	p, err := newParser(s, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParseQuery()
+}
+
+// ParseStatement parses a statement string and returns its AST representation.
+func ParseStatement(s string, opts ...Option) (ast.Statement, error) {
+	p, err := newParser(s, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParseStatement()
+}
+
+// ParseExpr parses an expression string and returns its AST representation.
+func ParseExpr(s string, opts ...Option) (ast.Expr, error) {
+	p, err := newParser(s, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParseExpr()
+}
+
+// newParser returns a new Parser for s with the options applied.
+func newParser(s string, opts []Option) (*Parser, error) {
+	p := NewParser(strings.NewReader(s))
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ParseQuery parses an CnosQL string and returns a Query AST object.
+func (p *Parser) ParseQuery() (*ast.Query, error) {
+	var statements ast.Statements
+	semi := true
+
+	for {
+		if pos, tok, lit := p.ScanIgnoreWhitespace(); tok == token.EOF {
+			return &ast.Query{Statements: statements, Comments: p.comments}, nil
+		} else if tok == token.SEMICOLON {
+			semi = true
+		} else {
+			if !semi {
+				return nil, newParseError(tokstr(tok, lit), []string{";"}, pos)
+			}
+			p.s.Unscan()
+			s, err := p.ParseStatement()
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, s)
+			semi = p.lineEnded
+		}
+	}
+}
+
+// ParseQueryCollect parses an CnosQL string like ParseQuery, but does not stop
+// at the first error. When a statement cannot be parsed, the error is recorded
+// and parsing resumes at the next semicolon or keyword that starts a statement.
+// It returns the statements that were parsed and the errors in the order they
+// were found.
+func (p *Parser) ParseQueryCollect() (*ast.Query, []error) {
+	var statements ast.Statements
+	var errs []error
+
+	for {
+		s, err := p.ParseNext()
+		if err == io.EOF {
+			return &ast.Query{Statements: statements, Comments: p.comments}, errs
+		} else if err != nil {
+			errs = append(errs, err)
+		} else {
+			statements = append(statements, s)
+		}
+	}
+}
+
+// ParseNext parses the next statement of an CnosQL string made of statements
+// separated by semicolons, or by the end of the line of an INSERT. It returns
+// io.EOF when there are no more statements. A statement followed by anything
+// else is an error, like a statement that cannot be parsed. After an error,
+// the rest of the statement is skipped like in ParseQueryCollect, so
+// ParseNext can be called again for the next one.
+func (p *Parser) ParseNext() (ast.Statement, error) {
+	_, tok, _ := p.ScanIgnoreWhitespace()
+	for tok == token.SEMICOLON {
+		_, tok, _ = p.ScanIgnoreWhitespace()
+	}
+	if tok == token.EOF {
+		return nil, io.EOF
+	}
+
+	p.s.Unscan()
+	s, err := p.ParseStatement()
+	if err == nil {
+		if err = p.checkStatementEnd(); err == nil {
+			return s, nil
+		}
+	}
+
+	// Skip the rest of the statement, unless the error was found at
+	// its end already.
+	if e, ok := err.(*ParseError); !ok || (e.Found != token.SEMICOLON.String() && e.Found != token.EOF.String()) {
+		p.synchronize()
+	}
+	return nil, err
+}
+
+// checkStatementEnd returns an error unless the statement read last ended
+// with its line, or is followed by a semicolon or EOF, which is left to be
+// read next.
+func (p *Parser) checkStatementEnd() error {
+	if p.lineEnded {
+		return nil
+	}
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	p.s.Unscan()
+	if tok != token.SEMICOLON && tok != token.EOF {
+		return newParseError(tokstr(tok, lit), []string{";"}, pos)
+	}
+	return nil
+}
+
+// synchronize skips tokens until the next statement boundary, which is a
+// semicolon, a SELECT or INSERT keyword or EOF. The boundary is left to be
+// read next. A SELECT right after "(" starts a subquery, one right after
+// BEGIN the body of a continuous query and one right after UNION or UNION ALL
+// the next statement of a union, which are not boundaries. The words that
+// start other statements, such as SHOW or WITH, are names or parts of a
+// statement anywhere but at its start, as in CREATE USER u WITH PASSWORD, so
+// they are only read as such after a semicolon.
+func (p *Parser) synchronize() {
+	prev, union := token.ILLEGAL, false
+	for {
+		_, tok, lit := p.ScanIgnoreWhitespace()
+		if tok == token.SEMICOLON || tok == token.EOF || tok == token.INSERT ||
+			(tok == token.SELECT && prev != token.LPAREN && prev != token.BEGIN && !union) {
+			p.s.Unscan()
+			return
+		}
+
+		// ALL continues the UNION before it.
+		if tok != token.ALL {
+			union = p.isWord(tok, lit, "UNION")
+		}
+		prev = tok
+	}
+}
+
+// ParseStatement parses an CnosQL string and returns a Statement AST object.
+func (p *Parser) ParseStatement() (ast.Statement, error) {
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+
+	p.violations, p.warnings, p.depth, p.opPos, p.callPos, p.castPos, p.ctes = nil, nil, 0, nil, nil, nil, nil
+	p.lineEnded = false
+
+	switch tok {
+	case token.SELECT:
+		stmt, err := p.parseSelectOrUnion(targetNotRequired, pos, true)
+		if err != nil {
+			return nil, p.paramError(err)
+		}
+		return stmt, nil
+	case token.INSERT:
+		return p.parseInsertStatement()
+	case token.IDENT:
+		switch {
+		case p.isWord(tok, lit, "SHOW"):
+			return p.parseShowStatement()
+		case p.isWord(tok, lit, "CREATE"):
+			return p.parseCreateStatement()
+		case p.isWord(tok, lit, "KILL"):
+			return p.parseKillQueryStatement()
+		case p.isWord(tok, lit, "WITH"):
+			return p.parseWithStatement()
+		case p.isWord(tok, lit, "DROP"):
+			return p.parseDropStatement()
+		case p.isWord(tok, lit, "SET"):
+			return p.parseSetPasswordUserStatement()
+		}
+	}
+
+	// There were no registered handlers. Return the valid tokens in the order they were added.
+	return nil, newParseError(p.foundstr(tok, lit), []string{token.SELECT.String(), "SHOW", "CREATE", "WITH", "KILL", "DROP", "SET", token.INSERT.String()}, pos)
+}
+
+// parseWithStatement parses a SELECT statement preceded by the statements it
+// names: "WITH <name> AS (SELECT ...) [, ...] SELECT ...". A source named like
+// one of them, in the statement or in a statement named after it, is a
+// CTERef to it, even if a metric has the same name. This function assumes
+// the WITH word has already been consumed.
+func (p *Parser) parseWithStatement() (ast.Statement, error) {
+	// Remember where the bound parameters of the named statements start.
+	nparams := len(p.boundParams)
+
+	var ctes []*ast.With
+	p.ctes = make(map[string]*ast.SelectStatement)
+	defer func() { p.ctes = nil }()
+	for {
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		if tok != token.IDENT {
+			return nil, newParseError(tokstr(tok, lit), []string{"identifier"}, pos)
+		} else if _, ok := p.ctes[lit]; ok {
+			return nil, &ParseError{Message: fmt.Sprintf("duplicate WITH name %s", lit), Pos: pos}
+		}
+
+		if err := p.parseTokens([]token.Token{token.AS, token.LPAREN, token.SELECT}); err != nil {
+			return nil, err
+		}
+		stmt, err := p.parseSelectStatement(targetSubquery)
+		if err != nil {
+			return nil, p.paramError(err)
+		}
+		if err := p.parseTokens([]token.Token{token.RPAREN}); err != nil {
+			return nil, err
+		}
+		ctes = append(ctes, &ast.With{Name: lit, Statement: stmt})
+
+		// The statements named so far read the metric, if any, that the
+		// name now shadows.
+		for _, cte := range ctes {
+			p.checkCTEShadowing(cte.Statement, lit, pos)
+		}
+		p.ctes[lit] = stmt
+
+		if _, tok, _ := p.ScanIgnoreWhitespace(); tok != token.COMMA {
+			p.s.Unscan()
+			break
+		}
+	}
+
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	if tok != token.SELECT {
+		return nil, newParseError(tokstr(tok, lit), []string{token.SELECT.String()}, pos)
+	}
+	cteParams := append([]string(nil), p.boundParams[nparams:]...)
+	stmt, err := p.parseSelectOrUnion(targetNotRequired, pos, true)
+	if err != nil {
+		return nil, p.paramError(err)
+	}
+
+	// The named statements of a union are defined for all of its statements,
+	// and their bound parameters are those of its first one.
+	switch stmt := stmt.(type) {
+	case *ast.SelectStatement:
+		stmt.CTEs = ctes
+		stmt.BoundParams = uniqueStrings(append(cteParams, stmt.BoundParams...))
+	case *ast.UnionStatement:
+		stmt.CTEs = ctes
+		first := stmt.Statements[0]
+		first.BoundParams = uniqueStrings(append(cteParams, first.BoundParams...))
+	}
+	return stmt, nil
+}
+
+// parseCreateStatement parses a CREATE statement. This function assumes the
+// CREATE word has already been consumed.
+func (p *Parser) parseCreateStatement() (ast.Statement, error) {
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	switch {
+	case p.isWord(tok, lit, "CONTINUOUS"):
+		return p.parseCreateContinuousQueryStatement()
+	case p.isWord(tok, lit, "USER"):
+		return p.parseCreateUserStatement()
+	case p.isWord(tok, lit, "TIME"):
+		return p.parseCreateTimeToLiveStatement()
+	}
+	return nil, newParseError(p.foundstr(tok, lit), []string{"CONTINUOUS", "USER", "TIME"}, pos)
+}
+
+// parseCreateTimeToLiveStatement parses a CREATE TIME TO LIVE statement. This
+// function assumes the CREATE TIME words have already been consumed.
+func (p *Parser) parseCreateTimeToLiveStatement() (*ast.CreateTimeToLiveStatement, error) {
+	stmt := &ast.CreateTimeToLiveStatement{}
+	var err error
+	if stmt.Name, stmt.Database, err = p.parseTimeToLiveName(); err != nil {
+		return nil, err
+	}
+
+	// Parse the required duration: "DURATION <duration>|INF".
+	if err := p.parseWords("DURATION"); err != nil {
+		return nil, err
+	}
+	pos, _, _ := p.ScanIgnoreWhitespace()
+	p.s.Unscan()
+	if stmt.Duration, err = p.parseDuration(); err != nil {
+		return nil, err
+	} else if stmt.Duration < 0 {
+		return nil, &ParseError{Message: "DURATION must be a positive duration or INF", Pos: pos}
+	}
+
+	// Parse the optional shard duration: "SHARD DURATION <duration>".
+	if _, tok, lit := p.ScanIgnoreWhitespace(); p.isWord(tok, lit, "SHARD") {
+		if err := p.parseWords("DURATION"); err != nil {
+			return nil, err
+		}
+		pos, _, _ := p.ScanIgnoreWhitespace()
+		p.s.Unscan()
+		if stmt.ShardDuration, err = p.parseDurationExpr(); err != nil {
+			return nil, err
+		} else if stmt.ShardDuration <= 0 {
+			return nil, &ParseError{Message: "SHARD DURATION must be a positive duration", Pos: pos}
+		}
+	} else {
+		p.s.Unscan()
+	}
+
+	// Parse the optional default flag.
+	if _, tok, lit := p.ScanIgnoreWhitespace(); p.isWord(tok, lit, "DEFAULT") {
+		stmt.Default = true
+	} else {
+		p.s.Unscan()
+	}
+	return stmt, nil
+}
+
+// parseTimeToLiveName parses the name and the database of a time to live,
+// "TO LIVE <name> ON <db>", after the TIME word.
+func (p *Parser) parseTimeToLiveName() (name, db string, err error) {
+	if err := p.parseWords("TO", "LIVE"); err != nil {
+		return "", "", err
+	}
+	if name, err = p.parseIdent(); err != nil {
+		return "", "", err
+	}
+	if err := p.parseWords("ON"); err != nil {
+		return "", "", err
+	}
+	if db, err = p.parseIdent(); err != nil {
+		return "", "", err
+	}
+	return name, db, nil
+}
+
+// parseCreateUserStatement parses a CREATE USER statement. This function
+// assumes the CREATE USER words have already been consumed.
+func (p *Parser) parseCreateUserStatement() (*ast.CreateUserStatement, error) {
+	stmt := &ast.CreateUserStatement{}
+	var err error
+
+	// Parse the name and the password: "<name> WITH PASSWORD '<password>'".
+	if stmt.Name, err = p.parseIdent(); err != nil {
+		return nil, err
+	}
+	if err := p.parseWords("WITH"); err != nil {
+		return nil, err
+	} else if err := p.parseWords("PASSWORD"); err != nil {
+		return nil, err
+	}
+	if stmt.Password, err = p.parseString(); err != nil {
+		return nil, err
+	}
+
+	// Parse the optional admin flag: "WITH ALL PRIVILEGES".
+	if _, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, "WITH") {
+		p.s.Unscan()
+		return stmt, nil
+	}
+	if err := p.parseTokens([]token.Token{token.ALL}); err != nil {
+		return nil, err
+	} else if err := p.parseWords("PRIVILEGES"); err != nil {
+		return nil, err
+	}
+	stmt.Admin = true
+	return stmt, nil
+}
+
+// parseDropStatement parses a DROP statement. This function assumes the DROP
+// word has already been consumed.
+func (p *Parser) parseDropStatement() (ast.Statement, error) {
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	switch {
+	case p.isWord(tok, lit, "USER"):
+		return p.parseDropUserStatement()
+	case p.isWord(tok, lit, "TIME"):
+		return p.parseDropTimeToLiveStatement()
+	}
+	return nil, newParseError(p.foundstr(tok, lit), []string{"USER", "TIME"}, pos)
+}
+
+// parseDropTimeToLiveStatement parses a DROP TIME TO LIVE statement. This
+// function assumes the DROP TIME words have already been consumed.
+func (p *Parser) parseDropTimeToLiveStatement() (*ast.DropTimeToLiveStatement, error) {
+	name, db, err := p.parseTimeToLiveName()
+	if err != nil {
+		return nil, err
+	}
+	return &ast.DropTimeToLiveStatement{Name: name, Database: db}, nil
+}
+
+// parseDropUserStatement parses a DROP USER statement. This function assumes
+// the DROP USER words have already been consumed.
+func (p *Parser) parseDropUserStatement() (*ast.DropUserStatement, error) {
+	name, err := p.parseIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &ast.DropUserStatement{Name: name}, nil
+}
+
+// parseSetPasswordUserStatement parses a SET PASSWORD statement. This function
+// assumes the SET word has already been consumed.
+func (p *Parser) parseSetPasswordUserStatement() (*ast.SetPasswordUserStatement, error) {
+	if err := p.parseWords("PASSWORD", "FOR"); err != nil {
+		return nil, err
+	}
+	stmt := &ast.SetPasswordUserStatement{}
+	var err error
+
+	// Parse the name and the password: "<name> = '<password>'".
+	if stmt.Name, err = p.parseIdent(); err != nil {
+		return nil, err
+	}
+	if err := p.parseTokens([]token.Token{token.EQ}); err != nil {
+		return nil, err
+	}
+	if stmt.Password, err = p.parseString(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseCreateContinuousQueryStatement parses a CREATE CONTINUOUS QUERY
+// statement. This function assumes the CREATE CONTINUOUS words have already
+// been consumed.
+func (p *Parser) parseCreateContinuousQueryStatement() (*ast.CreateContinuousQueryStatement, error) {
+	if err := p.parseWords("QUERY"); err != nil {
+		return nil, err
+	}
+	stmt := &ast.CreateContinuousQueryStatement{}
+	var err error
+
+	// Parse the name and the database: "<name> ON <db>".
+	if stmt.Name, err = p.parseIdent(); err != nil {
+		return nil, err
+	}
+	if err := p.parseWords("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Database, err = p.parseIdent(); err != nil {
+		return nil, err
+	}
+
+	// Parse the resample options: "RESAMPLE [EVERY <d>] [FOR <d>]".
+	if _, tok, lit := p.ScanIgnoreWhitespace(); p.isWord(tok, lit, "RESAMPLE") {
+		if stmt.ResampleEvery, stmt.ResampleFor, err = p.parseResample(); err != nil {
+			return nil, err
+		}
+	} else {
+		p.s.Unscan()
+	}
+
+	// Parse the statement: "BEGIN SELECT ... INTO ... END".
+	if err := p.parseTokens([]token.Token{token.BEGIN}); err != nil {
+		return nil, err
+	}
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	if tok != token.SELECT {
+		return nil, newParseError(tokstr(tok, lit), []string{token.SELECT.String()}, pos)
+	}
+	if stmt.Source, err = p.parseSelectStatement(targetRequired); err != nil {
+		return nil, p.paramError(err)
+	}
+	if err := p.checkPolicy(stmt.Source, pos); err != nil {
+		return nil, err
+	}
+	if err := p.parseWords("END"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseResample parses the durations of a RESAMPLE clause. This function
+// assumes the RESAMPLE word has already been consumed.
+func (p *Parser) parseResample() (every, forDuration time.Duration, err error) {
+	for _, opt := range []struct {
+		word string
+		d    *time.Duration
+	}{{"EVERY", &every}, {"FOR", &forDuration}} {
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		if !p.isWord(tok, lit, opt.word) {
+			p.s.Unscan()
+			continue
+		}
+		if *opt.d, err = p.parseDuration(); err != nil {
+			return 0, 0, err
+		} else if *opt.d <= 0 {
+			return 0, 0, &ParseError{Message: fmt.Sprintf("RESAMPLE %s must be a positive duration", opt.word), Pos: pos}
+		}
+	}
+
+	if every == 0 && forDuration == 0 {
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		return 0, 0, newParseError(p.foundstr(tok, lit), []string{"EVERY", "FOR"}, pos)
+	}
+	return every, forDuration, nil
+}
+
+// showStatements are the statements that start with SHOW, by the word that
+// follows it. The words are not keywords, so that time remains a field and a
+// function elsewhere. They are listed in this order when none matches.
+var showStatements = []struct {
+	word  string
+	parse func(p *Parser) (ast.Statement, error)
+}{
+	{"TIME", func(p *Parser) (ast.Statement, error) { return p.parseShowTimeToLivesStatement() }},
+	{"QUERIES", func(p *Parser) (ast.Statement, error) { return &ast.ShowQueriesStatement{}, nil }},
+	{"GRANTS", func(p *Parser) (ast.Statement, error) { return p.parseShowGrantsForUserStatement() }},
+	{"TAG", func(p *Parser) (ast.Statement, error) { return p.parseShowTagKeyCardinalityStatement() }},
+	{"FIELD", func(p *Parser) (ast.Statement, error) { return p.parseShowFieldKeyCardinalityStatement() }},
+}
+
+// parseShowStatement parses a SHOW statement. This function assumes the SHOW
+// word has already been consumed.
+func (p *Parser) parseShowStatement() (ast.Statement, error) {
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	expected := make([]string, len(showStatements))
+	for i, s := range showStatements {
+		if p.isWord(tok, lit, s.word) || (tok.IsKeyword() && tok.String() == s.word) {
+			return s.parse(p)
+		}
+		expected[i] = s.word
+	}
+	return nil, newParseError(p.foundstr(tok, lit), expected, pos)
+}
+
+// parseShowTagKeyCardinalityStatement parses a SHOW TAG KEY CARDINALITY
+// statement. This function assumes the SHOW TAG tokens have already been
+// consumed.
+func (p *Parser) parseShowTagKeyCardinalityStatement() (*ast.ShowTagKeyCardinalityStatement, error) {
+	stmt := &ast.ShowTagKeyCardinalityStatement{}
+	if err := p.parseKeyCardinality(&stmt.CardinalityOptions); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseShowFieldKeyCardinalityStatement parses a SHOW FIELD KEY CARDINALITY
+// statement. This function assumes the SHOW FIELD tokens have already been
+// consumed.
+func (p *Parser) parseShowFieldKeyCardinalityStatement() (*ast.ShowFieldKeyCardinalityStatement, error) {
+	stmt := &ast.ShowFieldKeyCardinalityStatement{}
+	if err := p.parseKeyCardinality(&stmt.CardinalityOptions); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseKeyCardinality parses the rest of a SHOW TAG KEY CARDINALITY or SHOW
+// FIELD KEY CARDINALITY statement into opts, from the KEY word.
+func (p *Parser) parseKeyCardinality(opts *ast.CardinalityOptions) error {
+	if err := p.parseWords("KEY"); err != nil {
+		return err
+	}
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	if p.isWord(tok, lit, "EXACT") {
+		opts.Exact = true
+		pos, tok, lit = p.ScanIgnoreWhitespace()
+	}
+	if !p.isWord(tok, lit, "CARDINALITY") {
+		expected := []string{"EXACT", "CARDINALITY"}
+		if opts.Exact {
+			expected = expected[1:]
+		}
+		return newParseError(p.foundstr(tok, lit), expected, pos)
+	}
+	return p.parseCardinalityOptions(opts)
+}
+
+// parseCardinalityOptions parses the clauses of a cardinality statement after
+// the CARDINALITY word: "[ON db] [FROM sources] [WHERE condition]
+// [GROUP BY dimensions] [LIMIT n] [OFFSET n]".
+func (p *Parser) parseCardinalityOptions(opts *ast.CardinalityOptions) error {
+	var err error
+
+	// Parse the optional database: "ON <db>".
+	if _, tok, lit := p.ScanIgnoreWhitespace(); p.isWord(tok, lit, "ON") {
+		if opts.Database, err = p.parseIdent(); err != nil {
+			return err
+		}
+	} else {
+		p.s.Unscan()
+	}
+
+	// Parse the optional sources: "FROM <sources>".
+	if _, tok, _ := p.ScanIgnoreWhitespace(); tok == token.FROM {
+		if opts.Sources, err = p.parseSources(false); err != nil {
+			return err
+		}
+	} else {
+		p.s.Unscan()
+	}
+
+	if opts.Condition, err = p.parseCondition(); err != nil {
+		return err
+	}
+	if opts.Dimensions, err = p.parseDimensions(); err != nil {
+		return err
+	}
+	if opts.Limit, err = p.ParseOptionalTokenAndInt(token.LIMIT); err != nil {
+		return err
+	}
+	if opts.Offset, err = p.ParseOptionalTokenAndInt(token.OFFSET); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseShowGrantsForUserStatement parses a SHOW GRANTS FOR statement. This
+// function assumes the SHOW GRANTS words have already been consumed.
+func (p *Parser) parseShowGrantsForUserStatement() (*ast.ShowGrantsForUserStatement, error) {
+	if err := p.parseWords("FOR"); err != nil {
+		return nil, err
+	}
+	name, err := p.parseIdent()
+	if err != nil {
+		return nil, err
 	}
+	return &ast.ShowGrantsForUserStatement{Name: name}, nil
 }
 
-// ParseQuery parses a query string and returns its AST representation.
-func ParseQuery(s string) (*ast.Query, error) {
-	return NewParser(strings.NewReader(s)).ParseQuery()
-}
+// parseShowTimeToLivesStatement parses a SHOW TIME TO LIVES statement. This
+// function assumes the SHOW TIME words have already been consumed.
+func (p *Parser) parseShowTimeToLivesStatement() (*ast.ShowTimeToLivesStatement, error) {
+	if err := p.parseWords("TO", "LIVES"); err != nil {
+		return nil, err
+	}
 
-// ParseStatement parses a statement string and returns its AST representation.
-func ParseStatement(s string) (ast.Statement, error) {
-	return NewParser(strings.NewReader(s)).ParseStatement()
+	// Parse the optional database: "ON <db>".
+	stmt := &ast.ShowTimeToLivesStatement{}
+	if _, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, "ON") {
+		p.s.Unscan()
+		return stmt, nil
+	}
+	db, err := p.parseIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Database = db
+	return stmt, nil
 }
 
-// ParseExpr parses an expression string and returns its AST representation.
-func ParseExpr(s string) (ast.Expr, error) { return NewParser(strings.NewReader(s)).ParseExpr() }
-
-// ParseQuery parses an CnosQL string and returns a Query AST object.
-func (p *Parser) ParseQuery() (*ast.Query, error) {
-	var statements ast.Statements
-	semi := true
+// parseKillQueryStatement parses a KILL QUERY statement. This function
+// assumes the KILL word has already been consumed.
+func (p *Parser) parseKillQueryStatement() (*ast.KillQueryStatement, error) {
+	if err := p.parseWords("QUERY"); err != nil {
+		return nil, err
+	}
+	stmt := &ast.KillQueryStatement{}
+	var err error
+	if stmt.QueryID, err = p.parseUInt64(); err != nil {
+		return nil, err
+	}
 
-	for {
-		if pos, tok, lit := p.ScanIgnoreWhitespace(); tok == token.EOF {
-			return &ast.Query{Statements: statements}, nil
-		} else if tok == token.SEMICOLON {
-			semi = true
-		} else {
-			if !semi {
-				return nil, newParseError(tokstr(tok, lit), []string{";"}, pos)
-			}
-			p.s.Unscan()
-			s, err := p.ParseStatement()
-			if err != nil {
-				return nil, err
-			}
-			statements = append(statements, s)
-			semi = false
-		}
+	// Parse the optional host: "ON <host>".
+	if _, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, "ON") {
+		p.s.Unscan()
+		return stmt, nil
+	}
+	if stmt.Host, err = p.parseIdent(); err != nil {
+		return nil, err
 	}
+	return stmt, nil
 }
 
-// ParseStatement parses an CnosQL string and returns a Statement AST object.
-func (p *Parser) ParseStatement() (ast.Statement, error) {
-	pos, tok, lit := p.ScanIgnoreWhitespace()
+// isWord returns true if the token just scanned is a bare identifier that
+// reads word, which is a keyword only where it is expected. A quoted
+// identifier, such as "KILL", is never a word.
+func (p *Parser) isWord(tok token.Token, lit, word string) bool {
+	return tok == token.IDENT && p.s.Raw() == lit && strings.EqualFold(lit, word)
+}
 
-	switch tok {
-	case token.SELECT:
-		return p.parseSelectStatement(targetNotRequired)
+// parseWords consumes an expected sequence of words, which are not keywords.
+// See isWord.
+func (p *Parser) parseWords(words ...string) error {
+	for _, word := range words {
+		if pos, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, word) {
+			return newParseError(p.foundstr(tok, lit), []string{word}, pos)
+		}
 	}
-
-	// There were no registered handlers. Return the valid tokens in the order they were added.
-	return nil, newParseError(tokstr(tok, lit), []string{token.SELECT.String()}, pos)
+	return nil
 }
 
 // parseInt parses a string representing a base 10 integer and returns the number.
@@ -125,23 +930,38 @@ func (p *Parser) parseUInt64() (uint64, error) {
 }
 
 // parseDuration parses a string and returns a duration literal.
+// INF is accepted and returned as a zero duration.
 // This function assumes the DURATION token has already been consumed.
 func (p *Parser) parseDuration() (time.Duration, error) {
+	if _, tok, _ := p.ScanIgnoreWhitespace(); tok == token.INF {
+		return 0, nil
+	}
+	p.s.Unscan()
+
+	return p.parseDurationExpr()
+}
+
+// parseDurationExpr parses a duration literal with an optional sign, e.g. "-5m".
+func (p *Parser) parseDurationExpr() (time.Duration, error) {
+	sign := time.Duration(1)
 	pos, tok, lit := p.ScanIgnoreWhitespace()
-	if tok != token.DURATIONVAL && tok != token.INF {
-		return 0, newParseError(tokstr(tok, lit), []string{"duration"}, pos)
+	if tok == token.ADD || tok == token.SUB {
+		if tok == token.SUB {
+			sign = -1
+		}
+		pos, tok, lit = p.ScanIgnoreWhitespace()
 	}
 
-	if tok == token.INF {
-		return 0, nil
+	if tok != token.DURATIONVAL {
+		return 0, newParseError(tokstr(tok, lit), []string{"duration"}, pos)
 	}
 
-	d, err := ParseDuration(lit)
+	d, err := tools.ParseDuration(lit)
 	if err != nil {
 		return 0, &ParseError{Message: err.Error(), Pos: pos}
 	}
 
-	return d, nil
+	return sign * d, nil
 }
 
 // parseIdent parses an identifier.
@@ -164,10 +984,16 @@ func (p *Parser) parseIdentList() ([]string, error) {
 
 	// Parse remaining (optional) identifiers.
 	for {
-		if _, tok, _ := p.ScanIgnoreWhitespace(); tok != token.COMMA {
+		pos, tok, _ := p.ScanIgnoreWhitespace()
+		if tok != token.COMMA {
 			p.s.Unscan()
 			return idents, nil
 		}
+		if end, err := p.trailingComma(pos, identsEnd); err != nil {
+			return nil, err
+		} else if end {
+			return idents, nil
+		}
 
 		if ident, err = p.parseIdent(); err != nil {
 			return nil, err
@@ -180,45 +1006,68 @@ func (p *Parser) parseIdentList() ([]string, error) {
 // parseSegmentedIdents parses a segmented identifiers.
 // e.g.,  "db"."ttl".metric  or  "db"..metric
 func (p *Parser) parseSegmentedIdents() ([]string, error) {
+	idents, _, err := p.parseSegmentedIdentsDot()
+	return idents, err
+}
+
+// parseSegmentedIdentsDot parses segmented identifiers like
+// parseSegmentedIdents, and also returns whether they end with a dot that is
+// followed by a regex or ":", such as "db"."ttl"./cpu.*/.
+func (p *Parser) parseSegmentedIdentsDot() ([]string, bool, error) {
 	ident, err := p.parseIdent()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	idents := []string{ident}
+	// Valid names have at most three segments.
+	idents := make([]string, 1, 3)
+	idents[0] = ident
 
 	// Parse remaining (optional) identifiers.
-	for {
-		if _, tok, _ := p.scan(); tok != token.DOT {
-			// No more segments so we're done.
-			p.s.Unscan()
-			break
+	// tok is the token after the last segment.
+	_, tok, _ := p.scan()
+	for tok == token.DOT {
+		// Next segment is a regex or context-specific so let caller handle
+		// it. The caller peeks at it too, so it must not be scanned.
+		if ch := p.s.Peek(); ch == '/' || ch == ':' {
+			idents, err := checkSegments(idents)
+			return idents, true, err
 		}
 
-		if ch := p.s.Peek(); ch == '/' {
-			// Next segment is a regex so we're done.
-			break
-		} else if ch == ':' {
-			// Next segment is context-specific so let caller handle it.
-			break
-		} else if ch == '.' {
-			// Add an empty identifier.
+		pos, next, lit := p.scan()
+		switch next {
+		case token.IDENT:
+			idents = append(idents, lit)
+			_, tok, _ = p.scan()
+		case token.DOT:
+			// Add an empty identifier. The DOT starts the next segment.
 			idents = append(idents, "")
-			continue
-		}
-
-		// Parse the next identifier.
-		if ident, err = p.parseIdent(); err != nil {
-			return nil, err
+		case token.WS, token.COMMENT:
+			// Whitespace may come before an identifier only.
+			if next == token.COMMENT {
+				p.keepComment(pos, lit)
+			}
+			if ident, err = p.parseIdent(); err != nil {
+				return nil, false, err
+			}
+			idents = append(idents, ident)
+			_, tok, _ = p.scan()
+		default:
+			return nil, false, newParseError(tokstr(next, lit), []string{"identifier"}, pos)
 		}
-
-		idents = append(idents, ident)
 	}
+	// No more segments so we're done.
+	p.s.Unscan()
 
+	idents, err = checkSegments(idents)
+	return idents, false, err
+}
+
+// checkSegments returns an error if there are too many segmented identifiers.
+func checkSegments(idents []string) ([]string, error) {
 	if len(idents) > 3 {
 		msg := fmt.Sprintf("too many segments in %s", QuoteIdent(idents...))
 		return nil, &ParseError{Message: msg}
 	}
-
 	return idents, nil
 }
 
@@ -258,6 +1107,121 @@ func (p *Parser) parseStringList() ([]string, error) {
 // parseSelectStatement parses a select string and returns a Statement AST object.
 // This function assumes the SELECT token has already been consumed.
 func (p *Parser) parseSelectStatement(tr targetRequirement) (*ast.SelectStatement, error) {
+	// Remember where the bound parameters of this statement start.
+	nparams := len(p.boundParams)
+
+	stmt, err := p.parseSelectBody(tr)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.parseSelectTail(stmt); err != nil {
+		return nil, err
+	}
+	if err := p.finishSelect(stmt, nparams); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseSelectOrUnion parses a SELECT statement, or the union of SELECT
+// statements joined by "UNION [ALL] SELECT" if it is followed by one. The
+// ORDER BY, LIMIT and OFFSET after the last statement of a union apply to
+// the union as a whole, so the statements of a union stop before them.
+// If policy is true, the rules of the policy are checked for each statement,
+// which starts at pos for the first one. This function assumes the SELECT
+// token has already been consumed.
+func (p *Parser) parseSelectOrUnion(tr targetRequirement, pos token.Pos, policy bool) (ast.Statement, error) {
+	nparams := len(p.boundParams)
+	stmt, err := p.parseSelectBody(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, "UNION") {
+		p.s.Unscan()
+		if err := p.parseSelectTail(stmt); err != nil {
+			return nil, err
+		} else if err := p.finishSelect(stmt, nparams); err != nil {
+			return nil, err
+		}
+
+		// The clauses of the statement of a union follow its last statement.
+		if unionPos, tok, lit := p.ScanIgnoreWhitespace(); p.isWord(tok, lit, "UNION") {
+			return nil, &ParseError{Message: "UNION cannot follow ORDER BY, LIMIT, OFFSET, SLIMIT, SOFFSET or TZ()", Pos: unionPos}
+		}
+		p.s.Unscan()
+
+		if policy {
+			if err := p.checkPolicy(stmt, pos); err != nil {
+				return nil, err
+			}
+		}
+		return stmt, nil
+	}
+	p.s.Unscan()
+	if err := p.finishSelect(stmt, nparams); err != nil {
+		return nil, err
+	}
+
+	union := &ast.UnionStatement{Statements: []*ast.SelectStatement{stmt}}
+	positions := []token.Pos{pos}
+	for {
+		unionPos, tok, lit := p.ScanIgnoreWhitespace()
+		if !p.isWord(tok, lit, "UNION") {
+			p.s.Unscan()
+			break
+		}
+
+		all := false
+		if _, tok, _ := p.ScanIgnoreWhitespace(); tok == token.ALL {
+			all = true
+		} else {
+			p.s.Unscan()
+		}
+
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		if tok != token.SELECT {
+			return nil, newParseError(tokstr(tok, lit), []string{token.SELECT.String()}, pos)
+		}
+		nparams := len(p.boundParams)
+		stmt, err := p.parseSelectBody(tr)
+		if err != nil {
+			return nil, err
+		} else if err := p.finishSelect(stmt, nparams); err != nil {
+			return nil, err
+		}
+		union.Statements = append(union.Statements, stmt)
+		union.All = append(union.All, all)
+		positions = append(positions, pos)
+
+		if err := union.Validate(); err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: unionPos}
+		}
+	}
+
+	// Parse the clauses of the union: "ORDER BY FIELD+", "LIMIT <n>" and
+	// "OFFSET <n>".
+	if union.SortFields, err = p.parseOrderBy(); err != nil {
+		return nil, err
+	}
+	if union.Limit, err = p.ParseOptionalTokenAndInt(token.LIMIT); err != nil {
+		return nil, err
+	}
+	if union.Offset, err = p.ParseOptionalTokenAndInt(token.OFFSET); err != nil {
+		return nil, err
+	}
+
+	if policy {
+		if err := p.checkUnionPolicy(union, positions); err != nil {
+			return nil, err
+		}
+	}
+	return union, nil
+}
+
+// parseSelectBody parses the clauses of a SELECT statement up to its fill
+// option, which the statements of a union have too.
+func (p *Parser) parseSelectBody(tr targetRequirement) (*ast.SelectStatement, error) {
 	stmt := &ast.SelectStatement{}
 	var err error
 
@@ -294,45 +1258,64 @@ func (p *Parser) parseSelectStatement(tr targetRequirement) (*ast.SelectStatemen
 		return nil, err
 	}
 
+	return stmt, nil
+}
+
+// parseSelectTail parses the clauses of a SELECT statement after its fill
+// option, which a statement of a union does not have.
+func (p *Parser) parseSelectTail(stmt *ast.SelectStatement) error {
+	var err error
+
 	// Parse sort: "ORDER BY FIELD+".
 	if stmt.SortFields, err = p.parseOrderBy(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Parse limit: "LIMIT <n>".
 	if stmt.Limit, err = p.ParseOptionalTokenAndInt(token.LIMIT); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Parse offset: "OFFSET <n>".
 	if stmt.Offset, err = p.ParseOptionalTokenAndInt(token.OFFSET); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Parse series limit: "SLIMIT <n>".
 	if stmt.SLimit, err = p.ParseOptionalTokenAndInt(token.SLIMIT); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Parse series offset: "SOFFSET <n>".
 	if stmt.SOffset, err = p.ParseOptionalTokenAndInt(token.SOFFSET); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Parse timezone: "TZ(<timezone>)".
+	tzPos, _, _ := p.ScanIgnoreWhitespace()
+	p.s.Unscan()
 	if stmt.Location, err = p.parseLocation(); err != nil {
-		return nil, err
+		return err
 	}
+	return checkSubqueryLocations(stmt, tzPos)
+}
 
-	// Set if the query is a raw data query or one with an aggregate
-	stmt.IsRawQuery = true
-	ast.WalkFunc(stmt.Fields, func(n ast.Node) {
-		if _, ok := n.(*ast.Call); ok {
-			stmt.IsRawQuery = false
-		}
-	})
+// finishSelect checks a parsed SELECT statement and sets the properties
+// derived from it. Its bound parameters start at nparams.
+func (p *Parser) finishSelect(stmt *ast.SelectStatement, nparams int) error {
+	if err := p.checkTypes(stmt); err != nil {
+		return err
+	} else if err := p.checkCasts(stmt); err != nil {
+		return err
+	} else if err := p.checkCalls(stmt); err != nil {
+		return err
+	}
 
-	return stmt, nil
+	// Record the bound parameters used by the statement and its subqueries.
+	stmt.BoundParams = uniqueStrings(p.boundParams[nparams:])
+
+	stmt.IsRawQuery = ast.IsRawQuery(stmt.Fields)
+	return nil
 }
 
 // targetRequirement specifies whether a target clause is required.
@@ -341,17 +1324,25 @@ type targetRequirement int
 const (
 	targetRequired targetRequirement = iota
 	targetNotRequired
+
+	// targetSubquery is a subquery, which cannot have a target since its
+	// results are not written. It may have its own TZ() only if the outer
+	// statement has none or the same, since the outer statement would
+	// otherwise group the same points by different days.
 	targetSubquery
 )
 
 // parseTarget parses a string and returns a Target.
 func (p *Parser) parseTarget(tr targetRequirement) (*ast.Target, error) {
-	if pos, tok, lit := p.ScanIgnoreWhitespace(); tok != token.INTO {
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	if tok != token.INTO {
 		if tr == targetRequired {
 			return nil, newParseError(tokstr(tok, lit), []string{"INTO"}, pos)
 		}
 		p.s.Unscan()
 		return nil, nil
+	} else if tr == targetSubquery {
+		return nil, &ParseError{Message: "INTO clause not allowed in subquery", Pos: pos}
 	}
 
 	// db, ttl, and / or metric
@@ -360,15 +1351,16 @@ func (p *Parser) parseTarget(tr targetRequirement) (*ast.Target, error) {
 		return nil, err
 	}
 
-	if len(idents) < 3 {
-		// Check for source metric reference.
-		if ch := p.s.Peek(); ch == ':' {
-			if err := p.parseTokens([]token.Token{token.COLON, token.METRIC}); err != nil {
-				return nil, err
-			}
-			// Append empty metric name.
-			idents = append(idents, "")
+	// Check for source metric reference.
+	if len(idents) < 3 && p.s.Peek() == ':' {
+		if err := p.parseTokens([]token.Token{token.COLON, token.METRIC}); err != nil {
+			return nil, err
 		}
+		// Append empty metric name.
+		idents = append(idents, "")
+	} else if idents[len(idents)-1] == "" {
+		// An empty name is reserved for :METRIC.
+		return nil, errors.New("target metric name cannot be empty")
 	}
 
 	t := &ast.Target{Metric: &ast.Metric{IsTarget: true}}
@@ -403,9 +1395,16 @@ func (p *Parser) parseFields() (ast.Fields, error) {
 		fields = append(fields, f)
 
 		// If there's not a comma next then stop parsing fields.
-		if _, tok, _ := p.scan(); tok != token.COMMA {
+		pos, tok, _ := p.scan()
+		if tok != token.COMMA {
 			p.s.Unscan()
 			break
+		} else if end, err := p.trailingComma(pos, fieldsEnd); err != nil {
+			return nil, err
+		} else if end {
+			break
+		} else if err := p.checkLimit("fields", len(fields), p.maxFields); err != nil {
+			return nil, err
 		}
 	}
 	return fields, nil
@@ -425,14 +1424,19 @@ func (p *Parser) parseField() (*ast.Field, error) {
 		pos, _, _ := p.ScanIgnoreWhitespace()
 		p.s.Unscan()
 		// Parse the expression first.
-		expr, err := p.ParseExpr()
+		expr, err := p.parseExpr()
 		if err != nil {
 			return nil, err
 		}
 		var c validateField
 		ast.Walk(&c, expr)
 		if c.foundInvalid {
-			return nil, fmt.Errorf("invalid operator %s in SELECT clause at line %d, char %d; operator is intended for WHERE clause", c.badToken, pos.Line+1, pos.Char+1)
+			return nil, &ParseError{Message: fmt.Sprintf("invalid operator %s in SELECT clause; operator is intended for WHERE clause", c.badToken), Pos: pos}
+		}
+		if wc, ok := expr.(*ast.Wildcard); ok {
+			if wc.Except, err = p.parseExcept(); err != nil {
+				return nil, err
+			}
 		}
 		f.Expr = expr
 	}
@@ -450,6 +1454,26 @@ func (p *Parser) parseField() (*ast.Field, error) {
 	return f, nil
 }
 
+// parseExcept parses the names excluded from a wildcard field, if any:
+// "EXCEPT(<name>, ...)". EXCEPT is only a keyword there.
+func (p *Parser) parseExcept() ([]string, error) {
+	if _, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, "EXCEPT") {
+		p.s.Unscan()
+		return nil, nil
+	}
+	if err := p.parseTokens([]token.Token{token.LPAREN}); err != nil {
+		return nil, err
+	}
+	names, err := p.parseIdentList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.parseTokens([]token.Token{token.RPAREN}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
 // validateField checks if the Expr is a valid field. We disallow all binary expression
 // that return a boolean.
 type validateField struct {
@@ -466,7 +1490,7 @@ func (c *validateField) Visit(n ast.Node) ast.Visitor {
 	switch e.Op {
 	case token.EQ, token.NEQ, token.EQREGEX,
 		token.NEQREGEX, token.LT, token.LTE, token.GT, token.GTE,
-		token.AND, token.OR:
+		token.IN, token.AND, token.OR:
 		c.foundInvalid = true
 		c.badToken = e.Op
 		return nil
@@ -475,6 +1499,7 @@ func (c *validateField) Visit(n ast.Node) ast.Visitor {
 }
 
 // parseAlias parses the "AS IDENT" alias for fields and dimensions.
+// The alias may also be a string, such as 'p95 latency'.
 func (p *Parser) parseAlias() (string, error) {
 	// Check if the next token is "AS". If not, then Unscan and exit.
 	if _, tok, _ := p.ScanIgnoreWhitespace(); tok != token.AS {
@@ -482,12 +1507,16 @@ func (p *Parser) parseAlias() (string, error) {
 		return "", nil
 	}
 
-	// Then we should have the alias identifier.
-	lit, err := p.parseIdent()
-	if err != nil {
-		return "", err
-	}
-	return lit, nil
+	// Then we should have the alias identifier or string.
+	pos, tok, lit := p.ScanIgnoreWhitespace()
+	switch {
+	case tok == token.IDENT, tok == token.STRING:
+		return lit, nil
+	case tok.IsKeyword():
+		msg := fmt.Sprintf("alias cannot be the reserved keyword %s, quote it as %s", tok, QuoteIdent(lit))
+		return "", &ParseError{Message: msg, Pos: pos}
+	}
+	return "", newParseError(tokstr(tok, lit), []string{"identifier", "string"}, pos)
 }
 
 // parseSources parses a comma delimited list of sources.
@@ -499,11 +1528,35 @@ func (p *Parser) parseSources(subqueries bool) (ast.Sources, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		// Parse joins: "JOIN source ON expr", joined from left to right.
+		for {
+			if _, tok, lit := p.ScanIgnoreWhitespace(); !p.isWord(tok, lit, "JOIN") {
+				p.s.Unscan()
+				break
+			}
+			join := &ast.Join{Left: s}
+			if join.Right, err = p.parseSource(subqueries); err != nil {
+				return nil, err
+			}
+			if err := p.parseWords("ON"); err != nil {
+				return nil, err
+			}
+			if join.On, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+			s = join
+		}
 		sources = append(sources, s)
 
-		if _, tok, _ := p.ScanIgnoreWhitespace(); tok != token.COMMA {
+		pos, tok, _ := p.ScanIgnoreWhitespace()
+		if tok != token.COMMA {
 			p.s.Unscan()
 			break
+		} else if end, err := p.trailingComma(pos, sourcesEnd); err != nil {
+			return nil, err
+		} else if end {
+			break
 		}
 	}
 
@@ -514,11 +1567,14 @@ func (p *Parser) parseSource(subqueries bool) (ast.Source, error) {
 	m := &ast.Metric{}
 
 	// Attempt to parse a regex.
-	re, err := p.parseRegex()
+	pos, re, err := p.parseRegexPos()
 	if err != nil {
 		return nil, err
 	} else if re != nil {
 		m.Regex = re
+		if err := p.checkRegexSource(pos); err != nil {
+			return nil, err
+		}
 		// Regex is always last so we're done.
 		return m, nil
 	}
@@ -526,60 +1582,76 @@ func (p *Parser) parseSource(subqueries bool) (ast.Source, error) {
 	// If there is no regular expression, this might be a subquery.
 	// Parse the subquery if we are in a query that allows them as a source.
 	if m.Regex == nil && subqueries {
-		if _, tok, _ := p.ScanIgnoreWhitespace(); tok == token.LPAREN {
+		if pos, tok, _ := p.ScanIgnoreWhitespace(); tok == token.LPAREN {
 			if err := p.parseTokens([]token.Token{token.SELECT}); err != nil {
 				return nil, err
 			}
 
-			stmt, err := p.parseSelectStatement(targetSubquery)
+			p.depth++
+			p.checkSubqueryDepth(pos)
+			stmt, err := p.parseSelectOrUnion(targetSubquery, pos, false)
 			if err != nil {
 				return nil, err
 			}
+			p.depth--
 
 			if err := p.parseTokens([]token.Token{token.RPAREN}); err != nil {
 				return nil, err
 			}
-			return &ast.SubQuery{Statement: stmt}, nil
+			if union, ok := stmt.(*ast.UnionStatement); ok {
+				return &ast.UnionSubQuery{Statement: union}, nil
+			}
+			return &ast.SubQuery{Statement: stmt.(*ast.SelectStatement)}, nil
 		} else {
 			p.s.Unscan()
 		}
 	}
 
 	// Didn't find a regex so parse segmented identifiers.
-	idents, err := p.parseSegmentedIdents()
+	idents, dot, err := p.parseSegmentedIdentsDot()
 	if err != nil {
 		return nil, err
 	}
 
-	// If we already have the max allowed idents, we're done.
-	if len(idents) == 3 {
-		m.Database, m.TimeToLive, m.Name = idents[0], idents[1], idents[2]
+	// Assign identifiers to their proper locations.
+	if !dot {
+		switch len(idents) {
+		case 1:
+			// A name defined by WITH refers to the named statement.
+			if stmt, ok := p.ctes[idents[0]]; ok {
+				return &ast.CTERef{Name: idents[0], Statement: stmt}, nil
+			}
+			m.Name = idents[0]
+		case 2:
+			m.TimeToLive, m.Name = idents[0], idents[1]
+		case 3:
+			m.Database, m.TimeToLive, m.Name = idents[0], idents[1], idents[2]
+		}
 		return m, nil
 	}
-	// Check again for regex.
-	re, err = p.parseRegex()
+
+	// A trailing dot must be followed by a regex, which takes the place of
+	// the name, so only a database and a TTL may come before it.
+	pos, re, err = p.parseRegexPos()
 	if err != nil {
 		return nil, err
-	} else if re != nil {
-		m.Regex = re
+	} else if re == nil {
+		pos, tok, lit := p.scan()
+		return nil, newParseError(tokstr(tok, lit), []string{"identifier", "regex"}, pos)
+	} else if len(idents) == 3 {
+		msg := fmt.Sprintf("too many segments before regex in %s.%s", QuoteIdent(idents...), re)
+		return nil, &ParseError{Message: msg, Pos: pos}
+	}
+	m.Regex = re
+	if err := p.checkRegexSource(pos); err != nil {
+		return nil, err
 	}
-
-	// Assign identifiers to their proper locations.
 	switch len(idents) {
 	case 1:
-		if re != nil {
-			m.TimeToLive = idents[0]
-		} else {
-			m.Name = idents[0]
-		}
+		m.TimeToLive = idents[0]
 	case 2:
-		if re != nil {
-			m.Database, m.TimeToLive = idents[0], idents[1]
-		} else {
-			m.TimeToLive, m.Name = idents[0], idents[1]
-		}
+		m.Database, m.TimeToLive = idents[0], idents[1]
 	}
-
 	return m, nil
 }
 
@@ -592,7 +1664,7 @@ func (p *Parser) parseCondition() (ast.Expr, error) {
 	}
 
 	// Scan the identifier for the source.
-	expr, err := p.ParseExpr()
+	expr, err := p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
@@ -625,9 +1697,16 @@ func (p *Parser) parseDimensions() (ast.Dimensions, error) {
 		dimensions = append(dimensions, d)
 
 		// If there's not a comma next then stop parsing dimensions.
-		if _, tok, _ := p.scan(); tok != token.COMMA {
+		pos, tok, _ := p.scan()
+		if tok != token.COMMA {
 			p.s.Unscan()
 			break
+		} else if end, err := p.trailingComma(pos, dimensionsEnd); err != nil {
+			return nil, err
+		} else if end {
+			break
+		} else if err := p.checkLimit("dimensions", len(dimensions), p.maxDimensions); err != nil {
+			return nil, err
 		}
 	}
 	return dimensions, nil
@@ -643,10 +1722,15 @@ func (p *Parser) parseDimension() (*ast.Dimension, error) {
 	}
 
 	// Parse the expression first.
-	expr, err := p.ParseExpr()
+	pos, _, _ := p.ScanIgnoreWhitespace()
+	p.s.Unscan()
+	expr, err := p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := expr.(*ast.Wildcard); ok {
+		p.checkGroupByWildcard(pos)
+	}
 
 	// Consume all trailing whitespace.
 	p.consumeWhitespace()
@@ -656,22 +1740,31 @@ func (p *Parser) parseDimension() (*ast.Dimension, error) {
 
 // parseFill parses the fill call and its options.
 func (p *Parser) parseFill() (ast.FillOption, interface{}, error) {
-	// Parse the expression first.
-	_, tok, lit := p.ScanIgnoreWhitespace()
-	p.s.Unscan()
+	// Parse the expression first.
+	pos, tok, lit := p.ScanIgnoreWhitespace()
 	if tok != token.IDENT || strings.ToLower(lit) != "fill" {
+		p.s.Unscan()
 		return ast.NullFill, nil, nil
 	}
+	if _, tok, _ := p.scan(); tok != token.LPAREN {
+		return ast.NullFill, nil, &ParseError{Message: "fill must be a function call", Pos: pos}
+	}
 
-	expr, err := p.ParseExpr()
+	// Remember where the argument is, to report it if it is not valid.
+	argPos, re, err := p.parseRegexPos()
 	if err != nil {
 		return ast.NullFill, nil, err
+	} else if re != nil {
+		return ast.NullFill, nil, &ParseError{Message: "expected number argument in fill()", Pos: argPos}
 	}
-	fill, ok := expr.(*ast.Call)
-	if !ok {
-		return ast.NullFill, nil, errors.New("fill must be a function call")
+	argPos, _, _ = p.ScanIgnoreWhitespace()
+	p.s.Unscan()
+
+	fill, err := p.parseCall(lit)
+	if err != nil {
+		return ast.NullFill, nil, err
 	} else if len(fill.Args) != 1 {
-		return ast.NullFill, nil, errors.New("fill requires an argument, e.g.: 0, null, none, previous, linear")
+		return ast.NullFill, nil, &ParseError{Message: "fill requires an argument, e.g.: 0, null, none, previous, linear", Pos: pos}
 	}
 	switch fill.Args[0].String() {
 	case "null":
@@ -689,7 +1782,7 @@ func (p *Parser) parseFill() (ast.FillOption, interface{}, error) {
 		case *ast.NumberLiteral:
 			return ast.NumberFill, num.Val, nil
 		default:
-			return ast.NullFill, nil, fmt.Errorf("expected number argument in fill()")
+			return ast.NullFill, nil, &ParseError{Message: "expected number argument in fill()", Pos: argPos}
 		}
 	}
 }
@@ -703,7 +1796,7 @@ func (p *Parser) parseLocation() (*time.Location, error) {
 		return nil, nil
 	}
 
-	expr, err := p.ParseExpr()
+	expr, err := p.parseExpr()
 	if err != nil {
 		return nil, err
 	}
@@ -727,6 +1820,42 @@ func (p *Parser) parseLocation() (*time.Location, error) {
 	return loc, nil
 }
 
+// checkSubqueryLocations returns an error at pos, where the TZ() of stmt is,
+// if a subquery of stmt, at any depth, has a different time zone than stmt.
+// A subquery without a TZ() does not hide the ones nested in it, since the
+// points it reads are still grouped by their time zone.
+func checkSubqueryLocations(stmt *ast.SelectStatement, pos token.Pos) error {
+	if stmt.Location == nil {
+		return nil
+	}
+	outer := stmt.Location.String()
+
+	var inner string
+	var visit func(ast.Node)
+	visit = func(node ast.Node) {
+		ast.WalkFunc(node, func(n ast.Node) {
+			switch n := n.(type) {
+			case *ast.SelectStatement:
+				if loc := n.Location; inner == "" && loc != nil && loc.String() != outer {
+					inner = loc.String()
+				}
+			case *ast.CTERef:
+				// A named statement is read like a subquery.
+				visit(n.Statement)
+			}
+		})
+	}
+	visit(stmt.Sources)
+
+	if inner != "" {
+		return &ParseError{
+			Message: fmt.Sprintf("time zone %s differs from subquery time zone %s", outer, inner),
+			Pos:     pos,
+		}
+	}
+	return nil
+}
+
 // ParseOptionalTokenAndInt parses the specified token followed
 // by an int, if it exists.
 func (p *Parser) ParseOptionalTokenAndInt(t token.Token) (int, error) {
@@ -856,10 +1985,44 @@ func (p *Parser) ParseVarRef() (*ast.VarRef, error) {
 		return nil, err
 	}
 
+	dtype, err := p.parseDataType()
+	if err != nil {
+		return nil, err
+	}
+
+	vr := &ast.VarRef{Val: strings.Join(segments, "."), Type: dtype}
+
+	return vr, nil
+}
+
+// parseFieldAccess parses the keys of the members of base that follow it, if
+// any, such as "->'status'". The dot is not used for members since it
+// already separates the segments of a name.
+func (p *Parser) parseFieldAccess(base ast.Expr) (ast.Expr, error) {
+	var path []string
+	for {
+		if _, tok, _ := p.ScanIgnoreWhitespace(); tok != token.ARROW {
+			p.s.Unscan()
+			break
+		}
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		if tok != token.STRING {
+			return nil, newParseError(tokstr(tok, lit), []string{"string"}, pos)
+		}
+		path = append(path, lit)
+	}
+	if path == nil {
+		return base, nil
+	}
+	return &ast.FieldAccess{Base: base, Path: path}, nil
+}
+
+// parseDataType parses an optional "::type" cast following a variable reference.
+func (p *Parser) parseDataType() (ast.DataType, error) {
 	var dtype ast.DataType
 	if _, tok, _ := p.scan(); tok == token.DOUBLECOLON {
 		pos, tok, lit := p.scan()
-		switch tok {
+		switch p.keyword(tok, lit) {
 		case token.IDENT:
 			switch strings.ToLower(lit) {
 			case "float":
@@ -873,32 +2036,57 @@ func (p *Parser) ParseVarRef() (*ast.VarRef, error) {
 			case "boolean":
 				dtype = ast.Boolean
 			default:
-				return nil, newParseError(tokstr(tok, lit), []string{"float", "integer", "unsigned", "string", "boolean", "field", "tag"}, pos)
+				return ast.Unknown, newParseError(p.foundstr(tok, lit), []string{"float", "integer", "unsigned", "string", "boolean", "field", "tag"}, pos)
 			}
 		case token.FIELD:
 			dtype = ast.AnyField
 		case token.TAG:
 			dtype = ast.Tag
 		default:
-			return nil, newParseError(tokstr(tok, lit), []string{"float", "integer", "string", "boolean", "field", "tag"}, pos)
+			return ast.Unknown, newParseError(tokstr(tok, lit), []string{"float", "integer", "string", "boolean", "field", "tag"}, pos)
 		}
 	} else {
 		p.s.Unscan()
 	}
 
-	vr := &ast.VarRef{Val: strings.Join(segments, "."), Type: dtype}
-
-	return vr, nil
+	return dtype, nil
 }
 
 // ParseExpr parses an expression.
 func (p *Parser) ParseExpr() (ast.Expr, error) {
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, p.paramError(err)
+	}
+	return expr, nil
+}
+
+// parseExpr parses an expression.
+func (p *Parser) parseExpr() (ast.Expr, error) {
+	return p.parseExprAbove(0)
+}
+
+// parseExprAbove parses an expression whose binary operators bind more
+// tightly than the precedence min. It ends before the first operator that
+// does not, such as before AND for the operand of "!".
+func (p *Parser) parseExprAbove(min int) (ast.Expr, error) {
 	var err error
 	// Dummy root node.
 	root := &ast.BinaryExpr{}
 
+	// The last operator that is not a comparison, with a subquery as RHS.
+	var pending *ast.BinaryExpr
+	var pendingPos token.Pos
+
+	// The first comparison of a comparison, such as 1 < a < 10, which is
+	// reported once its RHS is complete.
+	var chained *ast.BinaryExpr
+	var chainedPos token.Pos
+
 	// Parse a non-binary expression type to start.
 	// This variable will always be the root of the expression tree.
+	start, _, _ := p.ScanIgnoreWhitespace()
+	p.s.Unscan()
 	root.RHS, err = p.parseUnaryExpr()
 	if err != nil {
 		return nil, err
@@ -907,9 +2095,17 @@ func (p *Parser) ParseExpr() (ast.Expr, error) {
 	// Loop over operations and unary exprs and build a tree based on precendence.
 	for {
 		// If the next token is NOT an operator then return the expression.
-		_, op, _ := p.ScanIgnoreWhitespace()
-		if !op.IsOperator() {
+		// IN is a keyword, but it compares like an operator.
+		pos, op, _ := p.ScanIgnoreWhitespace()
+		if (!op.IsOperator() && op != token.IN) || op.Precedence() <= min {
 			p.s.Unscan()
+			if pending != nil {
+				return nil, subqueryOperandError(pendingPos)
+			} else if isSubqueryExpr(root.RHS) {
+				return nil, subqueryOperandError(start)
+			} else if chained != nil {
+				return nil, chainedComparisonError(chained, chainedPos)
+			}
 			return root.RHS, nil
 		}
 
@@ -917,15 +2113,21 @@ func (p *Parser) ParseExpr() (ast.Expr, error) {
 		var rhs ast.Expr
 		if op.IsRegexOp() {
 			// RHS of a regex operator must be a regular expression.
-			if rhs, err = p.parseRegex(); err != nil {
+			if rhs, err = p.parseRequiredRegex(); err != nil {
 				return nil, err
 			}
-			// parseRegex can return an empty type, but we need it to be present
-			if rhs.(*ast.RegexLiteral) == nil {
-				pos, tok, lit := p.ScanIgnoreWhitespace()
-				return nil, newParseError(tokstr(tok, lit), []string{"regex"}, pos)
+		} else if op == token.IN {
+			// RHS of IN must be a list.
+			if rhs, err = p.parseListLiteral(); err != nil {
+				return nil, err
+			}
+		} else if _, tok, _ := p.ScanIgnoreWhitespace(); op.Precedence() == token.EQ.Precedence() && (tok == token.ANY || tok == token.ALL) {
+			// A comparison may be with ANY or ALL of a list.
+			if rhs, err = p.parseQuantifiedExpr(tok); err != nil {
+				return nil, err
 			}
 		} else {
+			p.s.Unscan()
 			if rhs, err = p.parseUnaryExpr(); err != nil {
 				return nil, err
 			}
@@ -935,23 +2137,171 @@ func (p *Parser) ParseExpr() (ast.Expr, error) {
 		// descending the RHS of the expression tree until we reach the last
 		// BinaryExpr or a BinaryExpr whose RHS has an operator with
 		// precedence >= the operator being added.
+		var expr *ast.BinaryExpr
 		for node := root; ; {
 			r, ok := node.RHS.(*ast.BinaryExpr)
 			if !ok || r.Op.Precedence() >= op.Precedence() {
 				// Add the new expression here and break.
-				node.RHS = &ast.BinaryExpr{LHS: node.RHS, RHS: rhs, Op: op}
+				expr = &ast.BinaryExpr{LHS: node.RHS, RHS: rhs, Op: op}
+				p.recordOp(expr, pos)
+				node.RHS = expr
 				break
 			}
 			node = r
 		}
+
+		// Comparisons do not chain: 1 < a < 10 would compare the boolean
+		// 1 < a with 10.
+		if lhs, ok := expr.LHS.(*ast.BinaryExpr); ok && chained == nil && isComparison(op) && isComparison(lhs.Op) {
+			chained, chainedPos = expr, pos
+		}
+
+		// A subquery must be an operand of a comparison. It is final once
+		// it is a LHS, but a RHS may still be taken by the next operator.
+		if pending != nil && isSubqueryExpr(pending.RHS) {
+			return nil, subqueryOperandError(pendingPos)
+		}
+		pending = nil
+		if op.Precedence() != token.EQ.Precedence() {
+			if isSubqueryExpr(expr.LHS) {
+				return nil, subqueryOperandError(pos)
+			} else if isSubqueryExpr(rhs) {
+				pending, pendingPos = expr, pos
+			}
+		}
+	}
+}
+
+// parseQuantifiedExpr parses the list following ANY or ALL, such as
+// "('a', 'b')" or "($list)" where $list is bound to a list.
+func (p *Parser) parseQuantifiedExpr(op token.Token) (*ast.QuantifiedExpr, error) {
+	if pos, tok, lit := p.ScanIgnoreWhitespace(); tok != token.LPAREN {
+		return nil, newParseError(tokstr(tok, lit), []string{"("}, pos)
+	}
+
+	expr := &ast.QuantifiedExpr{Op: op}
+	for {
+		// A bound list is expanded in place.
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		if list, ok := p.params[strings.TrimPrefix(lit, "$")].(ListValue); ok && tok == token.BOUNDPARAM {
+			for _, v := range list {
+				val, err := p.valueExpr(v)
+				if err != nil {
+					return nil, &ParseError{Message: err.Error(), Pos: pos}
+				}
+				expr.Vals = append(expr.Vals, val)
+				if err := p.checkListLength(op, len(expr.Vals), pos); err != nil {
+					return nil, err
+				}
+			}
+		} else if tok == token.RPAREN && len(expr.Vals) == 0 {
+			return nil, &ParseError{Message: fmt.Sprintf("%s requires at least one value", op), Pos: pos}
+		} else {
+			p.s.Unscan()
+			val, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			expr.Vals = append(expr.Vals, val)
+			if err := p.checkListLength(op, len(expr.Vals), pos); err != nil {
+				return nil, err
+			}
+		}
+
+		switch pos, tok, lit := p.ScanIgnoreWhitespace(); tok {
+		case token.COMMA:
+		case token.RPAREN:
+			// Bound lists may all be empty.
+			if len(expr.Vals) == 0 {
+				return nil, &ParseError{Message: fmt.Sprintf("%s requires at least one value", op), Pos: pos}
+			}
+			return expr, nil
+		default:
+			return nil, newParseError(tokstr(tok, lit), []string{",", ")"}, pos)
+		}
+	}
+}
+
+// parseListLiteral parses the list following IN, such as "(a, 'b')". Its
+// values are identifiers or strings.
+func (p *Parser) parseListLiteral() (*ast.ListLiteral, error) {
+	if pos, tok, lit := p.ScanIgnoreWhitespace(); tok != token.LPAREN {
+		return nil, newParseError(tokstr(tok, lit), []string{"("}, pos)
+	}
+
+	list := &ast.ListLiteral{}
+	for {
+		pos, tok, lit := p.ScanIgnoreWhitespace()
+		switch tok {
+		case token.IDENT, token.STRING:
+			list.Vals = append(list.Vals, lit)
+			if err := p.checkListLength(token.IN, len(list.Vals), pos); err != nil {
+				return nil, err
+			}
+		case token.RPAREN:
+			if len(list.Vals) == 0 {
+				return nil, &ParseError{Message: "IN requires at least one value", Pos: pos}
+			}
+			fallthrough
+		default:
+			return nil, newParseError(tokstr(tok, lit), []string{"identifier", "string"}, pos)
+		}
+
+		switch pos, tok, lit := p.ScanIgnoreWhitespace(); tok {
+		case token.COMMA:
+		case token.RPAREN:
+			return list, nil
+		default:
+			return nil, newParseError(tokstr(tok, lit), []string{",", ")"}, pos)
+		}
+	}
+}
+
+// valueExpr returns the expression of a value of a bound list.
+func (p *Parser) valueExpr(v Value) (ast.Expr, error) {
+	switch v := v.(type) {
+	case Identifier:
+		ref := &ast.VarRef{Val: string(v)}
+		if err := p.checkConditionRef(ref); err != nil {
+			return nil, err
+		}
+		return ref, nil
+	case StringValue:
+		return &ast.StringLiteral{Val: string(v)}, nil
+	case RegexValue:
+		return p.regexLiteral(string(v))
+	case NumberValue:
+		return &ast.NumberLiteral{Val: float64(v)}, nil
+	case IntegerValue:
+		return &ast.IntegerLiteral{Val: int64(v)}, nil
+	case UnsignedValue:
+		if v <= math.MaxInt64 {
+			return &ast.IntegerLiteral{Val: int64(v)}, nil
+		}
+		return &ast.UnsignedLiteral{Val: uint64(v)}, nil
+	case BooleanValue:
+		return &ast.BooleanLiteral{Val: bool(v)}, nil
+	case DurationValue:
+		d, err := tools.ParseDuration(string(v))
+		if err != nil {
+			return nil, err
+		}
+		return &ast.DurationLiteral{Val: d}, nil
 	}
+	return nil, fmt.Errorf("unable to use %s in a list", v.Value())
 }
 
 // parseUnaryExpr parses an non-binary expression.
 func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
-	// If the first token is a LPAREN then parse it as its own grouped expression.
-	if _, tok, _ := p.ScanIgnoreWhitespace(); tok == token.LPAREN {
-		expr, err := p.ParseExpr()
+	// If the first token is a LPAREN then parse it as its own grouped expression,
+	// or as a subquery if it is followed by SELECT.
+	if pos, tok, _ := p.ScanIgnoreWhitespace(); tok == token.LPAREN {
+		if _, tok, _ := p.ScanIgnoreWhitespace(); tok == token.SELECT {
+			return p.parseSubqueryExpr(pos)
+		}
+		p.s.Unscan()
+
+		expr, err := p.parseExpr()
 		if err != nil {
 			return nil, err
 		}
@@ -961,7 +2311,9 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 			return nil, newParseError(tokstr(tok, lit), []string{")"}, pos)
 		}
 
-		return &ast.ParenExpr{Expr: expr}, nil
+		// The members of a grouped expression may be accessed too, such
+		// as (a + b)->'status' printed for a built FieldAccess.
+		return p.parseFieldAccess(&ast.ParenExpr{Expr: expr})
 	}
 	p.s.Unscan()
 
@@ -972,31 +2324,74 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 		// If the next immediate token is a left parentheses, parse as function call.
 		// Otherwise parse as a variable reference.
 		if _, tok0, _ := p.scan(); tok0 == token.LPAREN {
-			return p.parseCall(lit)
+			if err := p.checkConditionCall(lit); err != nil {
+				return nil, &ParseError{Message: err.Error(), Pos: pos}
+			}
+			call, err := p.parseCall(lit)
+			if err != nil {
+				return nil, err
+			} else if err := call.ValidateArgs(); err != nil {
+				return nil, &ParseError{Message: err.Error(), Pos: pos}
+			}
+			p.recordCall(call, pos)
+			return call, nil
 		}
 
 		p.s.Unscan() // Unscan the last token (wasn't an LPAREN)
 		p.s.Unscan() // Unscan the IDENT token
 
 		// Parse it as a VarRef.
-		return p.ParseVarRef()
+		ref, err := p.ParseVarRef()
+		if err != nil {
+			return nil, err
+		} else if err := p.checkConditionRef(ref); err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: pos}
+		}
+		p.recordCast(ref, pos)
+		return p.parseFieldAccess(ref)
+	case token.SYSREF:
+		dtype, err := p.parseDataType()
+		if err != nil {
+			return nil, err
+		}
+		ref := &ast.VarRef{Val: strings.TrimPrefix(lit, "@"), Type: dtype, System: true}
+		if err := p.checkConditionRef(ref); err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: pos}
+		}
+		p.recordCast(ref, pos)
+		return ref, nil
 	case token.DISTINCT:
+		if err := p.checkConditionCall("distinct"); err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: pos}
+		}
+
 		// If the next immediate token is a left parentheses, parse as function call.
-		// Otherwise parse as a Distinct expression.
+		// Otherwise parse "DISTINCT ident", which is the same call.
+		// Tokens are only read forward here so no Unscan is needed.
 		pos, tok0, lit := p.scan()
 		if tok0 == token.LPAREN {
 			return p.parseCall("distinct")
-		} else if tok0 == token.WS {
-			pos, tok1, lit := p.ScanIgnoreWhitespace()
-			if tok1 != token.IDENT {
-				return nil, newParseError(tokstr(tok1, lit), []string{"identifier"}, pos)
+		} else if tok0 == token.WS || tok0 == token.COMMENT {
+			if tok0 == token.COMMENT {
+				p.keepComment(pos, lit)
+			}
+			pos, tok0, lit = p.ScanIgnoreWhitespace()
+			if tok0 == token.IDENT {
+				return (&ast.Distinct{Val: lit}).NewCall(), nil
 			}
-			return &ast.Distinct{Val: lit}, nil
 		}
 
-		return nil, newParseError(tokstr(tok0, lit), []string{"(", "identifier"}, pos)
+		found := tokstr(tok0, lit)
+		return nil, &ParseError{
+			Message:  fmt.Sprintf("found %s, expected identifier or ( after DISTINCT", found),
+			Found:    found,
+			Expected: []string{"identifier", "("},
+			Pos:      pos,
+		}
+	case token.ANY, token.ALL:
+		return nil, &ParseError{Message: fmt.Sprintf("%s must follow a comparison operator", tok), Pos: pos}
 	case token.STRING:
-		return &ast.StringLiteral{Val: lit}, nil
+		return &ast.StringLiteral{Val: p.parseAdjacentStrings(lit)}, nil
 	case token.NUMBER:
 		v, err := strconv.ParseFloat(lit, 64)
 		if err != nil {
@@ -1004,6 +2399,9 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 		}
 		return &ast.NumberLiteral{Val: v}, nil
 	case token.INTEGER:
+		// The literal is parsed here rather than while scanning it. Parsing
+		// is a small part of the cost of scanning, as measured by
+		// BenchmarkParseQuery/LargeIntegerList.
 		v, err := strconv.ParseInt(lit, 10, 64)
 		if err != nil {
 			// The literal may be too large to fit into an int64. If it is, use an unsigned integer.
@@ -1017,7 +2415,8 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 	case token.TRUE, token.FALSE:
 		return &ast.BooleanLiteral{Val: tok == token.TRUE}, nil
 	case token.DURATIONVAL:
-		v, err := ParseDuration(lit)
+		p.s.Unscan()
+		v, err := p.parseDurationExpr()
 		if err != nil {
 			return nil, err
 		}
@@ -1026,41 +2425,57 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 		wc := &ast.Wildcard{}
 		if _, tok, _ := p.scan(); tok == token.DOUBLECOLON {
 			pos, tok, lit := p.scan()
-			switch tok {
+			switch kw := p.keyword(tok, lit); kw {
 			case token.FIELD, token.TAG:
-				wc.Type = tok
+				wc.Type = kw
 			default:
-				return nil, newParseError(tokstr(tok, lit), []string{"field", "tag"}, pos)
+				return nil, newParseError(p.foundstr(tok, lit), []string{"field", "tag"}, pos)
 			}
 		} else {
 			p.s.Unscan()
 		}
 		return wc, nil
 	case token.REGEX:
-		re, err := regexp.Compile(lit)
+		re, err := p.regexLiteral(lit)
 		if err != nil {
 			return nil, &ParseError{Message: err.Error(), Pos: pos}
 		}
-		return &ast.RegexLiteral{Val: re}, nil
+		return re, nil
 	case token.BOUNDPARAM:
 		// If we have a BOUNDPARAM in the token stream,
 		// it wasn't resolved by the parser to another
 		// token type which means it is invalid.
 		// Figure out what is wrong with it.
 		k := strings.TrimPrefix(lit, "$")
-		if len(k) == 0 {
-			return nil, errors.New("empty bound parameter")
+		if err := checkParamName(k); err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: pos}
 		}
 
 		v, ok := p.params[k]
-		if !ok {
+		if !ok && p.deferBoundParams {
+			return &ast.BoundParameter{Name: k}, nil
+		} else if !ok {
 			return nil, fmt.Errorf("missing parameter: %s", k)
+		} else if _, ok := v.(ListValue); ok {
+			return nil, &ParseError{Message: fmt.Sprintf("list parameter $%s must be used in ANY or ALL", k), Pos: pos}
 		}
 
 		// The value must be an ErrorValue.
 		// Return the value as an error. A non-error value
 		// would have been substituted as something else.
 		return nil, errors.New(v.Value())
+	case token.NOT:
+		// The operand of "!" extends to the next AND or OR, so that
+		// !host = 'a' negates the comparison, and must be a boolean.
+		pos0, _, _ := p.ScanIgnoreWhitespace()
+		p.s.Unscan()
+		expr, err := p.parseExprAbove(token.AND.Precedence())
+		if err != nil {
+			return nil, err
+		} else if !isBooleanOperand(expr) {
+			return nil, &ParseError{Message: fmt.Sprintf("expected boolean operand of !, found %s", expr), Pos: pos0}
+		}
+		return &ast.NotExpr{Expr: expr}, nil
 	case token.ADD, token.SUB:
 		mul := 1
 		if tok == token.SUB {
@@ -1095,7 +2510,14 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 				}
 			case *ast.DurationLiteral:
 				lit.Val *= time.Duration(mul)
-			case *ast.VarRef, *ast.Call, *ast.ParenExpr:
+			case *ast.SubqueryExpr:
+				return nil, subqueryOperandError(pos0)
+			case *ast.VarRef, *ast.Call, *ast.ParenExpr, *ast.FieldAccess:
+				// A unary plus leaves the expression as-is.
+				if tok == token.ADD {
+					return lit, nil
+				}
+
 				// Multiply the variable.
 				return &ast.BinaryExpr{
 					Op:  token.MUL,
@@ -1114,8 +2536,99 @@ func (p *Parser) parseUnaryExpr() (ast.Expr, error) {
 	}
 }
 
-// parseRegex parses a regular expression.
+// parseSubqueryExpr parses a subquery used as an expression, such as
+// "(SELECT mean(value) FROM cpu)". This function assumes the LPAREN at pos
+// and the SELECT token have already been consumed.
+func (p *Parser) parseSubqueryExpr(pos token.Pos) (*ast.SubqueryExpr, error) {
+	p.depth++
+	p.checkSubqueryDepth(pos)
+	stmt, err := p.parseSelectStatement(targetSubquery)
+	if err != nil {
+		return nil, err
+	}
+	p.depth--
+
+	if err := p.parseTokens([]token.Token{token.RPAREN}); err != nil {
+		return nil, err
+	}
+
+	// The subquery reads its sources on its own, so the rules of the policy
+	// apply to it as to a statement.
+	p.checkStatementPolicy(stmt, stmt.Limit, pos)
+	return &ast.SubqueryExpr{Statement: stmt}, nil
+}
+
+// subqueryOperandError returns the error for a subquery at pos that is not
+// an operand of a comparison.
+func subqueryOperandError(pos token.Pos) error {
+	return &ParseError{Message: "subquery can only be an operand of a comparison", Pos: pos}
+}
+
+// chainedComparisonError returns the error for a comparison at pos whose LHS
+// is a comparison, suggesting the conjunction it was likely meant as.
+func chainedComparisonError(expr *ast.BinaryExpr, pos token.Pos) error {
+	lhs := expr.LHS.(*ast.BinaryExpr)
+	and := &ast.BinaryExpr{Op: token.AND, LHS: lhs, RHS: &ast.BinaryExpr{Op: expr.Op, LHS: lhs.RHS, RHS: expr.RHS}}
+	return &ParseError{Message: fmt.Sprintf("cannot chain comparisons in %s, use %s", expr, and), Pos: pos}
+}
+
+// isComparison returns true if op is a comparison operator.
+func isComparison(op token.Token) bool {
+	return op.Precedence() == token.EQ.Precedence()
+}
+
+// isBooleanOperand returns true if expr may be a boolean, which rules out
+// the literals of other types and arithmetic.
+func isBooleanOperand(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.BinaryExpr:
+		return isComparison(expr.Op)
+	case *ast.BooleanLiteral, *ast.BoundParameter:
+		return true
+	case ast.Literal:
+		return false
+	}
+	return true
+}
+
+// isSubqueryExpr returns true if expr is a subquery.
+func isSubqueryExpr(expr ast.Expr) bool {
+	_, ok := expr.(*ast.SubqueryExpr)
+	return ok
+}
+
+// parseAdjacentStrings returns lit followed by the strings that follow it,
+// separated only by whitespace, so that 'a' 'b' is the string 'ab'.
+func (p *Parser) parseAdjacentStrings(lit string) string {
+	for {
+		if _, tok, _ := p.scan(); tok != token.WS {
+			p.s.Unscan()
+			return lit
+		}
+		_, tok, next := p.scan()
+		if tok != token.STRING {
+			p.s.Unscan()
+			return lit
+		}
+		lit += next
+	}
+}
+
+// parseRegex parses a regular expression if one is next, otherwise it returns nils.
+//
+// This is the only place that decides whether a '/' starts a regex or is a DIV.
+// A regex may only start where the grammar allows one (the RHS of =~ and !~,
+// a source in FROM, a field, a dimension or a call argument) and only if the
+// '/' has not already been scanned as part of another token. Tokens pushed
+// back with Unscan are returned by ScanRegex as-is, so any token other than a
+// regex is pushed back again and no regex is parsed.
 func (p *Parser) parseRegex() (*ast.RegexLiteral, error) {
+	_, re, err := p.parseRegexPos()
+	return re, err
+}
+
+// parseRegexPos is like parseRegex, but also returns the position of the regex.
+func (p *Parser) parseRegexPos() (token.Pos, *ast.RegexLiteral, error) {
 	nextRune := p.s.Peek()
 	if tools.IsWhitespace(nextRune) {
 		p.consumeWhitespace()
@@ -1130,37 +2643,68 @@ func (p *Parser) parseRegex() (*ast.RegexLiteral, error) {
 		p.s.Unscan()
 		if tok != token.REGEX {
 			// It was not a regular expression so return.
-			return nil, nil
+			return token.Pos{}, nil, nil
 		}
 	} else if nextRune != '/' {
-		return nil, nil
+		return token.Pos{}, nil, nil
 	}
 
-	pos, tok, lit := p.s.ScanRegex()
+	pos, tok, lit := p.scanRegex()
 
 	if tok == token.BADESCAPE {
 		msg := fmt.Sprintf("bad escape: %s", lit)
-		return nil, &ParseError{Message: msg, Pos: pos}
+		return pos, nil, &ParseError{Message: msg, Pos: pos}
 	} else if tok == token.BADREGEX {
 		msg := fmt.Sprintf("bad regex: %s", lit)
-		return nil, &ParseError{Message: msg, Pos: pos}
+		return pos, nil, &ParseError{Message: msg, Pos: pos}
 	} else if tok != token.REGEX {
-		return nil, newParseError(tokstr(tok, lit), []string{"regex"}, pos)
+		// An unscanned token was in the way so this is not a regex.
+		p.s.Unscan()
+		return token.Pos{}, nil, nil
+	}
+
+	re, err := p.regexLiteral(lit)
+	if err != nil {
+		return pos, nil, &ParseError{Message: err.Error(), Pos: pos}
 	}
 
-	re, err := regexp.Compile(lit)
+	return pos, re, nil
+}
+
+// parseRequiredRegex parses a regular expression that must be present,
+// such as the RHS of a regex operator.
+func (p *Parser) parseRequiredRegex() (*ast.RegexLiteral, error) {
+	re, err := p.parseRegex()
 	if err != nil {
-		return nil, &ParseError{Message: err.Error(), Pos: pos}
+		return nil, err
+	} else if re != nil {
+		return re, nil
 	}
 
-	return &ast.RegexLiteral{Val: re}, nil
+	// Read the raw token so a bound parameter can be reported by name.
+	pos, tok, lit := p.s.Scan()
+	for tok == token.WS || tok == token.COMMENT {
+		pos, tok, lit = p.s.Scan()
+	}
+	if tok == token.BOUNDPARAM {
+		k := strings.TrimPrefix(lit, "$")
+		if err := checkParamName(k); err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: pos}
+		} else if v, ok := p.params[k]; !ok {
+			return nil, &ParseError{Message: fmt.Sprintf("missing parameter: %s", k), Pos: pos}
+		} else if _, ok := v.(ErrorValue); ok {
+			return nil, &ParseError{Message: v.Value(), Pos: pos}
+		} else {
+			return nil, &ParseError{Found: paramstr(v), Expected: []string{"regex"}, Pos: pos, Param: k}
+		}
+	}
+	return nil, newParseError(tokstr(tok, lit), []string{"regex"}, pos)
 }
 
 // parseCall parses a function call.
 // This function assumes the function name and LPAREN have been consumed.
+// The name is kept as written.
 func (p *Parser) parseCall(name string) (*ast.Call, error) {
-	name = strings.ToLower(name)
-
 	// Parse first function argument if one exists.
 	var args []ast.Expr
 	re, err := p.parseRegex()
@@ -1175,7 +2719,7 @@ func (p *Parser) parseCall(name string) (*ast.Call, error) {
 		}
 		p.s.Unscan()
 
-		arg, err := p.ParseExpr()
+		arg, err := p.parseExpr()
 		if err != nil {
 			return nil, err
 		}
@@ -1185,9 +2729,14 @@ func (p *Parser) parseCall(name string) (*ast.Call, error) {
 	// Parse additional function arguments if there is a comma.
 	for {
 		// If there's not a comma, stop parsing arguments.
-		if _, tok, _ := p.ScanIgnoreWhitespace(); tok != token.COMMA {
+		pos, tok, _ := p.ScanIgnoreWhitespace()
+		if tok != token.COMMA {
 			p.s.Unscan()
 			break
+		} else if end, err := p.trailingComma(pos, argsEnd); err != nil {
+			return nil, err
+		} else if end {
+			break
 		}
 
 		re, err := p.parseRegex()
@@ -1199,7 +2748,7 @@ func (p *Parser) parseCall(name string) (*ast.Call, error) {
 		}
 
 		// Parse an expression argument.
-		arg, err := p.ParseExpr()
+		arg, err := p.parseExpr()
 		if err != nil {
 			return nil, err
 		}
@@ -1215,24 +2764,26 @@ func (p *Parser) parseCall(name string) (*ast.Call, error) {
 }
 
 func (p *Parser) scan() (pos token.Pos, tok token.Token, lit string) {
-	pos, tok, lit = p.s.Scan()
-	if tok == token.BOUNDPARAM {
-		k := strings.TrimPrefix(lit, "$")
-		if len(k) != 0 {
-			if v, ok := p.params[k]; ok {
-				tok, lit = v.TokenType(), v.Value()
-			}
-		}
-	}
-	return pos, tok, lit
+	return p.bind(p.s.Scan())
 }
 
 func (p *Parser) scanRegex() (pos token.Pos, tok token.Token, lit string) {
-	pos, tok, lit = p.s.ScanRegex()
+	return p.bind(p.s.ScanRegex())
+}
+
+// bind substitutes a BOUNDPARAM token with the token of its bound value, if any.
+// The name of every bound parameter read is recorded before substitution.
+func (p *Parser) bind(pos token.Pos, tok token.Token, lit string) (token.Pos, token.Token, string) {
 	if tok == token.BOUNDPARAM {
 		k := strings.TrimPrefix(lit, "$")
 		if len(k) != 0 {
-			if v, ok := p.params[k]; ok {
+			p.boundParams = append(p.boundParams, k)
+			// An ErrorValue is left in place to be reported where it is used.
+			if v, ok := p.params[k]; ok && v.TokenType() != token.BOUNDPARAM {
+				if p.bound == nil {
+					p.bound = make(map[token.Pos]string)
+				}
+				p.bound[pos] = k
 				tok, lit = v.TokenType(), v.Value()
 			}
 		}
@@ -1244,13 +2795,31 @@ func (p *Parser) scanRegex() (pos token.Pos, tok token.Token, lit string) {
 func (p *Parser) ScanIgnoreWhitespace() (pos token.Pos, tok token.Token, lit string) {
 	for {
 		pos, tok, lit = p.scan()
-		if tok == token.WS || tok == token.COMMENT {
+		if tok == token.COMMENT {
+			p.keepComment(pos, lit)
+			continue
+		} else if tok == token.WS {
 			continue
 		}
 		return
 	}
 }
 
+// keepComment records a comment if comments are being kept.
+// Comments are only recorded once even if their token is unscanned and read again.
+func (p *Parser) keepComment(pos token.Pos, lit string) {
+	if !p.keepComments {
+		return
+	}
+	if n := len(p.comments); n > 0 {
+		last := p.comments[n-1].Pos
+		if pos.Line < last.Line || (pos.Line == last.Line && pos.Char <= last.Char) {
+			return
+		}
+	}
+	p.comments = append(p.comments, &ast.Comment{Text: lit, Pos: pos})
+}
+
 // consumeWhitespace scans the next token if it's whitespace.
 func (p *Parser) consumeWhitespace() {
 	if _, tok, _ := p.scan(); tok != token.WS {
@@ -1259,130 +2828,24 @@ func (p *Parser) consumeWhitespace() {
 }
 
 // ParseDuration parses a time duration from a string.
-// This is needed instead of time.ParseDuration because this will support
-// the full syntax that CnosQL supports for specifying durations
-// including weeks and days.
+//
+// Deprecated: Use tools.ParseDuration, which does not need the parser.
 func ParseDuration(s string) (time.Duration, error) {
-	// Return an error if the string is blank or one character
-	if len(s) < 2 {
-		return 0, ErrInvalidDuration
-	}
-
-	// Split string into individual runes.
-	a := []rune(s)
-
-	// Start with a zero duration.
-	var d time.Duration
-	i := 0
-
-	// Check for a negative.
-	isNegative := false
-	if a[i] == '-' {
-		isNegative = true
-		i++
-	}
-
-	var measure int64
-	var unit string
-
-	// Parsing loop.
-	for i < len(a) {
-		// Find the number portion.
-		start := i
-		for ; i < len(a) && tools.IsDigit(a[i]); i++ {
-			// Scan for the digits.
-		}
-
-		// Check if we reached the end of the string prematurely.
-		if i >= len(a) || i == start {
-			return 0, ErrInvalidDuration
-		}
-
-		// Parse the numeric part.
-		n, err := strconv.ParseInt(string(a[start:i]), 10, 64)
-		if err != nil {
-			return 0, ErrInvalidDuration
-		}
-		measure = n
-
-		// Extract the unit of measure.
-		// If the last two characters are "ms" then parse as milliseconds.
-		// Otherwise just use the last character as the unit of measure.
-		unit = string(a[i])
-		switch a[i] {
-		case 'n':
-			if i+1 < len(a) && a[i+1] == 's' {
-				unit = string(a[i : i+2])
-				d += time.Duration(n)
-				i += 2
-				continue
-			}
-			return 0, ErrInvalidDuration
-		case 'u', 'µ':
-			d += time.Duration(n) * time.Microsecond
-		case 'm':
-			if i+1 < len(a) && a[i+1] == 's' {
-				unit = string(a[i : i+2])
-				d += time.Duration(n) * time.Millisecond
-				i += 2
-				continue
-			}
-			d += time.Duration(n) * time.Minute
-		case 's':
-			d += time.Duration(n) * time.Second
-		case 'h':
-			d += time.Duration(n) * time.Hour
-		case 'd':
-			d += time.Duration(n) * 24 * time.Hour
-		case 'w':
-			d += time.Duration(n) * 7 * 24 * time.Hour
-		default:
-			return 0, ErrInvalidDuration
-		}
-		i++
-	}
-
-	// Check to see if we overflowed a duration
-	if d < 0 && !isNegative {
-		return 0, fmt.Errorf("overflowed duration %d%s: choose a smaller duration or INF", measure, unit)
-	}
-
-	if isNegative {
-		d = -d
-	}
-	return d, nil
+	return tools.ParseDuration(s)
 }
 
 // FormatDuration formats a duration to a string.
+//
+// Deprecated: Use tools.FormatDuration.
 func FormatDuration(d time.Duration) string {
-	if d == 0 {
-		return "0s"
-	} else if d%(7*24*time.Hour) == 0 {
-		return fmt.Sprintf("%dw", d/(7*24*time.Hour))
-	} else if d%(24*time.Hour) == 0 {
-		return fmt.Sprintf("%dd", d/(24*time.Hour))
-	} else if d%time.Hour == 0 {
-		return fmt.Sprintf("%dh", d/time.Hour)
-	} else if d%time.Minute == 0 {
-		return fmt.Sprintf("%dm", d/time.Minute)
-	} else if d%time.Second == 0 {
-		return fmt.Sprintf("%ds", d/time.Second)
-	} else if d%time.Millisecond == 0 {
-		return fmt.Sprintf("%dms", d/time.Millisecond)
-	} else if d%time.Microsecond == 0 {
-		// Although we accept both "u" and "µ" when reading microsecond durations,
-		// we output with "u", which can be represented in 1 byte,
-		// instead of "µ", which requires 2 bytes.
-		return fmt.Sprintf("%du", d/time.Microsecond)
-	}
-	return fmt.Sprintf("%dns", d)
+	return tools.FormatDuration(d)
 }
 
 // parseTokens consumes an expected sequence of tokens.
 func (p *Parser) parseTokens(toks []token.Token) error {
 	for _, expected := range toks {
-		if pos, tok, lit := p.ScanIgnoreWhitespace(); tok != expected {
-			return newParseError(tokstr(tok, lit), []string{expected.String()}, pos)
+		if pos, tok, lit := p.ScanIgnoreWhitespace(); p.keyword(tok, lit) != expected {
+			return newParseError(p.foundstr(tok, lit), []string{expected.String()}, pos)
 		}
 	}
 	return nil
@@ -1390,10 +2853,10 @@ func (p *Parser) parseTokens(toks []token.Token) error {
 
 var (
 	// Quote String replacer.
-	qsReplacer = strings.NewReplacer("\n", `\n`, `\`, `\\`, `'`, `\'`)
+	qsReplacer = strings.NewReplacer("\n", `\n`, "\t", `\t`, "\r", `\r`, "\x00", `\0`, `\`, `\\`, `'`, `\'`)
 
 	// Quote Ident replacer.
-	qiReplacer = strings.NewReplacer("\n", `\n`, `\`, `\\`, `"`, `\"`)
+	qiReplacer = strings.NewReplacer("\n", `\n`, "\t", `\t`, "\r", `\r`, "\x00", `\0`, `\`, `\\`, `"`, `\"`)
 )
 
 // QuoteString returns a quoted string.
@@ -1428,9 +2891,10 @@ func QuoteIdent(segments ...string) string {
 
 // IdentNeedsQuotes returns true if the ident string given would require quotes.
 func IdentNeedsQuotes(ident string) bool {
-	// check if this identifier is a keyword
+	// check if this identifier is a keyword, or the word UNION, which would
+	// end a list of sources or dimensions that it is the last of
 	tok := token.Lookup(ident)
-	if tok != token.IDENT {
+	if tok != token.IDENT || strings.EqualFold(ident, "union") {
 		return true
 	}
 	for i, r := range ident {
@@ -1449,9 +2913,74 @@ func isDateString(s string) bool { return dateStringRegexp.MatchString(s) }
 // isDateTimeString returns true if the string looks like a date+time time literal.
 func isDateTimeString(s string) bool { return dateTimeStringRegexp.MatchString(s) }
 
+// uniqueStrings returns the distinct strings of a in order of first appearance.
+// Returns nil if a is empty.
+func uniqueStrings(a []string) []string {
+	var other []string
+	seen := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		other = append(other, s)
+	}
+	return other
+}
+
+// paramError adds the bound parameter to a parse error found at the
+// position of a substituted parameter.
+func (p *Parser) paramError(err error) error {
+	if e, ok := err.(*ParseError); ok && e.Param == "" {
+		if k, ok := p.bound[e.Pos]; ok {
+			e.Param, e.Found = k, paramstr(p.params[k])
+		}
+	}
+	return err
+}
+
+// keyword returns the keyword spelled by the identifier just scanned, if any,
+// so that a keyword made non-reserved with AllowKeywordAsIdent is still
+// accepted where the grammar expects it. Only a bare identifier spells a
+// keyword, since quoting it, as in "tag", is the way to use a keyword as a
+// name. Other tokens are returned as-is.
+func (p *Parser) keyword(tok token.Token, lit string) token.Token {
+	if tok == token.IDENT && p.s.Raw() == lit {
+		if kw := token.Lookup(lit); kw != token.IDENT {
+			return kw
+		}
+	}
+	return tok
+}
+
+// foundstr returns the text of the token just scanned for an error, like
+// tokstr, except that an identifier is returned as written, so that a quoted
+// "tag" is not reported as the keyword it spells.
+func (p *Parser) foundstr(tok token.Token, lit string) string {
+	if tok == token.IDENT {
+		return p.s.Raw()
+	}
+	return tokstr(tok, lit)
+}
+
+// paramstr returns the text of a bound parameter value as it would be written
+// in a query.
+func paramstr(v Value) string {
+	switch v := v.(type) {
+	case StringValue:
+		return QuoteString(string(v))
+	case RegexValue:
+		return "/" + strings.Replace(string(v), "/", `\/`, -1) + "/"
+	case BooleanValue:
+		return v.Value()
+	}
+	return tokstr(v.TokenType(), v.Value())
+}
+
 // tokstr returns a literal if provided, otherwise returns the token string.
+// Keywords are always returned in their canonical form.
 func tokstr(tok token.Token, lit string) string {
-	if lit != "" {
+	if lit != "" && !tok.IsKeyword() {
 		return lit
 	}
 	return tok.String()
@@ -1461,7 +2990,9 @@ var dateStringRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
 var dateTimeStringRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}.+`)
 
 // ErrInvalidDuration is returned when parsing a malformed duration.
-var ErrInvalidDuration = errors.New("invalid duration")
+//
+// Deprecated: Use tools.ErrInvalidDuration.
+var ErrInvalidDuration = tools.ErrInvalidDuration
 
 // ParseError represents an error that occurred during parsing.
 type ParseError struct {
@@ -1469,6 +3000,10 @@ type ParseError struct {
 	Found    string
 	Expected []string
 	Pos      token.Pos
+
+	// Name of the bound parameter whose value was found, if any.
+	// Found holds the text of the value.
+	Param string
 }
 
 // newParseError returns a new instance of ParseError.
@@ -1478,8 +3013,15 @@ func newParseError(found string, expected []string, pos token.Pos) *ParseError {
 
 // Error returns the string representation of the error.
 func (e *ParseError) Error() string {
+	found := e.Found
+	if e.Param != "" {
+		found = fmt.Sprintf("parameter $%s (bound to %s)", tools.QuoteIdent(e.Param), e.Found)
+	}
 	if e.Message != "" {
+		if e.Param != "" {
+			return fmt.Sprintf("%s: %s at line %d, char %d", e.Message, found, e.Pos.Line+1, e.Pos.Char+1)
+		}
 		return fmt.Sprintf("%s at line %d, char %d", e.Message, e.Pos.Line+1, e.Pos.Char+1)
 	}
-	return fmt.Sprintf("found %s, expected %s at line %d, char %d", e.Found, strings.Join(e.Expected, ", "), e.Pos.Line+1, e.Pos.Char+1)
+	return fmt.Sprintf("found %s, expected %s at line %d, char %d", found, strings.Join(e.Expected, ", "), e.Pos.Line+1, e.Pos.Char+1)
 }
@@ -3,9 +3,13 @@ package parser_test
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,9 +28,100 @@ func TestParseQuery(t *testing.T) {
 	}
 }
 
+// Ensure the parser can keep comments found in a query.
+func TestParseQuery_KeepComments(t *testing.T) {
+	s := "-- leading\nSELECT a /* inline */ FROM b; SELECT c FROM d -- trailing"
+	p := parser.NewParser(strings.NewReader(s))
+	p.SetKeepComments(true)
+	q, err := p.ParseQuery()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := ast.Comments{
+		{Text: "-- leading", Pos: token.Pos{Line: 0, Char: 0}},
+		{Text: "/* inline */", Pos: token.Pos{Line: 1, Char: 9}},
+		{Text: "-- trailing", Pos: token.Pos{Line: 1, Char: 46}},
+	}
+	if !reflect.DeepEqual(exp, q.Comments) {
+		t.Fatalf("unexpected comments:\n\nexp=%s\n\ngot=%s", mustMarshalJSON(exp), mustMarshalJSON(q.Comments))
+	} else if len(q.Statements) != 2 {
+		t.Fatalf("unexpected statement count: %d", len(q.Statements))
+	}
+
+	// Comments are discarded by default.
+	q, err = parser.ParseQuery(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if q.Comments != nil {
+		t.Fatalf("unexpected comments: %s", mustMarshalJSON(q.Comments))
+	}
+}
+
+// Ensure a point ends at a comment, and that a point ending with its line
+// ends its statement.
+func TestParseQuery_Insert(t *testing.T) {
+	var tests = []struct {
+		s    string
+		stmt string
+		err  string
+	}{
+		{s: "INSERT cpu value=1 -- comment", stmt: `INSERT cpu value=1`},
+		{s: "INSERT cpu value=1 10 -- comment", stmt: `INSERT cpu value=1 10`},
+		{s: "INSERT cpu value=1 /* comment */", stmt: `INSERT cpu value=1`},
+		{s: "INSERT cpu value=1 /* comment */ 10", err: `found 10, expected ; at line 1, char 34`},
+		{s: "INSERT cpu value=1\nSELECT a FROM b", stmt: "INSERT cpu value=1;\nSELECT a FROM b"},
+		{s: "INSERT cpu value=1 10 -- comment\nINSERT mem value=2", stmt: "INSERT cpu value=1 10;\nINSERT mem value=2"},
+		{s: "INSERT cpu value=1; SELECT a FROM b", stmt: "INSERT cpu value=1;\nSELECT a FROM b"},
+		{s: "INSERT cpu value=1 /* comment */\nSELECT a FROM b", err: `found SELECT, expected ; at line 2, char 1`},
+		{s: "SELECT a FROM b\nINSERT cpu value=1", err: `found INSERT, expected ; at line 2, char 1`},
+	}
+
+	for i, tt := range tests {
+		q, err := parser.ParseQuery(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && q.String() != tt.stmt {
+			t.Errorf("%d. %q: query mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, q)
+		}
+	}
+
+	// The comment after a point is kept like any other.
+	p := parser.NewParser(strings.NewReader("INSERT cpu value=1 -- comment\nSELECT a FROM b"))
+	p.SetKeepComments(true)
+	q, err := p.ParseQuery()
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := (ast.Comments{{Text: "-- comment", Pos: token.Pos{Line: 0, Char: 19}}}); !reflect.DeepEqual(exp, q.Comments) {
+		t.Fatalf("unexpected comments: %s", mustMarshalJSON(q.Comments))
+	}
+
+	// ParseNext reads the statement on the next line too.
+	p = parser.NewParser(strings.NewReader("INSERT cpu value=1\nSELECT a FROM b"))
+	q, errs := p.ParseQueryCollect()
+	if errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	} else if len(q.Statements) != 2 {
+		t.Fatalf("unexpected statement count: %d", len(q.Statements))
+	}
+}
+
 func TestParseStatement(t *testing.T) {
 	now := time.Now()
 
+	// The statement named t by the WITH test.
+	cte := &ast.SelectStatement{
+		IsRawQuery: true,
+		Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+		Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+		Condition: &ast.BinaryExpr{
+			Op:  token.EQ,
+			LHS: &ast.VarRef{Val: "host"},
+			RHS: &ast.StringLiteral{Val: "a"},
+		},
+		BoundParams: []string{"host"},
+	}
+
 	var tests = []struct {
 		skip   bool
 		s      string
@@ -277,7 +372,7 @@ func TestParseStatement(t *testing.T) {
 			stmt: &ast.SelectStatement{
 				IsRawQuery: false,
 				Fields: []*ast.Field{
-					{Expr: &ast.Call{Name: "count", Args: []ast.Expr{&ast.Distinct{Val: "field3"}}}},
+					{Expr: &ast.Call{Name: "count", Args: []ast.Expr{&ast.Call{Name: "distinct", Args: []ast.Expr{&ast.VarRef{Val: "field3"}}}}}},
 				},
 				Sources: []ast.Source{&ast.Metric{Name: "metrics"}},
 			},
@@ -287,7 +382,7 @@ func TestParseStatement(t *testing.T) {
 			stmt: &ast.SelectStatement{
 				IsRawQuery: false,
 				Fields: []*ast.Field{
-					{Expr: &ast.Call{Name: "count", Args: []ast.Expr{&ast.Distinct{Val: "field3"}}}},
+					{Expr: &ast.Call{Name: "count", Args: []ast.Expr{&ast.Call{Name: "distinct", Args: []ast.Expr{&ast.VarRef{Val: "field3"}}}}}},
 					{Expr: &ast.Call{Name: "sum", Args: []ast.Expr{&ast.VarRef{Val: "field4"}}}},
 				},
 				Sources: []ast.Source{&ast.Metric{Name: "metrics"}},
@@ -453,6 +548,270 @@ func TestParseStatement(t *testing.T) {
 			},
 		},
 
+		// SELECT * FROM a JOIN b ON a.id = b.id
+		{
+			s: `SELECT * FROM a JOIN b ON a.id = b.id WHERE a.v > 1`,
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.Wildcard{}}},
+				Sources: []ast.Source{&ast.Join{
+					Left:  &ast.Metric{Name: "a"},
+					Right: &ast.Metric{Name: "b"},
+					On: &ast.BinaryExpr{
+						Op:  token.EQ,
+						LHS: &ast.VarRef{Val: "a.id"},
+						RHS: &ast.VarRef{Val: "b.id"},
+					},
+				}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.GT,
+					LHS: &ast.VarRef{Val: "a.v"},
+					RHS: &ast.IntegerLiteral{Val: 1},
+				},
+			},
+		},
+
+		// SHOW TIME TO LIVES
+		{
+			s:    `SHOW TIME TO LIVES`,
+			stmt: &ast.ShowTimeToLivesStatement{},
+		},
+		{
+			s:    `show time to lives on "my db"`,
+			stmt: &ast.ShowTimeToLivesStatement{Database: "my db"},
+		},
+
+		// SELECT ... UNION [ALL] SELECT ...
+		{
+			s: `SELECT a FROM x UNION SELECT a FROM y`,
+			stmt: &ast.UnionStatement{
+				Statements: []*ast.SelectStatement{
+					{
+						IsRawQuery: true,
+						Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "a"}}},
+						Sources:    []ast.Source{&ast.Metric{Name: "x"}},
+					},
+					{
+						IsRawQuery: true,
+						Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "a"}}},
+						Sources:    []ast.Source{&ast.Metric{Name: "y"}},
+					},
+				},
+				All: []bool{false},
+			},
+		},
+		{
+			s: `SELECT a FROM x UNION ALL SELECT * FROM y UNION SELECT b FROM z ORDER BY time DESC LIMIT 1 OFFSET 2`,
+			stmt: &ast.UnionStatement{
+				Statements: []*ast.SelectStatement{
+					{
+						IsRawQuery: true,
+						Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "a"}}},
+						Sources:    []ast.Source{&ast.Metric{Name: "x"}},
+					},
+					{
+						IsRawQuery: true,
+						Fields:     []*ast.Field{{Expr: &ast.Wildcard{}}},
+						Sources:    []ast.Source{&ast.Metric{Name: "y"}},
+					},
+					{
+						IsRawQuery: true,
+						Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "b"}}},
+						Sources:    []ast.Source{&ast.Metric{Name: "z"}},
+					},
+				},
+				All:        []bool{true, false},
+				SortFields: []*ast.SortField{{Name: "time", Ascending: false}},
+				Limit:      1,
+				Offset:     2,
+			},
+		},
+		{
+			s: `SELECT max(a) FROM (SELECT a FROM x UNION ALL SELECT a FROM y LIMIT 10) GROUP BY time(1m)`,
+			stmt: &ast.SelectStatement{
+				Fields: []*ast.Field{{Expr: &ast.Call{Name: "max", Args: []ast.Expr{&ast.VarRef{Val: "a"}}}}},
+				Sources: []ast.Source{&ast.UnionSubQuery{Statement: &ast.UnionStatement{
+					Statements: []*ast.SelectStatement{
+						{
+							IsRawQuery: true,
+							Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "a"}}},
+							Sources:    []ast.Source{&ast.Metric{Name: "x"}},
+						},
+						{
+							IsRawQuery: true,
+							Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "a"}}},
+							Sources:    []ast.Source{&ast.Metric{Name: "y"}},
+						},
+					},
+					All:   []bool{true},
+					Limit: 10,
+				}}},
+				Dimensions: []*ast.Dimension{{Expr: &ast.Call{Name: "time", Args: []ast.Expr{&ast.DurationLiteral{Val: time.Minute}}}}},
+			},
+		},
+
+		// CREATE CONTINUOUS QUERY
+		{
+			s: `CREATE CONTINUOUS QUERY cq ON db RESAMPLE EVERY 10m FOR 1h BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END`,
+			stmt: &ast.CreateContinuousQueryStatement{
+				Name:          "cq",
+				Database:      "db",
+				ResampleEvery: 10 * time.Minute,
+				ResampleFor:   time.Hour,
+				Source: &ast.SelectStatement{
+					Fields:  []*ast.Field{{Expr: &ast.Call{Name: "mean", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}},
+					Target:  &ast.Target{Metric: &ast.Metric{Name: "cpu_1h", IsTarget: true}},
+					Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+					Dimensions: []*ast.Dimension{{Expr: &ast.Call{
+						Name: "time",
+						Args: []ast.Expr{&ast.DurationLiteral{Val: time.Hour}},
+					}}},
+				},
+			},
+		},
+
+		// WITH t AS (SELECT ...) SELECT ... FROM t
+		{
+			s:      `WITH t AS (SELECT value FROM cpu WHERE host = $host) SELECT max(value) FROM t`,
+			params: map[string]interface{}{"host": "a"},
+			stmt: &ast.SelectStatement{
+				CTEs:        []*ast.With{{Name: "t", Statement: cte}},
+				Fields:      []*ast.Field{{Expr: &ast.Call{Name: "max", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}},
+				Sources:     []ast.Source{&ast.CTERef{Name: "t", Statement: cte}},
+				BoundParams: []string{"host"},
+			},
+		},
+
+		// SHOW QUERIES and KILL QUERY
+		{
+			s:    `SHOW QUERIES`,
+			stmt: &ast.ShowQueriesStatement{},
+		},
+		{
+			s:    `KILL QUERY 36`,
+			stmt: &ast.KillQueryStatement{QueryID: 36},
+		},
+		{
+			s:    `kill query 18446744073709551615 on "host:8088"`,
+			stmt: &ast.KillQueryStatement{QueryID: 18446744073709551615, Host: "host:8088"},
+		},
+
+		// CREATE USER, DROP USER and SET PASSWORD
+		{
+			s:    `CREATE USER jdoe WITH PASSWORD 'pw'`,
+			stmt: &ast.CreateUserStatement{Name: "jdoe", Password: "pw"},
+		},
+		{
+			s:    `CREATE USER "j.doe-2" WITH PASSWORD 'it\'s' WITH ALL PRIVILEGES`,
+			stmt: &ast.CreateUserStatement{Name: "j.doe-2", Password: "it's", Admin: true},
+		},
+		{
+			s:    `DROP USER "select"`,
+			stmt: &ast.DropUserStatement{Name: "select"},
+		},
+		{
+			s:    `SET PASSWORD FOR "j doe" = 'new\'pw'`,
+			stmt: &ast.SetPasswordUserStatement{Name: "j doe", Password: "new'pw"},
+		},
+
+		// SHOW GRANTS FOR
+		{
+			s:    `SHOW GRANTS FOR jdoe`,
+			stmt: &ast.ShowGrantsForUserStatement{Name: "jdoe"},
+		},
+		{
+			s:    `show grants for "j.doe"`,
+			stmt: &ast.ShowGrantsForUserStatement{Name: "j.doe"},
+		},
+
+		// CREATE and DROP TIME TO LIVE
+		{
+			s:    `CREATE TIME TO LIVE one_day ON db DURATION 1d`,
+			stmt: &ast.CreateTimeToLiveStatement{Name: "one_day", Database: "db", Duration: 24 * time.Hour},
+		},
+		{
+			s:    `create time to live "forever" on "my db" duration INF shard duration 1w default`,
+			stmt: &ast.CreateTimeToLiveStatement{Name: "forever", Database: "my db", ShardDuration: 7 * 24 * time.Hour, Default: true},
+		},
+		{
+			s:    `CREATE TIME TO LIVE one_hour ON db DURATION 1h DEFAULT`,
+			stmt: &ast.CreateTimeToLiveStatement{Name: "one_hour", Database: "db", Duration: time.Hour, Default: true},
+		},
+		{
+			s:    `DROP TIME TO LIVE "one day" ON db`,
+			stmt: &ast.DropTimeToLiveStatement{Name: "one day", Database: "db"},
+		},
+
+		// INSERT
+		{
+			s: `INSERT cpu,host=server01,region=us-west value=0.64,count=10i,ok=t,msg="it's \"ok\"" 1434055562000000000`,
+			stmt: &ast.InsertStatement{
+				Metric: "cpu",
+				Tags:   []ast.PointTag{{Key: "host", Value: "server01"}, {Key: "region", Value: "us-west"}},
+				Fields: []*ast.PointField{
+					{Key: "value", Value: &ast.NumberLiteral{Val: 0.64}},
+					{Key: "count", Value: &ast.IntegerLiteral{Val: 10}},
+					{Key: "ok", Value: &ast.BooleanLiteral{Val: true}},
+					{Key: "msg", Value: &ast.StringLiteral{Val: `it's "ok"`}},
+				},
+				Timestamp: func() *int64 { ts := int64(1434055562000000000); return &ts }(),
+			},
+		},
+		{
+			s: `INSERT INTO "my db".one_day my\ metric,tag\,key=a\=b\ c value=-1,done=FALSE`,
+			stmt: &ast.InsertStatement{
+				Database:   "my db",
+				TimeToLive: "one_day",
+				Metric:     "my metric",
+				Tags:       []ast.PointTag{{Key: "tag,key", Value: "a=b c"}},
+				Fields: []*ast.PointField{
+					{Key: "value", Value: &ast.NumberLiteral{Val: -1}},
+					{Key: "done", Value: &ast.BooleanLiteral{Val: false}},
+				},
+			},
+		},
+		{
+			s: `insert into db select value=1`,
+			stmt: &ast.InsertStatement{
+				Database: "db",
+				Metric:   "select",
+				Fields:   []*ast.PointField{{Key: "value", Value: &ast.NumberLiteral{Val: 1}}},
+			},
+		},
+
+		// SHOW TAG KEY and FIELD KEY CARDINALITY
+		{
+			s:    `SHOW TAG KEY CARDINALITY`,
+			stmt: &ast.ShowTagKeyCardinalityStatement{},
+		},
+		{
+			s: `SHOW TAG KEY EXACT CARDINALITY ON db FROM cpu, /^mem/ WHERE region = 'west' GROUP BY host LIMIT 10 OFFSET 5`,
+			stmt: &ast.ShowTagKeyCardinalityStatement{CardinalityOptions: ast.CardinalityOptions{
+				Exact:    true,
+				Database: "db",
+				Sources:  ast.Sources{&ast.Metric{Name: "cpu"}, &ast.Metric{Regex: &ast.RegexLiteral{Val: regexp.MustCompile(`^mem`)}}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.EQ,
+					LHS: &ast.VarRef{Val: "region"},
+					RHS: &ast.StringLiteral{Val: "west"},
+				},
+				Dimensions: ast.Dimensions{{Expr: &ast.VarRef{Val: "host"}}},
+				Limit:      10,
+				Offset:     5,
+			}},
+		},
+		{
+			s: `show field key cardinality from db.ttl.cpu group by host, region`,
+			stmt: &ast.ShowFieldKeyCardinalityStatement{CardinalityOptions: ast.CardinalityOptions{
+				Sources:    ast.Sources{&ast.Metric{Database: "db", TimeToLive: "ttl", Name: "cpu"}},
+				Dimensions: ast.Dimensions{{Expr: &ast.VarRef{Val: "host"}}, {Expr: &ast.VarRef{Val: "region"}}},
+			}},
+		},
+		{
+			s:    `SHOW FIELD KEY EXACT CARDINALITY LIMIT 1`,
+			stmt: &ast.ShowFieldKeyCardinalityStatement{CardinalityOptions: ast.CardinalityOptions{Exact: true, Limit: 1}},
+		},
+
 		// SELECT statement with fill
 		{
 			s: fmt.Sprintf(`SELECT mean(value) FROM cpu where time < '%s' GROUP BY time(5m) fill(1)`, now.UTC().Format(time.RFC3339Nano)),
@@ -574,32 +933,3879 @@ func TestParseStatement(t *testing.T) {
 					LHS: &ast.VarRef{Val: "value"},
 					RHS: &ast.IntegerLiteral{Val: 2},
 				},
+				BoundParams: []string{"value"},
 			},
 		},
-	}
 
-	for i, tt := range tests {
-		if tt.skip {
-			continue
-		}
-		p := parser.NewParser(strings.NewReader(tt.s))
-		if tt.params != nil {
-			p.SetParams(tt.params)
-		}
-		stmt, _ := p.ParseStatement()
+		// SELECT statement with a bound regex parameter
+		{
+			s: `SELECT value FROM cpu WHERE host =~ $re`,
+			params: map[string]interface{}{
+				"re": map[string]interface{}{"regex": "^cpu$"},
+			},
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.EQREGEX,
+					LHS: &ast.VarRef{Val: "host"},
+					RHS: &ast.RegexLiteral{Val: regexp.MustCompile("^cpu$")},
+				},
+				BoundParams: []string{"re"},
+			},
+		},
+		{
+			s: `SELECT value FROM cpu WHERE host !~ $re`,
+			params: map[string]interface{}{
+				"re": map[string]interface{}{"regex": "^cpu$"},
+			},
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.NEQREGEX,
+					LHS: &ast.VarRef{Val: "host"},
+					RHS: &ast.RegexLiteral{Val: regexp.MustCompile("^cpu$")},
+				},
+				BoundParams: []string{"re"},
+			},
+		},
+		{
+			s: `SELECT value FROM $re`,
+			params: map[string]interface{}{
+				"re": map[string]interface{}{"regex": "^cpu$"},
+			},
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources: []ast.Source{&ast.Metric{
+					Regex: &ast.RegexLiteral{Val: regexp.MustCompile("^cpu$")}},
+				},
+				BoundParams: []string{"re"},
+			},
+		},
 
-		if !reflect.DeepEqual(tt.stmt, stmt) {
-			t.Logf("\n# %s\nexp=%s\ngot=%s\n", tt.s, mustMarshalJSON(tt.stmt), mustMarshalJSON(stmt))
-			t.Logf("\nSQL exp=%s\nSQL got=%s\n", tt.stmt.String(), stmt.String())
-			t.Errorf("%d. %q\n\nstmt mismatch:\n\nexp=%#v\n\ngot=%#v\n\n", i, tt.s, tt.stmt, stmt)
-		}
-	}
-}
+		// SELECT statement with signed durations
+		{
+			s: `SELECT mean(value) FROM cpu GROUP BY time(10m, -5m)`,
+			stmt: &ast.SelectStatement{
+				Fields:     []*ast.Field{{Expr: &ast.Call{Name: "mean", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Dimensions: []*ast.Dimension{{Expr: &ast.Call{Name: "time", Args: []ast.Expr{&ast.DurationLiteral{Val: 10 * time.Minute}, &ast.DurationLiteral{Val: -5 * time.Minute}}}}},
+			},
+		},
+		{
+			s: `SELECT mean(value) FROM cpu GROUP BY time(10m, +5m)`,
+			stmt: &ast.SelectStatement{
+				Fields:     []*ast.Field{{Expr: &ast.Call{Name: "mean", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Dimensions: []*ast.Dimension{{Expr: &ast.Call{Name: "time", Args: []ast.Expr{&ast.DurationLiteral{Val: 10 * time.Minute}, &ast.DurationLiteral{Val: 5 * time.Minute}}}}},
+			},
+		},
+		{
+			s: `SELECT value FROM cpu WHERE d > -1h`,
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.GT,
+					LHS: &ast.VarRef{Val: "d"},
+					RHS: &ast.DurationLiteral{Val: -time.Hour},
+				},
+			},
+		},
 
-func mustMarshalJSON(v interface{}) []byte {
-	b, err := json.Marshal(v)
-	if err != nil {
-		panic(err)
-	}
-	return b
+		// SELECT statement with a bound identifier, which is unscanned twice
+		// before being read again as a variable reference.
+		{
+			s: `SELECT $f FROM cpu`,
+			params: map[string]interface{}{
+				"f": map[string]interface{}{"identifier": "value"},
+			},
+			stmt: &ast.SelectStatement{
+				IsRawQuery:  true,
+				Fields:      []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:     []ast.Source{&ast.Metric{Name: "cpu"}},
+				BoundParams: []string{"f"},
+			},
+		},
+
+		// SELECT DISTINCT statements
+		{
+			s: `SELECT DISTINCT value FROM cpu`,
+			stmt: &ast.SelectStatement{
+				Fields:  []*ast.Field{{Expr: &ast.Call{Name: "distinct", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}},
+				Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+			},
+		},
+		{
+			s: `SELECT DISTINCT/* c */value AS v, host FROM cpu`,
+			stmt: &ast.SelectStatement{
+				Fields: []*ast.Field{
+					{Expr: &ast.Call{Name: "distinct", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}, Alias: "v"},
+					{Expr: &ast.VarRef{Val: "host"}},
+				},
+				Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+			},
+		},
+		{
+			s: `SELECT count(distinct value), sum(x) FROM cpu WHERE host = 'a'`,
+			stmt: &ast.SelectStatement{
+				Fields: []*ast.Field{
+					{Expr: &ast.Call{Name: "count", Args: []ast.Expr{&ast.Call{Name: "distinct", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}}},
+					{Expr: &ast.Call{Name: "sum", Args: []ast.Expr{&ast.VarRef{Val: "x"}}}},
+				},
+				Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.EQ,
+					LHS: &ast.VarRef{Val: "host"},
+					RHS: &ast.StringLiteral{Val: "a"},
+				},
+			},
+		},
+		{
+			s: `SELECT count(distinct $f) FROM cpu`,
+			params: map[string]interface{}{
+				"f": map[string]interface{}{"identifier": "value"},
+			},
+			stmt: &ast.SelectStatement{
+				Fields:      []*ast.Field{{Expr: &ast.Call{Name: "count", Args: []ast.Expr{&ast.Call{Name: "distinct", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}}}}},
+				Sources:     []ast.Source{&ast.Metric{Name: "cpu"}},
+				BoundParams: []string{"f"},
+			},
+		},
+
+		// System field references
+		{
+			s: `SELECT @timestamp, value FROM cpu WHERE @"row id"::integer > 10 GROUP BY @shard`,
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields: []*ast.Field{
+					{Expr: &ast.VarRef{Val: "timestamp", System: true}},
+					{Expr: &ast.VarRef{Val: "value"}},
+				},
+				Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.GT,
+					LHS: &ast.VarRef{Val: "row id", Type: ast.Integer, System: true},
+					RHS: &ast.IntegerLiteral{Val: 10},
+				},
+				Dimensions: []*ast.Dimension{{Expr: &ast.VarRef{Val: "shard", System: true}}},
+			},
+		},
+
+		// Unsigned bound parameters
+		{
+			s:      `SELECT value FROM cpu WHERE counter > $c`,
+			params: map[string]interface{}{"c": uint64(math.MaxUint64 - 1)},
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.GT,
+					LHS: &ast.VarRef{Val: "counter"},
+					RHS: &ast.UnsignedLiteral{Val: math.MaxUint64 - 1},
+				},
+				BoundParams: []string{"c"},
+			},
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE counter > $c`,
+			params: map[string]interface{}{"c": uint64(math.MaxInt64 + 1)},
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.GT,
+					LHS: &ast.VarRef{Val: "counter"},
+					RHS: &ast.UnsignedLiteral{Val: math.MaxInt64 + 1},
+				},
+				BoundParams: []string{"c"},
+			},
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE counter > $c`,
+			params: map[string]interface{}{"c": uint64(math.MaxInt64)},
+			stmt: &ast.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Condition: &ast.BinaryExpr{
+					Op:  token.GT,
+					LHS: &ast.VarRef{Val: "counter"},
+					RHS: &ast.IntegerLiteral{Val: math.MaxInt64},
+				},
+				BoundParams: []string{"c"},
+			},
+		},
+
+		// SELECT statement with function names that keep their case
+		{
+			s: `SELECT MyUDF(value), MEAN(value) FROM cpu GROUP BY TIME(1m)`,
+			stmt: &ast.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*ast.Field{
+					{Expr: &ast.Call{Name: "MyUDF", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}},
+					{Expr: &ast.Call{Name: "MEAN", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}},
+				},
+				Sources:    []ast.Source{&ast.Metric{Name: "cpu"}},
+				Dimensions: []*ast.Dimension{{Expr: &ast.Call{Name: "TIME", Args: []ast.Expr{&ast.DurationLiteral{Val: time.Minute}}}}},
+			},
+		},
+
+		// SELECT statement with string aliases
+		{
+			s: `SELECT mean(value) AS 'p95 latency', max(value) AS "max, value" FROM cpu`,
+			stmt: &ast.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*ast.Field{
+					{Expr: &ast.Call{Name: "mean", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}, Alias: "p95 latency"},
+					{Expr: &ast.Call{Name: "max", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}, Alias: "max, value"},
+				},
+				Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		if tt.skip {
+			continue
+		}
+		p := parser.NewParser(strings.NewReader(tt.s))
+		if tt.params != nil {
+			p.SetParams(tt.params)
+		}
+		stmt, _ := p.ParseStatement()
+
+		if !reflect.DeepEqual(tt.stmt, stmt) {
+			t.Errorf("%d. %q\n\nstmt mismatch:\n\n%s\n\n", i, tt.s, ast.FormatDiff(ast.Diff(tt.stmt, stmt)))
+		}
+	}
+}
+
+// Ensure '/' is parsed as a regex or a division depending on its position.
+func TestParseStatement_Slash(t *testing.T) {
+	var tests = []struct {
+		s   string
+		exp string
+	}{
+		// Field expressions.
+		{s: `SELECT a / b FROM m`, exp: `SELECT a / b FROM m`},
+		{s: `SELECT a/ b FROM m`, exp: `SELECT a / b FROM m`},
+		{s: `SELECT a /b FROM m`, exp: `SELECT a / b FROM m`},
+		{s: `SELECT a/b FROM m`, exp: `SELECT a / b FROM m`},
+		{s: `SELECT (a)/2 FROM m`, exp: `SELECT (a) / 2 FROM m`},
+		{s: `SELECT /a/ FROM m`, exp: `SELECT /a/ FROM m`},
+
+		// WHERE expressions after a regex operator.
+		{s: `SELECT a FROM m WHERE x =~/re/ AND y = 1/2`, exp: `SELECT a FROM m WHERE x =~ /re/ AND y = 1 / 2`},
+		{s: `SELECT a FROM m WHERE 10/5 = 2`, exp: `SELECT a FROM m WHERE 10 / 5 = 2`},
+		{s: `SELECT a FROM m WHERE value =~ /a/ OR value2 > 1/2`, exp: `SELECT a FROM m WHERE value =~ /a/ OR value2 > 1 / 2`},
+		{s: `SELECT a FROM m WHERE value =~ /a\/b/ AND value2 / 2 > 1`, exp: `SELECT a FROM m WHERE value =~ /a\/b/ AND value2 / 2 > 1`},
+		{s: `SELECT a FROM m WHERE (value !~ /a/) AND b = 4/2`, exp: `SELECT a FROM m WHERE (value !~ /a/) AND b = 4 / 2`},
+		{s: `SELECT a FROM m WHERE a/2 =~ /x/`, exp: `SELECT a FROM m WHERE a / 2 =~ /x/`},
+
+		// FROM clause.
+		{s: `SELECT a FROM /m/`, exp: `SELECT a FROM /m/`},
+		{s: `SELECT a FROM m, /n/`, exp: `SELECT a FROM m, /n/`},
+		{s: `SELECT a FROM m,/n/`, exp: `SELECT a FROM m, /n/`},
+		{s: `SELECT a FROM /m/,/n/`, exp: `SELECT a FROM /m/, /n/`},
+		{s: `SELECT a FROM db../n/`, exp: `SELECT a FROM db../n/`},
+
+		// Call arguments.
+		{s: `SELECT mean(a/2) FROM m`, exp: `SELECT mean(a / 2) FROM m`},
+		{s: `SELECT mean(/a/) FROM m`, exp: `SELECT mean(/a/) FROM m`},
+		{s: `SELECT percentile(a, 2/1) FROM m`, exp: `SELECT percentile(a, 2 / 1) FROM m`},
+		{s: `SELECT f(1,/a/) FROM m`, exp: `SELECT f(1, /a/) FROM m`},
+
+		// GROUP BY clause.
+		{s: `SELECT a FROM m GROUP BY /t/`, exp: `SELECT a FROM m GROUP BY /t/`},
+		{s: `SELECT a FROM m GROUP BY a,/t/`, exp: `SELECT a FROM m GROUP BY a, /t/`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Errorf("%d. %q: unexpected error: %s", i, tt.s, err)
+		} else if stmt.String() != tt.exp {
+			t.Errorf("%d. %q: mismatch:\n  exp=%s\n  got=%s\n", i, tt.s, tt.exp, stmt.String())
+		}
+	}
+}
+
+// Ensure a statement reports everything it depends on, including subqueries.
+func TestSelectStatement_Dependencies(t *testing.T) {
+	s := `SELECT max(value) * $scale, host::tag FROM (
+		SELECT mean(usage::float) AS value, host::tag FROM (
+			SELECT usage::float, host::tag, region FROM db.ttl.cpu, mem WHERE region =~ $re AND time > now() - 1h
+		), cpu WHERE usage::float > $min GROUP BY time(1m), host
+	) WHERE value > $min GROUP BY host`
+
+	p := parser.NewParser(strings.NewReader(s))
+	p.SetParams(map[string]interface{}{
+		"scale": int64(2),
+		"min":   1.5,
+		"re":    map[string]interface{}{"regex": "^us-"},
+	})
+	stmt, err := p.ParseStatement()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	deps := stmt.(*ast.SelectStatement).Dependencies()
+	if exp := []ast.VarRef{
+		{Val: "host"},
+		{Val: "region"},
+		{Val: "usage", Type: ast.Float},
+		{Val: "value"},
+	}; !reflect.DeepEqual(exp, deps.Fields) {
+		t.Errorf("fields mismatch:\n  exp=%v\n  got=%v", exp, deps.Fields)
+	}
+	if exp := []ast.VarRef{{Val: "host", Type: ast.Tag}}; !reflect.DeepEqual(exp, deps.Tags) {
+		t.Errorf("tags mismatch:\n  exp=%v\n  got=%v", exp, deps.Tags)
+	}
+	if exp := "cpu, db.ttl.cpu, mem"; ast.Metrics(deps.Metrics).String() != exp {
+		t.Errorf("metrics mismatch:\n  exp=%s\n  got=%s", exp, ast.Metrics(deps.Metrics))
+	}
+	if exp := []string{"min", "re", "scale"}; !reflect.DeepEqual(exp, deps.Params) {
+		t.Errorf("params mismatch:\n  exp=%v\n  got=%v", exp, deps.Params)
+	}
+
+	// The metrics of a subquery in a condition are read too.
+	stmt, err = parser.ParseStatement(`SELECT v FROM cpu WHERE time > now() - 1h AND v > (SELECT max(v) FROM mem)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps = stmt.(*ast.SelectStatement).Dependencies()
+	if exp := "cpu, mem"; ast.Metrics(deps.Metrics).String() != exp {
+		t.Errorf("metrics mismatch:\n  exp=%s\n  got=%s", exp, ast.Metrics(deps.Metrics))
+	}
+}
+
+// Ensure that the String() output of every query in the round-trip corpus
+// parses back to the same statements and prints the same way again.
+func TestParseQuery_RoundTrip(t *testing.T) {
+	for _, q := range roundTripCorpus(t) {
+		if err := roundTrip(q); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// FuzzParseQuery ensures the parser returns an error rather than panicking on
+// malformed input, and that a parsed query can be used without panicking.
+//
+// Run it with:
+//
+//	go test ./parser -run '^$' -fuzz '^FuzzParseQuery$'
+//
+// Failing inputs are saved in testdata/fuzz/FuzzParseQuery and then run by
+// go test like the seeds.
+func FuzzParseQuery(f *testing.F) {
+	for _, q := range roundTripCorpus(f) {
+		f.Add(q)
+	}
+
+	f.Fuzz(func(t *testing.T, q string) {
+		query, err := parser.ParseQuery(q)
+		if err != nil {
+			return
+		}
+		_ = query.String()
+		ast.WalkFunc(query, func(n ast.Node) {
+			if stmt, ok := n.(*ast.SelectStatement); ok {
+				stmt.Dimensions.Normalize()
+			}
+		})
+	})
+}
+
+func FuzzParseQuery_RoundTrip(f *testing.F) {
+	for _, q := range roundTripCorpus(f) {
+		f.Add(q)
+	}
+
+	f.Fuzz(func(t *testing.T, q string) {
+		if _, err := parser.ParseQuery(q); err != nil {
+			return
+		}
+		if err := roundTrip(q); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// roundTripCorpus returns the queries in testdata/roundtrip.
+// Each non-blank line that does not start with "--" is a query.
+func roundTripCorpus(tb testing.TB) []string {
+	files, err := filepath.Glob(filepath.Join("testdata", "roundtrip", "*.sql"))
+	if err != nil {
+		tb.Fatal(err)
+	} else if len(files) == 0 {
+		tb.Fatal("no round-trip corpus found")
+	}
+
+	var queries []string
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+				queries = append(queries, line)
+			}
+		}
+	}
+	return queries
+}
+
+// roundTrip parses q, prints it and parses the output again.
+// It returns an error if the two parses or the two outputs differ.
+func roundTrip(q string) error {
+	q0, err := parser.ParseQuery(q)
+	if err != nil {
+		return fmt.Errorf("%q: %s", q, err)
+	}
+	s1 := q0.String()
+
+	q1, err := parser.ParseQuery(s1)
+	if err != nil {
+		return fmt.Errorf("%q: cannot parse output %q: %s", q, s1, err)
+	}
+	s2 := q1.String()
+
+	if s1 != s2 {
+		return fmt.Errorf("%q: output mismatch:\n\n%s", q, lineDiff(s1, s2))
+	} else if !reflect.DeepEqual(q0, q1) {
+		return fmt.Errorf("%q: statement mismatch:\n\n%s", q, ast.FormatDiff(ast.Diff(q0, q1)))
+	}
+	return nil
+}
+
+// lineDiff returns the first line that differs between exp and got.
+func lineDiff(exp, got string) string {
+	a, b := strings.Split(exp, "\n"), strings.Split(got, "\n")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return fmt.Sprintf("line %d:\nexp=%s\ngot=%s", i+1, x, y)
+		}
+	}
+	return fmt.Sprintf("exp=%s\ngot=%s", exp, got)
+}
+
+// Ensure the package-level functions can bind parameters.
+func TestParseExpr_WithParams(t *testing.T) {
+	var tests = []struct {
+		s      string
+		params map[string]interface{}
+		expr   ast.Expr
+		err    string
+	}{
+		{
+			s:      `value > $threshold`,
+			params: map[string]interface{}{"threshold": int64(10)},
+			expr: &ast.BinaryExpr{
+				Op:  token.GT,
+				LHS: &ast.VarRef{Val: "value"},
+				RHS: &ast.IntegerLiteral{Val: 10},
+			},
+		},
+		{
+			s:      `$f = $v`,
+			params: map[string]interface{}{"f": map[string]interface{}{"identifier": "host"}, "v": "a"},
+			expr: &ast.BinaryExpr{
+				Op:  token.EQ,
+				LHS: &ast.VarRef{Val: "host"},
+				RHS: &ast.StringLiteral{Val: "a"},
+			},
+		},
+		{s: `value > $threshold`, err: `missing parameter: threshold`},
+
+		// Parameter names
+		{
+			s:      `host = $host`,
+			params: map[string]interface{}{"host": "a"},
+			expr:   &ast.BinaryExpr{Op: token.EQ, LHS: &ast.VarRef{Val: "host"}, RHS: &ast.StringLiteral{Val: "a"}},
+		},
+		{
+			s:      `host = $"my param"`,
+			params: map[string]interface{}{"my param": "a"},
+			expr:   &ast.BinaryExpr{Op: token.EQ, LHS: &ast.VarRef{Val: "host"}, RHS: &ast.StringLiteral{Val: "a"}},
+		},
+		{s: `host = $`, err: `empty bound parameter name, use $name or $"name" at line 1, char 8`},
+		{s: `host = $""`, err: `empty bound parameter name, use $name or $"name" at line 1, char 8`},
+		{s: `host =~ $`, err: `empty bound parameter name, use $name or $"name" at line 1, char 9`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s, parser.WithParams(tt.params))
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s\n\n", i, tt.s, tt.err, err)
+		} else if !reflect.DeepEqual(tt.expr, expr) {
+			t.Errorf("%d. %q\n\nexpr mismatch:\n\n%s\n\n", i, tt.s, ast.FormatDiff(ast.Diff(tt.expr, expr)))
+		}
+	}
+
+	stmt, err := parser.ParseStatement(`SELECT value FROM cpu WHERE value > $x`, parser.WithParams(map[string]interface{}{"x": 1.5}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if got, exp := stmt.String(), `SELECT value FROM cpu WHERE value > 1.500`; got != exp {
+		t.Fatalf("unexpected statement: exp=%s got=%s", exp, got)
+	}
+}
+
+// Ensure SetParams merges parameters across calls.
+func TestParser_SetParams_Merge(t *testing.T) {
+	p := parser.NewParser(strings.NewReader(`a = $a AND b = $b AND c = $c`))
+	p.SetParams(map[string]interface{}{"a": int64(1), "b": int64(2)})
+	p.SetParams(map[string]interface{}{"b": int64(20), "c": int64(30)})
+	p.SetParams(nil)
+
+	expr, err := p.ParseExpr()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if got, exp := expr.String(), `a = 1 AND b = 20 AND c = 30`; got != exp {
+		t.Fatalf("unexpected expression: exp=%s got=%s", exp, got)
+	}
+}
+
+// Ensure keywords can be made non-reserved.
+func TestParser_AllowKeywordAsIdent(t *testing.T) {
+	var tests = []struct {
+		s    string
+		toks []token.Token
+		stmt string
+		err  string
+	}{
+		{
+			s:    `SELECT metric, Field::field FROM cpu WHERE tag::tag = 'a'`,
+			toks: []token.Token{token.METRIC, token.FIELD, token.TAG},
+			stmt: `SELECT "metric", "Field"::field FROM cpu WHERE "tag"::tag = 'a'`,
+		},
+		{
+			s:    `SELECT *::field INTO db..:METRIC FROM cpu`,
+			toks: []token.Token{token.METRIC, token.FIELD},
+			stmt: `SELECT *::field INTO db..:METRIC FROM cpu`,
+		},
+		{
+			s:   `SELECT metric FROM cpu`,
+			err: `found METRIC, expected identifier, string, number, bool at line 1, char 8`,
+		},
+
+		// A quoted identifier never spells a keyword.
+		{
+			s:    `SELECT a::"tag" FROM cpu`,
+			toks: []token.Token{token.TAG},
+			err:  `found "tag", expected float, integer, unsigned, string, boolean, field, tag at line 1, char 11`,
+		},
+		{
+			s:   `SELECT *::"field" FROM cpu`,
+			err: `found "field", expected field, tag at line 1, char 11`,
+		},
+		{
+			s:    `SELECT a INTO db..:"metric" FROM cpu`,
+			toks: []token.Token{token.METRIC},
+			err:  `found "metric", expected METRIC at line 1, char 20`,
+		},
+		{
+			s:   `CREATE USER u "WITH" "PASSWORD" 'x'`,
+			err: `found "WITH", expected WITH at line 1, char 15`,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s, parser.WithKeywordsAsIdents(tt.toks...))
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s\n\n", i, tt.s, tt.err, err)
+		} else if err == nil && stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: statement mismatch:\n  exp=%s\n  got=%s\n\n", i, tt.s, tt.stmt, stmt)
+		}
+	}
+}
+
+// Ensure the words of statements added after SELECT are not reserved, so
+// that the identifiers of existing queries still parse.
+func TestParseStatement_ContextualWords(t *testing.T) {
+	var tests = []struct {
+		s    string
+		stmt string
+	}{
+		{s: `SELECT on, join FROM m WHERE join = 'a'`, stmt: `SELECT on, join FROM m WHERE join = 'a'`},
+		{s: `SELECT v FROM on JOIN join ON on = join`, stmt: `SELECT v FROM on JOIN join ON on = join`},
+		{s: `SELECT show FROM show WHERE show = 'a' GROUP BY show`, stmt: `SELECT show FROM show WHERE show = 'a' GROUP BY show`},
+		{s: `SHOW TIME TO LIVES ON show`, stmt: `SHOW TIME TO LIVES ON show`},
+		{s: `SELECT union FROM union WHERE union = 'a' UNION ALL SELECT union FROM m`, stmt: `SELECT "union" FROM "union" WHERE "union" = 'a' UNION ALL SELECT "union" FROM m`},
+		{s: `SELECT a FROM x, "union" GROUP BY a, "union"`, stmt: `SELECT a FROM x, "union" GROUP BY a, "union"`},
+		{s: `SELECT end, every, query FROM m`, stmt: `SELECT end, every, query FROM m`},
+		{s: `SELECT create, continuous, resample, for FROM m`, stmt: `SELECT create, continuous, resample, for FROM m`},
+		{
+			s:    `CREATE CONTINUOUS QUERY query ON for RESAMPLE EVERY 1h BEGIN SELECT mean(end) INTO every FROM end GROUP BY time(1h) END`,
+			stmt: `CREATE CONTINUOUS QUERY query ON for RESAMPLE EVERY 1h BEGIN SELECT mean(end) INTO every FROM end GROUP BY time(1h) END`,
+		},
+		{s: `SELECT with FROM with WHERE with = 'a'`, stmt: `SELECT with FROM with WHERE with = 'a'`},
+		{s: `WITH with AS (SELECT v FROM cpu) SELECT v FROM with`, stmt: `WITH with AS (SELECT v FROM cpu) SELECT v FROM with`},
+		{s: `CREATE USER with WITH PASSWORD 'pw' WITH ALL PRIVILEGES`, stmt: `CREATE USER with WITH PASSWORD 'pw' WITH ALL PRIVILEGES`},
+		{s: `SELECT user FROM m`, stmt: `SELECT user FROM m`},
+		{s: `SELECT drop, password, privileges, set FROM user WHERE set = 'a'`, stmt: `SELECT drop, password, privileges, set FROM user WHERE set = 'a'`},
+		{s: `CREATE USER user WITH PASSWORD 'pw'`, stmt: `CREATE USER user WITH PASSWORD 'pw'`},
+		{s: `SET PASSWORD FOR password = 'pw'`, stmt: `SET PASSWORD FOR password = 'pw'`},
+		{s: `DROP USER drop`, stmt: `DROP USER drop`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Errorf("%d. %q: unexpected error: %s", i, tt.s, err)
+			continue
+		} else if stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: statement mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, stmt)
+		}
+		if other, err := parser.ParseStatement(stmt.String()); err != nil {
+			t.Errorf("%d. %q: cannot parse the statement again: %s", i, tt.s, err)
+		} else if other.String() != stmt.String() {
+			t.Errorf("%d. %q: statement changed when parsed again: %s", i, tt.s, other)
+		}
+	}
+}
+
+// Ensure Go values are bound to the expected parameter values.
+func TestBindValue(t *testing.T) {
+	var tests = []struct {
+		v   interface{}
+		exp parser.Value
+	}{
+		{v: 1, exp: parser.IntegerValue(1)},
+		{v: int32(-2), exp: parser.IntegerValue(-2)},
+		{v: int64(3), exp: parser.IntegerValue(3)},
+		{v: uint(4), exp: parser.UnsignedValue(4)},
+		{v: uint64(math.MaxUint64), exp: parser.UnsignedValue(math.MaxUint64)},
+		{v: json.Number("9223372036854775808"), exp: parser.UnsignedValue(math.MaxInt64 + 1)},
+		{v: map[string]interface{}{"unsigned": json.Number("18446744073709551615")}, exp: parser.UnsignedValue(math.MaxUint64)},
+		{v: map[string]interface{}{"unsigned": float64(10)}, exp: parser.UnsignedValue(10)},
+		{v: map[string]interface{}{"unsigned": int64(-1)}, exp: parser.ErrorValue("unsigned literal must be an unsigned integer value")},
+		{v: float32(1.5), exp: parser.NumberValue(1.5)},
+		{v: json.Number("10"), exp: parser.IntegerValue(10)},
+		{v: map[string]interface{}{"int": float64(10)}, exp: parser.IntegerValue(10)},
+		{v: map[string]interface{}{"int": 10.5}, exp: parser.ErrorValue("integer literal must be an integer value")},
+		{v: map[string]interface{}{"integer": json.Number("10")}, exp: parser.IntegerValue(10)},
+		{v: map[string]interface{}{"duration": float64(time.Second)}, exp: parser.DurationValue("1s")},
+		{v: []byte("a"), exp: parser.ErrorValue("unable to bind parameter with type []uint8")},
+		{v: []interface{}{"a", json.Number("1"), map[string]interface{}{"regex": "^b"}}, exp: parser.ListValue{parser.StringValue("a"), parser.IntegerValue(1), parser.RegexValue("^b")}},
+		{v: []interface{}{"a", []interface{}{"b"}}, exp: parser.ErrorValue("bound list parameter value cannot contain a list")},
+		{v: []interface{}{"a", []byte("b")}, exp: parser.ErrorValue("unable to bind parameter with type []uint8")},
+	}
+
+	for i, tt := range tests {
+		if got := parser.BindValue(tt.v); !reflect.DeepEqual(tt.exp, got) {
+			t.Errorf("%d. %#v: value mismatch: exp=%#v got=%#v", i, tt.v, tt.exp, got)
+		}
+	}
+}
+
+// Ensure SetParams reports every parameter that cannot be bound.
+func TestParser_SetParams_Errors(t *testing.T) {
+	params := map[string]interface{}{
+		"ok":       int64(1),
+		"bytes":    []byte("a"),
+		"my param": struct{}{},
+		"":         "a",
+	}
+
+	p := parser.NewParser(strings.NewReader(`SELECT value FROM cpu WHERE value > $ok AND host = $bytes`))
+	err := p.SetParams(params)
+	if exp := `cannot bind parameters: $"": empty bound parameter name, use $name or $"name"; $"my param": unable to bind parameter with type struct {}; $bytes: unable to bind parameter with type []uint8`; errstring(err) != exp {
+		t.Fatalf("unexpected error:\n  exp=%s\n  got=%s", exp, err)
+	}
+
+	// The parameters that cannot be bound are still reported when used.
+	if _, err := p.ParseStatement(); errstring(err) != `unable to bind parameter with type []uint8` {
+		t.Fatalf("unexpected parse error: %s", err)
+	}
+
+	// The package-level functions stop before parsing.
+	if _, err := parser.ParseStatement(`SELECT value FROM cpu`, parser.WithParams(params)); errstring(err) == "" {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the parser collects the errors of every bad statement in a query.
+func TestParser_ParseQueryCollect(t *testing.T) {
+	var tests = []struct {
+		s     string
+		stmts []string
+		errs  []string
+	}{
+		{
+			s:     `SELECT FROM cpu; SELECT value FROM cpu WHERE; SELECT value FROM mem`,
+			stmts: []string{`SELECT value FROM mem`},
+			errs: []string{
+				`found FROM, expected identifier, string, number, bool at line 1, char 8`,
+				`found ;, expected identifier, string, number, bool at line 1, char 45`,
+			},
+		},
+		{
+			s:     `SELECT a FROM b c; SELECT d FROM e; SELECT`,
+			stmts: []string{`SELECT d FROM e`},
+			errs: []string{
+				`found c, expected ; at line 1, char 17`,
+				`found EOF, expected identifier, string, number, bool at line 1, char 43`,
+			},
+		},
+		{
+			s:     `SELECT a FROM b; SELECT c FROM d`,
+			stmts: []string{`SELECT a FROM b`, `SELECT c FROM d`},
+		},
+		{
+			s:     `SELECT a FROM b c d SELECT e FROM f; SELECT g FROM (SELECT h FROM i j); SELECT k FROM l`,
+			stmts: []string{`SELECT e FROM f`, `SELECT k FROM l`},
+			errs: []string{
+				`found c, expected ; at line 1, char 17`,
+				`found j, expected ) at line 1, char 69`,
+			},
+		},
+		{
+			s:     `SELECT FROM FROM ; ; SELECT a FROM b`,
+			stmts: []string{`SELECT a FROM b`},
+			errs:  []string{`found FROM, expected identifier, string, number, bool at line 1, char 8`},
+		},
+		{
+			s:     `SELECT a FROM b WHERE (`,
+			stmts: nil,
+			errs:  []string{`found EOF, expected identifier, string, number, bool at line 1, char 24`},
+		},
+		{
+			s:     `CREATE USER 1 WITH PASSWORD 'x'; SELECT a FROM b`,
+			stmts: []string{`SELECT a FROM b`},
+			errs:  []string{`found 1, expected identifier at line 1, char 13`},
+		},
+		{
+			s:     `SELECT a FROM b c WITH x SHOW; DROP USER u`,
+			stmts: []string{`DROP USER u`},
+			errs:  []string{`found c, expected ; at line 1, char 17`},
+		},
+		{
+			s:     `SELECT FROM x UNION SELECT a FROM y; SELECT b FROM z`,
+			stmts: []string{`SELECT b FROM z`},
+			errs:  []string{`found FROM, expected identifier, string, number, bool at line 1, char 8`},
+		},
+		{
+			s:     `SELECT FROM x UNION ALL SELECT a FROM y; SELECT b FROM z`,
+			stmts: []string{`SELECT b FROM z`},
+			errs:  []string{`found FROM, expected identifier, string, number, bool at line 1, char 8`},
+		},
+	}
+
+	for i, tt := range tests {
+		q, errs := parser.NewParser(strings.NewReader(tt.s)).ParseQueryCollect()
+		var stmts, errstrs []string
+		for _, stmt := range q.Statements {
+			stmts = append(stmts, stmt.String())
+		}
+		for _, err := range errs {
+			errstrs = append(errstrs, err.Error())
+		}
+		if !reflect.DeepEqual(tt.stmts, stmts) {
+			t.Errorf("%d. %q: statements mismatch:\n  exp=%q\n  got=%q", i, tt.s, tt.stmts, stmts)
+		} else if !reflect.DeepEqual(tt.errs, errstrs) {
+			t.Errorf("%d. %q: errors mismatch:\n  exp=%q\n  got=%q", i, tt.s, tt.errs, errstrs)
+		}
+	}
+}
+
+// Ensure the parser enforces each rule of a policy only if it is set.
+func TestParser_Policy(t *testing.T) {
+	var tests = []struct {
+		s      string
+		policy parser.Policy
+		err    string
+		name   string
+	}{
+		// The default policy enforces nothing.
+		{s: `SELECT * FROM (SELECT * FROM (SELECT * FROM /cpu.*/)) GROUP BY *`, policy: parser.DefaultPolicy},
+
+		{s: `SELECT value FROM cpu WHERE time > now() - 1h`, policy: parser.Policy{MaxTimeRange: time.Hour}},
+		{s: `SELECT value FROM cpu WHERE time >= '2000-01-01T00:00:00Z' AND time < '2000-01-01T01:00:00Z'`, policy: parser.Policy{MaxTimeRange: time.Hour}},
+		{s: `SELECT mean(value) FROM (SELECT value FROM cpu WHERE time > now() - 10m)`, policy: parser.Policy{MaxTimeRange: time.Hour}},
+		{s: `SELECT v FROM cpu WHERE time > now() - 1h AND v > (SELECT max(v) FROM mem WHERE time > now() - 1h)`, policy: parser.Policy{MaxTimeRange: time.Hour}},
+		{
+			s:      `SELECT v FROM cpu WHERE time > now() - 1h AND v > (SELECT max(v) FROM mem)`,
+			policy: parser.Policy{MaxTimeRange: 24 * time.Hour},
+			err:    `policy violation: time_range: time must be bounded to at most 1d at line 1, char 51`,
+			name:   parser.PolicyTimeRange,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE host = 'a' OR time > now() - 1h`,
+			policy: parser.Policy{MaxTimeRange: time.Hour},
+			err:    `policy violation: time_range: time must be bounded to at most 1h at line 1, char 1`,
+			name:   parser.PolicyTimeRange,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE '2000-01-01T00:00:00Z' <= time AND time < '2000-01-02T00:00:00Z'`,
+			policy: parser.Policy{MaxTimeRange: time.Hour},
+			err:    `policy violation: time_range: time range of 1d exceeds 1h at line 1, char 1`,
+			name:   parser.PolicyTimeRange,
+		},
+
+		{s: `SELECT value FROM cpu LIMIT 10`, policy: parser.Policy{RequireRawLimit: true}},
+		{s: `SELECT mean(value) FROM cpu`, policy: parser.Policy{RequireRawLimit: true}},
+		{
+			s:      `SELECT value FROM cpu`,
+			policy: parser.Policy{RequireRawLimit: true},
+			err:    `policy violation: raw_limit: raw queries must have a LIMIT at line 1, char 1`,
+			name:   parser.PolicyRawLimit,
+		},
+		{s: `SELECT value FROM cpu UNION SELECT value FROM mem LIMIT 10`, policy: parser.Policy{RequireRawLimit: true}},
+		{
+			s:      `SELECT mean(value) FROM cpu UNION SELECT value FROM mem`,
+			policy: parser.Policy{RequireRawLimit: true},
+			err:    `policy violation: raw_limit: raw queries must have a LIMIT at line 1, char 35`,
+			name:   parser.PolicyRawLimit,
+		},
+
+		{s: `SELECT mean(value) FROM cpu GROUP BY host`, policy: parser.Policy{DisallowGroupByWildcard: true}},
+		{
+			s:      `SELECT mean(value) FROM cpu GROUP BY time(1m), *`,
+			policy: parser.Policy{DisallowGroupByWildcard: true},
+			err:    `policy violation: group_by_wildcard: GROUP BY * is not allowed at line 1, char 48`,
+			name:   parser.PolicyGroupByWildcard,
+		},
+
+		{s: `WITH t AS (SELECT v FROM cpu) SELECT v FROM t`, policy: parser.Policy{DisallowCTEShadowing: true}},
+		{s: `WITH cpu AS (SELECT v FROM cpu) SELECT max(v) FROM cpu`},
+		{
+			s:      `WITH cpu AS (SELECT v FROM cpu) SELECT max(v) FROM cpu`,
+			policy: parser.Policy{DisallowCTEShadowing: true},
+			err:    `policy violation: cte_shadowing: WITH name cpu shadows a metric at line 1, char 6`,
+			name:   parser.PolicyCTEShadowing,
+		},
+		{
+			s:      `WITH a AS (SELECT v FROM b), b AS (SELECT v FROM a) SELECT v FROM b`,
+			policy: parser.Policy{DisallowCTEShadowing: true},
+			err:    `policy violation: cte_shadowing: WITH name b shadows a metric at line 1, char 30`,
+			name:   parser.PolicyCTEShadowing,
+		},
+		{s: `WITH t AS (SELECT v FROM cpu) SELECT v FROM t, db.rp.t`, policy: parser.Policy{DisallowCTEShadowing: true}},
+		{s: `WITH cpu AS (SELECT v FROM db.rp.cpu) SELECT max(v) FROM cpu`, policy: parser.Policy{DisallowCTEShadowing: true}},
+
+		{s: `SELECT * FROM (SELECT * FROM cpu)`, policy: parser.Policy{MaxSubqueryDepth: 1}},
+		{
+			s:      `SELECT * FROM (SELECT * FROM (SELECT * FROM cpu))`,
+			policy: parser.Policy{MaxSubqueryDepth: 1},
+			err:    `policy violation: subquery_depth: subqueries are nested deeper than 1 at line 1, char 30`,
+			name:   parser.PolicySubqueryDepth,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s, parser.WithPolicy(tt.policy))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%d. %q: unexpected error: %s", i, tt.s, err)
+			} else if stmt == nil {
+				t.Errorf("%d. %q: expected statement", i, tt.s)
+			}
+			continue
+		}
+
+		violations, ok := err.(parser.Violations)
+		if !ok {
+			t.Errorf("%d. %q: expected violations, got %#v", i, tt.s, err)
+		} else if err.Error() != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if violations[0].Policy != tt.name {
+			t.Errorf("%d. %q: policy mismatch: exp=%s got=%s", i, tt.s, tt.name, violations[0].Policy)
+		}
+	}
+}
+
+// Ensure a name defined by WITH that shadows a metric is a warning unless the
+// policy disallows it.
+func TestParser_Warnings(t *testing.T) {
+	p := parser.NewParser(strings.NewReader(`WITH cpu AS (SELECT v FROM cpu) SELECT max(v) FROM cpu; WITH t AS (SELECT v FROM db.rp.t) SELECT v FROM t`))
+	if _, err := p.ParseNext(); err != nil {
+		t.Fatal(err)
+	} else if exp := `policy violation: cte_shadowing: WITH name cpu shadows a metric at line 1, char 6`; errstring(p.Warnings()) != exp {
+		t.Fatalf("unexpected warnings: %v", p.Warnings())
+	}
+
+	// The warnings are those of the last statement parsed.
+	if _, err := p.ParseNext(); err != nil {
+		t.Fatal(err)
+	} else if warnings := p.Warnings(); warnings != nil {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+}
+
+// Ensure segmented identifiers are parsed in every context they are used in.
+func TestParser_ParseSegmentedIdents(t *testing.T) {
+	var tests = []struct {
+		s   string
+		out string
+		err string
+	}{
+		{s: `SELECT v FROM "db"."ttl"."cpu"`, out: `SELECT v FROM db.ttl.cpu`},
+		{s: `SELECT v FROM ttl.cpu`, out: `SELECT v FROM ttl.cpu`},
+		{s: `SELECT v FROM db..cpu`, out: `SELECT v FROM db..cpu`},
+		{s: `SELECT v FROM ttl. /* c */ cpu`, out: `SELECT v FROM ttl.cpu`},
+		{s: `SELECT v FROM db.ttl./cpu.*/`, out: `SELECT v FROM db.ttl./cpu.*/`},
+		{s: `SELECT v FROM ttl./cpu.*/`, out: `SELECT v FROM ttl./cpu.*/`},
+		{s: `SELECT v FROM db../cpu.*/`, out: `SELECT v FROM db../cpu.*/`},
+		{s: `SELECT v INTO db.ttl.:METRIC FROM cpu`, out: `SELECT v INTO db.ttl.:METRIC FROM cpu`},
+		{s: `SELECT v INTO db..:METRIC FROM cpu`, out: `SELECT v INTO db..:METRIC FROM cpu`},
+		{s: `SELECT "m"."v"::float FROM cpu`, out: `SELECT "m.v"::float FROM cpu`},
+		{s: `SELECT v FROM a.b.c.d`, err: `too many segments in "a"."b"."c".d at line 1, char 1`},
+		{s: `SELECT v FROM a...d`, err: `too many segments in "a"...d at line 1, char 1`},
+		{s: `SELECT v FROM db.-`, err: `found -, expected identifier at line 1, char 18`},
+		{s: `SELECT v FROM db. 5`, err: `found 5, expected identifier at line 1, char 19`},
+		{s: `SELECT v FROM db.`, err: `found EOF, expected identifier at line 1, char 18`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, errstring(err))
+		} else if err == nil && stmt.String() != tt.out {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.out, stmt.String())
+		}
+	}
+}
+
+// Ensure a regex cache returns the compiled regex of the same pattern and
+// drops the least recently used pattern when it is full.
+func TestParser_RegexCache(t *testing.T) {
+	cache := parser.NewRegexCache(2)
+	parse := func(s string) *ast.SelectStatement {
+		t.Helper()
+		stmt, err := parser.ParseStatement(s, parser.WithRegexCache(cache))
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		return stmt.(*ast.SelectStatement)
+	}
+
+	a := parse(`SELECT value FROM /cpu.*/ WHERE host =~ /^a$/`)
+	b := parse(`SELECT value FROM /cpu.*/ WHERE host =~ /^a$/`)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("statements mismatch:\n\n%s", ast.FormatDiff(ast.Diff(a, b)))
+	}
+	reA := a.Sources[0].(*ast.Metric).Regex.Val
+	if reB := b.Sources[0].(*ast.Metric).Regex.Val; reA != reB {
+		t.Fatal("expected the regex to be compiled once")
+	} else if n := cache.Len(); n != 2 {
+		t.Fatalf("unexpected cache length: %d", n)
+	}
+
+	// Copies share the compiled regex too.
+	if re := a.Sources[0].(*ast.Metric).Clone().Regex.Val; re != reA {
+		t.Fatal("expected the clone to share the regex")
+	}
+	if other, err := a.Substitute(nil); err != nil {
+		t.Fatal(err)
+	} else if re := other.Sources[0].(*ast.Metric).Regex.Val; re != reA {
+		t.Fatal("expected the substituted copy to share the regex")
+	}
+
+	// A pattern that does not compile is reported and not cached.
+	if _, err := parser.ParseStatement(`SELECT value FROM /(/`, parser.WithRegexCache(cache)); err == nil {
+		t.Fatal("expected error")
+	} else if n := cache.Len(); n != 2 {
+		t.Fatalf("unexpected cache length: %d", n)
+	}
+
+	// "^a$" was used last, so adding "mem" drops "cpu.*".
+	parse(`SELECT value FROM /mem/`)
+	c := parse(`SELECT value FROM /cpu.*/`)
+	if reC := c.Sources[0].(*ast.Metric).Regex.Val; reC == reA {
+		t.Fatal("expected the regex to be compiled again")
+	} else if reC.String() != reA.String() {
+		t.Fatalf("regex mismatch: exp=%s got=%s", reA, reC)
+	} else if n := cache.Len(); n != 2 {
+		t.Fatalf("unexpected cache length: %d", n)
+	}
+}
+
+// Ensure parsers used concurrently can share a regex cache, and match with
+// the regexes they share. Run with -race.
+func TestParser_RegexCache_Concurrent(t *testing.T) {
+	cache := parser.NewRegexCache(4)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s := fmt.Sprintf(`SELECT value FROM cpu WHERE host =~ /^prod-%d.*/ AND tenant = 't%d'`, j%6, i)
+				stmt, err := parser.ParseStatement(s, parser.WithRegexCache(cache))
+				if err != nil {
+					errs <- err
+					return
+				}
+				re := stmt.(*ast.SelectStatement).Condition.(*ast.BinaryExpr).LHS.(*ast.BinaryExpr).RHS.(*ast.RegexLiteral).Val
+				if host := fmt.Sprintf("prod-%d-a", j%6); !re.MatchString(host) {
+					errs <- fmt.Errorf("%s does not match %s", re, host)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := cache.Len(); n != 4 {
+		t.Fatalf("unexpected cache length: %d", n)
+	}
+}
+
+// Ensure conditions are simplified without modifying them.
+func TestSimplifyCondition(t *testing.T) {
+	var tests = []struct {
+		s             string
+		out           string
+		detect        string
+		contradiction bool
+	}{
+		{s: `true AND host = 'a'`, out: `host = 'a'`},
+		{s: `host = 'a' AND true`, out: `host = 'a'`},
+		{s: `host = 'a' OR false`, out: `host = 'a'`},
+		{s: `host = 'a' AND false`, out: `false`},
+		{s: `host = 'a' OR (true)`, out: `true`},
+		{s: `true AND true`, out: `true`},
+		{s: `false OR false`, out: `false`},
+		{s: `host = 'a' AND host = 'a'`, out: `host = 'a'`},
+		{s: `host = 'a' AND (region = 'b' AND host = 'a')`, out: `host = 'a' AND region = 'b'`},
+		{s: `((host = 'a'))`, out: `host = 'a'`},
+		{s: `(host = 'a') AND ((region = 'b'))`, out: `host = 'a' AND region = 'b'`},
+		{s: `host = 'a' AND (region = 'b' OR region = 'c')`, out: `host = 'a' AND (region = 'b' OR region = 'c')`},
+		{s: `(host = 'a' AND true) OR region = 'c'`, out: `host = 'a' OR region = 'c'`},
+		{s: `(a OR b) AND true`, out: `a OR b`},
+		{s: `((a AND b) OR false) AND c`, out: `a AND b AND c`},
+		{s: `(host = 'a' OR false) AND (region = 'b' OR region = 'b')`, out: `host = 'a' AND region = 'b'`},
+		{s: `(a + b) * 2 > 1`, out: `(a + b) * 2 > 1`},
+		{
+			s:             `host = 'a' AND host = 'b'`,
+			out:           `host = 'a' AND host = 'b'`,
+			detect:        `false`,
+			contradiction: true,
+		},
+		{
+			s:             `region = 'x' OR ('a' = host AND value > 1 AND host = 'b')`,
+			out:           `region = 'x' OR 'a' = host AND value > 1 AND host = 'b'`,
+			detect:        `region = 'x'`,
+			contradiction: true,
+		},
+		{s: `host = 'a' OR host = 'b'`, out: `host = 'a' OR host = 'b'`},
+		{s: `host = 'a' AND host::tag = 'b'`, out: `host = 'a' AND host::tag = 'b'`},
+		{s: `value = 1 AND value = 1.0`, out: `value = 1 AND value = 1.000`},
+		{s: `time = '2000-01-01' AND time = '2000-01-01T00:00:00Z'`, out: `time = '2000-01-01' AND time = '2000-01-01T00:00:00Z'`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		before := mustMarshalIndentJSON(expr)
+
+		if out := ast.SimplifyCondition(expr).String(); out != tt.out {
+			t.Errorf("%d. %q: SimplifyCondition mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.out, out)
+		}
+
+		detect := tt.detect
+		if detect == "" {
+			detect = tt.out
+		}
+		if out, c := ast.SimplifyConditionDetect(expr); out.String() != detect || c != tt.contradiction {
+			t.Errorf("%d. %q: SimplifyConditionDetect mismatch:\n  exp=%s, %v\n  got=%s, %v", i, tt.s, detect, tt.contradiction, out, c)
+		}
+
+		if after := mustMarshalIndentJSON(expr); after != before {
+			t.Errorf("%d. %q: input modified:\n  exp=%s\n  got=%s", i, tt.s, before, after)
+		}
+	}
+}
+
+// Ensure lazy regexes are compiled on first use, and invalid ones reported then.
+func TestParser_LazyRegex(t *testing.T) {
+	s := `SELECT value FROM /cpu.*/ WHERE host =~ /(/`
+	if _, err := parser.ParseStatement(s); err == nil {
+		t.Fatal("expected error")
+	}
+
+	stmt, err := parser.ParseStatement(s, parser.WithLazyRegex())
+	if err != nil {
+		t.Fatal(err)
+	} else if out := stmt.String(); out != s {
+		t.Fatalf("output mismatch:\n  exp=%s\n  got=%s", s, out)
+	}
+	sel := stmt.(*ast.SelectStatement)
+
+	source := sel.Sources[0].(*ast.Metric)
+	if source.Regex.Val != nil || source.Regex.Pattern != "cpu.*" {
+		t.Fatalf("expected a lazy regex: %#v", source.Regex)
+	}
+	clone := source.Clone()
+	if re, err := source.Regex.Regexp(); err != nil {
+		t.Fatal(err)
+	} else if !re.MatchString("cpu0") || source.Regex.Val != re {
+		t.Fatalf("unexpected regex: %v", re)
+	}
+	if clone.Regex.Val != nil || clone.Regex.Pattern != "cpu.*" {
+		t.Fatalf("expected the clone to stay lazy: %#v", clone.Regex)
+	}
+
+	cond := sel.Condition.(*ast.BinaryExpr).RHS.(*ast.RegexLiteral)
+	for i := 0; i < 2; i++ {
+		if _, err := cond.Regexp(); errstring(err) != "error parsing regexp: missing closing ): `(`" {
+			t.Fatalf("%d. unexpected error: %v", i, err)
+		}
+	}
+}
+
+// Ensure the size and depth of expressions are measured.
+func TestNodeCount_Depth(t *testing.T) {
+	var tests = []struct {
+		s     string
+		count int
+		depth int
+	}{
+		{s: `a`, count: 1, depth: 1},
+		{s: `a + 1`, count: 3, depth: 2},
+		{s: `(a + 1) * 2`, count: 6, depth: 4},
+		{s: `a = 1 OR b = 2 OR c = 3`, count: 11, depth: 4},
+		{s: `top(a, 2) - min(b)`, count: 6, depth: 3},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %s: %s", i, tt.s, err)
+		}
+		if count := ast.NodeCount(expr); count != tt.count {
+			t.Errorf("%d. %s: count mismatch: exp=%d got=%d", i, tt.s, tt.count, count)
+		}
+		if depth := ast.Depth(expr); depth != tt.depth {
+			t.Errorf("%d. %s: depth mismatch: exp=%d got=%d", i, tt.s, tt.depth, depth)
+		}
+	}
+
+	if count, depth := ast.NodeCount(nil), ast.Depth((ast.Expr)(nil)); count != 0 || depth != 0 {
+		t.Errorf("nil: unexpected count %d and depth %d", count, depth)
+	}
+}
+
+// Ensure the size and depth of statements include their subqueries.
+func TestNodeCount_Depth_Statement(t *testing.T) {
+	var tests = []struct {
+		s     string
+		count int
+		depth int
+	}{
+		{s: `SELECT value FROM cpu`, count: 8, depth: 4},
+		{s: `SELECT mean(value) FROM cpu WHERE host = 'a' GROUP BY time(1m)`, count: 15, depth: 5},
+		{s: `SELECT max(mean) FROM (SELECT mean(value) FROM (SELECT value FROM cpu WHERE host = 'a'))`, count: 29, depth: 10},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %s: %s", i, tt.s, err)
+		}
+		if count := ast.NodeCount(stmt); count != tt.count {
+			t.Errorf("%d. %s: count mismatch: exp=%d got=%d", i, tt.s, tt.count, count)
+		}
+		if depth := ast.Depth(stmt); depth != tt.depth {
+			t.Errorf("%d. %s: depth mismatch: exp=%d got=%d", i, tt.s, tt.depth, depth)
+		}
+	}
+}
+
+// Ensure walking a partially populated statement skips nil nodes.
+func TestWalk_Nil(t *testing.T) {
+	for i, node := range []ast.Node{
+		(ast.Expr)(nil),
+		(*ast.BinaryExpr)(nil),
+		(*ast.Target)(nil),
+		&ast.SelectStatement{},
+		&ast.SelectStatement{
+			Fields:     ast.Fields{nil, {Expr: nil}},
+			Target:     &ast.Target{},
+			Dimensions: ast.Dimensions{nil},
+			Sources:    ast.Sources{nil, (*ast.SubQuery)(nil), &ast.SubQuery{}},
+			Condition:  &ast.BinaryExpr{Op: token.AND, LHS: (*ast.ParenExpr)(nil)},
+			SortFields: ast.SortFields{nil},
+		},
+		&ast.Query{Statements: ast.Statements{nil, (*ast.SelectStatement)(nil)}},
+		&ast.Call{Name: "f", Args: []ast.Expr{nil, (*ast.VarRef)(nil)}},
+	} {
+		ast.WalkFunc(node, func(n ast.Node) {
+			if n == nil || reflect.ValueOf(n).Kind() == reflect.Ptr && reflect.ValueOf(n).IsNil() {
+				t.Errorf("%d. visited a nil node: %#v", i, n)
+			}
+		})
+		_, _ = ast.NodeCount(node), ast.Depth(node)
+	}
+}
+
+// Ensure a query with any number of statements is printed as a query that
+// parses back to the same statements.
+func TestQuery_String_RoundTrip(t *testing.T) {
+	for i, s := range []string{
+		``,
+		`;`,
+		`SELECT value FROM cpu`,
+		`SELECT value FROM cpu;`,
+		"SELECT value FROM cpu; SELECT mean(value) FROM mem GROUP BY time(1m);\n;SELECT * FROM /disk.*/ WHERE host = 'a'",
+	} {
+		q, err := parser.ParseQuery(s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, s, err)
+		}
+
+		out := q.String()
+		other, err := parser.ParseQuery(out)
+		if err != nil {
+			t.Fatalf("%d. %q: cannot parse %q: %s", i, s, out, err)
+		} else if !reflect.DeepEqual(q, other) {
+			t.Errorf("%d. %q: %q parsed as a different query:\n\n%s", i, s, out, ast.FormatDiff(ast.Diff(q, other)))
+		} else if other.String() != out {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%q\n  got=%q", i, s, out, other.String())
+		}
+	}
+}
+
+// Ensure nodes are walked with the path leading to them.
+func TestWalkWithPath(t *testing.T) {
+	stmt, err := parser.ParseStatement(`SELECT max(v) AS m FROM (SELECT v FROM cpu WHERE host = 'a'), mem WHERE time > now() - 1h GROUP BY host`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	ast.WalkWithPath(stmt, func(path []ast.PathElem, n ast.Node) bool {
+		if ref, ok := n.(*ast.VarRef); ok {
+			paths = append(paths, ref.Val+" "+ast.FormatPath(path))
+			if parent := path[len(path)-1].Parent; parent == nil {
+				t.Errorf("%s: missing parent", ref.Val)
+			}
+		}
+		return true
+	})
+	if exp := []string{
+		"v Fields[0].Expr.Args[0]",
+		"host Dimensions[0].Expr",
+		"v Sources[0].Statement.Fields[0].Expr",
+		"host Sources[0].Statement.Condition.LHS",
+		"time Condition.LHS",
+	}; !reflect.DeepEqual(paths, exp) {
+		t.Fatalf("paths mismatch:\n  exp=%q\n  got=%q", exp, paths)
+	}
+
+	// Skip the children of subqueries.
+	var metrics []string
+	ast.WalkWithPath(stmt, func(path []ast.PathElem, n ast.Node) bool {
+		if m, ok := n.(*ast.Metric); ok {
+			metrics = append(metrics, m.Name+" "+ast.FormatPath(path))
+		}
+		_, ok := n.(*ast.SubQuery)
+		return !ok
+	})
+	if exp := []string{"mem Sources[1]"}; !reflect.DeepEqual(metrics, exp) {
+		t.Fatalf("metrics mismatch:\n  exp=%q\n  got=%q", exp, metrics)
+	}
+}
+
+// Ensure the differences between two trees are reported with their paths.
+func TestDiff(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		diff string
+	}{
+		{a: `SELECT value FROM cpu`, b: `SELECT value FROM cpu`},
+		{
+			a:    `SELECT value FROM cpu WHERE host = 'a'`,
+			b:    `SELECT value FROM cpu WHERE host = 'b'`,
+			diff: `Condition.RHS.Val: a != b`,
+		},
+		{
+			a:    `SELECT value FROM cpu WHERE host = 'a'`,
+			b:    `SELECT value FROM cpu WHERE host != 'a'`,
+			diff: `Condition.Op: = != !=`,
+		},
+
+		// Nodes of different types.
+		{
+			a:    `SELECT value FROM cpu WHERE value > 1`,
+			b:    `SELECT value FROM cpu WHERE value > 1.5`,
+			diff: `Condition.RHS: 1 != 1.500`,
+		},
+		{
+			a:    `SELECT value FROM cpu`,
+			b:    `SELECT value FROM (SELECT value FROM cpu)`,
+			diff: `Sources[0]: cpu != (SELECT value FROM cpu)`,
+		},
+
+		// Missing and extra nodes.
+		{
+			a:    `SELECT value FROM cpu WHERE host = 'a'`,
+			b:    `SELECT value FROM cpu`,
+			diff: `Condition: missing host = 'a'`,
+		},
+		{
+			a:    `SELECT value FROM cpu`,
+			b:    `SELECT value INTO out FROM cpu`,
+			diff: `Target: extra INTO out`,
+		},
+		{
+			a:    `SELECT a, b, c FROM cpu`,
+			b:    `SELECT a FROM cpu`,
+			diff: "Fields[1]: missing b\nFields[2]: missing c",
+		},
+		{
+			a:    `SELECT f(a) FROM cpu`,
+			b:    `SELECT f(a, 2) FROM cpu`,
+			diff: `Fields[0].Expr.Args[1]: extra 2`,
+		},
+
+		// Differences in subqueries.
+		{
+			a:    `SELECT value FROM (SELECT value FROM cpu LIMIT 1)`,
+			b:    `SELECT value FROM (SELECT value FROM mem LIMIT 2)`,
+			diff: "Sources[0].Statement.Sources[0].Name: cpu != mem\nSources[0].Statement.Limit: 1 != 2",
+		},
+
+		// Differences in settings.
+		{
+			a:    `SELECT mean(value) FROM cpu GROUP BY time(1m) fill(1) tz('UTC')`,
+			b:    `SELECT mean(value) FROM cpu GROUP BY time(1m) fill(2) tz('Europe/Paris')`,
+			diff: "FillValue: 1 != 2\nLocation: UTC != Europe/Paris",
+		},
+	}
+
+	for i, tt := range tests {
+		a, err := parser.ParseStatement(tt.a)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		b, err := parser.ParseStatement(tt.b)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if diff := ast.FormatDiff(ast.Diff(a, b)); diff != tt.diff {
+			t.Errorf("%d. %s\n\ndiff mismatch:\n\nexp=%s\n\ngot=%s\n\n", i, tt.b, tt.diff, diff)
+		}
+	}
+
+	if diffs := ast.Diff(&ast.SelectStatement{Fields: ast.Fields{}}, &ast.SelectStatement{}); len(diffs) != 0 {
+		t.Errorf("expected empty and nil fields to be equal: %s", ast.FormatDiff(diffs))
+	}
+	if diffs := ast.Diff(nil, (*ast.VarRef)(nil)); len(diffs) != 0 {
+		t.Errorf("expected nil nodes to be equal: %s", ast.FormatDiff(diffs))
+	}
+	if diffs := ast.Diff(&ast.VarRef{Val: "a"}, nil); len(diffs) != 1 || diffs[0].Kind != ast.DiffMissing || diffs[0].String() != "(root): missing a" {
+		t.Errorf("unexpected diff: %s", ast.FormatDiff(diffs))
+	}
+}
+
+// Ensure the options of a select statement list every setting that is not a
+// node, so that a new one cannot be left out of the tools that use them.
+func TestSelectStatement_Options(t *testing.T) {
+	nodeType := reflect.TypeOf((*ast.Node)(nil)).Elem()
+	stmtType := reflect.TypeOf(ast.SelectStatement{})
+	optsType := reflect.TypeOf(ast.StatementOptions{})
+
+	var n int
+	for i := 0; i < stmtType.NumField(); i++ {
+		f := stmtType.Field(i)
+		if f.PkgPath != "" || f.Type.Implements(nodeType) || (f.Type.Kind() == reflect.Slice && f.Type.Elem().Implements(nodeType)) {
+			continue
+		}
+		n++
+		if opt, ok := optsType.FieldByName(f.Name); !ok {
+			t.Errorf("SelectStatement.%s is missing from StatementOptions", f.Name)
+		} else if opt.Type != f.Type {
+			t.Errorf("StatementOptions.%s is a %s, expected %s", f.Name, opt.Type, f.Type)
+		}
+	}
+	if n != optsType.NumField() {
+		t.Errorf("StatementOptions has %d fields, expected %d", optsType.NumField(), n)
+	}
+
+	stmt, err := parser.ParseStatement(`SELECT mean(value) FROM cpu WHERE host = $host GROUP BY time(1m) fill(0) LIMIT 1 OFFSET 2 SLIMIT 3 SOFFSET 4 tz('UTC')`, parser.WithParams(map[string]interface{}{"host": "a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := stmt.(*ast.SelectStatement)
+	opts := sel.Options()
+	exp := ast.StatementOptions{
+		Limit:       1,
+		Offset:      2,
+		SLimit:      3,
+		SOffset:     4,
+		Fill:        ast.NumberFill,
+		FillValue:   int64(0),
+		Location:    time.UTC,
+		BoundParams: []string{"host"},
+	}
+	if !reflect.DeepEqual(opts, exp) {
+		t.Fatalf("unexpected options:\n  exp=%#v\n  got=%#v", exp, opts)
+	}
+
+	// The options are copied to and from the statement.
+	opts.BoundParams[0] = "region"
+	if sel.BoundParams[0] != "host" {
+		t.Errorf("options share bound parameters with the statement")
+	}
+	other := &ast.SelectStatement{Fields: sel.Fields, Sources: sel.Sources, Condition: sel.Condition, Dimensions: sel.Dimensions}
+	other.SetOptions(sel.Options())
+	if diffs := ast.Diff(sel, other); len(diffs) != 0 {
+		t.Errorf("unexpected diff: %s", ast.FormatDiff(diffs))
+	}
+}
+
+// Ensure every statement has a stable type name, and can be asserted to its type.
+func TestStatementType(t *testing.T) {
+	var tests = []struct {
+		s   string
+		typ string
+	}{
+		{s: `SELECT value FROM cpu`, typ: "SELECT"},
+		{s: `SELECT a FROM x UNION SELECT a FROM y`, typ: "UNION"},
+		{s: `INSERT cpu value=1`, typ: "INSERT"},
+		{s: `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END`, typ: "CREATE CONTINUOUS QUERY"},
+		{s: `CREATE TIME TO LIVE one_day ON db DURATION 1d`, typ: "CREATE TIME TO LIVE"},
+		{s: `DROP TIME TO LIVE one_day ON db`, typ: "DROP TIME TO LIVE"},
+		{s: `SHOW TIME TO LIVES`, typ: "SHOW TIME TO LIVES"},
+		{s: `CREATE USER jdoe WITH PASSWORD 'pw'`, typ: "CREATE USER"},
+		{s: `DROP USER jdoe`, typ: "DROP USER"},
+		{s: `SET PASSWORD FOR jdoe = 'pw'`, typ: "SET PASSWORD"},
+		{s: `SHOW GRANTS FOR jdoe`, typ: "SHOW GRANTS"},
+		{s: `SHOW QUERIES`, typ: "SHOW QUERIES"},
+		{s: `KILL QUERY 36`, typ: "KILL QUERY"},
+		{s: `SHOW TAG KEY CARDINALITY`, typ: "SHOW TAG KEY CARDINALITY"},
+		{s: `SHOW FIELD KEY CARDINALITY`, typ: "SHOW FIELD KEY CARDINALITY"},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		if typ := ast.StatementType(stmt); typ != tt.typ {
+			t.Errorf("%d. %q: type mismatch: exp=%s got=%s", i, tt.s, tt.typ, typ)
+		}
+		if sel, ok := ast.AsSelect(stmt); ok != (tt.typ == "SELECT") || ok && sel != stmt {
+			t.Errorf("%d. %q: unexpected AsSelect: %v", i, tt.s, ok)
+		}
+	}
+
+	stmt, err := parser.ParseStatement(`SHOW QUERIES`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := ast.AsShowQueries(stmt); !ok || s == nil {
+		t.Errorf("expected a SHOW QUERIES statement")
+	} else if _, ok := ast.AsKillQuery(stmt); ok {
+		t.Errorf("expected SHOW QUERIES not to be a KILL QUERY statement")
+	}
+	if typ := ast.StatementType(nil); typ != "" {
+		t.Errorf("unexpected type of nil: %s", typ)
+	}
+}
+
+// Ensure calls are classified as aggregates, selectors or transformations.
+func TestCall_IsAggregate_IsSelector(t *testing.T) {
+	var tests = []struct {
+		name           string
+		aggregate      bool
+		selector       bool
+		transformation bool
+	}{
+		{name: "mean", aggregate: true},
+		{name: "sum", aggregate: true},
+		{name: "COUNT", aggregate: true},
+		{name: "distinct", aggregate: true},
+		{name: "top", selector: true},
+		{name: "Bottom", selector: true},
+		{name: "first", selector: true},
+		{name: "last", selector: true},
+		{name: "max", selector: true},
+		{name: "min", selector: true},
+		{name: "percentile", selector: true},
+		{name: "derivative", transformation: true},
+		{name: "Moving_Average", transformation: true},
+		{name: "abs"},
+		{name: "time"},
+		{name: "unknown"},
+	}
+
+	for i, tt := range tests {
+		c := &ast.Call{Name: tt.name}
+		if got := c.IsAggregate(); got != tt.aggregate {
+			t.Errorf("%d. %s: IsAggregate mismatch: exp=%v got=%v", i, tt.name, tt.aggregate, got)
+		}
+		if got := c.IsSelector(); got != tt.selector {
+			t.Errorf("%d. %s: IsSelector mismatch: exp=%v got=%v", i, tt.name, tt.selector, got)
+		}
+		if got := c.IsTransformation(); got != tt.transformation {
+			t.Errorf("%d. %s: IsTransformation mismatch: exp=%v got=%v", i, tt.name, tt.transformation, got)
+		}
+	}
+}
+
+// Ensure the arguments of transformations are validated against their
+// function and their statement.
+func TestParseStatement_Transformations(t *testing.T) {
+	var tests = []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT derivative(value) FROM cpu`},
+		{s: `SELECT derivative(value, 10s) FROM cpu`},
+		{s: `SELECT derivative(mean(value), 10s) FROM cpu WHERE time > now() - 1h GROUP BY time(1m)`},
+		{s: `SELECT non_negative_derivative(max(value)) FROM cpu GROUP BY time(1m), host`},
+		{s: `SELECT derivative(value, 0s) FROM cpu`, err: `expected positive duration as second argument of derivative, found 0s at line 1, char 8`},
+		{s: `SELECT derivative(value, 10) FROM cpu`, err: `expected positive duration as second argument of derivative, found 10 at line 1, char 8`},
+		{s: `SELECT derivative() FROM cpu`, err: `invalid number of arguments for derivative, expected 1 or 2, got 0 at line 1, char 8`},
+		{s: `SELECT derivative(value, 1s, 2s) FROM cpu`, err: `invalid number of arguments for derivative, expected 1 or 2, got 3 at line 1, char 8`},
+		{s: `SELECT derivative(value) FROM cpu GROUP BY time(1m)`, err: `aggregate function required inside the call to derivative at line 1, char 8`},
+		{s: `SELECT derivative(mean(value)) FROM cpu`, err: `derivative of an aggregate requires GROUP BY time at line 1, char 8`},
+		{s: `SELECT derivative(mean(value)) FROM cpu GROUP BY host`, err: `derivative of an aggregate requires GROUP BY time at line 1, char 8`},
+
+		{s: `SELECT difference(value) FROM cpu`},
+		{s: `SELECT non_negative_difference(sum(value)) FROM cpu GROUP BY time(1m)`},
+		{s: `SELECT difference(value, 1s) FROM cpu`, err: `invalid number of arguments for difference, expected 1, got 2 at line 1, char 8`},
+		{s: `SELECT difference('a') FROM cpu`, err: `expected field or aggregate as first argument of difference, found 'a' at line 1, char 8`},
+		{s: `SELECT difference(abs(value)) FROM cpu`, err: `expected field or aggregate as first argument of difference, found abs(value) at line 1, char 8`},
+
+		{s: `SELECT cumulative_sum(value) FROM cpu`},
+		{s: `SELECT cumulative_sum(count(value)) FROM cpu GROUP BY time(1m)`},
+		{s: `SELECT cumulative_sum(value) FROM cpu GROUP BY time(1m)`, err: `aggregate function required inside the call to cumulative_sum at line 1, char 8`},
+		{s: `SELECT cumulative_sum(max(value)) FROM cpu`, err: `cumulative_sum of an aggregate requires GROUP BY time at line 1, char 8`},
+
+		{s: `SELECT moving_average(value, 5) FROM cpu`},
+		{s: `SELECT moving_average(mean(value), 5) FROM cpu GROUP BY time(1m)`},
+		{s: `SELECT moving_average(value) FROM cpu`, err: `invalid number of arguments for moving_average, expected 2, got 1 at line 1, char 8`},
+		{s: `SELECT moving_average(value, 1) FROM cpu`, err: `expected integer greater than 1 as second argument of moving_average, found 1 at line 1, char 8`},
+		{s: `SELECT moving_average(value, 10s) FROM cpu`, err: `expected integer greater than 1 as second argument of moving_average, found 10s at line 1, char 8`},
+
+		{s: `SELECT elapsed(value) FROM cpu`},
+		{s: `SELECT elapsed(value, 1ms) FROM cpu`},
+		{s: `SELECT elapsed(value, -1ms) FROM cpu`, err: `expected positive duration as second argument of elapsed, found -1ms at line 1, char 8`},
+
+		{s: `SELECT derivative(difference(value)) FROM cpu`, err: `cannot nest difference in derivative at line 1, char 19`},
+		{s: `SELECT moving_average(derivative(mean(value)), 3) FROM cpu GROUP BY time(1m)`, err: `cannot nest derivative in moving_average at line 1, char 23`},
+		{s: `SELECT value FROM cpu WHERE (SELECT derivative(value) FROM mem GROUP BY time(1m)) > 0`, err: `aggregate function required inside the call to derivative at line 1, char 37`},
+		{s: `SELECT derivative(mean(value)) FROM (SELECT derivative(value) FROM cpu) GROUP BY time(1m)`},
+
+		{s: `SELECT value FROM cpu WHERE abs(value) > 1 AND time > today()`},
+		{s: `SELECT value FROM cpu WHERE derivative(value) > 1`, err: `derivative is not allowed in WHERE at line 1, char 29`},
+		{s: `SELECT mean(value) FROM cpu WHERE value > mean(value) GROUP BY time(1m)`, err: `mean is not allowed in WHERE at line 1, char 43`},
+		{s: `SELECT value FROM cpu WHERE abs(max(value)) > 1`, err: `max is not allowed in WHERE at line 1, char 33`},
+		{s: `SELECT value FROM cpu WHERE value > (SELECT max(value) FROM mem)`},
+	}
+
+	for i, tt := range tests {
+		_, err := parser.NewParser(strings.NewReader(tt.s)).ParseStatement()
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %s: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+}
+
+// Ensure the calls of a statement built without the parser are validated,
+// and the call at fault is named.
+func TestSelectStatement_ValidateCalls(t *testing.T) {
+	inner := &ast.Call{Name: "difference", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}
+	stmt := &ast.SelectStatement{
+		Fields:  ast.Fields{{Expr: &ast.Call{Name: "derivative", Args: []ast.Expr{inner}}}},
+		Sources: ast.Sources{&ast.Metric{Name: "cpu"}},
+	}
+	err := stmt.ValidateCalls()
+	if e, ok := err.(*ast.CallError); !ok || e.Call != inner || e.Message != "cannot nest difference in derivative" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	stmt.Fields[0].Expr = inner
+	stmt.Condition = &ast.BinaryExpr{Op: token.GT, LHS: &ast.Call{Name: "sum", Args: []ast.Expr{&ast.VarRef{Val: "value"}}}, RHS: &ast.IntegerLiteral{Val: 1}}
+	if err := stmt.ValidateCalls(); errstring(err) != "sum is not allowed in WHERE" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure only aggregates and selectors make a query not raw.
+func TestParseStatement_IsRawQuery(t *testing.T) {
+	var tests = []struct {
+		s   string
+		raw bool
+	}{
+		{s: `SELECT value FROM cpu`, raw: true},
+		{s: `SELECT abs(value) FROM cpu`, raw: true},
+		{s: `SELECT round(abs(value)), host FROM cpu`, raw: true},
+		{s: `SELECT mean(value) FROM cpu`, raw: false},
+		{s: `SELECT max(value) FROM cpu`, raw: false},
+		{s: `SELECT abs(value), sum(value) FROM cpu`, raw: false},
+		{s: `SELECT round(mean(value)) FROM cpu`, raw: false},
+		{s: `SELECT value FROM (SELECT mean(value) AS value FROM cpu)`, raw: true},
+		{s: `SELECT (max(value)) FROM cpu`, raw: false},
+		{s: `SELECT top(value, $n) FROM cpu`, raw: false},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s, parser.WithParams(map[string]interface{}{"n": 3}))
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		sel := stmt.(*ast.SelectStatement)
+		if raw := sel.IsRawQuery; raw != tt.raw {
+			t.Errorf("%d. %q: IsRawQuery mismatch: exp=%v got=%v", i, tt.s, tt.raw, raw)
+		}
+		if raw := ast.IsRawQuery(sel.Fields); raw != tt.raw {
+			t.Errorf("%d. %q: ast.IsRawQuery mismatch: exp=%v got=%v", i, tt.s, tt.raw, raw)
+		}
+	}
+}
+
+// Ensure statements built or rewritten without the parser are classified
+// as raw or not like parsed ones.
+func TestIsRawQuery_Built(t *testing.T) {
+	value := &ast.VarRef{Val: "value"}
+	var tests = []struct {
+		fields ast.Fields
+		raw    bool
+	}{
+		{fields: ast.Fields{{Expr: value}}, raw: true},
+		{fields: ast.Fields{{Expr: &ast.Call{Name: "abs", Args: []ast.Expr{value}}}}, raw: true},
+		{fields: ast.Fields{{Expr: &ast.Call{Name: "MEAN", Args: []ast.Expr{value}}}}, raw: false},
+		{fields: ast.Fields{{Expr: &ast.BinaryExpr{Op: token.MUL, LHS: &ast.ParenExpr{Expr: &ast.Call{Name: "first", Args: []ast.Expr{value}}}, RHS: &ast.IntegerLiteral{Val: 2}}}}, raw: false},
+	}
+
+	for i, tt := range tests {
+		stmt := &ast.SelectStatement{Fields: tt.fields, Sources: ast.Sources{&ast.Metric{Name: "cpu"}}}
+		if raw := ast.IsRawQuery(stmt.Fields); raw != tt.raw {
+			t.Errorf("%d. %s: IsRawQuery mismatch: exp=%v got=%v", i, stmt, tt.raw, raw)
+		}
+		parsed, err := parser.ParseStatement(stmt.String())
+		if err != nil {
+			t.Fatalf("%d. %s: %s", i, stmt, err)
+		} else if raw := parsed.(*ast.SelectStatement).IsRawQuery; raw != tt.raw {
+			t.Errorf("%d. %s: parsed IsRawQuery mismatch: exp=%v got=%v", i, stmt, tt.raw, raw)
+		}
+	}
+
+	if !ast.IsRawQuery(nil) {
+		t.Error("expected no fields to be raw")
+	}
+
+	// A bound parameter substituted with a call changes the statement.
+	stmt := &ast.SelectStatement{
+		Fields:     ast.Fields{{Expr: &ast.BoundParameter{Name: "f"}}},
+		Sources:    ast.Sources{&ast.Metric{Name: "cpu"}},
+		IsRawQuery: true,
+	}
+	sub, err := stmt.Substitute(map[string]ast.Expr{"f": &ast.Call{Name: "sum", Args: []ast.Expr{value}}})
+	if err != nil {
+		t.Fatal(err)
+	} else if sub.IsRawQuery {
+		t.Errorf("%s: expected a query that is not raw", sub)
+	}
+
+	// Expanding a wildcard keeps the fields raw.
+	parsed, err := parser.ParseStatement(`SELECT * FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt = parsed.(*ast.SelectStatement)
+	stmt.IsRawQuery = false
+	if rewritten, err := stmt.RewriteFields([]string{"value"}, nil); err != nil {
+		t.Fatal(err)
+	} else if !rewritten.IsRawQuery {
+		t.Errorf("%s: expected a raw query", rewritten)
+	}
+}
+
+// Ensure strings separated only by whitespace are concatenated.
+func TestParseExpr_AdjacentStrings(t *testing.T) {
+	var tests = []struct {
+		s    string
+		expr string
+		err  string
+	}{
+		{s: `'a' 'b'`, expr: `'ab'`},
+		{s: "payload = '{\"a\": 1, ' \n\t '\"b\": 2, '\n'\"c\": 3}'", expr: `payload = '{"a": 1, "b": 2, "c": 3}'`},
+		{s: `host = 'a' 'b' AND region = 'c'`, expr: `host = 'ab' AND region = 'c'`},
+		{s: `'a' + 'b'`, expr: `'a' + 'b'`},
+		{s: `'a' /* c */ 'b'`, expr: `'a'`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && expr.String() != tt.expr {
+			t.Errorf("%d. %q: expr mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.expr, expr)
+		}
+	}
+
+	// A comma separates fields rather than concatenating them.
+	stmt, err := parser.ParseStatement(`SELECT 'a', 'b' 'c' FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `SELECT 'a', 'bc' FROM cpu`; stmt.String() != exp {
+		t.Fatalf("output mismatch:\n  exp=%s\n  got=%s", exp, stmt)
+	}
+
+	// A comment ends the string.
+	_, err = parser.ParseQuery(`SELECT value FROM cpu WHERE host = 'a' /* c */ 'b'`)
+	if exp := `found b, expected ; at line 1, char 48`; errstring(err) != exp {
+		t.Fatalf("error mismatch:\n  exp=%s\n  got=%s", exp, err)
+	}
+}
+
+// Ensure the members of structured fields are parsed with "->".
+func TestParseExpr_FieldAccess(t *testing.T) {
+	var tests = []struct {
+		s    string
+		expr string
+		err  string
+	}{
+		{s: `payload->'status' = 200`, expr: `payload->'status' = 200`},
+		{s: `payload -> 'a' -> 'b c' > 1`, expr: `payload->'a'->'b c' > 1`},
+		{s: `payload::field->'a'->'b c' > 1`, expr: `payload::field->'a'->'b c' > 1`},
+		{s: `"db.payload"->'it\'s'`, expr: `"db.payload"->'it\'s'`},
+		{s: `-payload->'a' * 2`, expr: `-payload->'a' * 2`},
+		{s: `payload.status = 200`, expr: `"payload.status" = 200`},
+		{s: `payload->status`, err: `found status, expected string at line 1, char 10`},
+		{s: `payload->`, err: `found EOF, expected string at line 1, char 10`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && expr.String() != tt.expr {
+			t.Errorf("%d. %q: expr mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.expr, expr)
+		}
+	}
+
+	expr, err := parser.ParseExpr(`payload->'status'->'code'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ast.FieldAccess{Base: &ast.VarRef{Val: "payload"}, Path: []string{"status", "code"}}
+	if !reflect.DeepEqual(expr, exp) {
+		t.Fatalf("unexpected expr: %#v", expr)
+	}
+	if names := ast.ExprNames(expr); !reflect.DeepEqual(names, []ast.VarRef{{Val: "payload"}}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+}
+
+// Ensure "!" negates the expression that follows it.
+func TestParseExpr_Not(t *testing.T) {
+	var tests = []struct {
+		s    string
+		expr string
+		err  string
+	}{
+		{s: `!(a = 1)`, expr: `!(a = 1)`},
+		{s: `! (a = 1 OR b =~ /x/)`, expr: `!(a = 1 OR b =~ /x/)`},
+		{s: `host = 'a' AND !(region = 'b')`, expr: `host = 'a' AND !(region = 'b')`},
+		{s: `!ok`, expr: `!ok`},
+		{s: `!!ok`, expr: `!!ok`},
+		{s: `!a != b`, expr: `!a != b`},
+		{s: `!host = 'a' AND b`, expr: `!host = 'a' AND b`},
+		{s: `!(a + 1) > 2`, expr: `!(a + 1) > 2`},
+		{s: `!true`, expr: `!true`},
+		{s: `!`, err: `found EOF, expected identifier, string, number, bool at line 1, char 2`},
+		{s: `!(SELECT value FROM cpu)`, err: `subquery can only be an operand of a comparison at line 1, char 2`},
+		{s: `!'a'`, err: `expected boolean operand of !, found 'a' at line 1, char 2`},
+		{s: `!1`, err: `expected boolean operand of !, found 1 at line 1, char 2`},
+		{s: `a = 1 AND ! b + 1`, err: `expected boolean operand of !, found b + 1 at line 1, char 13`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && expr.String() != tt.expr {
+			t.Errorf("%d. %q: expr mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.expr, expr)
+		}
+	}
+
+	// The negation binds less tightly than the comparison, and more tightly
+	// than AND.
+	expr, err := parser.ParseExpr(`!a = b AND c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ast.BinaryExpr{
+		Op:  token.AND,
+		LHS: &ast.NotExpr{Expr: &ast.BinaryExpr{Op: token.EQ, LHS: &ast.VarRef{Val: "a"}, RHS: &ast.VarRef{Val: "b"}}},
+		RHS: &ast.VarRef{Val: "c"},
+	}
+	if !reflect.DeepEqual(expr, exp) {
+		t.Fatalf("unexpected expr: %s", expr)
+	}
+
+	for _, s := range []string{
+		`SELECT value FROM cpu WHERE !(time < now() - 1h)`,
+		`SELECT value FROM cpu WHERE !time > now() - 1h`,
+	} {
+		stmt, err := parser.ParseStatement(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sel := stmt.(*ast.SelectStatement); !sel.HasTimeFilter() {
+			t.Errorf("%s: expected a time filter", sel)
+		}
+	}
+}
+
+// Ensure binary operators group by precedence, and from the left when they
+// have the same precedence.
+func TestParseExpr_Precedence(t *testing.T) {
+	var tests = []struct {
+		s     string
+		group string
+	}{
+		{s: `a = 1 AND b = 2 OR c = 3`, group: `(((a = 1) AND (b = 2)) OR (c = 3))`},
+		{s: `a = 1 OR b = 2 AND c = 3`, group: `((a = 1) OR ((b = 2) AND (c = 3)))`},
+		{s: `a = 1 OR b = 2 OR c = 3`, group: `(((a = 1) OR (b = 2)) OR (c = 3))`},
+		{s: `a = 1 AND b = 2 AND c = 3`, group: `(((a = 1) AND (b = 2)) AND (c = 3))`},
+		{s: `a = 1 AND (b = 2 OR c = 3)`, group: `((a = 1) AND [((b = 2) OR (c = 3))])`},
+		{s: `a + b * c > d AND e`, group: `(((a + (b * c)) > d) AND e)`},
+		{s: `a - b - c`, group: `((a - b) - c)`},
+		{s: `a / b / c`, group: `((a / b) / c)`},
+		{s: `a - b + c * d % e`, group: `((a - b) + ((c * d) % e))`},
+		{s: `a | b & c ^ d`, group: `((a | (b & c)) ^ d)`},
+		{s: `a < b + 1 OR !c AND d =~ /x/`, group: `((a < (b + 1)) OR (!c AND (d =~ /x/)))`},
+	}
+
+	// group prints an expression with every binary expression in parentheses
+	// and every ParenExpr in brackets.
+	var group func(expr ast.Expr) string
+	group = func(expr ast.Expr) string {
+		switch expr := expr.(type) {
+		case *ast.BinaryExpr:
+			return fmt.Sprintf("(%s %s %s)", group(expr.LHS), expr.Op, group(expr.RHS))
+		case *ast.ParenExpr:
+			return "[" + group(expr.Expr) + "]"
+		case *ast.NotExpr:
+			return "!" + group(expr.Expr)
+		}
+		return expr.String()
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			t.Errorf("%d. %q: %s", i, tt.s, err)
+		} else if s := group(expr); s != tt.group {
+			t.Errorf("%d. %q: grouping mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.group, s)
+		}
+	}
+}
+
+// Ensure a comparison of a comparison is rejected, unless it is in parentheses.
+func TestParseExpr_ChainedComparison(t *testing.T) {
+	var tests = []struct {
+		s    string
+		expr string
+		err  string
+	}{
+		{s: `a < 10`, expr: `a < 10`},
+		{s: `1 < a AND a < 10`, expr: `1 < a AND a < 10`},
+		{s: `(1 < a) = true`, expr: `(1 < a) = true`},
+		{s: `1 < a < 10`, err: `cannot chain comparisons in 1 < a < 10, use 1 < a AND a < 10 at line 1, char 7`},
+		{s: `1 < a < 10 + b OR c`, err: `cannot chain comparisons in 1 < a < 10 + b, use 1 < a AND a < 10 + b at line 1, char 7`},
+		{s: `a = b != c = d`, err: `cannot chain comparisons in a = b != c, use a = b AND b != c at line 1, char 7`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && expr.String() != tt.expr {
+			t.Errorf("%d. %q: expr mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.expr, expr)
+		}
+	}
+
+	if _, err := parser.ParseStatement(`SELECT value FROM cpu WHERE 1 < value < 10`); errstring(err) != `cannot chain comparisons in 1 < value < 10, use 1 < value AND value < 10 at line 1, char 39` {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Ensure built expressions get the parentheses they need to parse back to
+// the same tree.
+func TestParenthesizeExpr(t *testing.T) {
+	ref := func(name string) ast.Expr { return &ast.VarRef{Val: name} }
+	bin := func(op token.Token, lhs, rhs ast.Expr) ast.Expr { return &ast.BinaryExpr{Op: op, LHS: lhs, RHS: rhs} }
+
+	var tests = []struct {
+		expr ast.Expr
+		s    string
+	}{
+		{expr: bin(token.ADD, ref("a"), bin(token.MUL, ref("b"), ref("c"))), s: `a + b * c`},
+		{expr: bin(token.MUL, bin(token.ADD, ref("a"), ref("b")), ref("c")), s: `(a + b) * c`},
+		{expr: bin(token.SUB, ref("a"), bin(token.SUB, ref("b"), ref("c"))), s: `a - (b - c)`},
+		{expr: bin(token.SUB, bin(token.SUB, ref("a"), ref("b")), ref("c")), s: `a - b - c`},
+		{expr: bin(token.AND, bin(token.OR, ref("a"), ref("b")), ref("c")), s: `(a OR b) AND c`},
+		{expr: &ast.NotExpr{Expr: bin(token.EQ, ref("a"), ref("b"))}, s: `!(a = b)`},
+		{expr: bin(token.EQ, &ast.NotExpr{Expr: ref("a")}, ref("b")), s: `(!a) = b`},
+		{expr: bin(token.ADD, bin(token.EQ, ref("a"), &ast.NotExpr{Expr: ref("b")}), ref("c")), s: `(a = (!b)) + c`},
+		{expr: bin(token.AND, &ast.NotExpr{Expr: ref("a")}, &ast.NotExpr{Expr: ref("b")}), s: `!a AND !b`},
+		{expr: bin(token.MUL, &ast.IntegerLiteral{Val: -1}, ref("a")), s: `-a`},
+		{expr: &ast.FieldAccess{Base: bin(token.ADD, ref("a"), ref("b")), Path: []string{"x"}}, s: `(a + b)->'x'`},
+		{expr: &ast.FieldAccess{Base: bin(token.MUL, &ast.IntegerLiteral{Val: -1}, ref("a")), Path: []string{"x"}}, s: `(-a)->'x'`},
+		{expr: &ast.FieldAccess{Base: &ast.NotExpr{Expr: ref("a")}, Path: []string{"x"}}, s: `(!a)->'x'`},
+		{expr: bin(token.MUL, &ast.IntegerLiteral{Val: -1}, &ast.FieldAccess{Base: ref("a"), Path: []string{"x"}}), s: `-a->'x'`},
+		{expr: &ast.Call{Name: "mean", Args: []ast.Expr{bin(token.DIV, bin(token.ADD, ref("a"), ref("b")), &ast.IntegerLiteral{Val: 2})}}, s: `mean((a + b) / 2)`},
+	}
+
+	for i, tt := range tests {
+		expr := ast.ParenthesizeExpr(tt.expr)
+		if expr.String() != tt.s {
+			t.Errorf("%d. %s: string mismatch:\n  exp=%s\n  got=%s", i, tt.expr, tt.s, expr)
+			continue
+		}
+		other, err := parser.ParseExpr(expr.String())
+		if err != nil {
+			t.Errorf("%d. %s: %s", i, expr, err)
+		} else if diff := ast.Diff(expr, other); diff != nil {
+			t.Errorf("%d. %s: reparsed tree differs:\n%s", i, expr, ast.FormatDiff(diff))
+		}
+	}
+
+	// Parsed expressions are left as they are.
+	for _, s := range []string{`a + b * c`, `(a + b) * c`} {
+		expr, err := parser.ParseExpr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other := ast.ParenthesizeExpr(expr); !reflect.DeepEqual(expr, other) {
+			t.Errorf("%s: unexpected expr: %s", s, other)
+		}
+	}
+}
+
+// Ensure IN is parsed as a comparison with a list of names.
+func TestParseExpr_In(t *testing.T) {
+	var tests = []struct {
+		s    string
+		expr string
+		err  string
+	}{
+		{s: `host IN (a, 'b', "c d")`, expr: `host IN (a, b, "c d")`},
+		{s: `host in ('a')`, expr: `host IN (a)`},
+		{s: `time IN ('2000-01-01')`, expr: `time IN ("2000-01-01")`},
+		{s: `region = 'us' AND host IN (a, b) OR value > 1`, expr: `region = 'us' AND host IN (a, b) OR value > 1`},
+		{s: `host IN ()`, err: `IN requires at least one value at line 1, char 10`},
+		{s: `host IN (a,)`, err: `found ), expected identifier, string at line 1, char 12`},
+		{s: `host IN (1)`, err: `found 1, expected identifier, string at line 1, char 10`},
+		{s: `host IN 'a'`, err: `found a, expected ( at line 1, char 9`},
+		{s: `host IN (a b)`, err: `found b, expected ,, ) at line 1, char 12`},
+		{s: `host = a IN (b)`, err: `cannot chain comparisons in host = a IN (b), use host = a AND a IN (b) at line 1, char 10`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && expr.String() != tt.expr {
+			t.Errorf("%d. %q: expr mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.expr, expr)
+		}
+	}
+
+	expr, err := parser.ParseExpr(`host IN (a, 'b')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ast.BinaryExpr{Op: token.IN, LHS: &ast.VarRef{Val: "host"}, RHS: &ast.ListLiteral{Vals: []string{"a", "b"}}}
+	if !reflect.DeepEqual(expr, exp) {
+		t.Fatalf("unexpected expr: %s", expr)
+	}
+
+	if _, err := parser.ParseStatement(`SELECT host IN (a) FROM cpu`); err == nil {
+		t.Error("expected an error for IN in a field")
+	}
+	if _, err := parser.ParseExpr(`host IN (a, b, c)`, parser.WithMaxListLength(2)); errstring(err) != `too many values for IN, expected at most 2 at line 1, char 16` {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Ensure a list tells whether it contains a value.
+func TestListLiteral_Contains(t *testing.T) {
+	list := &ast.ListLiteral{Vals: []string{"a", "b c"}}
+	for _, tt := range []struct {
+		s   string
+		exp bool
+	}{
+		{s: "a", exp: true},
+		{s: "b c", exp: true},
+		{s: "A"},
+		{s: "b"},
+		{s: ""},
+	} {
+		if got := list.Contains(tt.s); got != tt.exp {
+			t.Errorf("%q: exp=%v got=%v", tt.s, tt.exp, got)
+		}
+	}
+	if (&ast.ListLiteral{}).Contains("") {
+		t.Error("expected an empty list to contain nothing")
+	}
+}
+
+// Ensure calls with a variable argument are named after it, so that selecting
+// the same function of different fields gives distinct names.
+func TestFields_AliasNames(t *testing.T) {
+	var tests = []struct {
+		s     string
+		names []string
+	}{
+		{s: `SELECT max(a), max(b) FROM cpu`, names: []string{"max_a", "max_b"}},
+		{s: `SELECT first(a), last(a), min(a) FROM cpu`, names: []string{"first_a", "last_a", "min_a"}},
+		{s: `SELECT max(a) AS a, mean(b), value FROM cpu`, names: []string{"a", "mean_b", "value"}},
+		{s: `SELECT top(a, 3), count(*) FROM cpu`, names: []string{"top", "count"}},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		if names := stmt.(*ast.SelectStatement).Fields.AliasNames(); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("%d. %q: names mismatch:\n  exp=%q\n  got=%q", i, tt.s, tt.names, names)
+		}
+	}
+}
+
+// Ensure DISTINCT with and without parentheses is parsed as the same call.
+func TestParseStatement_Distinct(t *testing.T) {
+	for i, tt := range [][2]string{
+		{`SELECT count(distinct value) FROM cpu`, `SELECT count(distinct(value)) FROM cpu`},
+		{`SELECT DISTINCT value FROM cpu`, `SELECT distinct(value) FROM cpu`},
+		{`SELECT (DISTINCT value) FROM cpu`, `SELECT (distinct(value)) FROM cpu`},
+	} {
+		a, err := parser.ParseStatement(tt[0])
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt[0], err)
+		}
+		b, err := parser.ParseStatement(tt[1])
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt[1], err)
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("%d. %q: stmt mismatch:\n\n%s", i, tt[0], ast.FormatDiff(ast.Diff(b, a)))
+		} else if a.String() != tt[1] {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt[0], tt[1], a)
+		}
+	}
+}
+
+// Ensure the tag keys and the count of top and bottom are returned.
+func TestCall_SelectorTags_SelectorN(t *testing.T) {
+	var tests = []struct {
+		s    string
+		tags []ast.VarRef
+		n    int64
+		ok   bool
+	}{
+		{s: `top(value, 3)`, n: 3, ok: true},
+		{s: `top(value, host, 3)`, tags: []ast.VarRef{{Val: "host"}}, n: 3, ok: true},
+		{s: `BOTTOM(value, host, region::tag, 5)`, tags: []ast.VarRef{{Val: "host"}, {Val: "region", Type: ast.Tag}}, n: 5, ok: true},
+		{s: `max(value)`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		call := expr.(*ast.Call)
+		if tags := call.SelectorTags(); !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%d. %q: tags mismatch:\n  exp=%v\n  got=%v", i, tt.s, tt.tags, tags)
+		}
+		if n, ok := call.SelectorN(); n != tt.n || ok != tt.ok {
+			t.Errorf("%d. %q: count mismatch: exp=%d, %v got=%d, %v", i, tt.s, tt.n, tt.ok, n, ok)
+		}
+	}
+
+	// Calls built without the parser may have arguments in the wrong order.
+	call := &ast.Call{Name: "top", Args: []ast.Expr{&ast.VarRef{Val: "v"}, &ast.IntegerLiteral{Val: 3}, &ast.VarRef{Val: "host"}}}
+	if tags := call.SelectorTags(); tags != nil {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	if n, ok := call.SelectorN(); ok {
+		t.Errorf("unexpected count: %d", n)
+	}
+	if err := call.ValidateArgs(); errstring(err) != "expected tag key as argument of top, found 3" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := parser.ParseExpr(`top(v, 3, host)`); errstring(err) != "expected tag key as argument of top, found 3 at line 1, char 1" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a field is found by its name, or by a tag key of top or bottom.
+func TestFields_FieldExprByName(t *testing.T) {
+	stmt, err := parser.ParseStatement(`SELECT mean(value), top(value, host, region, 3) AS t, load FROM cpu GROUP BY time(1m)`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fields := stmt.(*ast.SelectStatement).Fields
+	var tests = []struct {
+		name  string
+		index int
+		expr  string
+	}{
+		{name: "mean_value", index: 0, expr: "mean(value)"},
+		{name: "t", index: 1, expr: "top(value, host, region, 3)"},
+		{name: "region", index: 1, expr: "region"},
+		{name: "load", index: 2, expr: "load"},
+		{name: "value", index: -1},
+	}
+
+	for i, tt := range tests {
+		index, expr := fields.FieldExprByName(tt.name)
+		if index != tt.index {
+			t.Errorf("%d. %s: index mismatch: exp=%d got=%d", i, tt.name, tt.index, index)
+		}
+		if s := fmt.Sprint(expr); expr != nil && s != tt.expr || expr == nil && tt.expr != "" {
+			t.Errorf("%d. %s: expr mismatch: exp=%s got=%s", i, tt.name, tt.expr, s)
+		}
+	}
+}
+
+// Ensure comparisons with ANY or ALL of a list are parsed, including bound lists.
+func TestParseStatement_AnyAll(t *testing.T) {
+	var tests = []struct {
+		s      string
+		params map[string]interface{}
+		stmt   string
+		err    string
+	}{
+		{s: `SELECT value FROM cpu WHERE host = ANY('a', 'b')`, stmt: `SELECT value FROM cpu WHERE host = ANY('a', 'b')`},
+		{s: `SELECT value FROM cpu WHERE host != all ('a')`, stmt: `SELECT value FROM cpu WHERE host != ALL('a')`},
+		{s: `SELECT value FROM cpu WHERE value > ANY(1, 2 * 3) AND host = 'a'`, stmt: `SELECT value FROM cpu WHERE value > ANY(1, 2 * 3) AND host = 'a'`},
+		{
+			s:      `SELECT value FROM cpu WHERE host = ANY($hosts)`,
+			params: map[string]interface{}{"hosts": []interface{}{"a", "b"}},
+			stmt:   `SELECT value FROM cpu WHERE host = ANY('a', 'b')`,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE value = ANY($values, 3, $empty)`,
+			params: map[string]interface{}{"values": []interface{}{1, 2.5}, "empty": []interface{}{}},
+			stmt:   `SELECT value FROM cpu WHERE value = ANY(1, 2.500, 3)`,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE host = ANY($host)`,
+			params: map[string]interface{}{"host": "a"},
+			stmt:   `SELECT value FROM cpu WHERE host = ANY('a')`,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE host = ANY($empty)`,
+			params: map[string]interface{}{"empty": []interface{}{}},
+			err:    `ANY requires at least one value at line 1, char 46`,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE d = ANY($d)`,
+			params: map[string]interface{}{"d": []interface{}{map[string]interface{}{"duration": "1x"}}},
+			err:    `invalid duration at line 1, char 37`,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s, parser.WithParams(tt.params))
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, stmt)
+		}
+	}
+
+	stmt, err := parser.ParseStatement(`SELECT value FROM cpu WHERE host = ANY('a', 'b')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ast.BinaryExpr{
+		Op:  token.EQ,
+		LHS: &ast.VarRef{Val: "host"},
+		RHS: &ast.QuantifiedExpr{Op: token.ANY, Vals: []ast.Expr{&ast.StringLiteral{Val: "a"}, &ast.StringLiteral{Val: "b"}}},
+	}
+	if cond := stmt.(*ast.SelectStatement).Condition; !reflect.DeepEqual(cond, exp) {
+		t.Fatalf("condition mismatch:\n\n%s", ast.FormatDiff(ast.Diff(exp, cond)))
+	}
+}
+
+// Ensure subqueries are parsed as operands of comparisons, and rejected elsewhere.
+func TestParseStatement_SubqueryExpr(t *testing.T) {
+	var tests = []struct {
+		s    string
+		stmt string
+		err  string
+	}{
+		{
+			s:    `SELECT value FROM cpu WHERE value > (SELECT mean(value) FROM cpu WHERE time > now() - 1h)`,
+			stmt: `SELECT value FROM cpu WHERE value > (SELECT mean(value) FROM cpu WHERE time > now() - 1h)`,
+		},
+		{
+			s:    `SELECT value FROM cpu WHERE ( select count(value) from cpu ) = 3 AND host = 'a'`,
+			stmt: `SELECT value FROM cpu WHERE (SELECT count(value) FROM cpu) = 3 AND host = 'a'`,
+		},
+		{
+			s:    `SELECT value FROM cpu WHERE value > (SELECT max(value) FROM cpu WHERE value < (SELECT mean(value) FROM cpu))`,
+			stmt: `SELECT value FROM cpu WHERE value > (SELECT max(value) FROM cpu WHERE value < (SELECT mean(value) FROM cpu))`,
+		},
+		{
+			s:    `SELECT value FROM cpu WHERE host = 'a' OR (SELECT count(value) FROM cpu) > 3`,
+			stmt: `SELECT value FROM cpu WHERE host = 'a' OR (SELECT count(value) FROM cpu) > 3`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host = 'a' OR (SELECT count(value) FROM cpu)`,
+			err: `subquery can only be an operand of a comparison at line 1, char 40`,
+		},
+		{
+			s:    `SELECT value FROM cpu WHERE (value > (SELECT mean(value) FROM cpu))`,
+			stmt: `SELECT value FROM cpu WHERE (value > (SELECT mean(value) FROM cpu))`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > (SELECT mean(value) FROM cpu) + 1`,
+			err: `subquery can only be an operand of a comparison at line 1, char 67`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > 1 + (SELECT mean(value) FROM cpu)`,
+			err: `subquery can only be an operand of a comparison at line 1, char 39`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > -(SELECT mean(value) FROM cpu)`,
+			err: `subquery can only be an operand of a comparison at line 1, char 38`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > ((SELECT mean(value) FROM cpu))`,
+			err: `subquery can only be an operand of a comparison at line 1, char 38`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE (SELECT mean(value) FROM cpu)`,
+			err: `subquery can only be an operand of a comparison at line 1, char 29`,
+		},
+		{
+			s:   `SELECT (SELECT mean(value) FROM cpu) FROM cpu`,
+			err: `subquery can only be an operand of a comparison at line 1, char 8`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > (SELECT mean(value) FROM cpu WHERE)`,
+			err: `found ), expected identifier, string, number, bool at line 1, char 71`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > (SELECT mean(value) FROM cpu WHERE value > (SELECT FROM cpu))`,
+			err: `found FROM, expected identifier, string, number, bool at line 1, char 88`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE value > (SELECT mean(value) FROM cpu`,
+			err: `found EOF, expected ) at line 1, char 65`,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, stmt)
+		}
+	}
+}
+
+// Ensure walking a condition descends into its subqueries.
+func TestWalk_SubqueryExpr(t *testing.T) {
+	stmt, err := parser.ParseStatement(`SELECT value FROM cpu WHERE value > (SELECT max(usage) FROM mem WHERE host = 'a')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cond, ok := stmt.(*ast.SelectStatement).Condition.(*ast.BinaryExpr)
+	if !ok {
+		t.Fatalf("unexpected condition: %s", stmt)
+	}
+	sub, ok := cond.RHS.(*ast.SubqueryExpr)
+	if !ok {
+		t.Fatalf("unexpected RHS: %#v", cond.RHS)
+	} else if got, exp := sub.Statement.String(), `SELECT max(usage) FROM mem WHERE host = 'a'`; got != exp {
+		t.Fatalf("unexpected subquery: %s", got)
+	}
+
+	var refs []string
+	ast.WalkFunc(cond, func(n ast.Node) {
+		if ref, ok := n.(*ast.VarRef); ok {
+			refs = append(refs, ref.Val)
+		}
+	})
+	if got, exp := strings.Join(refs, ","), "value,usage,host"; got != exp {
+		t.Fatalf("unexpected refs: got %s, exp %s", got, exp)
+	}
+}
+
+// Ensure regex conditions that match a single string are rewritten as equalities.
+func TestSelectStatement_RewriteRegexConditions(t *testing.T) {
+	var tests = []struct {
+		s    string
+		stmt string
+	}{
+		{s: `SELECT value FROM cpu WHERE host =~ /^host1$/`, stmt: `SELECT value FROM cpu WHERE host = 'host1'`},
+		{s: `SELECT value FROM cpu WHERE host !~ /^host1$/`, stmt: `SELECT value FROM cpu WHERE host != 'host1'`},
+		{s: `SELECT value FROM cpu WHERE host =~ /^a\.b$/ AND (region =~ /^$/ OR value > 1)`, stmt: `SELECT value FROM cpu WHERE host = 'a.b' AND (region = '' OR value > 1)`},
+		{s: `SELECT value FROM (SELECT value FROM cpu WHERE host =~ /^a$/) WHERE host =~ /^b$/`, stmt: `SELECT value FROM (SELECT value FROM cpu WHERE host = 'a') WHERE host = 'b'`},
+		{s: `SELECT value FROM cpu WHERE !(host =~ /^a$/) AND !region !~ /^b$/`, stmt: `SELECT value FROM cpu WHERE !(host = 'a') AND !region != 'b'`},
+
+		// Patterns matching more than one string are left alone.
+		{s: `SELECT value FROM cpu WHERE host =~ /host1/`, stmt: `SELECT value FROM cpu WHERE host =~ /host1/`},
+		{s: `SELECT value FROM cpu WHERE host =~ /^host1/`, stmt: `SELECT value FROM cpu WHERE host =~ /^host1/`},
+		{s: `SELECT value FROM cpu WHERE host =~ /^host.$/`, stmt: `SELECT value FROM cpu WHERE host =~ /^host.$/`},
+		{s: `SELECT value FROM cpu WHERE host =~ /^(?i)host1$/`, stmt: `SELECT value FROM cpu WHERE host =~ /^(?i)host1$/`},
+		{s: `SELECT value FROM cpu WHERE host =~ /(?m)^host1$/`, stmt: `SELECT value FROM cpu WHERE host =~ /(?m)^host1$/`},
+		{s: `SELECT value FROM cpu`, stmt: `SELECT value FROM cpu`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		stmt.(*ast.SelectStatement).RewriteRegexConditions()
+		if stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, stmt)
+		}
+	}
+}
+
+// Ensure operators applied to operands of the wrong type are rejected with
+// strict types.
+func TestParser_StrictTypes(t *testing.T) {
+	var tests = []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT value FROM cpu WHERE host::tag = 'a' AND value::integer > 5`},
+		{s: `SELECT value FROM cpu WHERE host > 5 AND value =~ /x/`},
+		{s: `SELECT value::float * 2, host::tag FROM cpu WHERE (value::float) < 1.5 OR ok::boolean = true`},
+		{s: `SELECT value FROM cpu WHERE host::tag =~ /x/ AND name::string !~ /y/`},
+		{s: `SELECT value FROM cpu WHERE d::integer < 1h`},
+
+		{s: `SELECT value FROM cpu WHERE host::tag > 5`, err: `cannot compare host::tag of type tag with 5 of type integer at line 1, char 39`},
+		{s: `SELECT value FROM cpu WHERE time > now() - 1h AND value::integer =~ /x/`, err: `cannot match value::integer of type integer against a regex at line 1, char 66`},
+		{s: `SELECT value FROM cpu WHERE (ok::boolean) =~ /x/`, err: `cannot match (ok::boolean) of type boolean against a regex at line 1, char 43`},
+		{s: `SELECT value FROM cpu WHERE ok::boolean = 1`, err: `cannot compare ok::boolean of type boolean with 1 of type integer at line 1, char 41`},
+		{s: `SELECT value FROM cpu WHERE 'a' = 1.5`, err: `cannot compare 'a' of type string with 1.500 of type float at line 1, char 33`},
+		{s: `SELECT host::tag + 1 FROM cpu`, err: `cannot apply + to host::tag of type tag at line 1, char 18`},
+		{s: `SELECT value FROM (SELECT value FROM cpu WHERE host::tag < 1)`, err: `cannot compare host::tag of type tag with 1 of type integer at line 1, char 58`},
+	}
+
+	for i, tt := range tests {
+		if _, err := parser.ParseStatement(tt.s); err != nil {
+			t.Fatalf("%d. %q: unexpected error without strict types: %s", i, tt.s, err)
+		}
+		if _, err := parser.ParseStatement(tt.s, parser.WithStrictTypes()); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+}
+
+// Ensure regex sources can be rejected.
+func TestParser_SetAllowRegexSources(t *testing.T) {
+	var tests = []struct {
+		s     string
+		allow bool
+		err   string
+	}{
+		{s: `SELECT * FROM /cpu.*/`, allow: true},
+		{s: `SELECT * FROM /cpu.*/`, allow: false, err: `regex sources are not allowed at line 1, char 15`},
+		{s: `SELECT * FROM db../cpu.*/`, allow: false, err: `regex sources are not allowed at line 1, char 19`},
+		{s: `SELECT * FROM (SELECT value FROM cpu, /mem/)`, allow: false, err: `regex sources are not allowed at line 1, char 39`},
+		{s: `SELECT * FROM cpu WHERE host =~ /a/`, allow: false},
+	}
+
+	for i, tt := range tests {
+		p := parser.NewParser(strings.NewReader(tt.s))
+		p.SetAllowRegexSources(tt.allow)
+		if _, err := p.ParseStatement(); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+
+	if _, err := parser.ParseStatement(`SELECT * FROM /cpu.*/`, parser.WithAllowRegexSources(false)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the numbers of fields and dimensions can be limited.
+func TestParser_SetMaxFields_SetMaxDimensions(t *testing.T) {
+	var tests = []struct {
+		s             string
+		maxFields     int
+		maxDimensions int
+		err           string
+	}{
+		{s: `SELECT a, b, c FROM cpu GROUP BY host, region`},
+		{s: `SELECT a, b, c FROM cpu GROUP BY host, region`, maxFields: 3, maxDimensions: 2},
+		{s: `SELECT a, b, c FROM cpu`, maxFields: 2, err: `too many fields, expected at most 2 at line 1, char 14`},
+		{s: `SELECT a,/b/ FROM cpu`, maxFields: 1, err: `too many fields, expected at most 1 at line 1, char 10`},
+		{s: `SELECT a FROM (SELECT a, b FROM cpu)`, maxFields: 1, err: `too many fields, expected at most 1 at line 1, char 26`},
+		{s: `SELECT a FROM cpu GROUP BY host, region, time(1m)`, maxDimensions: 2, err: `too many dimensions, expected at most 2 at line 1, char 42`},
+		{s: `SELECT a FROM cpu GROUP BY host,  /r/`, maxDimensions: 1, err: `too many dimensions, expected at most 1 at line 1, char 35`},
+		{s: `SELECT a, b FROM cpu GROUP BY host, region`, maxFields: 1, maxDimensions: 1, err: `too many fields, expected at most 1 at line 1, char 11`},
+	}
+
+	for i, tt := range tests {
+		p := parser.NewParser(strings.NewReader(tt.s))
+		p.SetMaxFields(tt.maxFields)
+		p.SetMaxDimensions(tt.maxDimensions)
+		if _, err := p.ParseStatement(); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+
+	if _, err := parser.ParseStatement(`SELECT a, b FROM cpu`, parser.WithMaxFields(1)); err == nil {
+		t.Fatal("expected error")
+	} else if _, err := parser.ParseStatement(`SELECT a FROM cpu GROUP BY a, b`, parser.WithMaxDimensions(1)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure interning identifiers does not change what is parsed.
+func TestParser_SetInternIdents(t *testing.T) {
+	s := strings.Repeat(`SELECT mean(value) FROM cpu WHERE host = 'a' GROUP BY host; `, 3) + `SELECT "value", a, b, c FROM cpu`
+	exp, err := parser.ParseQuery(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 100} {
+		q, err := parser.ParseQuery(s, parser.WithInternIdents(n))
+		if err != nil {
+			t.Fatalf("%d. %s", n, err)
+		} else if diffs := ast.Diff(exp, q); len(diffs) != 0 {
+			t.Errorf("%d. unexpected diff:\n%s", n, ast.FormatDiff(diffs))
+		}
+	}
+}
+
+// Ensure the number of values of a list can be limited.
+func TestParser_SetMaxListLength(t *testing.T) {
+	var tests = []struct {
+		s      string
+		params map[string]interface{}
+		max    int
+		err    string
+	}{
+		{s: `SELECT value FROM cpu WHERE host = ANY('a', 'b', 'c')`},
+		{s: `SELECT value FROM cpu WHERE host = ANY('a', 'b', 'c')`, max: 3},
+		{s: `SELECT value FROM cpu WHERE host = ANY('a', 'b', 'c')`, max: 2, err: `too many values for ANY, expected at most 2 at line 1, char 50`},
+		{s: `SELECT value FROM cpu WHERE value != ALL(1, 2 * 3)`, max: 1, err: `too many values for ALL, expected at most 1 at line 1, char 45`},
+		{s: `SELECT value FROM cpu WHERE host = ANY($hosts)`, params: map[string]interface{}{"hosts": []interface{}{"a", "b"}}, max: 2},
+		{s: `SELECT value FROM cpu WHERE host = ANY('a', $hosts)`, params: map[string]interface{}{"hosts": []interface{}{"b", "c"}}, max: 2, err: `too many values for ANY, expected at most 2 at line 1, char 45`},
+	}
+
+	for i, tt := range tests {
+		p := parser.NewParser(strings.NewReader(tt.s))
+		if err := p.SetParams(tt.params); err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		p.SetMaxListLength(tt.max)
+		if _, err := p.ParseStatement(); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+
+	if _, err := parser.ParseStatement(`SELECT value FROM cpu WHERE host = ANY('a', 'b')`, parser.WithMaxListLength(1)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure lists may end with a comma on request, and that such a comma is
+// reported as such otherwise.
+func TestParser_SetAllowTrailingCommas(t *testing.T) {
+	var tests = []struct {
+		s    string
+		stmt string
+		err  string
+	}{
+		{s: `SELECT a, b, FROM m`, stmt: `SELECT a, b FROM m`, err: `trailing comma before FROM at line 1, char 12`},
+		{s: `SELECT a,FROM m`, stmt: `SELECT a FROM m`, err: `trailing comma before FROM at line 1, char 9`},
+		{s: `SELECT a, INTO t FROM m`, stmt: `SELECT a INTO t FROM m`, err: `trailing comma before INTO at line 1, char 9`},
+		{s: `SELECT mean(a) FROM m GROUP BY host, time(1m),`, stmt: `SELECT mean(a) FROM m GROUP BY host, time(1m)`, err: `trailing comma before EOF at line 1, char 46`},
+		{s: `SELECT mean(a) FROM m GROUP BY host, fill(0)`, stmt: `SELECT mean(a) FROM m GROUP BY host fill(0)`, err: `trailing comma before fill at line 1, char 36`},
+		{s: `SELECT mean(a) FROM m GROUP BY host, ORDER BY time DESC`, stmt: `SELECT mean(a) FROM m GROUP BY host ORDER BY time DESC`, err: `trailing comma before ORDER at line 1, char 36`},
+		{s: `SELECT a FROM m, n, WHERE a > 1`, stmt: `SELECT a FROM m, n WHERE a > 1`, err: `trailing comma before WHERE at line 1, char 19`},
+		{s: `SELECT a FROM m, ; SELECT b FROM n`, stmt: `SELECT a FROM m`, err: `trailing comma before ; at line 1, char 16`},
+		{s: `SELECT top(a, host, 3,) FROM m`, stmt: `SELECT top(a, host, 3) FROM m`, err: `trailing comma before ) at line 1, char 22`},
+		{s: `SELECT * EXCEPT(a, b,) FROM m`, stmt: `SELECT * EXCEPT(a, b) FROM m`, err: `trailing comma before ) at line 1, char 21`},
+		{s: `SELECT a FROM (SELECT a, b, FROM m)`, stmt: `SELECT a FROM (SELECT a, b FROM m)`, err: `trailing comma before FROM at line 1, char 27`},
+		{s: `SELECT a FROM m GROUP BY host, /reg/`, stmt: `SELECT a FROM m GROUP BY host, /reg/`},
+		{s: `SELECT a, fill FROM m GROUP BY host, fill`, stmt: `SELECT a, fill FROM m GROUP BY host, fill`},
+	}
+
+	for i, tt := range tests {
+		if _, err := parser.ParseStatement(tt.s); errstring(err) != tt.err {
+			t.Errorf("%d. %q: strict error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+		stmt, err := parser.ParseStatement(tt.s, parser.WithAllowTrailingCommas())
+		if err != nil {
+			t.Errorf("%d. %q: unexpected error: %s", i, tt.s, err)
+		} else if stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: statement mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, stmt)
+		}
+	}
+
+	// Only one comma may end a list.
+	if _, err := parser.ParseStatement(`SELECT a,, FROM m`, parser.WithAllowTrailingCommas()); errstring(err) != `found ,, expected identifier, string, number, bool at line 1, char 10` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a statement cannot cast the same name to conflicting types.
+func TestParseStatement_ConflictingCasts(t *testing.T) {
+	var tests = []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT value::float, value::integer FROM cpu`, err: `conflicting types for value: float and integer at line 1, char 22`},
+		{s: `SELECT host::tag FROM cpu WHERE host::field = 'a'`, err: `conflicting types for host: tag and field at line 1, char 33`},
+		{s: `SELECT value::integer + 1 FROM cpu WHERE value::float > 1 AND value::integer < 5`, err: `conflicting types for value: float and integer at line 1, char 42`},
+		{s: `SELECT mean(value::float) FROM cpu GROUP BY time(1m), value::string`, err: `conflicting types for value: float and string at line 1, char 55`},
+
+		// Consistent casts.
+		{s: `SELECT value::float FROM cpu WHERE value::float > 1`},
+		{s: `SELECT value::field FROM cpu WHERE value::float > 1`},
+		{s: `SELECT value FROM cpu WHERE value::integer > 1`},
+		{s: `SELECT @value::integer, value::float FROM cpu`},
+		{s: `SELECT value::float FROM (SELECT value::integer FROM cpu)`},
+		{s: `SELECT value::float FROM cpu WHERE value > (SELECT max(value::integer) FROM cpu)`},
+	}
+
+	for i, tt := range tests {
+		if _, err := parser.ParseStatement(tt.s); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+
+	refs := []ast.VarRef{{Val: "a", Type: ast.Integer}, {Val: "b", Type: ast.Tag}, {Val: "a"}, {Val: "b", Type: ast.AnyField}, {Val: "a", Type: ast.Float}}
+	if a, b, ok := ast.TypeConflict(refs); !ok || a != (ast.VarRef{Val: "a", Type: ast.Float}) || b != (ast.VarRef{Val: "a", Type: ast.Integer}) {
+		t.Errorf("unexpected conflict: %v, %v, %v", a, b, ok)
+	}
+	if _, _, ok := ast.TypeConflict(refs[1:4]); !ok {
+		t.Error("expected tag and field to conflict")
+	}
+	if a, b, ok := ast.TypeConflict(refs[:3]); ok {
+		t.Errorf("unexpected conflict: %v, %v", a, b)
+	}
+}
+
+// Ensure a standalone condition only references allowed names and now().
+func TestParseCondition(t *testing.T) {
+	allowed := map[string]ast.DataType{"cpu": ast.Float, "host": ast.Tag}
+	var tests = []struct {
+		s    string
+		opts []parser.Option
+		exp  string
+		err  string
+	}{
+		{s: `cpu > 80 AND host =~ /prod/`, exp: `cpu::float > 80 AND host::tag =~ /prod/`},
+		{s: `cpu::float > 80`, exp: `cpu::float > 80`},
+		{s: `cpu::field > 80`, exp: `cpu::float > 80`},
+		{s: `time > now() - 1h AND cpu > 80`, opts: []parser.Option{parser.WithTimeInCondition()}, exp: `time::time > now() - 1h AND cpu::float > 80`},
+
+		{s: `cpu > 80 AND region = 'us'`, err: `unknown identifier region at line 1, char 14`},
+		{s: `@cpu > 80`, err: `unknown identifier @cpu at line 1, char 1`},
+		{s: `time > now() - 1h`, err: `time is not allowed in the condition at line 1, char 1`},
+		{s: `mean(cpu) > 80`, err: `function mean is not allowed in the condition, only now() is at line 1, char 1`},
+		{s: `host::field = 'a'`, err: `cannot cast host to field, it is declared as tag at line 1, char 1`},
+		{s: `cpu > 80 host`, err: `found host, expected operator, EOF at line 1, char 10`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseCondition(tt.s, allowed, tt.opts...)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && expr.String() != tt.exp {
+			t.Errorf("%d. %q: condition mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.exp, expr)
+		}
+	}
+}
+
+// Ensure a statement without a lower bound of time is rejected on request.
+func TestSelectStatement_RequireTimeRange(t *testing.T) {
+	var tests = []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT value FROM cpu WHERE time > now() - 1h`},
+		{s: `SELECT value FROM cpu WHERE host = 'a' AND time >= '2000-01-01T00:00:00Z'`},
+		{s: `SELECT value FROM cpu WHERE now() - 1h < time`},
+		{s: `SELECT mean(value) FROM (SELECT value FROM cpu WHERE time > now() - 1h)`},
+		{s: `SELECT mean(value) FROM (SELECT value FROM cpu WHERE time > now() - 1h UNION SELECT value FROM mem WHERE time > now() - 2h)`},
+		{s: `SELECT mean(value) FROM (SELECT value FROM cpu WHERE time > now() - 1h UNION SELECT value FROM mem)`, err: `time must have a lower bound, such as time > now() - 1h`},
+		{s: `SELECT value FROM cpu`, err: `time must have a lower bound, such as time > now() - 1h`},
+		{s: `SELECT value FROM cpu WHERE time < now()`, err: `time must have a lower bound, such as time > now() - 1h`},
+		{s: `SELECT value FROM cpu WHERE time > now() - 1h OR host = 'a'`, err: `time must have a lower bound, such as time > now() - 1h`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: unexpected error: %s", i, tt.s, err)
+		}
+		if err := stmt.(*ast.SelectStatement).RequireTimeRange(); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+}
+
+// Ensure a default time range is applied to statements without a time
+// filter, and every statement is clamped to a hard maximum range.
+func TestSelectStatement_EnsureTimeRange(t *testing.T) {
+	now := time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+	def := ast.TimeRange{Min: now.Add(-time.Hour)}
+	limit := ast.TimeRange{Min: now.Add(-24 * time.Hour), Max: now}
+
+	var tests = []struct {
+		s      string
+		limits []ast.TimeRange
+		stmt   string
+		filter bool
+		tr     ast.TimeRange
+	}{
+		{
+			s:    `SELECT value FROM cpu`,
+			stmt: `SELECT value FROM cpu WHERE time >= '2000-01-01T23:00:00Z'`,
+			tr:   def,
+		},
+		{
+			s:    `SELECT value FROM cpu WHERE host = 'a' OR host = 'b'`,
+			stmt: `SELECT value FROM cpu WHERE (host = 'a' OR host = 'b') AND time >= '2000-01-01T23:00:00Z'`,
+			tr:   def,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE time > now() - 2h AND host = 'a'`,
+			stmt:   `SELECT value FROM cpu WHERE time > now() - 2h AND host = 'a'`,
+			filter: true,
+			tr:     ast.TimeRange{Min: now.Add(-2 * time.Hour)},
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE time < now()`,
+			stmt:   `SELECT value FROM cpu WHERE time < now() AND time >= '2000-01-01T23:00:00Z'`,
+			filter: true,
+			tr:     ast.TimeRange{Min: def.Min, Max: now},
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE time IN ('2000-01-01T00:00:00Z')`,
+			stmt:   `SELECT value FROM cpu WHERE time IN ("2000-01-01T00:00:00Z") AND time >= '2000-01-01T23:00:00Z'`,
+			filter: true,
+			tr:     def,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE !(time < now() - 1h)`,
+			stmt:   `SELECT value FROM cpu WHERE !(time < now() - 1h) AND time >= '2000-01-01T23:00:00Z'`,
+			filter: true,
+			tr:     def,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE time > now() - 7d`,
+			limits: []ast.TimeRange{limit},
+			stmt:   `SELECT value FROM cpu WHERE time > now() - 1w AND time >= '2000-01-01T00:00:00Z' AND time <= '2000-01-02T00:00:00Z'`,
+			filter: true,
+			tr:     limit,
+		},
+		{
+			s:      `SELECT value FROM cpu`,
+			limits: []ast.TimeRange{limit},
+			stmt:   `SELECT value FROM cpu WHERE time >= '2000-01-01T23:00:00Z' AND time >= '2000-01-01T00:00:00Z' AND time <= '2000-01-02T00:00:00Z'`,
+			tr:     ast.TimeRange{Min: def.Min, Max: now},
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: unexpected error: %s", i, tt.s, err)
+		}
+		sel := stmt.(*ast.SelectStatement)
+		if filter := sel.HasTimeFilter(); filter != tt.filter {
+			t.Errorf("%d. %q: filter mismatch: exp=%v got=%v", i, tt.s, tt.filter, filter)
+		}
+		sel.EnsureTimeRange(def, tt.limits...)
+		if s := sel.String(); s != tt.stmt {
+			t.Errorf("%d. %q: statement mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, s)
+		}
+		if tr := sel.TimeRangeAt(now); !tr.Min.Equal(tt.tr.Min) || !tr.Max.Equal(tt.tr.Max) {
+			t.Errorf("%d. %q: time range mismatch:\n  exp=%v\n  got=%v", i, tt.s, tt.tr, tr)
+		}
+	}
+}
+
+// Ensure time expressions, including the relative day functions, are
+// evaluated against now in a location.
+func TestEvalTimeExpr(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var tests = []struct {
+		s   string
+		loc *time.Location
+		exp string
+		err string
+	}{
+		{s: `now()`, exp: `2000-01-02T03:04:05Z`},
+		{s: `now() - 1h`, exp: `2000-01-02T02:04:05Z`},
+		{s: `'2000-01-01'`, exp: `2000-01-01T00:00:00Z`},
+		{s: `today()`, exp: `2000-01-02T00:00:00Z`},
+		{s: `TODAY()`, exp: `2000-01-02T00:00:00Z`},
+		{s: `yesterday()`, exp: `2000-01-01T00:00:00Z`},
+		{s: `tomorrow()`, exp: `2000-01-03T00:00:00Z`},
+		{s: `today() + 6h`, exp: `2000-01-02T06:00:00Z`},
+		{s: `(yesterday())`, exp: `2000-01-01T00:00:00Z`},
+		{s: `today()`, loc: paris, exp: `2000-01-02T00:00:00+01:00`},
+		{s: `today`, err: `cannot evaluate today as a time`},
+		{s: `mean(value)`, err: `cannot evaluate mean(value) as a time`},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: unexpected error: %s", i, tt.s, err)
+		}
+		got, err := ast.EvalTimeExpr(expr, now, tt.loc)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && got.Format(time.RFC3339) != tt.exp {
+			t.Errorf("%d. %q: time mismatch: exp=%s got=%s", i, tt.s, tt.exp, got.Format(time.RFC3339))
+		}
+	}
+
+	// A reference named today is not the function.
+	stmt, err := parser.ParseStatement(`SELECT today FROM cpu WHERE time >= today()`)
+	if err != nil {
+		t.Fatal(err)
+	} else if s := stmt.String(); s != `SELECT today FROM cpu WHERE time >= today()` {
+		t.Fatalf("unexpected statement: %s", s)
+	} else if stmt.(*ast.SelectStatement).RequireTimeRange() != nil {
+		t.Fatal("expected today() to bound time")
+	}
+}
+
+// Ensure every combination of source segments, with and without a regex, is
+// assigned to the right fields and round-trips.
+func TestParseStatement_SourceSegments(t *testing.T) {
+	var tests = []struct {
+		s             string
+		db, ttl, name string
+		regex         string
+		out           string
+		err           string
+	}{
+		{s: `cpu`, name: `cpu`, out: `cpu`},
+		{s: `ttl.cpu`, ttl: `ttl`, name: `cpu`, out: `ttl.cpu`},
+		{s: `db.ttl.cpu`, db: `db`, ttl: `ttl`, name: `cpu`, out: `db.ttl.cpu`},
+		{s: `db..cpu`, db: `db`, name: `cpu`, out: `db..cpu`},
+		{s: `"".ttl.cpu`, ttl: `ttl`, name: `cpu`, out: `ttl.cpu`},
+		{s: `db.ttl.""`, db: `db`, ttl: `ttl`, out: `db.ttl.""`},
+		{s: `/re/`, regex: `/re/`, out: `/re/`},
+		{s: `ttl./re/`, ttl: `ttl`, regex: `/re/`, out: `ttl./re/`},
+		{s: `db.ttl./re/`, db: `db`, ttl: `ttl`, regex: `/re/`, out: `db.ttl./re/`},
+		{s: `db../re/`, db: `db`, regex: `/re/`, out: `db../re/`},
+		{s: `db.""./re/`, db: `db`, regex: `/re/`, out: `db../re/`},
+		{s: `"".ttl./re/`, ttl: `ttl`, regex: `/re/`, out: `ttl./re/`},
+		{s: `""./re/`, regex: `/re/`, out: `/re/`},
+
+		{s: `db.ttl.cpu./re/`, err: `too many segments before regex in "db"."ttl".cpu./re/ at line 1, char 26`},
+		{s: `db..cpu./re/`, err: `too many segments before regex in "db"..cpu./re/ at line 1, char 23`},
+		{s: `db.../re/`, err: `too many segments before regex in "db"..""./re/ at line 1, char 20`},
+		{s: `a.b.c.d`, err: `too many segments in "a"."b"."c".d at line 1, char 1`},
+		{s: `cpu/re/`, err: `found /, expected ; at line 1, char 18`},
+		{s: `ttl.cpu /re/`, err: `found /, expected ; at line 1, char 23`},
+		{s: `db.:x`, err: `found :, expected identifier, regex at line 1, char 18`},
+		{s: `ttl.cpu.:x`, err: `found :, expected identifier, regex at line 1, char 23`},
+		{s: `..cpu`, err: `found ., expected identifier at line 1, char 15`},
+		{s: `db.ttl.`, err: `found EOF, expected identifier at line 1, char 22`},
+	}
+
+	for i, tt := range tests {
+		q, err := parser.ParseQuery(`SELECT v FROM ` + tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		m := q.Statements[0].(*ast.SelectStatement).Sources[0].(*ast.Metric)
+		var regex string
+		if m.Regex != nil {
+			regex = m.Regex.String()
+		}
+		if m.Database != tt.db || m.TimeToLive != tt.ttl || m.Name != tt.name || regex != tt.regex {
+			t.Errorf("%d. %q: segments mismatch: exp=%q %q %q %q got=%q %q %q %q", i, tt.s,
+				tt.db, tt.ttl, tt.name, tt.regex, m.Database, m.TimeToLive, m.Name, regex)
+		} else if m.String() != tt.out {
+			t.Errorf("%d. %q: string mismatch: exp=%s got=%s", i, tt.s, tt.out, m)
+		} else if q2, err := parser.ParseQuery(`SELECT v FROM ` + m.String()); err != nil {
+			t.Errorf("%d. %q: cannot parse %s: %s", i, tt.s, m, err)
+		} else if diff := ast.Diff(q, q2); len(diff) != 0 {
+			t.Errorf("%d. %q: round trip mismatch:\n%s", i, tt.s, ast.FormatDiff(diff))
+		}
+	}
+}
+
+// Ensure the names defined by WITH are listed in order.
+func TestSelectStatement_CTENames(t *testing.T) {
+	stmt, err := parser.ParseStatement(`WITH b AS (SELECT v FROM cpu), a AS (SELECT v FROM b) SELECT v FROM a, b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := stmt.(*ast.SelectStatement).CTENames(); !reflect.DeepEqual(names, []string{"b", "a"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	stmt, err = parser.ParseStatement(`SELECT v FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	} else if names := stmt.(*ast.SelectStatement).CTENames(); names != nil {
+		t.Fatalf("unexpected names: %v", names)
+	}
+}
+
+// Ensure the names defined by WITH before a union are defined for all of its
+// statements.
+func TestUnionStatement_CTENames(t *testing.T) {
+	s := `WITH base AS (SELECT v FROM cpu), t AS (SELECT v FROM base) SELECT max(v) FROM t UNION SELECT min(v) FROM base`
+	stmt, err := parser.ParseStatement(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if stmt.String() != s {
+		t.Fatalf("unexpected string: %s", stmt)
+	}
+
+	union := stmt.(*ast.UnionStatement)
+	if names := union.CTENames(); !reflect.DeepEqual(names, []string{"base", "t"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+	for i, stmt := range union.Statements {
+		if names := stmt.CTENames(); names != nil {
+			t.Fatalf("%d. unexpected names of the statement: %v", i, names)
+		}
+	}
+	if ref, ok := union.Statements[1].Sources[0].(*ast.CTERef); !ok || ref.Statement != union.CTEs[0].Statement {
+		t.Fatalf("unexpected source of the second statement: %#v", union.Statements[1].Sources[0])
+	}
+}
+
+// Ensure sources named like a statement defined by WITH refer to it, in the
+// statement and in the statements named after it.
+func TestSelectStatement_CTERef(t *testing.T) {
+	s := `WITH a AS (SELECT v FROM cpu WHERE time > now() - 1h), b AS (SELECT max(v) AS v FROM (SELECT v FROM a)) SELECT v FROM b, db.rp.a`
+	stmt, err := parser.ParseStatement(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if stmt.String() != s {
+		t.Fatalf("unexpected string: %s", stmt)
+	}
+
+	sel := stmt.(*ast.SelectStatement)
+	a, b := sel.CTEs[0].Statement, sel.CTEs[1].Statement
+	if ref, ok := sel.Sources[0].(*ast.CTERef); !ok || ref.Name != "b" || ref.Statement != b {
+		t.Fatalf("unexpected source: %#v", sel.Sources[0])
+	} else if m, ok := sel.Sources[1].(*ast.Metric); !ok || m.String() != "db.rp.a" {
+		t.Fatalf("unexpected source: %#v", sel.Sources[1])
+	}
+	inner := b.Sources[0].(*ast.SubQuery).Statement
+	if ref, ok := inner.Sources[0].(*ast.CTERef); !ok || ref.Name != "a" || ref.Statement != a {
+		t.Fatalf("unexpected nested source: %#v", inner.Sources[0])
+	}
+
+	// The metrics read through the named statements are dependencies.
+	if got := ast.Metrics(sel.Dependencies().Metrics).String(); got != "cpu, db.rp.a" {
+		t.Fatalf("unexpected metrics: %s", got)
+	}
+}
+
+// Ensure wildcard fields exclude the names listed by EXCEPT.
+func TestParseStatement_WildcardExcept(t *testing.T) {
+	var tests = []struct {
+		s    string
+		stmt string
+		err  string
+	}{
+		{s: `SELECT *::field EXCEPT(debug_blob, raw_payload) FROM m`, stmt: `SELECT *::field EXCEPT(debug_blob, raw_payload) FROM m`},
+		{s: `SELECT * except ( "a b" ), *::tag EXCEPT(host) FROM m`, stmt: `SELECT * EXCEPT("a b"), *::tag EXCEPT(host) FROM m`},
+		{s: `SELECT except, "except" FROM except`, stmt: `SELECT except, except FROM except`},
+		{s: `SELECT * EXCEPT FROM m`, err: `found FROM, expected ( at line 1, char 17`},
+		{s: `SELECT * EXCEPT() FROM m`, err: `found ), expected identifier at line 1, char 17`},
+		{s: `SELECT * EXCEPT(a, 'b') FROM m`, err: `found b, expected identifier at line 1, char 20`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && stmt.String() != tt.stmt {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, stmt)
+		}
+	}
+}
+
+// Ensure wildcard fields are expanded into the names they select.
+func TestSelectStatement_RewriteFields(t *testing.T) {
+	fields, tags := []string{"value", "debug", "host"}, []string{"region", "host"}
+	var tests = []struct {
+		s    string
+		stmt string
+		err  string
+	}{
+		{s: `SELECT * FROM m`, stmt: `SELECT debug, host, host::tag, region::tag, value FROM m`},
+		{s: `SELECT mean(value), *::field EXCEPT(debug) FROM m`, stmt: `SELECT mean(value), host, value FROM m`},
+		{s: `SELECT *::tag EXCEPT(host) FROM m`, stmt: `SELECT region::tag FROM m`},
+		{s: `SELECT * EXCEPT(host, debug) FROM m`, stmt: `SELECT region::tag, value FROM m`},
+		{s: `SELECT *::tag EXCEPT(value) FROM m`, err: `EXCEPT name value is not selected by *::tag`},
+		{s: `SELECT *::field EXCEPT(nope) FROM m`, err: `EXCEPT name nope is not selected by *::field`},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: unexpected error: %s", i, tt.s, err)
+		}
+		rewritten, err := stmt.(*ast.SelectStatement).RewriteFields(fields, tags)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if err == nil && rewritten.String() != tt.stmt {
+			t.Errorf("%d. %q: output mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.stmt, rewritten)
+		} else if stmt.String() != tt.s {
+			t.Errorf("%d. %q: statement modified: %s", i, tt.s, stmt)
+		}
+	}
+}
+
+// Ensure the number of fill() is converted to the type of the aggregates
+// without loss, and a fill() that is not a number is reported where it is.
+func TestSelectStatement_CoerceFillValue(t *testing.T) {
+	var tests = []struct {
+		s      string
+		target ast.DataType
+		value  interface{}
+		err    string
+	}{
+		{s: `fill(1)`, target: ast.Float, value: float64(1)},
+		{s: `fill(-3)`, target: ast.Float, value: float64(-3)},
+		{s: `fill(9007199254740993)`, target: ast.Float, err: `cannot convert fill(9007199254740993) to float without loss`},
+		{s: `fill(1.5)`, target: ast.Float, value: 1.5},
+		{s: `fill(2.0)`, target: ast.Integer, value: int64(2)},
+		{s: `fill(1.5)`, target: ast.Integer, err: `cannot convert fill(1.5) to integer without loss`},
+		{s: `fill(7)`, target: ast.Integer, value: int64(7)},
+		{s: `fill(7)`, target: ast.Unsigned, value: uint64(7)},
+		{s: `fill(-1)`, target: ast.Unsigned, err: `cannot convert fill(-1) to unsigned without loss`},
+		{s: `fill(1)`, target: ast.Boolean, err: `cannot fill boolean values with a number`},
+		{s: `fill(1)`, target: ast.String, err: `cannot fill string values with a number`},
+		{s: `fill(1.5)`, target: ast.Unknown, value: 1.5},
+		{s: `fill(previous)`, target: ast.Integer},
+	}
+
+	for i, tt := range tests {
+		s := `SELECT mean(value) FROM cpu GROUP BY time(1m) ` + tt.s
+		stmt, err := parser.ParseStatement(s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, s, err)
+		}
+		sel := stmt.(*ast.SelectStatement)
+		if err := sel.CoerceFillValue(tt.target); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, s, tt.err, err)
+		} else if err == nil && !reflect.DeepEqual(sel.FillValue, tt.value) {
+			t.Errorf("%d. %q: value mismatch: exp=%#v got=%#v", i, s, tt.value, sel.FillValue)
+		}
+	}
+
+	for i, tt := range []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT mean(value) FROM cpu GROUP BY time(1m) fill('foo')`, err: `expected number argument in fill() at line 1, char 52`},
+		{s: `SELECT mean(value) FROM cpu GROUP BY time(1m) fill( true )`, err: `expected number argument in fill() at line 1, char 53`},
+		{s: `SELECT mean(value) FROM cpu GROUP BY time(1m) fill(/x/)`, err: `expected number argument in fill() at line 1, char 52`},
+		{s: `SELECT mean(value) FROM cpu GROUP BY time(1m) fill(1, 2)`, err: `fill requires an argument, e.g.: 0, null, none, previous, linear at line 1, char 47`},
+		{s: `SELECT mean(value) FROM cpu GROUP BY time(1m) fill()`, err: `fill requires an argument, e.g.: 0, null, none, previous, linear at line 1, char 47`},
+		{s: "SELECT mean(value) FROM cpu GROUP BY time(1m)\nfill 0", err: `fill must be a function call at line 2, char 1`},
+	} {
+		_, err := parser.ParseStatement(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if _, ok := err.(*parser.ParseError); !ok {
+			t.Errorf("%d. %q: unexpected error type: %T", i, tt.s, err)
+		}
+	}
+}
+
+// Ensure the references of an expression are listed once each, in the same
+// order every time.
+func TestExprNames(t *testing.T) {
+	expr, err := parser.ParseExpr(`b::tag + a::float * mean(c) - a::integer + b::tag / (d + time + a::float) > e`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []ast.VarRef{
+		{Val: "a", Type: ast.Float},
+		{Val: "a", Type: ast.Integer},
+		{Val: "b", Type: ast.Tag},
+		{Val: "c"},
+		{Val: "d"},
+		{Val: "e"},
+	}
+	for i := 0; i < 100; i++ {
+		if names := ast.ExprNames(expr); !reflect.DeepEqual(names, exp) {
+			t.Fatalf("%d. unexpected names:\n  exp=%v\n  got=%v", i, exp, names)
+		}
+	}
+}
+
+// Ensure references are listed sorted or in source order, with or without time,
+// and that the same name with different types gives distinct references.
+func TestExprRefs_FirstAppearanceRefs(t *testing.T) {
+	var tests = []struct {
+		s       string
+		sorted  []ast.VarRef
+		ordered []ast.VarRef
+		time    bool
+	}{
+		{
+			s:       `b::tag + a::float * mean(c) - a::integer + b::tag / (d + time + a::float) > e`,
+			sorted:  []ast.VarRef{{Val: "a", Type: ast.Float}, {Val: "a", Type: ast.Integer}, {Val: "b", Type: ast.Tag}, {Val: "c"}, {Val: "d"}, {Val: "e"}},
+			ordered: []ast.VarRef{{Val: "b", Type: ast.Tag}, {Val: "a", Type: ast.Float}, {Val: "c"}, {Val: "a", Type: ast.Integer}, {Val: "d"}, {Val: "e"}},
+		},
+		{
+			s:       `time > now() - 1h AND host = 'a' AND time < now()`,
+			sorted:  []ast.VarRef{{Val: "host"}, {Val: "time"}},
+			ordered: []ast.VarRef{{Val: "time"}, {Val: "host"}},
+			time:    true,
+		},
+		{
+			s:       `time > now() - 1h AND host = 'a'`,
+			sorted:  []ast.VarRef{{Val: "host"}},
+			ordered: []ast.VarRef{{Val: "host"}},
+		},
+		{
+			s:       `x::tag = 'a' OR x::field = 1 OR x = 2`,
+			sorted:  []ast.VarRef{{Val: "x"}, {Val: "x", Type: ast.Tag}, {Val: "x", Type: ast.AnyField}},
+			ordered: []ast.VarRef{{Val: "x", Type: ast.Tag}, {Val: "x", Type: ast.AnyField}, {Val: "x"}},
+		},
+		{
+			s:       `1 + 2`,
+			sorted:  []ast.VarRef{},
+			ordered: []ast.VarRef{},
+		},
+	}
+
+	for i, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: %s", i, tt.s, err)
+		}
+		if refs := ast.ExprRefs(expr, tt.time); !reflect.DeepEqual(refs, tt.sorted) {
+			t.Errorf("%d. %q: sorted refs mismatch:\n  exp=%v\n  got=%v", i, tt.s, tt.sorted, refs)
+		}
+		if refs := ast.FirstAppearanceRefs(expr, tt.time); !reflect.DeepEqual(refs, tt.ordered) {
+			t.Errorf("%d. %q: ordered refs mismatch:\n  exp=%v\n  got=%v", i, tt.s, tt.ordered, refs)
+		}
+	}
+
+	// Many distinct names are still listed once each.
+	var terms []string
+	for i := 0; i < 40; i++ {
+		terms = append(terms, fmt.Sprintf("f%02d = 1 OR f%02d = 2", i, i))
+	}
+	expr, err := parser.ParseExpr(strings.Join(terms, " OR "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := ast.FirstAppearanceRefs(expr, false)
+	if len(refs) != 40 {
+		t.Fatalf("unexpected number of refs: %d", len(refs))
+	}
+	for i, ref := range refs {
+		if exp := fmt.Sprintf("f%02d", i); ref.Val != exp {
+			t.Fatalf("%d. unexpected ref: exp=%s got=%s", i, exp, ref.Val)
+		}
+	}
+}
+
+// Ensure the names a statement selects are told apart from the ones it filters on.
+func TestSelectStatement_FieldNames(t *testing.T) {
+	var tests = []struct {
+		s         string
+		fields    []string
+		condition []string
+	}{
+		{
+			s:         `SELECT mean(usage) * 2, max(idle), host::tag, usage FROM cpu WHERE region = 'us' AND (host =~ /^a/ OR usage > 1) AND time > now() - 1h`,
+			fields:    []string{"host", "idle", "usage"},
+			condition: []string{"host", "region", "usage"},
+		},
+		{
+			s:      `SELECT count(DISTINCT host), time FROM cpu`,
+			fields: []string{"host"},
+		},
+		{
+			s:         `SELECT * FROM cpu WHERE usage > (SELECT mean(idle) FROM cpu WHERE zone = 'a')`,
+			condition: []string{"usage"},
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: unexpected error: %s", i, tt.s, err)
+		}
+		s := stmt.(*ast.SelectStatement)
+		if names := s.FieldNames(); !reflect.DeepEqual(names, tt.fields) {
+			t.Errorf("%d. %q: field names mismatch:\n  exp=%v\n  got=%v", i, tt.s, tt.fields, names)
+		}
+		if names := s.ConditionNames(); !reflect.DeepEqual(names, tt.condition) {
+			t.Errorf("%d. %q: condition names mismatch:\n  exp=%v\n  got=%v", i, tt.s, tt.condition, names)
+		}
+	}
+}
+
+// Ensure bound parameters of a statement built by hand are substituted in a
+// copy of the statement.
+func TestSelectStatement_Substitute(t *testing.T) {
+	stmt := &ast.SelectStatement{
+		Fields: []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+		Sources: []ast.Source{&ast.SubQuery{Statement: &ast.SelectStatement{
+			Fields:  []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+			Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+			Condition: &ast.BinaryExpr{
+				Op:  token.EQREGEX,
+				LHS: &ast.VarRef{Val: "region"},
+				RHS: &ast.BoundParameter{Name: "region"},
+			},
+		}}},
+		Condition: &ast.BinaryExpr{
+			Op: token.AND,
+			LHS: &ast.BinaryExpr{
+				Op:  token.EQ,
+				LHS: &ast.VarRef{Val: "host"},
+				RHS: &ast.BoundParameter{Name: "host"},
+			},
+			RHS: &ast.BinaryExpr{
+				Op:  token.GT,
+				LHS: &ast.VarRef{Val: "value"},
+				RHS: &ast.BoundParameter{Name: "min"},
+			},
+		},
+	}
+	orig := stmt.String()
+
+	got, err := parser.Substitute(stmt, map[string]interface{}{
+		"host":   "server01",
+		"min":    10,
+		"region": &ast.RegexLiteral{Val: regexp.MustCompile(`^us-`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `SELECT value FROM (SELECT value FROM cpu WHERE region =~ /^us-/) WHERE host = 'server01' AND value > 10`; got.String() != exp {
+		t.Fatalf("unexpected statement:\n  exp=%s\n  got=%s", exp, got)
+	} else if stmt.String() != orig {
+		t.Fatalf("statement modified: %s", stmt)
+	}
+
+	for _, tt := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{params: map[string]interface{}{"host": "a", "min": 1.5}, err: `missing parameter: region`},
+		{params: map[string]interface{}{"host": []string{"a"}, "min": 1, "region": "a"}, err: `unable to bind parameter host: unable to bind parameter with type []string`},
+		{params: map[string]interface{}{"host": []interface{}{"a"}, "min": 1, "region": "a"}, err: `unable to bind parameter host: list parameter $host must be used in ANY or ALL`},
+		{params: map[string]interface{}{"host": "a", "min": 1, "region": map[string]interface{}{"regex": "("}}, err: "unable to bind parameter region: error parsing regexp: missing closing ): `(`"},
+	} {
+		if _, err := parser.Substitute(stmt, tt.params); errstring(err) != tt.err {
+			t.Errorf("error mismatch:\n  exp=%s\n  got=%s", tt.err, err)
+		}
+	}
+}
+
+// Ensure each place of a parameter gets its own copy of its expression, and
+// that the parameters in the expression are not substituted again.
+func TestSelectStatement_Substitute_Copies(t *testing.T) {
+	stmt := &ast.SelectStatement{
+		Fields:  []*ast.Field{{Expr: &ast.VarRef{Val: "value"}}},
+		Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+		Condition: &ast.BinaryExpr{
+			Op:  token.AND,
+			LHS: &ast.BinaryExpr{Op: token.GT, LHS: &ast.VarRef{Val: "a"}, RHS: &ast.BoundParameter{Name: "x"}},
+			RHS: &ast.BinaryExpr{Op: token.LT, LHS: &ast.VarRef{Val: "c"}, RHS: &ast.BoundParameter{Name: "x"}},
+		},
+	}
+	value := &ast.IntegerLiteral{Val: 1}
+	got, err := stmt.Substitute(map[string]ast.Expr{"x": value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cond := got.Condition.(*ast.BinaryExpr)
+	l, r := cond.LHS.(*ast.BinaryExpr).RHS, cond.RHS.(*ast.BinaryExpr).RHS
+	if l == r {
+		t.Fatal("places of the parameter share the same copy")
+	} else if l == ast.Expr(value) || r == ast.Expr(value) {
+		t.Fatal("the expression of the parameter is shared with the copy")
+	}
+
+	// A parameter whose expression refers to itself, or to a parameter that
+	// refers back to it, is replaced once.
+	for _, params := range []map[string]ast.Expr{
+		{"x": &ast.BoundParameter{Name: "x"}},
+		{"x": &ast.BoundParameter{Name: "y"}, "y": &ast.BoundParameter{Name: "x"}},
+	} {
+		got, err := stmt.Substitute(params)
+		if err != nil {
+			t.Fatal(err)
+		} else if exp := fmt.Sprintf(`SELECT value FROM cpu WHERE a > %[1]s AND c < %[1]s`, params["x"]); got.String() != exp {
+			t.Fatalf("unexpected statement:\n  exp=%s\n  got=%s", exp, got)
+		}
+	}
+}
+
+// Ensure the sources of a copy made by Substitute refer to the statements
+// defined by WITH in the copy.
+func TestSubstitute_CTERef(t *testing.T) {
+	stmt, err := parser.ParseStatement(`WITH a AS (SELECT v FROM cpu WHERE host = $host) SELECT v FROM a, (SELECT v FROM a)`, parser.WithDeferBoundParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parser.Substitute(stmt.(*ast.SelectStatement), map[string]interface{}{"host": "a"})
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `WITH a AS (SELECT v FROM cpu WHERE host = 'a') SELECT v FROM a, (SELECT v FROM a)`; got.String() != exp {
+		t.Fatalf("unexpected statement:\n  exp=%s\n  got=%s", exp, got)
+	}
+
+	cte := got.CTEs[0].Statement
+	if ref := got.Sources[0].(*ast.CTERef); ref.Statement != cte {
+		t.Fatalf("source refers to another statement than the one defined: %s", ref.Statement)
+	} else if ref := got.Sources[1].(*ast.SubQuery).Statement.Sources[0].(*ast.CTERef); ref.Statement != cte {
+		t.Fatalf("source of the subquery refers to another statement than the one defined: %s", ref.Statement)
+	} else if cte == stmt.(*ast.SelectStatement).CTEs[0].Statement {
+		t.Fatal("statement defined is shared with the original")
+	}
+}
+
+// Ensure the values substituted are bound like the parameters of the parser,
+// including the typed objects.
+func TestSubstitute_BindValue(t *testing.T) {
+	stmt := &ast.SelectStatement{
+		Fields:  []*ast.Field{{Expr: &ast.BoundParameter{Name: "field"}}},
+		Sources: []ast.Source{&ast.Metric{Name: "cpu"}},
+		Condition: &ast.BinaryExpr{
+			Op: token.AND,
+			LHS: &ast.BinaryExpr{
+				Op:  token.EQREGEX,
+				LHS: &ast.VarRef{Val: "host"},
+				RHS: &ast.BoundParameter{Name: "host"},
+			},
+			RHS: &ast.BinaryExpr{
+				Op:  token.GT,
+				LHS: &ast.VarRef{Val: "time"},
+				RHS: &ast.BinaryExpr{Op: token.SUB, LHS: &ast.Call{Name: "now"}, RHS: &ast.BoundParameter{Name: "ago"}},
+			},
+		},
+	}
+	params := map[string]interface{}{
+		"field": map[string]interface{}{"identifier": "value"},
+		"host":  map[string]interface{}{"regex": "^server0[12]$"},
+		"ago":   map[string]interface{}{"duration": "1h"},
+	}
+
+	got, err := parser.Substitute(stmt, params)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `SELECT value FROM cpu WHERE host =~ /^server0[12]$/ AND time > now() - 1h`; got.String() != exp {
+		t.Fatalf("unexpected statement:\n  exp=%s\n  got=%s", exp, got)
+	}
+
+	// The same values bound by the parser give the same statement.
+	other, err := parser.ParseStatement(`SELECT $field FROM cpu WHERE host =~ $host AND time > now() - $ago`, parser.WithParams(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := other.(*ast.SelectStatement)
+	if diff := ast.Diff(got.Fields, sel.Fields); len(diff) != 0 {
+		t.Fatalf("fields differ from the ones parsed:\n%s", ast.FormatDiff(diff))
+	} else if diff := ast.Diff(got.Condition, sel.Condition); len(diff) != 0 {
+		t.Fatalf("condition differs from the one parsed:\n%s", ast.FormatDiff(diff))
+	}
+}
+
+// Ensure bound parameters without a value can be parsed as nodes and bound
+// later.
+func TestParser_SetDeferBoundParams(t *testing.T) {
+	s := `SELECT value FROM cpu WHERE v > $x AND host = $host`
+	if _, err := parser.ParseStatement(s); errstring(err) != `missing parameter: x` {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	stmt, err := parser.ParseStatement(s, parser.WithDeferBoundParams(), parser.WithParams(map[string]interface{}{"host": "a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := stmt.(*ast.SelectStatement)
+	if exp := `SELECT value FROM cpu WHERE v > $x AND host = 'a'`; sel.String() != exp {
+		t.Fatalf("unexpected statement:\n  exp=%s\n  got=%s", exp, sel)
+	}
+	cond := sel.Condition.(*ast.BinaryExpr).LHS.(*ast.BinaryExpr)
+	if !reflect.DeepEqual(cond.RHS, &ast.BoundParameter{Name: "x"}) {
+		t.Fatalf("unexpected operand: %#v", cond.RHS)
+	}
+
+	for _, tt := range []struct {
+		params map[string]interface{}
+		s      string
+		err    string
+	}{
+		{params: map[string]interface{}{"x": 10}, s: `SELECT value FROM cpu WHERE v > 10 AND host = 'a'`},
+		{params: map[string]interface{}{"x": 1.5}, s: `SELECT value FROM cpu WHERE v > 1.500 AND host = 'a'`},
+		{params: map[string]interface{}{}, err: `missing parameter: x`},
+	} {
+		other, err := parser.Substitute(sel, tt.params)
+		if errstring(err) != tt.err {
+			t.Errorf("%v: error mismatch:\n  exp=%s\n  got=%s", tt.params, tt.err, err)
+		} else if err == nil && other.String() != tt.s {
+			t.Errorf("%v: statement mismatch:\n  exp=%s\n  got=%s", tt.params, tt.s, other)
+		}
+	}
+}
+
+// Ensure passwords are only printed by String, for round trips, and not by
+// RedactedString.
+func TestStatement_RedactedString(t *testing.T) {
+	var tests = []struct {
+		s        string
+		str      string
+		redacted string
+	}{
+		{
+			s:        `CREATE USER "j doe" WITH PASSWORD 's3cr3t' WITH ALL PRIVILEGES`,
+			str:      `CREATE USER "j doe" WITH PASSWORD 's3cr3t' WITH ALL PRIVILEGES`,
+			redacted: `CREATE USER "j doe" WITH PASSWORD [REDACTED] WITH ALL PRIVILEGES`,
+		},
+		{
+			s:        `set password for jdoe = 's3cr3t'`,
+			str:      `SET PASSWORD FOR jdoe = 's3cr3t'`,
+			redacted: `SET PASSWORD FOR jdoe = [REDACTED]`,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := parser.ParseStatement(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %q: unexpected error: %s", i, tt.s, err)
+		}
+		if s := stmt.String(); s != tt.str {
+			t.Errorf("%d. %q: string mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.str, s)
+		}
+		if s := stmt.(interface{ RedactedString() string }).RedactedString(); s != tt.redacted {
+			t.Errorf("%d. %q: redacted string mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.redacted, s)
+		}
+	}
+}
+
+// Ensure the names of the bound parameters of a query are listed in order of
+// first appearance, without binding them.
+func TestBoundParameterNames(t *testing.T) {
+	var tests = []struct {
+		s     string
+		names []string
+		err   string
+	}{
+		{s: `SELECT value FROM cpu WHERE host = $a AND region = $b OR host = $a`, names: []string{"a", "b"}},
+		{s: `SELECT $b, $a FROM cpu WHERE value > $b`, names: []string{"b", "a"}},
+		{s: `SELECT $"my param" / $d FROM cpu WHERE host =~ /\$c/`, names: []string{"my param", "d"}},
+		{s: `SELECT value FROM cpu -- WHERE host = $a`},
+		{s: `SELECT value FROM cpu WHERE host = '$a'`},
+		{s: `SELECT value FROM cpu WHERE host = $`, err: `empty bound parameter name, use $name or $"name" at line 1, char 36`},
+		{s: `SELECT value FROM cpu WHERE host = 'a`, err: `bad string at line 1, char 36`},
+	}
+
+	for i, tt := range tests {
+		names, err := parser.BoundParameterNames(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		} else if !reflect.DeepEqual(tt.names, names) {
+			t.Errorf("%d. %q: names mismatch: exp=%q got=%q", i, tt.s, tt.names, names)
+		}
+	}
+}
+
+// Ensure GROUP BY is accepted by the cardinality statements but not by the
+// other SHOW statements.
+func TestParseQuery_ShowGroupBy(t *testing.T) {
+	var tests = []struct {
+		s   string
+		err string
+	}{
+		{s: `SHOW TAG KEY CARDINALITY GROUP BY host`},
+		{s: `SHOW FIELD KEY EXACT CARDINALITY GROUP BY host`},
+		{s: `SHOW QUERIES GROUP BY host`, err: `found GROUP, expected ; at line 1, char 14`},
+		{s: `SHOW TIME TO LIVES ON db GROUP BY host`, err: `found GROUP, expected ; at line 1, char 26`},
+		{s: `SHOW GRANTS FOR jdoe GROUP BY host`, err: `found GROUP, expected ; at line 1, char 22`},
+	}
+
+	for i, tt := range tests {
+		if _, err := parser.ParseQuery(tt.s); errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, err)
+		}
+	}
+}
+
+// Ensure metrics are compared by value, and have the same key only if equal.
+func TestMetric_Equal(t *testing.T) {
+	re := func(pattern string) *ast.RegexLiteral { return &ast.RegexLiteral{Val: regexp.MustCompile(pattern)} }
+	var tests = []struct {
+		a, b  *ast.Metric
+		equal bool
+	}{
+		{a: &ast.Metric{Name: "cpu"}, b: &ast.Metric{Name: "cpu"}, equal: true},
+		{a: &ast.Metric{Database: "db", TimeToLive: "ttl", Name: "cpu"}, b: &ast.Metric{Database: "db", TimeToLive: "ttl", Name: "cpu", IsTarget: true}, equal: true},
+		{a: &ast.Metric{Database: "db", Name: "cpu"}, b: &ast.Metric{TimeToLive: "db", Name: "cpu"}},
+		{a: &ast.Metric{Name: "cpu"}, b: &ast.Metric{SystemIterator: "cpu"}},
+		{a: &ast.Metric{Regex: re(`^cpu`)}, b: &ast.Metric{Regex: re(`^cpu`)}, equal: true},
+		{a: &ast.Metric{Regex: re(`^cpu`)}, b: &ast.Metric{Regex: &ast.RegexLiteral{Pattern: `^cpu`}}, equal: true},
+		{a: &ast.Metric{Regex: re(`^cpu`)}, b: &ast.Metric{Regex: re(`^cpu$`)}},
+		{a: &ast.Metric{Regex: re(`a/b`)}, b: &ast.Metric{Regex: re(`a\/b`)}},
+		{a: &ast.Metric{Regex: re(``)}, b: &ast.Metric{}},
+		{a: &ast.Metric{Name: "a.b"}, b: &ast.Metric{Database: "a", Name: "b"}},
+		{a: nil, b: nil, equal: true},
+		{a: &ast.Metric{}, b: nil},
+		{a: nil, b: &ast.Metric{}},
+	}
+
+	for i, tt := range tests {
+		if got := tt.a.Equal(tt.b); got != tt.equal {
+			t.Errorf("%d. %v.Equal(%v): exp=%v got=%v", i, tt.a, tt.b, tt.equal, got)
+		}
+		if got := tt.b.Equal(tt.a); got != tt.equal {
+			t.Errorf("%d. %v.Equal(%v): exp=%v got=%v", i, tt.b, tt.a, tt.equal, got)
+		}
+		if got := tt.a.Key() == tt.b.Key(); got != tt.equal {
+			t.Errorf("%d. keys %q and %q: exp equal=%v", i, tt.a.Key(), tt.b.Key(), tt.equal)
+		}
+	}
+}
+
+// Ensure the parser returns errors for invalid statements.
+func TestParseStatement_Errors(t *testing.T) {
+	var tests = []struct {
+		s      string
+		params map[string]interface{}
+		err    string
+	}{
+		{
+			s:      `SELECT value FROM cpu WHERE host =~ $re`,
+			params: map[string]interface{}{"re": "^cpu$"},
+			err:    `found parameter $re (bound to '^cpu$'), expected regex at line 1, char 37`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host =~ $re`,
+			err: `missing parameter: re at line 1, char 37`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host =~ 'cpu'`,
+			err: `found cpu, expected regex at line 1, char 37`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE d > -`,
+			err: `found EOF, expected identifier, number, duration, ( at line 1, char 34`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE d > -1x`,
+			err: `invalid duration at line 1, char 34`,
+		},
+		{
+			s:   "SELECT \"café\" /* one\r\ntwo\rthree */ FROM \"µ\" -- note é\r\nWHERE x = 'ü' AND\ry = #",
+			err: `found #, expected identifier, string, number, bool at line 5, char 5`,
+		},
+		{s: `SELECT value INTO "" FROM cpu`, err: `target metric name cannot be empty`},
+		{s: `SELECT value INTO db.ttl."" FROM cpu`, err: `target metric name cannot be empty`},
+		{s: `SELECT @ FROM cpu`, err: `found @, expected identifier, string, number, bool at line 1, char 8`},
+		{s: `SELECT @timestamp::time FROM cpu`, err: `found time, expected float, integer, unsigned, string, boolean, field, tag at line 1, char 20`},
+		{
+			s:      `SELECT value FROM cpu LIMIT $p`,
+			params: map[string]interface{}{"p": true},
+			err:    `found parameter $p (bound to true), expected integer at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM cpu LIMIT $p`,
+			params: map[string]interface{}{"p": "a"},
+			err:    `found parameter $p (bound to 'a'), expected integer at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM cpu LIMIT $p`,
+			params: map[string]interface{}{"p": 1.5},
+			err:    `found parameter $p (bound to 1.5), expected integer at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM cpu LIMIT $p`,
+			params: map[string]interface{}{"p": map[string]interface{}{"identifier": "host"}},
+			err:    `found parameter $p (bound to host), expected integer at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM cpu LIMIT $p`,
+			params: map[string]interface{}{"p": map[string]interface{}{"regex": "^a/b"}},
+			err:    `found parameter $p (bound to /^a\/b/), expected integer at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM cpu LIMIT $p`,
+			params: map[string]interface{}{"p": map[string]interface{}{"duration": "1h"}},
+			err:    `found parameter $p (bound to 1h), expected integer at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM $p`,
+			params: map[string]interface{}{"p": int64(1)},
+			err:    `found parameter $p (bound to 1), expected identifier at line 1, char 19`,
+		},
+		{
+			s:      `SELECT value FROM cpu LIMIT $"my param"`,
+			params: map[string]interface{}{"my param": int64(-1)},
+			err:    `LIMIT must be >= 0: parameter $"my param" (bound to -1) at line 1, char 29`,
+		},
+		{
+			s:      `SELECT value FROM cpu GROUP BY time($p)`,
+			params: map[string]interface{}{"p": map[string]interface{}{"duration": "1x"}},
+			err:    `invalid duration: parameter $p (bound to 1x) at line 1, char 37`,
+		},
+		{s: `SELECT mean(value) AS from FROM cpu`, err: `alias cannot be the reserved keyword FROM, quote it as "from" at line 1, char 23`},
+		{s: `SELECT mean(value) AS 5 FROM cpu`, err: `found 5, expected identifier, string at line 1, char 23`},
+		{
+			s:   `SELECT max(a, b) FROM cpu`,
+			err: `invalid number of arguments for max, expected 1, got 2 at line 1, char 8`,
+		},
+		{
+			s:   `SELECT value FROM (SELECT LAST() FROM cpu)`,
+			err: `invalid number of arguments for LAST, expected 1, got 0 at line 1, char 27`,
+		},
+		{
+			s:   `SELECT distinct,x FROM m`,
+			err: `found ,, expected identifier or ( after DISTINCT at line 1, char 16`,
+		},
+		{
+			s:   `SELECT distinct 1 FROM m`,
+			err: `found 1, expected identifier or ( after DISTINCT at line 1, char 17`,
+		},
+		{
+			s:   `SELECT count(distinct) FROM m`,
+			err: `found ), expected identifier or ( after DISTINCT at line 1, char 22`,
+		},
+		{
+			s:   `SELECT top(value) FROM cpu`,
+			err: `invalid number of arguments for top, expected at least 2, got 1 at line 1, char 8`,
+		},
+		{
+			s:   `SELECT top(value, host) FROM cpu`,
+			err: `expected positive integer as last argument of top, found host at line 1, char 8`,
+		},
+		{
+			s:   `SELECT bottom(value, host, 'a') FROM cpu`,
+			err: `expected positive integer as last argument of bottom, found 'a' at line 1, char 8`,
+		},
+		{
+			s:   `SELECT top(value, 1.5) FROM cpu`,
+			err: `expected positive integer as last argument of top, found 1.500 at line 1, char 8`,
+		},
+		{
+			s:   `SELECT top(value, 0) FROM cpu`,
+			err: `expected positive integer as last argument of top, found 0 at line 1, char 8`,
+		},
+		{
+			s:   `SELECT top(value, 'host', 3) FROM cpu`,
+			err: `expected tag key as argument of top, found 'host' at line 1, char 8`,
+		},
+		{
+			s:   `SELECT top(1, 3) FROM cpu`,
+			err: `expected field as first argument of top, found 1 at line 1, char 8`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host = ANY()`,
+			err: `ANY requires at least one value at line 1, char 40`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host = ANY 'a'`,
+			err: `found a, expected ( at line 1, char 40`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host = ALL('a' 'b'`,
+			err: `found EOF, expected ,, ) at line 1, char 47`,
+		},
+		{
+			s:   `SELECT value FROM cpu WHERE host + ANY('a') = 1`,
+			err: `ANY must follow a comparison operator at line 1, char 36`,
+		},
+		{
+			s:   `SELECT ALL('a') FROM cpu`,
+			err: `ALL must follow a comparison operator at line 1, char 8`,
+		},
+		{
+			s:      `SELECT value FROM cpu WHERE host = $hosts`,
+			params: map[string]interface{}{"hosts": []interface{}{"a", "b"}},
+			err:    `list parameter $hosts must be used in ANY or ALL at line 1, char 36`,
+		},
+		{s: `SELECT * FROM (SELECT value INTO other FROM cpu)`, err: `INTO clause not allowed in subquery at line 1, char 29`},
+		{s: `SELECT * FROM (SELECT * FROM (SELECT value INTO other FROM cpu))`, err: `INTO clause not allowed in subquery at line 1, char 44`},
+		{s: `SELECT * INTO other FROM (SELECT * FROM (SELECT value INTO db..:METRIC FROM cpu))`, err: `INTO clause not allowed in subquery at line 1, char 55`},
+		{s: `SELECT * FROM (SELECT value FROM cpu TZ('UTC')) TZ('America/Los_Angeles')`, err: `time zone America/Los_Angeles differs from subquery time zone UTC at line 1, char 49`},
+		{s: `SELECT * FROM (SELECT * FROM (SELECT value FROM cpu TZ('UTC')) TZ('Europe/Paris'))`, err: `time zone Europe/Paris differs from subquery time zone UTC at line 1, char 64`},
+		{s: `SELECT * FROM (SELECT * FROM (SELECT value FROM cpu TZ('UTC'))) TZ('Europe/Paris')`, err: `time zone Europe/Paris differs from subquery time zone UTC at line 1, char 65`},
+		{s: `SELECT * FROM (SELECT * FROM (SELECT * FROM (SELECT value FROM cpu TZ('UTC')))) TZ('Europe/Paris')`, err: `time zone Europe/Paris differs from subquery time zone UTC at line 1, char 81`},
+		{s: `WITH t AS (SELECT value FROM cpu TZ('UTC')) SELECT * FROM (SELECT * FROM t) TZ('Europe/Paris')`, err: `time zone Europe/Paris differs from subquery time zone UTC at line 1, char 77`},
+		{s: `SELECT value FROM cpu WHERE time >= today(1)`, err: `invalid number of arguments for today, expected 0, got 1 at line 1, char 37`},
+		{s: `SELECT * FROM a JOIN b`, err: `found EOF, expected ON at line 1, char 23`},
+		{s: `SELECT * FROM a JOIN b WHERE a.id = b.id`, err: `found WHERE, expected ON at line 1, char 24`},
+		{s: `SELECT * FROM a JOIN ON a.id = b.id`, err: `found a, expected ON at line 1, char 25`},
+		{s: `SELECT * FROM a JOIN b "ON" a.id = b.id`, err: `found "ON", expected ON at line 1, char 24`},
+		{s: `SHOW`, err: `found EOF, expected TIME, QUERIES, GRANTS, TAG, FIELD at line 1, char 5`},
+		{s: `SHOW TIMES TO LIVES`, err: `found TIMES, expected TIME, QUERIES, GRANTS, TAG, FIELD at line 1, char 6`},
+		{s: `SHOW TIME LIVES`, err: `found LIVES, expected TO at line 1, char 11`},
+		{s: `SHOW TIME TO LIVES ON`, err: `found EOF, expected identifier at line 1, char 22`},
+		{s: `SHOW TIME TO LIVES ON 5`, err: `found 5, expected identifier at line 1, char 23`},
+		{s: `DELETE FROM cpu`, err: `found DELETE, expected SELECT, SHOW, CREATE, WITH, KILL, DROP, SET, INSERT at line 1, char 1`},
+		{s: `"KILL" QUERY 1`, err: `found "KILL", expected SELECT, SHOW, CREATE, WITH, KILL, DROP, SET, INSERT at line 1, char 1`},
+		{s: `"SHOW" QUERIES`, err: `found "SHOW", expected SELECT, SHOW, CREATE, WITH, KILL, DROP, SET, INSERT at line 1, char 1`},
+		{s: `SHOW "QUERIES"`, err: `found "QUERIES", expected TIME, QUERIES, GRANTS, TAG, FIELD at line 1, char 6`},
+		{s: `SHOW TIME "TO" LIVES`, err: `found "TO", expected TO at line 1, char 11`},
+		{s: `SELECT a FROM x UNION`, err: `found EOF, expected SELECT at line 1, char 22`},
+		{s: `SELECT a FROM x LIMIT 1 UNION SELECT a FROM y`, err: `UNION cannot follow ORDER BY, LIMIT, OFFSET, SLIMIT, SOFFSET or TZ() at line 1, char 25`},
+		{s: `SELECT a FROM x ORDER BY time DESC UNION ALL SELECT a FROM y`, err: `UNION cannot follow ORDER BY, LIMIT, OFFSET, SLIMIT, SOFFSET or TZ() at line 1, char 36`},
+		{s: `SELECT a FROM (SELECT a FROM x UNION SELECT a, b FROM y)`, err: `UNION sides have different numbers of fields: 1 and 2 at line 1, char 32`},
+		{s: `SELECT a FROM (SELECT a FROM x UNION SELECT a FROM y LIMIT 1 UNION SELECT a FROM z)`, err: `found UNION, expected ) at line 1, char 62`},
+		{s: `SELECT a FROM x UNION ALL a FROM y`, err: `found a, expected SELECT at line 1, char 27`},
+		{s: `SELECT a FROM x UNION SELECT a, b FROM y`, err: `UNION sides have different numbers of fields: 1 and 2 at line 1, char 17`},
+		{s: `SELECT a, b FROM x UNION SELECT * FROM y UNION ALL SELECT c FROM z`, err: `UNION sides have different numbers of fields: 2 and 1 at line 1, char 42`},
+		{s: `CREATE QUERY cq ON db BEGIN SELECT v INTO x FROM cpu END`, err: `found QUERY, expected CONTINUOUS, USER, TIME at line 1, char 8`},
+		{s: `CREATE CONTINUOUS QUERY cq BEGIN SELECT v INTO x FROM cpu END`, err: `found BEGIN, expected ON at line 1, char 28`},
+		{s: `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT v FROM cpu END`, err: `found FROM, expected INTO at line 1, char 49`},
+		{s: `CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT v INTO x FROM cpu`, err: `found EOF, expected END at line 1, char 64`},
+		{s: `CREATE CONTINUOUS QUERY cq ON db BEGIN v END`, err: `found v, expected SELECT at line 1, char 40`},
+		{s: `CREATE CONTINUOUS QUERY cq ON db RESAMPLE BEGIN SELECT v INTO x FROM cpu END`, err: `found BEGIN, expected EVERY, FOR at line 1, char 43`},
+		{s: `CREATE CONTINUOUS QUERY cq ON db RESAMPLE EVERY 0s BEGIN SELECT v INTO x FROM cpu END`, err: `RESAMPLE EVERY must be a positive duration at line 1, char 43`},
+		{s: `CREATE CONTINUOUS QUERY cq ON db RESAMPLE FOR x BEGIN SELECT v INTO x FROM cpu END`, err: `found x, expected duration at line 1, char 47`},
+		{s: `WITH AS (SELECT v FROM cpu) SELECT v FROM t`, err: `found AS, expected identifier at line 1, char 6`},
+		{s: `WITH t (SELECT v FROM cpu) SELECT v FROM t`, err: `found (, expected AS at line 1, char 8`},
+		{s: `WITH t AS (SELECT v FROM cpu SELECT v FROM t`, err: `found SELECT, expected ) at line 1, char 30`},
+		{s: `WITH t AS (SELECT v FROM cpu)`, err: `found EOF, expected SELECT at line 1, char 30`},
+		{s: `WITH t AS (SELECT v FROM cpu), t AS (SELECT v FROM mem) SELECT v FROM t`, err: `duplicate WITH name t at line 1, char 32`},
+		{s: `WITH t AS (SELECT v INTO x FROM cpu) SELECT v FROM t`, err: `INTO clause not allowed in subquery at line 1, char 21`},
+		{s: `KILL QUERY`, err: `found EOF, expected integer at line 1, char 11`},
+		{s: `KILL QUERY x`, err: `found x, expected integer at line 1, char 12`},
+		{s: `KILL QUERY 1.5`, err: `found 1.5, expected integer at line 1, char 12`},
+		{s: `KILL QUERY -1`, err: `found -, expected integer at line 1, char 12`},
+		{s: `KILL QUERY 18446744073709551616`, err: `strconv.ParseUint: parsing "18446744073709551616": value out of range at line 1, char 12`},
+		{s: `KILL QUERIES 1`, err: `found QUERIES, expected QUERY at line 1, char 6`},
+		{s: `KILL QUERY 1 ON 'host'`, err: `found host, expected identifier at line 1, char 17`},
+		{s: `CREATE USER WITH PASSWORD 'pw'`, err: `found PASSWORD, expected WITH at line 1, char 18`},
+		{s: `CREATE USER jdoe PASSWORD 'pw'`, err: `found PASSWORD, expected WITH at line 1, char 18`},
+		{s: `CREATE USER jdoe WITH PASSWORD pw`, err: `found pw, expected string at line 1, char 32`},
+		{s: `CREATE USER jdoe WITH PASSWORD 'pw' WITH PRIVILEGES`, err: `found PRIVILEGES, expected ALL at line 1, char 42`},
+		{s: `CREATE USER jdoe WITH PASSWORD 'pw' WITH ALL "PRIVILEGES"`, err: `found "PRIVILEGES", expected PRIVILEGES at line 1, char 46`},
+		{s: `DROP "USER" jdoe`, err: `found "USER", expected USER, TIME at line 1, char 6`},
+		{s: `"SET" PASSWORD FOR jdoe = 'pw'`, err: `found "SET", expected SELECT, SHOW, CREATE, WITH, KILL, DROP, SET, INSERT at line 1, char 1`},
+		{s: `DROP jdoe`, err: `found jdoe, expected USER, TIME at line 1, char 6`},
+		{s: `SET PASSWORD jdoe = 'pw'`, err: `found jdoe, expected FOR at line 1, char 14`},
+		{s: `SET PASSWORD FOR jdoe 'pw'`, err: `found pw, expected = at line 1, char 23`},
+		{s: `SHOW GRANT FOR jdoe`, err: `found GRANT, expected TIME, QUERIES, GRANTS, TAG, FIELD at line 1, char 6`},
+		{s: `SHOW GRANTS jdoe`, err: `found jdoe, expected FOR at line 1, char 13`},
+		{s: `SHOW GRANTS FOR`, err: `found EOF, expected identifier at line 1, char 16`},
+		{s: `CREATE TIME TO LIVE one_day ON db`, err: `found EOF, expected DURATION at line 1, char 34`},
+		{s: `CREATE TIME TO LIVE one_day ON db SHARD DURATION 1h`, err: `found SHARD, expected DURATION at line 1, char 35`},
+		{s: `CREATE TIME TO LIVE one_day DURATION 1d`, err: `found DURATION, expected ON at line 1, char 29`},
+		{s: `CREATE TIME TO LIVES one_day ON db DURATION 1d`, err: `found LIVES, expected LIVE at line 1, char 16`},
+		{s: `CREATE TIME TO LIVE one_day ON db DURATION -1d`, err: `DURATION must be a positive duration or INF at line 1, char 44`},
+		{s: `CREATE TIME TO LIVE one_day ON db DURATION 1d SHARD 1h`, err: `found 1h, expected DURATION at line 1, char 53`},
+		{s: `CREATE TIME TO LIVE one_day ON db DURATION 1d SHARD DURATION INF`, err: `found INF, expected duration at line 1, char 62`},
+		{s: `CREATE TIME TO LIVE one_day ON db DURATION 1d SHARD DURATION 0s`, err: `SHARD DURATION must be a positive duration at line 1, char 62`},
+		{s: `DROP TIME TO LIVE one_day`, err: `found EOF, expected ON at line 1, char 26`},
+		{s: `SELECT value, host = 'a' FROM cpu`, err: `invalid operator = in SELECT clause; operator is intended for WHERE clause at line 1, char 15`},
+		{s: `INSERT`, err: `found EOF, expected point at line 1, char 7`},
+		{s: `INSERT INTO db`, err: `found EOF, expected point at line 1, char 15`},
+		{s: `INSERT INTO 'db' cpu value=1`, err: `found db, expected identifier at line 1, char 13`},
+		{s: `INSERT cpu`, err: `invalid point at byte 3: missing fields at line 1, char 8`},
+		{s: `INSERT cpu,host value=1`, err: `invalid point at byte 9: missing tag value for host at line 1, char 8`},
+		{s: `INSERT cpu,=a value=1`, err: `invalid point at byte 4: missing tag key at line 1, char 8`},
+		{s: `INSERT cpu,host= value=1`, err: `invalid point at byte 10: missing tag value for host at line 1, char 8`},
+		{s: `INSERT ,host=a value=1`, err: `invalid point at byte 0: missing metric at line 1, char 8`},
+		{s: `INSERT cpu value`, err: `invalid point at byte 9: missing field value for value at line 1, char 8`},
+		{s: `INSERT cpu value=`, err: `invalid point at byte 10: missing field value at line 1, char 8`},
+		{s: `INSERT cpu value=1,=2`, err: `invalid point at byte 12: missing field key at line 1, char 8`},
+		{s: `INSERT cpu value=1.2.3`, err: `invalid point at byte 10: invalid field value 1.2.3 at line 1, char 8`},
+		{s: `INSERT cpu value=1.5i`, err: `invalid point at byte 10: invalid field value 1.5i at line 1, char 8`},
+		{s: `INSERT cpu value=NaN`, err: `invalid point at byte 10: invalid field value NaN at line 1, char 8`},
+		{s: `INSERT cpu msg="abc`, err: `invalid point at byte 8: unterminated string at line 1, char 8`},
+		{s: `INSERT cpu value=1 12:00`, err: `invalid point at byte 12: invalid timestamp 12:00 at line 1, char 8`},
+		{s: `INSERT cpu value=1 1 2`, err: `invalid point at byte 14: unexpected '2' at line 1, char 8`},
+		{s: `INSERT cpu,host=a,region=b,host=c value=1`, err: `invalid point at byte 20: duplicate tag key host at line 1, char 8`},
+		{s: `INSERT cpu value=1,count=2i,value=3`, err: `invalid point at byte 21: duplicate field key value at line 1, char 8`},
+		{s: `SHOW TAG KEYS`, err: `found KEYS, expected KEY at line 1, char 10`},
+		{s: `SHOW TAG KEY`, err: `found EOF, expected EXACT, CARDINALITY at line 1, char 13`},
+		{s: `SHOW FIELD KEY EXACT`, err: `found EOF, expected CARDINALITY at line 1, char 21`},
+		{s: `SHOW FIELD KEY CARDINALITY FROM (SELECT value FROM cpu)`, err: `found (, expected identifier at line 1, char 33`},
+		{s: `SHOW FIELD KEY CARDINALITY GROUP host`, err: `found host, expected BY at line 1, char 34`},
+	}
+
+	for i, tt := range tests {
+		p := parser.NewParser(strings.NewReader(tt.s))
+		if tt.params != nil {
+			p.SetParams(tt.params)
+		}
+		_, err := p.ParseStatement()
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s\n", i, tt.s, tt.err, errstring(err))
+		}
+	}
+}
+
+// BenchmarkParseQuery measures parsing representative queries.
+// IN only takes names, so the large integer list is written as the
+// equivalent chain of OR comparisons.
+func BenchmarkParseQuery(b *testing.B) {
+	var list, ints []string
+	for i := 0; i < 1000; i++ {
+		list = append(list, fmt.Sprintf("'server%d'", i))
+		ints = append(ints, fmt.Sprintf("code = %d", 1000000+i*7919))
+	}
+
+	var tests = []struct {
+		name string
+		s    string
+	}{
+		{name: "Simple", s: `SELECT value FROM cpu`},
+		{name: "QualifiedSource", s: `SELECT value FROM "db"."ttl"."metric"`},
+		{name: "Aggregate", s: `SELECT mean(value), max(value) FROM db.ttl.cpu WHERE time > now() - 1h AND region = 'west' GROUP BY time(1m), host fill(none) LIMIT 100`},
+		{name: "LargeList", s: `SELECT value FROM cpu WHERE host IN (` + strings.Join(list, ", ") + `)`},
+		{name: "LargeIntegerList", s: `SELECT value FROM cpu WHERE ` + strings.Join(ints, " OR ")},
+		{name: "NestedExpr", s: `SELECT ` + strings.Repeat("(", 100) + "value + 1" + strings.Repeat(")", 100) + ` FROM cpu`},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(tt.s)))
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.ParseQuery(tt.s); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkParseQuery_Regex measures parsing the same regex query repeatedly,
+// with and without a regex cache.
+func BenchmarkParseQuery_Regex(b *testing.B) {
+	s := `SELECT value FROM /^cpu[0-9]+$/ WHERE host =~ /^server(0[1-9]|1[0-2])\.example\.com$/`
+	b.Run("NoCache", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := parser.ParseQuery(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Cache", func(b *testing.B) {
+		cache := parser.NewRegexCache(16)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := parser.ParseQuery(s, parser.WithRegexCache(cache)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SharedCacheParallel", func(b *testing.B) {
+		cache := parser.NewRegexCache(16)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := parser.ParseQuery(s, parser.WithRegexCache(cache)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkExprRefs measures listing the references of alert-like conditions.
+func BenchmarkExprRefs(b *testing.B) {
+	var terms []string
+	for i := 0; i < 100; i++ {
+		terms = append(terms, fmt.Sprintf("host%d = 'a'", i))
+	}
+
+	var tests = []struct {
+		name string
+		s    string
+	}{
+		{name: "Small", s: `usage_idle < 10 AND host = 'a' AND time > now() - 5m`},
+		{name: "Large", s: strings.Join(terms, " OR ")},
+	}
+
+	for _, tt := range tests {
+		expr, err := parser.ParseExpr(tt.s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(tt.name+"/Sorted", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ast.ExprRefs(expr, false)
+			}
+		})
+		b.Run(tt.name+"/FirstAppearance", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ast.FirstAppearanceRefs(expr, false)
+			}
+		})
+	}
+}
+
+func errstring(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func mustMarshalJSON(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func mustMarshalIndentJSON(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
 }
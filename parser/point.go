@@ -0,0 +1,343 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"sql/ast"
+	"sql/scanner"
+	"sql/token"
+)
+
+// parseInsertStatement parses an INSERT statement. This function assumes the
+// INSERT token has already been consumed.
+//
+// The point after the optional "INTO db[.ttl]" is written in line protocol,
+// where spaces and commas separate its parts, so it is read rune by rune
+// rather than as tokens. It ends at a newline, at a semicolon or a comment
+// after its fields or at EOF. A point that ends with its line, at a newline
+// or a "--" comment, ends the statement too, so the next statement may
+// follow on the next line without a semicolon.
+func (p *Parser) parseInsertStatement() (*ast.InsertStatement, error) {
+	stmt := &ast.InsertStatement{}
+
+	pos, tok, raw := p.scanRawIgnoreWhitespace()
+	if tok == token.INTO {
+		var err error
+		if stmt.Database, err = p.parseIdent(); err != nil {
+			return nil, err
+		}
+		if p.s.Peek() == '.' {
+			p.s.Scan()
+			if stmt.TimeToLive, err = p.parseIdent(); err != nil {
+				return nil, err
+			}
+		}
+		pos, tok, raw = p.scanRawIgnoreWhitespace()
+	}
+	if tok == token.EOF || tok == token.SEMICOLON {
+		return nil, newParseError(tokstr(tok, raw), []string{"point"}, pos)
+	}
+
+	// The first token of the point was scanned already, so its source
+	// text is read again before the rest of the input.
+	r := &pointReader{prefix: raw, s: p.s}
+	if err := r.parsePoint(stmt); err != nil {
+		return nil, &ParseError{Message: err.Error(), Pos: pos}
+	}
+	p.lineEnded = r.eol
+	return stmt, nil
+}
+
+// scanRawIgnoreWhitespace scans the next non-whitespace and non-comment token
+// and returns its source text.
+func (p *Parser) scanRawIgnoreWhitespace() (pos token.Pos, tok token.Token, raw string) {
+	for {
+		pos, tok, raw = p.s.ScanRaw()
+		if tok != token.WS && tok != token.COMMENT {
+			return pos, tok, raw
+		}
+	}
+}
+
+// pointEOF is returned by pointReader at the end of the input.
+const pointEOF = rune(-1)
+
+// pointReader reads a point in line protocol: the source text of a token that
+// was already scanned, then the rest of the input of the scanner.
+type pointReader struct {
+	prefix string
+	i      int // next byte of prefix
+	s      scanner.Scanner
+
+	off      int  // byte offset of the next rune in the point
+	size     int  // size of the last rune read
+	inPrefix bool // whether the last rune read was in prefix
+
+	eol bool // whether the point ended with its line
+}
+
+// pointError is an error in a point, at a byte offset from its start.
+type pointError struct {
+	off int
+	msg string
+}
+
+func (e *pointError) Error() string {
+	return fmt.Sprintf("invalid point at byte %d: %s", e.off, e.msg)
+}
+
+// read reads the next rune, or pointEOF at the end of the input.
+func (r *pointReader) read() rune {
+	var ch rune
+	if r.i < len(r.prefix) {
+		ch, r.size = utf8.DecodeRuneInString(r.prefix[r.i:])
+		r.i += r.size
+		r.inPrefix = true
+	} else {
+		var err error
+		if ch, r.size, err = r.s.ReadRune(); err == io.EOF {
+			ch, r.size = pointEOF, 0
+		}
+		r.inPrefix = false
+	}
+	r.off += r.size
+	return ch
+}
+
+// unread pushes back the last rune read.
+func (r *pointReader) unread() {
+	if r.inPrefix {
+		r.i -= r.size
+	} else if r.size > 0 {
+		_ = r.s.UnreadRune()
+	}
+	r.off -= r.size
+	r.size = 0
+}
+
+// errorf returns an error at a byte offset of the point.
+func (r *pointReader) errorf(off int, format string, args ...interface{}) error {
+	return &pointError{off: off, msg: fmt.Sprintf(format, args...)}
+}
+
+// parsePoint parses a point into stmt.
+func (r *pointReader) parsePoint(stmt *ast.InsertStatement) error {
+	// Parse the metric and the tags: "metric[,tag=value...]".
+	off := r.off
+	metric, stop := r.readKey(false)
+	if metric == "" {
+		return r.errorf(off, "missing metric")
+	}
+	stmt.Metric = metric
+	for stop == ',' {
+		off := r.off
+		var key, value string
+		if key, stop = r.readKey(true); key == "" {
+			return r.errorf(off, "missing tag key")
+		} else if stop != '=' {
+			return r.errorf(r.off, "missing tag value for %s", key)
+		}
+		if value, stop = r.readKey(false); value == "" {
+			return r.errorf(r.off, "missing tag value for %s", key)
+		}
+		for _, tag := range stmt.Tags {
+			if tag.Key == key {
+				return r.errorf(off, "duplicate tag key %s", key)
+			}
+		}
+		stmt.Tags = append(stmt.Tags, ast.PointTag{Key: key, Value: value})
+	}
+	sort.SliceStable(stmt.Tags, func(i, j int) bool { return stmt.Tags[i].Key < stmt.Tags[j].Key })
+	if stop != ' ' {
+		return r.errorf(r.off, "missing fields")
+	}
+	r.skipSpaces()
+
+	// Parse the fields: "field=value[,field=value...]".
+	for {
+		off := r.off
+		key, stop := r.readKey(true)
+		if key == "" {
+			return r.errorf(off, "missing field key")
+		} else if stop != '=' {
+			return r.errorf(r.off, "missing field value for %s", key)
+		}
+		for _, field := range stmt.Fields {
+			if field.Key == key {
+				return r.errorf(off, "duplicate field key %s", key)
+			}
+		}
+		value, err := r.readFieldValue()
+		if err != nil {
+			return err
+		}
+		stmt.Fields = append(stmt.Fields, &ast.PointField{Key: key, Value: value})
+
+		if ch := r.read(); ch != ',' {
+			r.unread()
+			break
+		}
+	}
+
+	// Parse the optional timestamp.
+	r.skipSpaces()
+	off = r.off
+	if r.peekComment() == 0 {
+		if text := r.readUntilEnd(); text != "" {
+			ts, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return r.errorf(off, "invalid timestamp %s", text)
+			}
+			stmt.Timestamp = &ts
+			r.skipSpaces()
+		}
+	}
+
+	// The point must end here, and not within the text that was scanned
+	// as a token. A comment after it is left to the scanner.
+	if c := r.peekComment(); c != 0 {
+		r.eol = c == '-'
+	} else if ch := r.read(); ch != pointEOF && ch != '\n' && ch != ';' {
+		return r.errorf(r.off-r.size, "unexpected %q", ch)
+	} else {
+		r.eol = ch == '\n'
+		r.unread()
+	}
+	if r.i < len(r.prefix) {
+		return r.errorf(r.off, "unexpected %q", r.prefix[r.i:])
+	}
+	return nil
+}
+
+// peekComment returns the rune that starts the comment at the current
+// position without reading it: '-' for "--", '/' for "/*", or 0 if no
+// comment starts there.
+func (r *pointReader) peekComment() rune {
+	ch := r.read()
+	if ch != '-' && ch != '/' {
+		r.unread()
+		return 0
+	}
+	size, inPrefix := r.size, r.inPrefix
+	next := r.read()
+	r.unread()
+	r.size, r.inPrefix = size, inPrefix
+	r.unread()
+	if (ch == '-' && next == '-') || (ch == '/' && next == '*') {
+		return ch
+	}
+	return 0
+}
+
+// readKey reads the metric, a tag key or value, or a field key, where a comma,
+// a space, or an equal sign if eq is true, must be escaped with a backslash.
+// It returns the rune that ended it, which is consumed unless it is a newline
+// or EOF.
+func (r *pointReader) readKey(eq bool) (string, rune) {
+	var buf strings.Builder
+	for {
+		ch := r.read()
+		switch {
+		case ch == pointEOF || ch == '\n':
+			r.unread()
+			return buf.String(), ch
+		case ch == ',' || ch == ' ' || (eq && ch == '='):
+			return buf.String(), ch
+		case ch == '\\':
+			// A backslash only escapes the runes that need it.
+			next := r.read()
+			if next == ',' || next == ' ' || next == '=' || next == '\\' {
+				ch = next
+			} else {
+				r.unread()
+			}
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+}
+
+// readFieldValue reads a field value: a quoted string, an integer with an "i"
+// suffix, a number or a boolean.
+func (r *pointReader) readFieldValue() (ast.Literal, error) {
+	off := r.off
+	if ch := r.read(); ch == '"' {
+		return r.readFieldString(off)
+	}
+	r.unread()
+
+	var buf strings.Builder
+	for {
+		ch := r.read()
+		if ch == pointEOF || ch == '\n' || ch == ',' || ch == ' ' || ch == ';' {
+			r.unread()
+			break
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+
+	text := buf.String()
+	switch text {
+	case "":
+		return nil, r.errorf(off, "missing field value")
+	case "t", "T", "true", "True", "TRUE":
+		return &ast.BooleanLiteral{Val: true}, nil
+	case "f", "F", "false", "False", "FALSE":
+		return &ast.BooleanLiteral{Val: false}, nil
+	}
+	if strings.HasSuffix(text, "i") {
+		if v, err := strconv.ParseInt(strings.TrimSuffix(text, "i"), 10, 64); err == nil {
+			return &ast.IntegerLiteral{Val: v}, nil
+		}
+	} else if v, err := strconv.ParseFloat(text, 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+		return &ast.NumberLiteral{Val: v}, nil
+	}
+	return nil, r.errorf(off, "invalid field value %s", text)
+}
+
+// readFieldString reads a string field value after its opening quote, at off.
+// A double quote or a backslash in it is escaped with a backslash.
+func (r *pointReader) readFieldString(off int) (ast.Literal, error) {
+	var buf strings.Builder
+	for {
+		ch := r.read()
+		switch ch {
+		case pointEOF:
+			return nil, r.errorf(off, "unterminated string")
+		case '"':
+			return &ast.StringLiteral{Val: buf.String()}, nil
+		case '\\':
+			if next := r.read(); next == '"' || next == '\\' {
+				ch = next
+			} else {
+				r.unread()
+			}
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+}
+
+// readUntilEnd reads the text until a space or the end of the point.
+func (r *pointReader) readUntilEnd() string {
+	var buf strings.Builder
+	for {
+		ch := r.read()
+		if ch == pointEOF || ch == '\n' || ch == ';' || ch == ' ' {
+			r.unread()
+			return buf.String()
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+}
+
+// skipSpaces skips the spaces at the current position.
+func (r *pointReader) skipSpaces() {
+	for r.read() == ' ' {
+	}
+	r.unread()
+}
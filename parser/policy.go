@@ -0,0 +1,219 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"sql/ast"
+	"sql/token"
+	"sql/tools"
+)
+
+// Names of the policies, as reported in a Violation.
+const (
+	PolicyTimeRange       = "time_range"
+	PolicyRawLimit        = "raw_limit"
+	PolicyGroupByWildcard = "group_by_wildcard"
+	PolicySubqueryDepth   = "subquery_depth"
+	PolicyCTEShadowing    = "cte_shadowing"
+)
+
+// Policy describes the query shapes that a Parser rejects. Each rule is
+// enforced only if it is set, so the zero value enforces nothing.
+// Regex sources are rejected with SetAllowRegexSources instead.
+type Policy struct {
+	// MaxTimeRange, if positive, requires the WHERE clause of a statement
+	// to bound time to at most this duration. A time range without an upper
+	// bound ends now.
+	MaxTimeRange time.Duration
+
+	// RequireRawLimit requires a LIMIT in a statement that selects raw data
+	// rather than aggregates.
+	RequireRawLimit bool
+
+	// DisallowGroupByWildcard rejects "GROUP BY *".
+	DisallowGroupByWildcard bool
+
+	// MaxSubqueryDepth, if positive, limits how deeply subqueries are nested.
+	MaxSubqueryDepth int
+
+	// DisallowCTEShadowing rejects a name defined by WITH that a statement
+	// also reads as a metric, such as cpu in
+	// WITH cpu AS (SELECT v FROM cpu) SELECT max(v) FROM cpu, where the
+	// last cpu is the named statement rather than the metric. Otherwise the
+	// name is only reported by Warnings.
+	DisallowCTEShadowing bool
+}
+
+// DefaultPolicy is the policy of a Parser unless SetPolicy is called.
+// It enforces nothing.
+var DefaultPolicy = Policy{}
+
+// SetPolicy sets the policy that parsed statements must follow. A statement
+// that breaks the policy is not returned. The error is a Violations instead.
+// It must be called before parsing.
+func (p *Parser) SetPolicy(policy Policy) {
+	p.policy = policy
+}
+
+// Violation is a statement breaking a rule of a Policy.
+type Violation struct {
+	Policy  string
+	Message string
+	Pos     token.Pos
+}
+
+// Error returns the string representation of the violation.
+func (v *Violation) Error() string {
+	return fmt.Sprintf("%s: %s at line %d, char %d", v.Policy, v.Message, v.Pos.Line+1, v.Pos.Char+1)
+}
+
+// Violations is the error returned for a statement that breaks a Policy.
+// It lists every rule the statement breaks in the order of their position.
+type Violations []*Violation
+
+// Error returns the string representation of the violations.
+func (a Violations) Error() string {
+	msgs := make([]string, len(a))
+	for i, v := range a {
+		msgs[i] = v.Error()
+	}
+	return "policy violation: " + strings.Join(msgs, "; ")
+}
+
+// violate records a violation of the named policy.
+func (p *Parser) violate(policy string, pos token.Pos, format string, args ...interface{}) {
+	p.violations = append(p.violations, &Violation{Policy: policy, Message: fmt.Sprintf(format, args...), Pos: pos})
+}
+
+// Warnings returns the rules that the last statement parsed breaks but that
+// its policy does not enforce, such as PolicyCTEShadowing without
+// DisallowCTEShadowing, in the order they were found. They can be reported
+// by a linter, since the statement is returned anyway.
+func (p *Parser) Warnings() Violations {
+	return p.warnings
+}
+
+// warn records a warning for the named policy, which is not enforced.
+func (p *Parser) warn(policy string, pos token.Pos, format string, args ...interface{}) {
+	p.warnings = append(p.warnings, &Violation{Policy: policy, Message: fmt.Sprintf(format, args...), Pos: pos})
+}
+
+// SetAllowRegexSources sets whether a regular expression is allowed in a FROM
+// clause, such as /.*/ that reads every metric. It is by default. If it is
+// not, a regex source is a ParseError. It must be called before parsing.
+func (p *Parser) SetAllowRegexSources(allow bool) {
+	p.disallowRegexSources = !allow
+}
+
+// WithAllowRegexSources sets whether regex sources are allowed.
+// See SetAllowRegexSources.
+func WithAllowRegexSources(allow bool) Option {
+	return func(p *Parser) error {
+		p.SetAllowRegexSources(allow)
+		return nil
+	}
+}
+
+// checkRegexSource returns an error for a regex source at pos if they are not
+// allowed.
+func (p *Parser) checkRegexSource(pos token.Pos) error {
+	if p.disallowRegexSources {
+		return &ParseError{Message: "regex sources are not allowed", Pos: pos}
+	}
+	return nil
+}
+
+// checkSubqueryDepth records a subquery at pos if it is nested too deeply.
+func (p *Parser) checkSubqueryDepth(pos token.Pos) {
+	if max := p.policy.MaxSubqueryDepth; max > 0 && p.depth > max {
+		p.violate(PolicySubqueryDepth, pos, "subqueries are nested deeper than %d", max)
+	}
+}
+
+// checkCTEShadowing records the name defined by WITH at pos if stmt reads a
+// metric by the same unqualified name, which the name now refers to instead.
+// It is a violation if the policy disallows shadowing, and a warning
+// otherwise. A qualified name, such as db.rp.cpu, still reads the metric.
+func (p *Parser) checkCTEShadowing(stmt *ast.SelectStatement, name string, pos token.Pos) {
+	var found bool
+	ast.WalkFunc(stmt, func(n ast.Node) {
+		if m, ok := n.(*ast.Metric); ok && m.Regex == nil && m.Database == "" && m.TimeToLive == "" && m.Name == name {
+			found = true
+		}
+	})
+	if !found {
+		return
+	} else if p.policy.DisallowCTEShadowing {
+		p.violate(PolicyCTEShadowing, pos, "WITH name %s shadows a metric", name)
+	} else {
+		p.warn(PolicyCTEShadowing, pos, "WITH name %s shadows a metric", name)
+	}
+}
+
+// checkGroupByWildcard records a wildcard dimension at pos if it is disallowed.
+func (p *Parser) checkGroupByWildcard(pos token.Pos) {
+	if p.policy.DisallowGroupByWildcard {
+		p.violate(PolicyGroupByWildcard, pos, "GROUP BY * is not allowed")
+	}
+}
+
+// checkPolicy checks the rules that apply to a whole statement starting at
+// pos and returns the violations found while parsing it, if any.
+func (p *Parser) checkPolicy(stmt *ast.SelectStatement, pos token.Pos) error {
+	p.checkStatementPolicy(stmt, stmt.Limit, pos)
+	return p.policyError()
+}
+
+// checkUnionPolicy checks the rules that apply to each statement of a union,
+// starting at the position of the same index, and returns the violations
+// found while parsing it, if any. The LIMIT of the union applies to all of
+// its statements.
+func (p *Parser) checkUnionPolicy(union *ast.UnionStatement, positions []token.Pos) error {
+	for i, stmt := range union.Statements {
+		p.checkStatementPolicy(stmt, union.Limit, positions[i])
+	}
+	return p.policyError()
+}
+
+// checkStatementPolicy records the violations of the rules that apply to a
+// whole statement starting at pos, whose results are limited to limit rows.
+func (p *Parser) checkStatementPolicy(stmt *ast.SelectStatement, limit int, pos token.Pos) {
+	if p.policy.RequireRawLimit && stmt.IsRawQuery && limit == 0 {
+		p.violate(PolicyRawLimit, pos, "raw queries must have a LIMIT")
+	}
+
+	if max := p.policy.MaxTimeRange; max > 0 {
+		now := time.Now()
+		tr := stmt.TimeRangeAt(now)
+		if tr.Min.IsZero() {
+			p.violate(PolicyTimeRange, pos, "time must be bounded to at most %s", tools.FormatDuration(max))
+		} else {
+			end := tr.Max
+			if end.IsZero() {
+				end = now
+			}
+			if d := end.Sub(tr.Min); d > max {
+				p.violate(PolicyTimeRange, pos, "time range of %s exceeds %s", tools.FormatDuration(d), tools.FormatDuration(max))
+			}
+		}
+	}
+
+}
+
+// policyError returns the violations recorded so far, sorted by position,
+// or nil if there are none.
+func (p *Parser) policyError() error {
+	if len(p.violations) == 0 {
+		return nil
+	}
+	violations := p.violations
+	p.violations = nil
+	sort.SliceStable(violations, func(i, j int) bool {
+		a, b := violations[i].Pos, violations[j].Pos
+		return a.Line < b.Line || (a.Line == b.Line && a.Char < b.Char)
+	})
+	return violations
+}
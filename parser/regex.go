@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+
+	"sql/ast"
+)
+
+// RegexCache is a cache of compiled regular expressions keyed by pattern, so
+// that parsing the same regex again does not compile it again. It holds at
+// most a fixed number of patterns and drops the least recently used one when
+// it is full. It is safe to share between parsers used concurrently.
+type RegexCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *regexCacheEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type regexCacheEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// NewRegexCache returns a cache holding at most size patterns.
+func NewRegexCache(size int) *RegexCache {
+	return &RegexCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Compile returns the compiled pattern from the cache, or compiles and adds
+// it. Patterns that do not compile are not cached.
+func (c *RegexCache) Compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if e, ok := c.items[pattern]; ok {
+		c.order.MoveToFront(e)
+		re := e.Value.(*regexCacheEntry).re
+		c.mu.Unlock()
+		return re, nil
+	}
+	c.mu.Unlock()
+
+	// Compile without holding the lock. Another parser may compile the
+	// same pattern meanwhile, which is harmless.
+	re, err := regexp.Compile(pattern)
+	if err != nil || c.size <= 0 {
+		return re, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[pattern]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*regexCacheEntry).re, nil
+	}
+	c.items[pattern] = c.order.PushFront(&regexCacheEntry{pattern: pattern, re: re})
+	if c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*regexCacheEntry).pattern)
+	}
+	return re, nil
+}
+
+// Len returns the number of patterns in the cache.
+func (c *RegexCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// SetRegexCache sets the cache used to compile regular expressions. By
+// default, or if c is nil, every regex is compiled when it is parsed.
+// It must be called before parsing.
+func (p *Parser) SetRegexCache(c *RegexCache) {
+	p.regexCache = c
+}
+
+// WithRegexCache sets the cache used to compile regular expressions.
+// See SetRegexCache.
+func WithRegexCache(c *RegexCache) Option {
+	return func(p *Parser) error {
+		p.SetRegexCache(c)
+		return nil
+	}
+}
+
+// compileRegex compiles a regex pattern, using the regex cache if any.
+func (p *Parser) compileRegex(pattern string) (*regexp.Regexp, error) {
+	if p.regexCache != nil {
+		return p.regexCache.Compile(pattern)
+	}
+	return regexp.Compile(pattern)
+}
+
+// SetLazyRegex sets whether regular expressions are compiled on first use
+// rather than when they are parsed. A lazy RegexLiteral only holds its
+// Pattern, and an invalid pattern is reported by its Regexp method instead
+// of by the parser. It must be called before parsing.
+func (p *Parser) SetLazyRegex(lazy bool) {
+	p.lazyRegex = lazy
+}
+
+// WithLazyRegex makes regular expressions compiled on first use.
+// See SetLazyRegex.
+func WithLazyRegex() Option {
+	return func(p *Parser) error {
+		p.SetLazyRegex(true)
+		return nil
+	}
+}
+
+// regexLiteral returns the literal of a regex pattern. It is compiled now,
+// using the regex cache if any, unless regexes are lazy.
+func (p *Parser) regexLiteral(pattern string) (*ast.RegexLiteral, error) {
+	if p.lazyRegex {
+		return &ast.RegexLiteral{Pattern: pattern}, nil
+	}
+	re, err := p.compileRegex(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.RegexLiteral{Val: re}, nil
+}
@@ -0,0 +1,80 @@
+-- Queries that stress String() output: literal precision, quoting,
+-- escapes, regexes, unary minus and operator precedence.
+
+-- Numbers
+SELECT value FROM cpu WHERE value > 0.0001
+SELECT value FROM cpu WHERE value = 123456789.123456789
+SELECT value FROM cpu WHERE value = 1.0000000000000002
+SELECT value FROM cpu WHERE value = -0.5
+SELECT value FROM cpu WHERE value > 1.0
+SELECT value FROM cpu WHERE value > -1
+SELECT value FROM cpu WHERE x = 9223372036854775807
+SELECT value FROM cpu WHERE x = -9223372036854775808
+SELECT value FROM cpu WHERE x = 18446744073709551615
+SELECT value FROM cpu WHERE value = 0.1 + 0.2
+SELECT percentile(value, 99.99) FROM cpu
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(0)
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(1.0)
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(-1.5)
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(0.0001)
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(none)
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(previous)
+SELECT mean(value) FROM cpu GROUP BY time(10m) fill(linear)
+
+-- Unary minus and precedence
+SELECT -value FROM cpu
+SELECT +value, +mean(x) % +y FROM cpu
+SELECT -b * 2, -(a + b), -mean(x) FROM cpu
+SELECT value FROM cpu WHERE a = 2 * -b
+SELECT value FROM cpu WHERE a = 2 - -b + 1
+SELECT value FROM cpu WHERE a = -2 - -3
+SELECT (a + b) * c, a + b * c, a - (b - c) FROM cpu
+SELECT a % b & c | d ^ e FROM cpu
+SELECT value FROM cpu WHERE a = 1 OR b = 2 AND c = 3
+SELECT value FROM cpu WHERE (a = 1 OR b = 2) AND c = 3
+
+-- Identifiers
+SELECT "my field" FROM "my metric"
+SELECT "select" AS "from" FROM "where"
+SELECT "a\"b", "a\\b", "a\nb", "a\tb\rc\0" FROM cpu
+SELECT "1abc", "true", "é" FROM cpu
+SELECT DISTINCT "my value" FROM cpu
+SELECT count(DISTINCT "a b") FROM cpu
+SELECT value FROM "db"."ttl"."cpu"
+SELECT value FROM db..cpu
+SELECT value FROM "", db..""
+SELECT value FROM "a.b", "a/b", db."ttl x".cpu
+SELECT value FROM cpu GROUP BY "host name"
+SELECT value::field, host::tag, "x y"::integer FROM cpu
+SELECT *::field FROM cpu
+SELECT @timestamp, @"row id"::integer, @select FROM cpu GROUP BY @shard
+SELECT value INTO "db"."ttl"."out" FROM cpu
+SELECT mean(value) INTO db..:METRIC FROM /.*/ GROUP BY *
+
+-- Strings and regexes
+SELECT value FROM cpu WHERE host = 'it\'s'
+SELECT value FROM cpu WHERE host = 'a\nb\tc\\d\re'
+SELECT value FROM cpu WHERE host = 'é' AND region = ''
+SELECT value FROM cpu WHERE host =~ /a\/b/ AND region !~ /^a$/
+SELECT value FROM cpu WHERE host =~ /foo\\/bar/ AND region =~ /foo\\bar/
+SELECT value FROM cpu WHERE host =~ /a\/\/b/
+SELECT value FROM /cp\/u/, db./cpu.*/, db.ttl./cpu.*/
+
+-- Time
+SELECT value FROM cpu WHERE time > '2020-01-01T00:00:00Z'
+SELECT value FROM cpu WHERE time > '2020-01-01 00:00:00'
+SELECT value FROM cpu WHERE time > now() - 10m AND time < now() - -5m
+SELECT value FROM cpu WHERE time > now() - 1500ms OR time < now() - 1u
+SELECT mean(value) FROM cpu GROUP BY time(10m, 5m), host
+SELECT mean(value) FROM cpu GROUP BY time(1w3d)
+SELECT value FROM cpu TZ('America/Los_Angeles')
+SELECT value FROM cpu TZ('UTC')
+
+-- Clauses and subqueries
+SELECT value FROM cpu ORDER BY time ASC LIMIT 1 OFFSET 2 SLIMIT 3 SOFFSET 4
+SELECT value FROM (SELECT value FROM (SELECT value FROM cpu)) WHERE value > 1
+SELECT mean(value) FROM (SELECT max(value) AS value FROM cpu GROUP BY time(1m), host) GROUP BY time(1h)
+SELECT top(value, host, 3), count(*) FROM cpu
+SELECT * FROM (SELECT value FROM cpu TZ('UTC')) TZ('UTC')
+SELECT * FROM (SELECT * FROM (SELECT value FROM cpu TZ('Europe/Paris'))) TZ('Europe/Paris')
+SELECT * INTO other FROM (SELECT * FROM (SELECT value FROM cpu))
@@ -0,0 +1,74 @@
+-- Queries from TestParseStatement.
+
+SELECT * FROM ma
+SELECT * FROM ma GROUP BY *
+SELECT field1, * FROM ma GROUP BY *
+SELECT *, field1 FROM ma GROUP BY *
+SELECT "foo.bar.baz" AS foo FROM ma
+SELECT "foo.bar.baz" AS foo FROM foo
+select my_field FROM ma
+select 'my_field' FROM ma
+SELECT field1 FROM ma SLIMIT 10 SOFFSET 5
+SELECT * FROM cpu WHERE host = 'serverC' AND region =~ /.*west.*/
+select percentile("field1", 2.0) from cpu
+select percentile("field1", 2.0), field2 from cpu
+select top("field1", 2) from cpu
+select top(field1, 2) from cpu
+select top(field1, tag1, 2), tag1 from cpu
+select distinct(field1) from cpu
+select count(distinct field3) from metrics
+select count(distinct field3), sum(field4) from metrics
+select count(distinct(field3)), sum(field4) from metrics
+SELECT * FROM cpu WHERE load > 100
+SELECT * FROM cpu WHERE load >= 100
+SELECT * FROM cpu WHERE load = 100
+SELECT * FROM cpu WHERE load <= 100
+SELECT * FROM cpu WHERE load < 100
+SELECT * FROM cpu WHERE load != 100
+SELECT * FROM /cpu.*/
+SELECT * FROM "db"."ttl"./cpu.*/
+SELECT * FROM "db"../cpu.*/
+SELECT * FROM "ttl"./cpu.*/
+SELECT field1::float, field2::integer, field3::string, field4::boolean, field5::field, tag1::tag FROM cpu
+SELECT mean(value) FROM cpu GROUP BY time(10m, -5m)
+SELECT mean(value) FROM cpu GROUP BY time(10m, +5m)
+SELECT value FROM cpu WHERE d > -1h
+SELECT DISTINCT value FROM cpu
+SELECT DISTINCT/* c */value AS v, host FROM cpu
+SELECT count(distinct value), sum(x) FROM cpu WHERE host = 'a'
+SELECT MyUDF(value), MEAN(value) FROM cpu GROUP BY TIME(1m)
+SELECT mean(value) AS 'p95 latency' FROM cpu
+SELECT first(value), last(value), min(value), max(value) FROM cpu GROUP BY time(1m)
+SELECT value FROM cpu WHERE host = ANY('a', 'b') AND region != ALL('c')
+SELECT value FROM cpu WHERE host IN (a, 'b', "c d") OR region IN (west)
+SELECT * FROM a JOIN b ON a.id = b.id
+SELECT a.v, b.v FROM db..a JOIN (SELECT v, id FROM b) ON a.id = b.id JOIN c ON b.id = c.id AND c.v > 0 WHERE time > now() - 1h
+SHOW TIME TO LIVES
+SHOW TIME TO LIVES ON db
+SELECT time FROM cpu WHERE time > now() - 1h GROUP BY time(1m); SHOW TIME TO LIVES ON "my db"
+SELECT a FROM x UNION SELECT a FROM y
+SELECT mean(a) FROM x WHERE time > now() - 1h GROUP BY time(1m) UNION ALL SELECT max(b) FROM (SELECT b FROM y) UNION SELECT c FROM z ORDER BY time DESC LIMIT 10
+CREATE CONTINUOUS QUERY cq ON db BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END
+CREATE CONTINUOUS QUERY "my cq" ON "my db" RESAMPLE FOR 2h BEGIN SELECT max(value) INTO db.ttl.:METRIC FROM /cpu.*/ GROUP BY time(30m), * END
+CREATE CONTINUOUS QUERY cq ON db RESAMPLE EVERY 1m BEGIN SELECT count(value) INTO c FROM cpu GROUP BY time(1m) fill(0) END; SELECT * FROM c
+WITH t AS (SELECT value FROM cpu WHERE host = 'a') SELECT max(value) FROM t
+WITH base AS (SELECT mean(v) AS v FROM cpu GROUP BY time(1m)), "my t" AS (SELECT v FROM base) SELECT max(v) FROM "my t" UNION SELECT min(v) FROM base
+SHOW QUERIES
+KILL QUERY 36 ON "host:8088"; KILL QUERY 0
+SELECT kill, queries FROM cpu
+CREATE USER jdoe WITH PASSWORD 'pw'; DROP USER jdoe
+CREATE USER "ops\"admin" WITH PASSWORD 'p\'w\\' WITH ALL PRIVILEGES
+SET PASSWORD FOR "j doe" = ''
+SHOW GRANTS FOR jdoe; SHOW GRANTS FOR "ops admin"
+CREATE TIME TO LIVE one_day ON db DURATION 1d SHARD DURATION 1h DEFAULT; DROP TIME TO LIVE one_day ON db
+CREATE TIME TO LIVE "time" ON "to" DURATION INF
+SELECT time, duration, shard, "default" FROM cpu WHERE time > now() - 1h
+INSERT cpu,region=us,host=a value=1i,msg="semi;colon \"quoted\" \\ slash" 10; SELECT value FROM cpu
+INSERT INTO "my db".one_day "weird\ metric",k\=ey=v\,al ok=true,f=-1.5e-07
+SHOW TAG KEY EXACT CARDINALITY ON db FROM cpu WHERE host = 'a' GROUP BY region LIMIT 2 OFFSET 1; SHOW FIELD KEY CARDINALITY
+SELECT value FROM cpu WHERE value > (SELECT max(value) FROM cpu WHERE value < (SELECT mean(value) FROM cpu)) AND (SELECT count(value) FROM mem) = 3
+SELECT max(a) FROM (SELECT a FROM x UNION ALL SELECT a FROM y WHERE time > now() - 1h ORDER BY time DESC LIMIT 10 OFFSET 5) GROUP BY time(1m) UNION SELECT b FROM z LIMIT 3
+WITH a AS (SELECT v FROM cpu), b AS (SELECT max(v) AS v FROM (SELECT v FROM a) GROUP BY time(1m)) SELECT v FROM b, a UNION SELECT v FROM a
+SELECT payload->'status' AS status FROM http WHERE payload->'status'->'code' = 200 AND -payload->'latency' < 1
+SELECT *::field EXCEPT(debug_blob, "raw payload"), *::tag EXCEPT(host) FROM m; SELECT * EXCEPT(a) FROM (SELECT * FROM m)
+SELECT value FROM cpu WHERE !(host = 'a' OR region =~ /west/) AND !ok
@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"fmt"
+
+	"sql/ast"
+	"sql/token"
+)
+
+// SetStrictTypes sets whether the operators of the fields and the WHERE
+// clause of a statement are checked against the types of their operands,
+// such as in host::tag > 5 or value::integer =~ /x/. Only explicit casts and
+// literals have a type, so references without a cast are never rejected.
+// It must be called before parsing.
+func (p *Parser) SetStrictTypes(strict bool) {
+	p.strictTypes = strict
+}
+
+// WithStrictTypes makes the parser check the types of operands.
+// See SetStrictTypes.
+func WithStrictTypes() Option {
+	return func(p *Parser) error {
+		p.SetStrictTypes(true)
+		return nil
+	}
+}
+
+// recordOp records the position of the operator of a binary expression, so
+// that type errors can be reported where the operator is.
+func (p *Parser) recordOp(expr *ast.BinaryExpr, pos token.Pos) {
+	if !p.strictTypes {
+		return
+	}
+	if p.opPos == nil {
+		p.opPos = make(map[*ast.BinaryExpr]token.Pos)
+	}
+	p.opPos[expr] = pos
+}
+
+// checkTypes returns an error for the first operator of the fields or the
+// condition of stmt applied to operands of the wrong type.
+func (p *Parser) checkTypes(stmt *ast.SelectStatement) error {
+	if !p.strictTypes {
+		return nil
+	}
+	var err error
+	check := func(n ast.Node) {
+		// Negations such as -x are built without an operator to report.
+		if e, ok := n.(*ast.BinaryExpr); ok && err == nil {
+			if pos, ok := p.opPos[e]; ok {
+				if msg := typeError(e); msg != "" {
+					err = &ParseError{Message: msg, Pos: pos}
+				}
+			}
+		}
+	}
+	ast.WalkFunc(stmt.Fields, check)
+	ast.WalkFunc(stmt.Condition, check)
+	return err
+}
+
+// typeError describes why the operator of expr cannot apply to its operands,
+// or returns "" if it can or the types are not known.
+func typeError(e *ast.BinaryExpr) string {
+	lhs, rhs := exprType(e.LHS), exprType(e.RHS)
+	switch {
+	case e.Op.IsRegexOp():
+		if typeClass(lhs) == numericType || lhs == ast.Boolean {
+			return fmt.Sprintf("cannot match %s of type %s against a regex", e.LHS, lhs)
+		}
+	case e.Op.Precedence() == token.EQ.Precedence():
+		if lc, rc := typeClass(lhs), typeClass(rhs); lc != unknownType && rc != unknownType && lc != rc {
+			return fmt.Sprintf("cannot compare %s of type %s with %s of type %s", e.LHS, lhs, e.RHS, rhs)
+		}
+	case e.Op == token.ADD, e.Op == token.SUB, e.Op == token.MUL, e.Op == token.DIV, e.Op == token.MOD:
+		for _, operand := range []struct {
+			expr ast.Expr
+			typ  ast.DataType
+		}{{e.LHS, lhs}, {e.RHS, rhs}} {
+			if c := typeClass(operand.typ); c == stringType || c == booleanType {
+				return fmt.Sprintf("cannot apply %s to %s of type %s", e.Op, operand.expr, operand.typ)
+			}
+		}
+	}
+	return ""
+}
+
+// exprType returns the type of an expression known without a schema, which
+// is the type of a literal or of an explicit cast.
+func exprType(expr ast.Expr) ast.DataType {
+	switch expr := expr.(type) {
+	case *ast.ParenExpr:
+		return exprType(expr.Expr)
+	case *ast.VarRef:
+		return expr.Type
+	case *ast.IntegerLiteral:
+		return ast.Integer
+	case *ast.UnsignedLiteral:
+		return ast.Unsigned
+	case *ast.NumberLiteral:
+		return ast.Float
+	case *ast.StringLiteral:
+		return ast.String
+	case *ast.BooleanLiteral:
+		return ast.Boolean
+	case *ast.DurationLiteral:
+		return ast.Duration
+	}
+	return ast.Unknown
+}
+
+// Classes of types that can be compared with each other.
+const (
+	unknownType = iota
+	numericType
+	stringType
+	booleanType
+)
+
+// typeClass returns the class of a type.
+func typeClass(typ ast.DataType) int {
+	switch typ {
+	case ast.Integer, ast.Unsigned, ast.Float, ast.Duration:
+		return numericType
+	case ast.String, ast.Tag:
+		return stringType
+	case ast.Boolean:
+		return booleanType
+	}
+	return unknownType
+}
+
+// recordCast records the position of a reference with a cast, so that a
+// conflicting cast can be reported where it is.
+func (p *Parser) recordCast(ref *ast.VarRef, pos token.Pos) {
+	if ref.Type == ast.Unknown {
+		return
+	}
+	if p.castPos == nil {
+		p.castPos = make(map[*ast.VarRef]token.Pos)
+	}
+	p.castPos[ref] = pos
+}
+
+// checkCasts returns an error if the fields, the condition or the
+// dimensions of stmt cast the same name to types that cannot both hold,
+// such as value::float and value::integer. Subqueries are checked on their
+// own. The error is reported at the first cast of the pair that comes last.
+func (p *Parser) checkCasts(stmt *ast.SelectStatement) error {
+	var refs []*ast.VarRef
+	collect := func(n ast.Node) {
+		ast.Walk(castVisitor{refs: &refs}, n)
+	}
+	collect(stmt.Fields)
+	collect(stmt.Condition)
+	collect(stmt.Dimensions)
+
+	vals := make([]ast.VarRef, len(refs))
+	for i, ref := range refs {
+		vals[i] = *ref
+	}
+	a, b, ok := ast.TypeConflict(vals)
+	if !ok {
+		return nil
+	}
+
+	// first returns the position of the first cast like want.
+	first := func(want ast.VarRef) (pos token.Pos, found bool) {
+		for _, ref := range refs {
+			if at, ok := p.castPos[ref]; ok && *ref == want && (!found || posBefore(at, pos)) {
+				pos, found = at, true
+			}
+		}
+		return pos, found
+	}
+	pos, _ := first(a)
+	if posB, ok := first(b); ok && posBefore(pos, posB) {
+		pos = posB
+	}
+	return &ParseError{Message: fmt.Sprintf("conflicting types for %s: %s and %s", a.Val, a.Type, b.Type), Pos: pos}
+}
+
+// castVisitor collects the references with a cast, outside of subqueries.
+type castVisitor struct {
+	refs *[]*ast.VarRef
+}
+
+func (v castVisitor) Visit(n ast.Node) ast.Visitor {
+	switch n := n.(type) {
+	case *ast.SubqueryExpr:
+		return nil
+	case *ast.VarRef:
+		if n.Type != ast.Unknown {
+			*v.refs = append(*v.refs, n)
+		}
+	}
+	return v
+}
+
+// posBefore returns true if a comes before b.
+func posBefore(a, b token.Pos) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Char < b.Char)
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"sql/token"
 	"sql/tools"
@@ -16,23 +18,54 @@ type Scanner interface {
 	// Scan reads the next token from the scanner.
 	Scan() (pos token.Pos, tok token.Token, lit string)
 	// ScanRegex reads a regex token from the scanner.
+	// If tokens have been unscanned, the next of those is returned instead.
 	ScanRegex() (pos token.Pos, tok token.Token, lit string)
+	// ScanRaw reads the next token from the scanner and returns the exact
+	// source text of the token, such as the quotes and escapes of a string,
+	// instead of its decoded literal.
+	ScanRaw() (pos token.Pos, tok token.Token, raw string)
+	// Raw returns the source text of the current token, which is the last
+	// one read and not unscanned, such as "\"WITH\"" for a quoted WITH.
+	Raw() string
 	// Peek returns the next rune that would be read by the scanner.
 	Peek() rune
+	// ReadRune reads the next rune of the input without scanning a token,
+	// for text with its own lexical rules. Tokens that were unscanned are
+	// not returned again, so it should not be called after Unscan.
+	ReadRune() (ch rune, size int, err error)
+	// UnreadRune pushes back the rune read by ReadRune.
+	UnreadRune() error
 	// Unscan pushes the previously token back onto the buffer.
 	Unscan()
+	// AllowKeywordAsIdent makes a keyword non-reserved so that it is
+	// scanned as an identifier from then on.
+	AllowKeywordAsIdent(tok token.Token)
+	// InternIdents makes the scanner return the same string for bare
+	// identifiers and keywords written the same way, keeping at most n of
+	// them, or stop doing so if n is not positive.
+	InternIdents(n int)
 }
 
+// tokenBufLen is the number of tokens kept by bufScanner.
+// It is the maximum number of consecutive Unscan calls that are supported.
+// The parser never unscans more than two tokens in a row.
+const tokenBufLen = 3
+
+// runeBufLen is the number of runes kept by reader.
+// It is the maximum number of consecutive unread calls that are supported.
+const runeBufLen = 3
+
 // bufScanner represents a wrapper for scanner to add a buffer.
 // It provides a fixed-length circular buffer that can be unread.
 type bufScanner struct {
 	s   *scanner
 	i   int // buffer index
 	n   int // buffer size
-	buf [3]struct {
+	buf [tokenBufLen]struct {
 		tok token.Token
 		pos token.Pos
 		lit string
+		raw string
 	}
 }
 
@@ -51,6 +84,17 @@ func (s *bufScanner) ScanRegex() (pos token.Pos, tok token.Token, lit string) {
 	return s.ScanFunc(s.s.ScanRegex)
 }
 
+// ScanRaw reads the next token from the scanner and returns its source text.
+func (s *bufScanner) ScanRaw() (pos token.Pos, tok token.Token, raw string) {
+	pos, tok, _ = s.Scan()
+	return pos, tok, s.Raw()
+}
+
+// Raw returns the source text of the current token.
+func (s *bufScanner) Raw() string {
+	return s.buf[(s.i-s.n+len(s.buf))%len(s.buf)].raw
+}
+
 // ScanFunc uses the provided function to scan the next token.
 func (s *bufScanner) ScanFunc(scan func() (token.Pos, token.Token, string)) (pos token.Pos, tok token.Token, lit string) {
 	// If we have unread tokens then read them off the buffer first.
@@ -62,22 +106,67 @@ func (s *bufScanner) ScanFunc(scan func() (token.Pos, token.Token, string)) (pos
 	// Move buffer position forward and save the token.
 	s.i = (s.i + 1) % len(s.buf)
 	buf := &s.buf[s.i]
+	s.s.r.raw = s.s.r.raw[:0]
 	buf.pos, buf.tok, buf.lit = scan()
+	// Most tokens are their own source text, which is then not copied.
+	if raw := s.s.r.raw; string(raw) == buf.lit {
+		buf.raw = buf.lit
+	} else {
+		buf.raw = string(raw)
+	}
 
 	return s.curr()
 }
 
 func (s *bufScanner) Peek() rune {
-	r, _, _ := s.s.r.ReadRune()
-	if r != EOF {
+	r, _, err := s.s.r.ReadRune()
+	if err == nil {
 		_ = s.s.r.UnreadRune()
 	}
 
 	return r
 }
 
+// ReadRune reads the next rune of the input without scanning a token.
+func (s *bufScanner) ReadRune() (ch rune, size int, err error) {
+	return s.s.r.ReadRune()
+}
+
+// UnreadRune pushes back the rune read by ReadRune.
+func (s *bufScanner) UnreadRune() error {
+	return s.s.r.UnreadRune()
+}
+
 // Unscan pushes the previously token back onto the buffer.
-func (s *bufScanner) Unscan() { s.n++ }
+// It panics if more than tokenBufLen tokens are pushed back.
+func (s *bufScanner) Unscan() {
+	if s.n == len(s.buf) {
+		panic(fmt.Sprintf("scanner: more than %d consecutive Unscan calls", len(s.buf)))
+	}
+	s.n++
+}
+
+// AllowKeywordAsIdent makes a keyword non-reserved so that it is scanned as an
+// identifier. Tokens that were already scanned are not affected.
+func (s *bufScanner) AllowKeywordAsIdent(tok token.Token) {
+	if s.s.idents == nil {
+		s.s.idents = make(map[token.Token]bool)
+	}
+	s.s.idents[tok] = true
+}
+
+// InternIdents makes the scanner return the same string for bare identifiers
+// and keywords written the same way. The first n distinct ones are kept, and
+// the others are allocated every time, so that input with many distinct
+// names cannot grow the scanner without bound.
+func (s *bufScanner) InternIdents(n int) {
+	s.s.maxInterned = n
+	if n <= 0 {
+		s.s.interned = nil
+	} else if s.s.interned == nil {
+		s.s.interned = make(map[string]string)
+	}
+}
 
 // curr returns the last read token.
 func (s *bufScanner) curr() (pos token.Pos, tok token.Token, lit string) {
@@ -88,6 +177,14 @@ func (s *bufScanner) curr() (pos token.Pos, tok token.Token, lit string) {
 // scanner represents a lexical scanner for CnosQL.
 type scanner struct {
 	r *reader
+
+	// Keywords that are scanned as identifiers.
+	idents map[token.Token]bool
+
+	// Identifiers returned so far, if they are interned, and the maximum
+	// number of them.
+	interned    map[string]string
+	maxInterned int
 }
 
 // newScanner returns a new instance of scanner.
@@ -118,6 +215,10 @@ func (s *scanner) Scan() (pos token.Pos, tok token.Token, lit string) {
 	switch ch0 {
 	case EOF:
 		return pos, token.EOF, ""
+	case nul:
+		return pos, token.ILLEGAL, "NUL character"
+	case invalid:
+		return pos, token.ILLEGAL, "invalid UTF-8 encoding"
 	case '"':
 		s.r.unread()
 		return s.scanIdent(true)
@@ -136,13 +237,28 @@ func (s *scanner) Scan() (pos token.Pos, tok token.Token, lit string) {
 			return pos, tok, "$" + lit
 		}
 		return pos, token.BOUNDPARAM, "$" + lit
+	case '@':
+		// A system field reference is an '@' followed by a bare identifier
+		// made of letters, digits and underscores, or by a quoted identifier.
+		_, tok, lit = s.scanIdent(false)
+		if tok != token.IDENT {
+			return pos, tok, "@" + lit
+		} else if lit == "" {
+			return pos, token.ILLEGAL, "@"
+		}
+		return pos, token.SYSREF, "@" + lit
 	case '+':
 		return pos, token.ADD, ""
 	case '-':
 		ch1, _ := s.r.read()
 		if ch1 == '-' {
-			s.skipUntilNewline()
-			return pos, token.COMMENT, ""
+			text, err := s.scanUntilNewline()
+			if err != nil {
+				return pos, token.ILLEGAL, err.Error()
+			}
+			return pos, token.COMMENT, "--" + text
+		} else if ch1 == '>' {
+			return pos, token.ARROW, ""
 		}
 		s.r.unread()
 		return pos, token.SUB, ""
@@ -151,10 +267,13 @@ func (s *scanner) Scan() (pos token.Pos, tok token.Token, lit string) {
 	case '/':
 		ch1, _ := s.r.read()
 		if ch1 == '*' {
-			if err := s.skipUntilEndComment(); err != nil {
+			text, err := s.scanUntilEndComment()
+			if err == errBadRune {
+				return pos, token.ILLEGAL, err.Error()
+			} else if err != nil {
 				return pos, token.ILLEGAL, ""
 			}
-			return pos, token.COMMENT, ""
+			return pos, token.COMMENT, "/*" + text
 		} else {
 			s.r.unread()
 		}
@@ -180,6 +299,7 @@ func (s *scanner) Scan() (pos token.Pos, tok token.Token, lit string) {
 			return pos, token.NEQREGEX, ""
 		}
 		s.r.unread()
+		return pos, token.NOT, ""
 	case '>':
 		if ch1, _ := s.r.read(); ch1 == '=' {
 			return pos, token.GTE, ""
@@ -237,32 +357,49 @@ func (s *scanner) scanWhitespace() (pos token.Pos, tok token.Token, lit string)
 	return pos, token.WS, buf.String()
 }
 
-// skipUntilNewline skips characters until it reaches a newline.
-func (s *scanner) skipUntilNewline() {
+// scanUntilNewline consumes characters until it reaches a newline and
+// returns the text read. The newline is consumed but not returned.
+func (s *scanner) scanUntilNewline() (string, error) {
+	var buf strings.Builder
 	for {
-		if ch, _ := s.r.read(); ch == '\n' || ch == EOF {
-			return
+		ch, _ := s.r.read()
+		if ch == '\n' || ch == EOF {
+			return buf.String(), nil
+		} else if ch == nul || ch == invalid {
+			return "", errBadRune
 		}
+		_, _ = buf.WriteRune(ch)
 	}
 }
 
-// skipUntilEndComment skips characters until it reaches a '*/' symbol.
-func (s *scanner) skipUntilEndComment() error {
+// scanUntilEndComment consumes characters until it reaches a '*/' symbol
+// and returns the text read, including the closing symbol.
+func (s *scanner) scanUntilEndComment() (string, error) {
+	var buf strings.Builder
 	for {
-		if ch1, _ := s.r.read(); ch1 == '*' {
+		ch1, _ := s.r.read()
+		if ch1 == EOF {
+			return "", io.EOF
+		} else if ch1 == nul || ch1 == invalid {
+			return "", errBadRune
+		}
+		_, _ = buf.WriteRune(ch1)
+		if ch1 == '*' {
 			// We might be at the end.
 		star:
 			ch2, _ := s.r.read()
+			if ch2 == EOF {
+				return "", io.EOF
+			} else if ch2 == nul || ch2 == invalid {
+				return "", errBadRune
+			}
+			_, _ = buf.WriteRune(ch2)
 			if ch2 == '/' {
-				return nil
+				return buf.String(), nil
 			} else if ch2 == '*' {
 				// We are back in the state machine since we see a star.
 				goto star
-			} else if ch2 == EOF {
-				return io.EOF
 			}
-		} else if ch1 == EOF {
-			return io.EOF
 		}
 	}
 }
@@ -272,7 +409,6 @@ func (s *scanner) scanIdent(lookup bool) (pos token.Pos, tok token.Token, lit st
 	_, pos = s.r.read()
 	s.r.unread()
 
-	var buf strings.Builder
 	for {
 		if ch, _ := s.r.read(); ch == EOF {
 			break
@@ -284,34 +420,50 @@ func (s *scanner) scanIdent(lookup bool) (pos token.Pos, tok token.Token, lit st
 			return pos, token.IDENT, lit0
 		} else if tools.IsIdentChar(ch) {
 			s.r.unread()
-			buf.WriteString(ScanBareIdent(s.r))
+			lit += s.ident(s.r.readIdent())
 		} else {
 			s.r.unread()
 			break
 		}
 	}
-	lit = buf.String()
 
 	// If the literal matches a keyword then return that keyword.
+	// The literal is kept so that the original text can be recovered.
 	if lookup {
-		if tok = token.Lookup(lit); tok != token.IDENT {
-			return pos, tok, ""
+		if tok = token.Lookup(lit); tok != token.IDENT && !s.idents[tok] {
+			return pos, tok, lit
 		}
 	}
 	return pos, token.IDENT, lit
 }
 
+// ident returns the string of the bare identifier b, which is the one
+// returned before for the same text if identifiers are interned.
+func (s *scanner) ident(b []byte) string {
+	if s.interned == nil {
+		return string(b)
+	} else if lit, ok := s.interned[string(b)]; ok {
+		return lit
+	}
+	lit := string(b)
+	if len(s.interned) < s.maxInterned {
+		s.interned[lit] = lit
+	}
+	return lit
+}
+
 // scanString consumes a contiguous string of non-quote characters.
 // Quote characters can be consumed if they're first escaped with a backslash.
 func (s *scanner) scanString() (pos token.Pos, tok token.Token, lit string) {
-	s.r.unread()
+	// Save the position of the opening quote before unreading it.
 	_, pos = s.r.curr()
+	s.r.unread()
 
 	var err error
 	lit, err = ScanString(s.r)
 	if err == errBadString {
 		return pos, token.BADSTRING, lit
-	} else if err == errBadEscape {
+	} else if errors.Is(err, errBadEscape) {
 		_, pos = s.r.curr()
 		return pos, token.BADESCAPE, lit
 	}
@@ -320,7 +472,9 @@ func (s *scanner) scanString() (pos token.Pos, tok token.Token, lit string) {
 
 // ScanRegex consumes a token to find escapes
 func (s *scanner) ScanRegex() (pos token.Pos, tok token.Token, lit string) {
-	_, pos = s.r.curr()
+	// The regex starts at the next rune, not the current one.
+	_, pos = s.r.read()
+	s.r.unread()
 
 	// Start & end sentinels.
 	start, end := '/', '/'
@@ -425,24 +579,35 @@ func (s *scanner) scanDigits() string {
 // reader represents a buffered rune reader used by the scanner.
 // It provides a fixed-length circular buffer that can be unread.
 type reader struct {
-	r   io.RuneScanner
+	r   *bufio.Reader
 	i   int       // buffer index
 	n   int       // buffer char count
 	pos token.Pos // last read rune position
-	buf [3]struct {
-		ch  rune
-		pos token.Pos
+	buf [runeBufLen]struct {
+		ch   rune
+		pos  token.Pos
+		raw  [utf8.UTFMax]byte // source text of the rune
+		nraw int
 	}
-	eof bool // true if reader has ever seen eof.
+	bom bool   // true if reader has checked for a leading byte order mark.
+	raw []byte // source text of the runes read since it was last reset
 }
 
 // ReadRune reads the next rune from the reader.
 // This is a wrapper function to implement the io.RuneReader interface.
-// Note that this function does not return size.
+// NUL characters and invalid UTF-8 bytes are returned the same way a
+// *bufio.Reader would return them: as 0 and utf8.RuneError with a size of 1.
 func (r *reader) ReadRune() (ch rune, size int, err error) {
 	ch, _ = r.read()
-	if ch == EOF {
+	switch ch {
+	case EOF:
 		err = io.EOF
+	case nul:
+		ch, size = 0, 1
+	case invalid:
+		ch, size = utf8.RuneError, 1
+	default:
+		size = utf8.RuneLen(ch)
 	}
 	return
 }
@@ -459,48 +624,100 @@ func (r *reader) read() (ch rune, pos token.Pos) {
 	// If we have unread characters then read them off the buffer first.
 	if r.n > 0 {
 		r.n--
+		buf := &r.buf[(r.i-r.n+len(r.buf))%len(r.buf)]
+		r.raw = append(r.raw, buf.raw[:buf.nraw]...)
 		return r.curr()
 	}
 
 	// Read next rune from underlying reader.
 	// Any error (including io.EOF) should return as EOF.
-	ch, _, err := r.r.ReadRune()
-	if err != nil {
-		ch = EOF
-	} else if ch == '\r' {
-		if ch, _, err := r.r.ReadRune(); err != nil {
-			// nop
-		} else if ch != '\n' {
-			_ = r.r.UnreadRune()
+	ch, size, err := r.r.ReadRune()
+	if !r.bom {
+		// Skip a UTF-8 byte order mark at the start of the input.
+		r.bom = true
+		if err == nil && ch == '\uFEFF' {
+			ch, size, err = r.r.ReadRune()
 		}
-		ch = '\n'
 	}
-
-	// Save character and position to the buffer.
+	// Save the source text of the rune to the buffer without allocating,
+	// since every rune of the input is read here.
 	r.i = (r.i + 1) % len(r.buf)
 	buf := &r.buf[r.i]
+	if err != nil {
+		ch, buf.nraw = EOF, 0
+	} else if ch == utf8.RuneError && size == 1 {
+		// Re-read the offending byte so the source text is kept intact.
+		_ = r.r.UnreadRune()
+		buf.raw[0], _ = r.r.ReadByte()
+		ch, buf.nraw = invalid, 1
+	} else {
+		buf.nraw = utf8.EncodeRune(buf.raw[:], ch)
+		if ch == 0 {
+			ch = nul
+		} else if ch == '\r' {
+			if ch, _, err := r.r.ReadRune(); err != nil {
+				// nop
+			} else if ch != '\n' {
+				_ = r.r.UnreadRune()
+			} else {
+				buf.raw[1], buf.nraw = '\n', 2
+			}
+			ch = '\n'
+		}
+	}
+	r.raw = append(r.raw, buf.raw[:buf.nraw]...)
 	buf.ch, buf.pos = ch, r.pos
 
 	// Update position.
-	// Only count EOF once.
+	// EOF is never counted so it is always reported at the same position,
+	// no matter how many times it is read.
 	if ch == '\n' {
 		r.pos.Line++
 		r.pos.Char = 0
-	} else if !r.eof {
+	} else if ch != EOF {
 		r.pos.Char++
 	}
 
-	// Mark the reader as EOF.
-	// This is used so we don't double count EOF characters.
-	if ch == EOF {
-		r.eof = true
-	}
-
 	return r.curr()
 }
 
+// readIdent reads a run of identifier characters and returns their source
+// text, which is only valid until the next read. The runes that were unread
+// are read again first, then the others are read a byte at a time from the
+// underlying reader, since identifier characters are ASCII. This is the same
+// as calling read for each of them, only faster.
+func (r *reader) readIdent() []byte {
+	start := len(r.raw)
+	for r.n > 0 || !r.bom {
+		if ch, _ := r.read(); !tools.IsIdentChar(ch) {
+			r.unread()
+			return r.raw[start:]
+		}
+	}
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			break
+		} else if b >= utf8.RuneSelf || !tools.IsIdentChar(rune(b)) {
+			_ = r.r.UnreadByte()
+			break
+		}
+		r.i = (r.i + 1) % len(r.buf)
+		buf := &r.buf[r.i]
+		buf.ch, buf.pos, buf.raw[0], buf.nraw = rune(b), r.pos, b, 1
+		r.raw = append(r.raw, b)
+		r.pos.Char++
+	}
+	return r.raw[start:]
+}
+
 // unread pushes the previously read rune back onto the buffer.
+// It panics if more than runeBufLen runes are pushed back.
 func (r *reader) unread() {
+	if r.n == len(r.buf) {
+		panic(fmt.Sprintf("scanner: more than %d consecutive unread calls", len(r.buf)))
+	}
+	r.raw = r.raw[:len(r.raw)-r.buf[(r.i-r.n+len(r.buf))%len(r.buf)].nraw]
 	r.n++
 }
 
@@ -514,6 +731,22 @@ func (r *reader) curr() (ch rune, pos token.Pos) {
 // EOF is a marker code point to signify that the reader can't read any more.
 const EOF = rune(0)
 
+const (
+	// nul is a marker code point for a NUL character read from the input,
+	// which would otherwise be indistinguishable from EOF.
+	nul = rune(-1)
+
+	// invalid is a marker code point for a byte that is not valid UTF-8.
+	// A literal U+FFFD in the input is still read as utf8.RuneError.
+	invalid = rune(-2)
+)
+
+// isBadRune returns true if the rune read from r is a NUL character or
+// an invalid UTF-8 byte. Neither is allowed inside a quoted literal.
+func isBadRune(ch rune, size int, err error) bool {
+	return err == nil && (ch == 0 || (ch == utf8.RuneError && size == 1))
+}
+
 // ScanDelimited reads a delimited set of runes
 func ScanDelimited(r io.RuneScanner, start, end rune, escapes map[rune]rune, escapesPassThru bool) ([]byte, error) {
 	// Scan start delimiter.
@@ -525,19 +758,23 @@ func ScanDelimited(r io.RuneScanner, start, end rune, escapes map[rune]rune, esc
 
 	var buf bytes.Buffer
 	for {
-		ch0, _, err := r.ReadRune()
+		ch0, size, err := r.ReadRune()
 		if ch0 == end {
 			return buf.Bytes(), nil
 		} else if err != nil {
 			return buf.Bytes(), err
 		} else if ch0 == '\n' {
 			return nil, errors.New("delimited text contains new line")
+		} else if isBadRune(ch0, size, err) {
+			return nil, errBadRune
 		} else if ch0 == '\\' {
 			// If the next character is an escape then write the escaped char.
 			// If it's not a valid escape then return an error.
-			ch1, _, err := r.ReadRune()
+			ch1, size, err := r.ReadRune()
 			if err != nil {
 				return nil, err
+			} else if isBadRune(ch1, size, err) {
+				return nil, errBadRune
 			}
 
 			c, ok := escapes[ch1]
@@ -572,16 +809,18 @@ func ScanString(r io.RuneScanner) (string, error) {
 
 	var buf strings.Builder
 	for {
-		ch0, _, err := r.ReadRune()
+		ch0, size, err := r.ReadRune()
 		if ch0 == ending {
 			return buf.String(), nil
-		} else if err != nil || ch0 == '\n' {
+		} else if err != nil || ch0 == '\n' || isBadRune(ch0, size, err) {
 			return buf.String(), errBadString
 		} else if ch0 == '\\' {
 			// If the next character is an escape then write the escaped char.
 			// If it's not a valid escape then return an error.
-			ch1, _, _ := r.ReadRune()
-			if ch1 == 'n' {
+			ch1, size, err := r.ReadRune()
+			if err != nil || isBadRune(ch1, size, err) {
+				return buf.String(), errBadString
+			} else if ch1 == 'n' {
 				_, _ = buf.WriteRune('\n')
 			} else if ch1 == '\\' {
 				_, _ = buf.WriteRune('\\')
@@ -589,6 +828,18 @@ func ScanString(r io.RuneScanner) (string, error) {
 				_, _ = buf.WriteRune('"')
 			} else if ch1 == '\'' {
 				_, _ = buf.WriteRune('\'')
+			} else if ch1 == 't' {
+				_, _ = buf.WriteRune('\t')
+			} else if ch1 == 'r' {
+				_, _ = buf.WriteRune('\r')
+			} else if ch1 == '0' {
+				_, _ = buf.WriteRune(0)
+			} else if ch1 == 'u' || ch1 == 'U' {
+				ch, lit, err := scanUnicodeEscape(r, ch1)
+				if err != nil {
+					return lit, err
+				}
+				_, _ = buf.WriteRune(ch)
 			} else {
 				return string(ch0) + string(ch1), errBadEscape
 			}
@@ -598,8 +849,52 @@ func ScanString(r io.RuneScanner) (string, error) {
 	}
 }
 
+// scanUnicodeEscape reads the hex digits of a \uXXXX or \UXXXXXXXX escape.
+// The escape rune ('u' or 'U') must already have been consumed.
+// It returns the decoded rune and, on error, the escape text read so far.
+func scanUnicodeEscape(r io.RuneScanner, esc rune) (rune, string, error) {
+	n := 4
+	if esc == 'U' {
+		n = 8
+	}
+
+	lit := []rune{'\\', esc}
+	var ch uint32 // 8 hex digits overflow a rune
+	for i := 0; i < n; i++ {
+		ch1, _, err := r.ReadRune()
+		if err != nil || !tools.IsHexDigit(ch1) {
+			if err == nil {
+				_ = r.UnreadRune()
+			}
+			return 0, string(lit), fmt.Errorf("%w: \\%c escape requires %d hex digits, found %d", errBadEscape, esc, n, i)
+		}
+		lit = append(lit, ch1)
+		ch = ch<<4 | uint32(hexValue(ch1))
+	}
+
+	if ch > unicode.MaxRune {
+		return 0, string(lit), fmt.Errorf("%w: code point %s is out of range", errBadEscape, string(lit))
+	} else if ch >= 0xD800 && ch <= 0xDFFF {
+		return 0, string(lit), fmt.Errorf("%w: code point %s is a surrogate half", errBadEscape, string(lit))
+	}
+	return rune(ch), "", nil
+}
+
+// hexValue returns the value of a hex digit.
+func hexValue(ch rune) rune {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0'
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10
+	default:
+		return ch - 'A' + 10
+	}
+}
+
 var errBadString = errors.New("bad string")
 var errBadEscape = errors.New("bad escape")
+var errBadRune = errors.New("text contains NUL or invalid UTF-8")
 
 // ScanBareIdent reads bare identifier from a rune reader.
 func ScanBareIdent(r io.RuneScanner) string {
@@ -1,11 +1,19 @@
 package scanner_test
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sql/scanner"
 	"sql/token"
+	"sql/tools"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+	"unsafe"
 )
 
 // Ensure the scanner can scan tokens correctly.
@@ -19,6 +27,9 @@ func TestScanner_Scan(t *testing.T) {
 		// Special tokens (EOF, ILLEGAL, WS)
 		{s: ``, tok: token.EOF},
 		{s: `#`, tok: token.ILLEGAL, lit: `#`},
+		{s: "\x00", tok: token.ILLEGAL, lit: "NUL character"},
+		{s: "\xff", tok: token.ILLEGAL, lit: "invalid UTF-8 encoding"},
+		{s: "\uFFFD", tok: token.ILLEGAL, lit: "\uFFFD"},
 		{s: ` `, tok: token.WS, lit: " "},
 		{s: "\t", tok: token.WS, lit: "\t"},
 		{s: "\n", tok: token.WS, lit: "\n"},
@@ -28,6 +39,17 @@ func TestScanner_Scan(t *testing.T) {
 		{s: "\n\r", tok: token.WS, lit: "\n\n"},
 		{s: " \n\t \r\n\t", tok: token.WS, lit: " \n\t \n\t"},
 		{s: " foo", tok: token.WS, lit: " "},
+		{s: "\v", tok: token.WS, lit: "\v"},
+		{s: "\f", tok: token.WS, lit: "\f"},
+		{s: "\u00A0", tok: token.WS, lit: "\u00A0"},
+		{s: " \v\f\u00A0\u2003x", tok: token.WS, lit: " \v\f\u00A0\u2003"},
+
+		// Comments
+		{s: "-- foo\nbar", tok: token.COMMENT, lit: "-- foo"},
+		{s: "--", tok: token.COMMENT, lit: "--"},
+		{s: "/* foo\n * bar **/", tok: token.COMMENT, lit: "/* foo\n * bar **/"},
+		{s: "/* foo", tok: token.ILLEGAL},
+		{s: "-- foo\x00", tok: token.ILLEGAL, lit: "text contains NUL or invalid UTF-8"},
 
 		// Numeric operators
 		{s: `+`, tok: token.ADD},
@@ -37,14 +59,17 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `%`, tok: token.MOD},
 
 		// Logical operators
-		{s: `AND`, tok: token.AND},
-		{s: `and`, tok: token.AND},
-		{s: `OR`, tok: token.OR},
-		{s: `or`, tok: token.OR},
+		{s: `AND`, tok: token.AND, lit: `AND`},
+		{s: `and`, tok: token.AND, lit: `and`},
+		{s: `OR`, tok: token.OR, lit: `OR`},
+		{s: `or`, tok: token.OR, lit: `or`},
 
 		{s: `=`, tok: token.EQ},
 		{s: `<>`, tok: token.NEQ},
-		{s: `! `, tok: token.ILLEGAL, lit: "!"},
+		{s: `!=`, tok: token.NEQ},
+		{s: `! `, tok: token.NOT},
+		{s: `!(`, tok: token.NOT},
+		{s: `! =`, tok: token.NOT},
 		{s: `<`, tok: token.LT},
 		{s: `<=`, tok: token.LTE},
 		{s: `>`, tok: token.GT},
@@ -58,8 +83,11 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `.`, tok: token.DOT},
 		{s: `=~`, tok: token.EQREGEX},
 		{s: `!~`, tok: token.NEQREGEX},
+		{s: `! ~`, tok: token.NOT},
 		{s: `:`, tok: token.COLON},
 		{s: `::`, tok: token.DOUBLECOLON},
+		{s: `->`, tok: token.ARROW},
+		{s: `- >`, tok: token.SUB},
 
 		// Identifiers
 		{s: `foo`, tok: token.IDENT, lit: `foo`},
@@ -69,13 +97,18 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `"foo\\bar"`, tok: token.IDENT, lit: `foo\bar`},
 		{s: `"foo\bar"`, tok: token.BADESCAPE, lit: `\b`, pos: token.Pos{Line: 0, Char: 5}},
 		{s: `"foo\"bar\""`, tok: token.IDENT, lit: `foo"bar"`},
-		{s: `test"`, tok: token.BADSTRING, lit: "", pos: token.Pos{Line: 0, Char: 3}},
+		{s: `test"`, tok: token.BADSTRING, lit: "", pos: token.Pos{Line: 0, Char: 4}},
 		{s: `"test`, tok: token.BADSTRING, lit: `test`},
 		{s: `$host`, tok: token.BOUNDPARAM, lit: `$host`},
 		{s: `$"host param"`, tok: token.BOUNDPARAM, lit: `$host param`},
+		{s: `@timestamp`, tok: token.SYSREF, lit: `@timestamp`},
+		{s: `@_row_id2`, tok: token.SYSREF, lit: `@_row_id2`},
+		{s: `@"system time"`, tok: token.SYSREF, lit: `@system time`},
+		{s: `@ timestamp`, tok: token.ILLEGAL, lit: `@`},
+		{s: `@`, tok: token.ILLEGAL, lit: `@`},
 
-		{s: `true`, tok: token.TRUE},
-		{s: `false`, tok: token.FALSE},
+		{s: `true`, tok: token.TRUE, lit: `true`},
+		{s: `false`, tok: token.FALSE, lit: `false`},
 
 		// Strings
 		{s: `'testing 123!'`, tok: token.STRING, lit: `testing 123!`},
@@ -84,6 +117,12 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `'test`, tok: token.BADSTRING, lit: `test`},
 		{s: "'test\nfoo", tok: token.BADSTRING, lit: `test`},
 		{s: `'test\g'`, tok: token.BADESCAPE, lit: `\g`, pos: token.Pos{Line: 0, Char: 6}},
+		{s: `'a\tb'`, tok: token.STRING, lit: "a\tb"},
+		{s: `'\u00e9'`, tok: token.STRING, lit: "é"},
+		{s: `'ab\u12'`, tok: token.BADESCAPE, lit: `\u12`, pos: token.Pos{Line: 0, Char: 6}},
+		{s: "'te\x00st'", tok: token.BADSTRING, lit: `te`},
+		{s: "'te\xffst'", tok: token.BADSTRING, lit: `te`},
+		{s: "\"te\x00st\"", tok: token.BADSTRING, lit: `te`},
 
 		// Numbers
 		{s: `100`, tok: token.INTEGER, lit: `100`},
@@ -104,27 +143,28 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `10x`, tok: token.DURATIONVAL, lit: `10x`}, // non-duration unit, but scanned as a duration value
 
 		// Keywords
-		{s: `ALL`, tok: token.ALL},
-		{s: `AS`, tok: token.AS},
-		{s: `ASC`, tok: token.ASC},
-		{s: `BEGIN`, tok: token.BEGIN},
-		{s: `BY`, tok: token.BY},
-		{s: `DESC`, tok: token.DESC},
-		{s: `EXPLAIN`, tok: token.EXPLAIN},
-		{s: `FIELD`, tok: token.FIELD},
-		{s: `FROM`, tok: token.FROM},
-		{s: `GROUP`, tok: token.GROUP},
-		{s: `INSERT`, tok: token.INSERT},
-		{s: `INTO`, tok: token.INTO},
-		{s: `LIMIT`, tok: token.LIMIT},
-		{s: `METRIC`, tok: token.METRIC},
-		{s: `OFFSET`, tok: token.OFFSET},
-		{s: `ORDER`, tok: token.ORDER},
-		{s: `SELECT`, tok: token.SELECT},
-		{s: `TAG`, tok: token.TAG},
-		{s: `WHERE`, tok: token.WHERE},
-		{s: `explain`, tok: token.EXPLAIN}, // case insensitive
-		{s: `seLECT`, tok: token.SELECT},   // case insensitive
+		{s: `ALL`, tok: token.ALL, lit: `ALL`},
+		{s: `AS`, tok: token.AS, lit: `AS`},
+		{s: `ASC`, tok: token.ASC, lit: `ASC`},
+		{s: `BEGIN`, tok: token.BEGIN, lit: `BEGIN`},
+		{s: `BY`, tok: token.BY, lit: `BY`},
+		{s: `DESC`, tok: token.DESC, lit: `DESC`},
+		{s: `EXPLAIN`, tok: token.EXPLAIN, lit: `EXPLAIN`},
+		{s: `FIELD`, tok: token.FIELD, lit: `FIELD`},
+		{s: `FROM`, tok: token.FROM, lit: `FROM`},
+		{s: `GROUP`, tok: token.GROUP, lit: `GROUP`},
+		{s: `INSERT`, tok: token.INSERT, lit: `INSERT`},
+		{s: `INTO`, tok: token.INTO, lit: `INTO`},
+		{s: `LIMIT`, tok: token.LIMIT, lit: `LIMIT`},
+		{s: `METRIC`, tok: token.METRIC, lit: `METRIC`},
+		{s: `OFFSET`, tok: token.OFFSET, lit: `OFFSET`},
+		{s: `ORDER`, tok: token.ORDER, lit: `ORDER`},
+		{s: `SELECT`, tok: token.SELECT, lit: `SELECT`},
+		{s: `TAG`, tok: token.TAG, lit: `TAG`},
+		{s: `WHERE`, tok: token.WHERE, lit: `WHERE`},
+		{s: `explain`, tok: token.EXPLAIN, lit: `explain`}, // case insensitive
+		{s: `from`, tok: token.FROM, lit: `from`},          // case insensitive
+		{s: `seLECT`, tok: token.SELECT, lit: `seLECT`},    // case insensitive
 	}
 
 	for i, tt := range tests {
@@ -148,21 +188,21 @@ func TestScanner_Scan_Multi(t *testing.T) {
 		lit string
 	}
 	exp := []result{
-		{pos: token.Pos{Line: 0, Char: 0}, tok: token.SELECT, lit: ""},
+		{pos: token.Pos{Line: 0, Char: 0}, tok: token.SELECT, lit: "SELECT"},
 		{pos: token.Pos{Line: 0, Char: 6}, tok: token.WS, lit: " "},
 		{pos: token.Pos{Line: 0, Char: 7}, tok: token.IDENT, lit: "value"},
 		{pos: token.Pos{Line: 0, Char: 12}, tok: token.WS, lit: " "},
-		{pos: token.Pos{Line: 0, Char: 13}, tok: token.FROM, lit: ""},
+		{pos: token.Pos{Line: 0, Char: 13}, tok: token.FROM, lit: "from"},
 		{pos: token.Pos{Line: 0, Char: 17}, tok: token.WS, lit: " "},
 		{pos: token.Pos{Line: 0, Char: 18}, tok: token.IDENT, lit: "ma"},
 		{pos: token.Pos{Line: 0, Char: 20}, tok: token.WS, lit: " "},
-		{pos: token.Pos{Line: 0, Char: 21}, tok: token.WHERE, lit: ""},
+		{pos: token.Pos{Line: 0, Char: 21}, tok: token.WHERE, lit: "WHERE"},
 		{pos: token.Pos{Line: 0, Char: 26}, tok: token.WS, lit: " "},
 		{pos: token.Pos{Line: 0, Char: 27}, tok: token.IDENT, lit: "a"},
 		{pos: token.Pos{Line: 0, Char: 28}, tok: token.WS, lit: " "},
 		{pos: token.Pos{Line: 0, Char: 29}, tok: token.EQ, lit: ""},
 		{pos: token.Pos{Line: 0, Char: 30}, tok: token.WS, lit: " "},
-		{pos: token.Pos{Line: 0, Char: 30}, tok: token.STRING, lit: "b"},
+		{pos: token.Pos{Line: 0, Char: 31}, tok: token.STRING, lit: "b"},
 		{pos: token.Pos{Line: 0, Char: 34}, tok: token.EOF, lit: ""},
 	}
 
@@ -211,6 +251,19 @@ func TestScanString(t *testing.T) {
 		{in: `"foo` + "\n", out: `foo`, err: "bad string"}, // newline in string
 		{in: `"foo`, out: `foo`, err: "bad string"},        // unclosed quotes
 		{in: `"foo\xbar"`, out: `\x`, err: "bad escape"},   // invalid escape
+		{in: `'foo\tbar\r'`, out: "foo\tbar\r"},
+		{in: `'foo\0bar'`, out: "foo\x00bar"},
+		{in: `'\u00e9t\u00E9'`, out: "été"},
+		{in: `'\U0001F600'`, out: "\U0001F600"},
+		{in: `'\u00e'`, out: `\u00e`, err: `bad escape: \u escape requires 4 hex digits, found 3`},
+		{in: `'\u'`, out: `\u`, err: `bad escape: \u escape requires 4 hex digits, found 0`},
+		{in: `'\U0001F60'`, out: `\U0001F60`, err: `bad escape: \U escape requires 8 hex digits, found 7`},
+		{in: `'\U00110000'`, out: `\U00110000`, err: `bad escape: code point \U00110000 is out of range`},
+		{in: `'\UFFFFFFFF'`, out: `\UFFFFFFFF`, err: `bad escape: code point \UFFFFFFFF is out of range`},
+		{in: `'\U80000000'`, out: `\U80000000`, err: `bad escape: code point \U80000000 is out of range`},
+		{in: `'\uD800'`, out: `\uD800`, err: `bad escape: code point \uD800 is a surrogate half`},
+		{in: "\"foo\x00bar\"", out: `foo`, err: "bad string"}, // NUL in string
+		{in: "\"foo\xffbar\"", out: `foo`, err: "bad string"}, // invalid UTF-8 in string
 	}
 
 	for i, tt := range tests {
@@ -223,6 +276,208 @@ func TestScanString(t *testing.T) {
 	}
 }
 
+// Ensure quoted strings scan back to their original value.
+func TestScanString_QuoteString(t *testing.T) {
+	for i, in := range []string{
+		"foo bar",
+		"foo\nbar",
+		"foo\tbar\r\n",
+		"nul\x00byte",
+		`back\slash 'quoted'`,
+	} {
+		out, err := scanner.ScanString(strings.NewReader(tools.QuoteString(in)))
+		if err != nil {
+			t.Errorf("%d. %q: unexpected error: %s", i, in, err)
+		} else if out != in {
+			t.Errorf("%d. %q: out: exp=%q, got=%q", i, in, in, out)
+		}
+	}
+}
+
+// Ensure a keyword made non-reserved is scanned as an identifier.
+func TestScanner_AllowKeywordAsIdent(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader(`Metric metric FIELD`))
+	s.AllowKeywordAsIdent(token.METRIC)
+
+	type result struct {
+		tok token.Token
+		lit string
+	}
+	for i, exp := range []result{
+		{tok: token.IDENT, lit: "Metric"},
+		{tok: token.WS, lit: " "},
+		{tok: token.IDENT, lit: "metric"},
+		{tok: token.WS, lit: " "},
+		{tok: token.FIELD, lit: "FIELD"},
+		{tok: token.EOF},
+	} {
+		if _, tok, lit := s.Scan(); tok != exp.tok || lit != exp.lit {
+			t.Fatalf("%d. token mismatch: exp=%s %q got=%s %q", i, exp.tok, exp.lit, tok, lit)
+		}
+	}
+}
+
+// Ensure the casing of a keyword can be recovered from its source text.
+func TestScanner_KeywordCase(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader(`Select value from cpu WHERE`))
+	for _, exp := range []struct {
+		tok token.Token
+		raw string
+	}{
+		{tok: token.SELECT, raw: "Select"},
+		{tok: token.IDENT, raw: "value"},
+		{tok: token.FROM, raw: "from"},
+		{tok: token.IDENT, raw: "cpu"},
+		{tok: token.WHERE, raw: "WHERE"},
+	} {
+		_, tok, raw := s.ScanRaw()
+		for tok == token.WS {
+			_, tok, raw = s.ScanRaw()
+		}
+		if tok != exp.tok || raw != exp.raw {
+			t.Fatalf("token mismatch: exp=%s %q got=%s %q", exp.tok, exp.raw, tok, raw)
+		} else if kw := token.Lookup(raw); kw != tok {
+			t.Fatalf("lookup mismatch: exp=%s got=%s for %q", exp.tok, kw, raw)
+		}
+	}
+}
+
+// Ensure the scanner returns the same tokens after the maximum number of
+// consecutive unscans and panics when that number is exceeded.
+func TestScanner_Unscan(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader(`SELECT value FROM cpu`))
+	s.Scan()
+	_, tok0, lit0 := s.Scan()
+	_, tok1, lit1 := s.Scan()
+	_, tok2, lit2 := s.Scan()
+	s.Unscan()
+	s.Unscan()
+	s.Unscan()
+	for _, exp := range []struct {
+		tok token.Token
+		lit string
+	}{{tok0, lit0}, {tok1, lit1}, {tok2, lit2}} {
+		if _, tok, lit := s.Scan(); tok != exp.tok || lit != exp.lit {
+			t.Fatalf("token mismatch: exp=%s %q got=%s %q", exp.tok, exp.lit, tok, lit)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		s.Unscan()
+	}
+}
+
+// Ensure positions are correct in a multi-line query with comments,
+// mixed line endings and multi-byte runes.
+func TestScanner_Scan_MultiLinePos(t *testing.T) {
+	type result struct {
+		pos token.Pos
+		tok token.Token
+		lit string
+	}
+	exp := []result{
+		{pos: token.Pos{Line: 0, Char: 0}, tok: token.SELECT, lit: "SELECT"},
+		{pos: token.Pos{Line: 0, Char: 6}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 0, Char: 7}, tok: token.IDENT, lit: "café"},
+		{pos: token.Pos{Line: 0, Char: 13}, tok: token.COMMA},
+		{pos: token.Pos{Line: 0, Char: 14}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 0, Char: 15}, tok: token.STRING, lit: "a\nb"},
+		{pos: token.Pos{Line: 0, Char: 21}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 0, Char: 22}, tok: token.COMMENT, lit: "/* one\ntwo\nthree */"},
+		{pos: token.Pos{Line: 2, Char: 8}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 2, Char: 9}, tok: token.FROM, lit: "FROM"},
+		{pos: token.Pos{Line: 2, Char: 13}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 2, Char: 14}, tok: token.IDENT, lit: "µ"},
+		{pos: token.Pos{Line: 2, Char: 17}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 2, Char: 18}, tok: token.COMMENT, lit: "-- note é"},
+		{pos: token.Pos{Line: 3, Char: 0}, tok: token.WHERE, lit: "WHERE"},
+		{pos: token.Pos{Line: 3, Char: 5}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 3, Char: 6}, tok: token.IDENT, lit: "x"},
+		{pos: token.Pos{Line: 3, Char: 7}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 3, Char: 8}, tok: token.EQ},
+		{pos: token.Pos{Line: 3, Char: 9}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 3, Char: 10}, tok: token.STRING, lit: "ü"},
+		{pos: token.Pos{Line: 3, Char: 13}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 3, Char: 14}, tok: token.AND, lit: "AND"},
+		{pos: token.Pos{Line: 3, Char: 17}, tok: token.WS, lit: "\n"},
+		{pos: token.Pos{Line: 4, Char: 0}, tok: token.IDENT, lit: "y"},
+		{pos: token.Pos{Line: 4, Char: 1}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 4, Char: 2}, tok: token.EQ},
+		{pos: token.Pos{Line: 4, Char: 3}, tok: token.WS, lit: " "},
+		{pos: token.Pos{Line: 4, Char: 4}, tok: token.ILLEGAL, lit: "#"},
+		{pos: token.Pos{Line: 4, Char: 5}, tok: token.EOF},
+	}
+
+	v := "SELECT \"café\", 'a\\nb' /* one\r\ntwo\rthree */ FROM \"µ\" -- note é\r\nWHERE x = 'ü' AND\ry = #"
+	s := scanner.NewScanner(strings.NewReader(v))
+	for i := range exp {
+		pos, tok, lit := s.Scan()
+		if got := (result{pos: pos, tok: tok, lit: lit}); got != exp[i] {
+			t.Fatalf("%d. token mismatch:\n\nexp=%#v\n\ngot=%#v", i, exp[i], got)
+		}
+	}
+}
+
+// Ensure the scanner returns the source text of the current token.
+func TestScanner_Raw(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader(`with "WITH"`))
+	if _, _, lit := s.Scan(); s.Raw() != lit {
+		t.Fatalf("unexpected raw: %q", s.Raw())
+	}
+	s.Scan()
+	if _, tok, lit := s.Scan(); tok != token.IDENT || lit != "WITH" || s.Raw() != `"WITH"` {
+		t.Fatalf("unexpected token: %s %q %q", tok, lit, s.Raw())
+	}
+
+	// The current token is the last one that was not unscanned.
+	s.Unscan()
+	if raw := s.Raw(); raw != " " {
+		t.Fatalf("unexpected raw after unscan: %q", raw)
+	}
+}
+
+// Ensure the scanner returns the source text of a token.
+func TestScanner_ScanRaw(t *testing.T) {
+	var tests = []struct {
+		s   string
+		tok token.Token
+		lit string
+		raw string
+	}{
+		{s: `"foo\nbar"`, tok: token.IDENT, lit: "foo\nbar", raw: `"foo\nbar"`},
+		{s: `"foo\"bar"`, tok: token.IDENT, lit: `foo"bar`, raw: `"foo\"bar"`},
+		{s: `'it\'s é'`, tok: token.STRING, lit: "it's é", raw: `'it\'s é'`},
+		{s: "'foo", tok: token.BADSTRING, lit: "foo", raw: "'foo"},
+		{s: "/* a\r\nb */", tok: token.COMMENT, lit: "/* a\nb */", raw: "/* a\r\nb */"},
+		{s: "\xef\xbb\xbfSELECT", tok: token.SELECT, lit: "SELECT", raw: "SELECT"},
+		{s: "\xff", tok: token.ILLEGAL, lit: "invalid UTF-8 encoding", raw: "\xff"},
+		{s: "10m", tok: token.DURATIONVAL, lit: "10m", raw: "10m"},
+		{s: "12µs", tok: token.DURATIONVAL, lit: "12µs", raw: "12µs"},
+		{s: "1.5\r\n", tok: token.NUMBER, lit: "1.5", raw: "1.5"},
+		{s: "42\xff", tok: token.INTEGER, lit: "42", raw: "42"},
+		{s: "42é", tok: token.INTEGER, lit: "42", raw: "42"},
+		{s: "\r\n\t", tok: token.WS, lit: "\n\t", raw: "\r\n\t"},
+		{s: "", tok: token.EOF, lit: "", raw: ""},
+	}
+
+	for i, tt := range tests {
+		_, tok, lit := scanner.NewScanner(strings.NewReader(tt.s)).Scan()
+		_, _, raw := scanner.NewScanner(strings.NewReader(tt.s)).ScanRaw()
+		if tt.tok != tok {
+			t.Errorf("%d. %q token mismatch: exp=%q got=%q <%q>", i, tt.s, tt.tok, tok, lit)
+		} else if tt.lit != lit {
+			t.Errorf("%d. %q literal mismatch: exp=%q got=%q", i, tt.s, tt.lit, lit)
+		} else if tt.raw != raw {
+			t.Errorf("%d. %q raw mismatch: exp=%q got=%q", i, tt.s, tt.raw, raw)
+		}
+	}
+}
+
 // Test scanning regex
 func TestScanRegex(t *testing.T) {
 	var tests = []struct {
@@ -236,6 +491,8 @@ func TestScanRegex(t *testing.T) {
 		{in: `/foo\\/bar/`, tok: token.REGEX, lit: `foo\/bar`},
 		{in: `/foo\\bar/`, tok: token.REGEX, lit: `foo\\bar`},
 		{in: `/http\:\/\/www\.example\.com/`, tok: token.REGEX, lit: `http\://www\.example\.com`},
+		{in: "/foo\x00bar/", tok: token.BADREGEX},
+		{in: "/foo\xffbar/", tok: token.BADREGEX},
 	}
 
 	for i, tt := range tests {
@@ -250,6 +507,405 @@ func TestScanRegex(t *testing.T) {
 	}
 }
 
+// Ensure positions are correct across \r, \n and \r\n line endings.
+func TestScanner_Scan_LineEndings(t *testing.T) {
+	type result struct {
+		pos token.Pos
+		tok token.Token
+		lit string
+	}
+	var tests = []struct {
+		s   string
+		exp []result
+	}{
+		{
+			s: "SELECT a\rFROM b\r\nWHERE c = 'x'\n\r\rLIMIT 1\r",
+			exp: []result{
+				{pos: token.Pos{Line: 0, Char: 0}, tok: token.SELECT, lit: "SELECT"},
+				{pos: token.Pos{Line: 0, Char: 6}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 0, Char: 7}, tok: token.IDENT, lit: "a"},
+				{pos: token.Pos{Line: 0, Char: 8}, tok: token.WS, lit: "\n"},
+				{pos: token.Pos{Line: 1, Char: 0}, tok: token.FROM, lit: "FROM"},
+				{pos: token.Pos{Line: 1, Char: 4}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 1, Char: 5}, tok: token.IDENT, lit: "b"},
+				{pos: token.Pos{Line: 1, Char: 6}, tok: token.WS, lit: "\n"},
+				{pos: token.Pos{Line: 2, Char: 0}, tok: token.WHERE, lit: "WHERE"},
+				{pos: token.Pos{Line: 2, Char: 5}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 2, Char: 6}, tok: token.IDENT, lit: "c"},
+				{pos: token.Pos{Line: 2, Char: 7}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 2, Char: 8}, tok: token.EQ},
+				{pos: token.Pos{Line: 2, Char: 9}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 2, Char: 10}, tok: token.STRING, lit: "x"},
+				{pos: token.Pos{Line: 2, Char: 13}, tok: token.WS, lit: "\n\n\n"},
+				{pos: token.Pos{Line: 5, Char: 0}, tok: token.LIMIT, lit: "LIMIT"},
+				{pos: token.Pos{Line: 5, Char: 5}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 5, Char: 6}, tok: token.INTEGER, lit: "1"},
+				{pos: token.Pos{Line: 5, Char: 7}, tok: token.WS, lit: "\n"},
+				{pos: token.Pos{Line: 6, Char: 0}, tok: token.EOF},
+			},
+		},
+		{
+			s: "a\r\r\nb",
+			exp: []result{
+				{pos: token.Pos{Line: 0, Char: 0}, tok: token.IDENT, lit: "a"},
+				{pos: token.Pos{Line: 0, Char: 1}, tok: token.WS, lit: "\n\n"},
+				{pos: token.Pos{Line: 2, Char: 0}, tok: token.IDENT, lit: "b"},
+				{pos: token.Pos{Line: 2, Char: 1}, tok: token.EOF},
+			},
+		},
+		{
+			s: "'a'\r'b'\r\n\"c\"",
+			exp: []result{
+				{pos: token.Pos{Line: 0, Char: 0}, tok: token.STRING, lit: "a"},
+				{pos: token.Pos{Line: 0, Char: 3}, tok: token.WS, lit: "\n"},
+				{pos: token.Pos{Line: 1, Char: 0}, tok: token.STRING, lit: "b"},
+				{pos: token.Pos{Line: 1, Char: 3}, tok: token.WS, lit: "\n"},
+				{pos: token.Pos{Line: 2, Char: 0}, tok: token.IDENT, lit: "c"},
+				{pos: token.Pos{Line: 2, Char: 3}, tok: token.EOF},
+			},
+		},
+		{
+			s: "a -- c\rb /* x\r\ny */ c\r\"d\"",
+			exp: []result{
+				{pos: token.Pos{Line: 0, Char: 0}, tok: token.IDENT, lit: "a"},
+				{pos: token.Pos{Line: 0, Char: 1}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 0, Char: 2}, tok: token.COMMENT, lit: "-- c"},
+				{pos: token.Pos{Line: 1, Char: 0}, tok: token.IDENT, lit: "b"},
+				{pos: token.Pos{Line: 1, Char: 1}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 1, Char: 2}, tok: token.COMMENT, lit: "/* x\ny */"},
+				{pos: token.Pos{Line: 2, Char: 4}, tok: token.WS, lit: " "},
+				{pos: token.Pos{Line: 2, Char: 5}, tok: token.IDENT, lit: "c"},
+				{pos: token.Pos{Line: 2, Char: 6}, tok: token.WS, lit: "\n"},
+				{pos: token.Pos{Line: 3, Char: 0}, tok: token.IDENT, lit: "d"},
+				{pos: token.Pos{Line: 3, Char: 3}, tok: token.EOF},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		s := scanner.NewScanner(strings.NewReader(tt.s))
+		for j, exp := range tt.exp {
+			pos, tok, lit := s.Scan()
+			if got := (result{pos: pos, tok: tok, lit: lit}); got != exp {
+				t.Fatalf("%d.%d. %q token mismatch:\n\nexp=%#v\n\ngot=%#v", i, j, tt.s, exp, got)
+			}
+		}
+	}
+}
+
+// Ensure vertical tabs, form feeds and Unicode spaces do not start a new line.
+func TestScanner_Scan_WhitespacePos(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader("a\f\vb\u00A0c\nd"))
+	for _, exp := range []struct {
+		tok token.Token
+		pos token.Pos
+	}{
+		{tok: token.IDENT, pos: token.Pos{Line: 0, Char: 0}},
+		{tok: token.WS, pos: token.Pos{Line: 0, Char: 1}},
+		{tok: token.IDENT, pos: token.Pos{Line: 0, Char: 3}},
+		{tok: token.WS, pos: token.Pos{Line: 0, Char: 4}},
+		{tok: token.IDENT, pos: token.Pos{Line: 0, Char: 5}},
+		{tok: token.WS, pos: token.Pos{Line: 0, Char: 6}},
+		{tok: token.IDENT, pos: token.Pos{Line: 1, Char: 0}},
+	} {
+		if pos, tok, lit := s.Scan(); tok != exp.tok {
+			t.Fatalf("token mismatch: exp=%s got=%s <%q>", exp.tok, tok, lit)
+		} else if pos != exp.pos {
+			t.Fatalf("%s %q pos mismatch: exp=%#v got=%#v", tok, lit, exp.pos, pos)
+		}
+	}
+}
+
+// Ensure the scanner skips a byte order mark at the start of the input.
+func TestScanner_Scan_BOM(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader("\uFEFFSELECT a FROM b"))
+	if pos, tok, _ := s.Scan(); tok != token.SELECT {
+		t.Fatalf("token mismatch: exp=%s got=%s", token.SELECT, tok)
+	} else if exp := (token.Pos{Line: 0, Char: 0}); pos != exp {
+		t.Fatalf("pos mismatch: exp=%#v got=%#v", exp, pos)
+	}
+
+	// A byte order mark anywhere else is not skipped.
+	s = scanner.NewScanner(strings.NewReader("SELECT \uFEFF"))
+	s.Scan()
+	s.Scan()
+	if _, tok, lit := s.Scan(); tok != token.ILLEGAL || lit != "\uFEFF" {
+		t.Fatalf("unexpected token: %s %q", tok, lit)
+	}
+}
+
+// Ensure the scanner reports NUL and invalid UTF-8 bytes at their position.
+func TestScanner_Scan_BadRunes(t *testing.T) {
+	s := scanner.NewScanner(strings.NewReader("SELECT a\xff FROM b"))
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			t.Fatal("expected ILLEGAL token")
+		} else if tok != token.ILLEGAL {
+			continue
+		}
+
+		if exp := (token.Pos{Line: 0, Char: 8}); pos != exp {
+			t.Fatalf("pos mismatch: exp=%#v got=%#v", exp, pos)
+		} else if lit != "invalid UTF-8 encoding" {
+			t.Fatalf("literal mismatch: got=%q", lit)
+		}
+		return
+	}
+}
+
+// Ensure the scanner never panics and never returns a literal containing
+// invalid UTF-8, regardless of input. NUL may only be produced by an escape.
+func FuzzScanner_Scan(f *testing.F) {
+	for _, seed := range []string{
+		`SELECT value FROM cpu WHERE host = 'a' AND region =~ /west/`,
+		"SELECT \xff FROM \x00",
+		"'foo\x00bar'",
+		"\"foo\xffbar\"",
+		"/foo\xff/",
+		"$\x00",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, in string) {
+		s := scanner.NewScanner(strings.NewReader(in))
+		for i := 0; ; i++ {
+			var tok token.Token
+			var lit string
+			if i%2 == 0 {
+				_, tok, lit = s.Scan()
+			} else {
+				_, tok, lit = s.ScanRegex()
+			}
+			if !utf8.ValidString(lit) {
+				t.Fatalf("invalid UTF-8 in %s literal: %q", tok, lit)
+			} else if strings.ContainsRune(lit, 0) && !strings.ContainsRune(in, '\\') {
+				t.Fatalf("NUL in %s literal: %q", tok, lit)
+			}
+			if tok == token.EOF {
+				return
+			}
+		}
+	})
+}
+
+// Ensure the source text of all tokens adds up to the input.
+func FuzzScanner_ScanRaw(f *testing.F) {
+	for _, seed := range []string{
+		`SELECT "a\"b", 'cé' FROM cpu -- note`,
+		"SELECT \xff\r\nFROM\r\x00 /* a\r\nb */",
+		"\xef\xbb\xbf10m + 'foo",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, in string) {
+		s := scanner.NewScanner(strings.NewReader(in))
+		var buf strings.Builder
+		for {
+			_, tok, raw := s.ScanRaw()
+			buf.WriteString(raw)
+			if tok == token.EOF {
+				break
+			}
+		}
+		if exp := strings.TrimPrefix(in, "\uFEFF"); buf.String() != exp {
+			t.Fatalf("raw mismatch:\n\nexp=%q\n\ngot=%q", exp, buf.String())
+		}
+	})
+}
+
+// Ensure identifiers are scanned the same way whatever the reads of the
+// underlying reader return, and the same as ScanBareIdent reads them, over
+// the statements of the parser's round-trip corpus.
+func TestScanner_Scan_Corpus(t *testing.T) {
+	files, err := filepath.Glob("../parser/testdata/roundtrip/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) == 0 {
+		t.Fatal("no corpus files")
+	}
+
+	type result struct {
+		pos token.Pos
+		tok token.Token
+		lit string
+		raw string
+	}
+	scanAll := func(r io.Reader) []result {
+		var a []result
+		s := scanner.NewScanner(r)
+		for {
+			pos, tok, raw := s.ScanRaw()
+			s.Unscan()
+			_, _, lit := s.Scan()
+			a = append(a, result{pos: pos, tok: tok, lit: lit, raw: raw})
+			if tok == token.EOF {
+				return a
+			}
+		}
+	}
+
+	for _, file := range files {
+		in, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := scanAll(strings.NewReader(string(in)))
+		if got := scanAll(iotest.OneByteReader(strings.NewReader(string(in)))); !reflect.DeepEqual(exp, got) {
+			t.Errorf("%s: tokens differ when reading a byte at a time", file)
+		}
+
+		var n int
+		for _, r := range exp {
+			isBare := strings.IndexFunc(r.raw, func(ch rune) bool { return !tools.IsIdentChar(ch) }) < 0
+			if r.raw == "" || !tools.IsIdentFirstChar(rune(r.raw[0])) || !isBare {
+				continue
+			}
+			n++
+			if lit := scanner.ScanBareIdent(strings.NewReader(r.raw)); lit != r.lit {
+				t.Errorf("%s: %s at %v: exp=%q got=%q", file, r.tok, r.pos, lit, r.lit)
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: no identifiers", file)
+		}
+	}
+}
+
+// Ensure interned identifiers share their strings, up to the maximum number
+// of distinct ones.
+func TestScanner_InternIdents(t *testing.T) {
+	// sameString returns true if a and b share their bytes.
+	sameString := func(a, b string) bool {
+		return (*reflect.StringHeader)(unsafe.Pointer(&a)).Data == (*reflect.StringHeader)(unsafe.Pointer(&b)).Data
+	}
+	scanIdents := func(s scanner.Scanner) []string {
+		var a []string
+		for {
+			_, tok, lit := s.Scan()
+			if tok == token.EOF {
+				return a
+			} else if tok != token.WS {
+				a = append(a, lit)
+			}
+		}
+	}
+
+	in := `value host SELECT value "value" a_b host cc SELECT cc`
+	s := scanner.NewScanner(strings.NewReader(in))
+	s.InternIdents(3)
+	lits := scanIdents(s)
+	if exp := strings.Fields(strings.Replace(in, `"value"`, "value", 1)); !reflect.DeepEqual(lits, exp) {
+		t.Fatalf("unexpected literals:\n  exp=%q\n  got=%q", exp, lits)
+	}
+	for _, tt := range []struct {
+		i, j int
+		same bool
+	}{
+		{i: 0, j: 3, same: true},  // value
+		{i: 1, j: 6, same: true},  // host
+		{i: 2, j: 8, same: true},  // SELECT
+		{i: 0, j: 4, same: false}, // quoted identifiers are not interned
+		{i: 7, j: 9, same: false}, // cc is past the limit, after a_b
+	} {
+		if got := sameString(lits[tt.i], lits[tt.j]); got != tt.same {
+			t.Errorf("%q at %d and %d: exp same=%v got=%v", lits[tt.i], tt.i, tt.j, tt.same, got)
+		}
+	}
+
+	// Interning is off by default, and can be turned off again.
+	for _, n := range []int{-1, 0} {
+		s := scanner.NewScanner(strings.NewReader(in))
+		if n < 0 {
+			s.InternIdents(10)
+			s.InternIdents(0)
+		}
+		if lits := scanIdents(s); sameString(lits[0], lits[3]) {
+			t.Errorf("%d. expected identifiers not to be interned", n)
+		}
+	}
+}
+
+// benchQuery is a representative query with keywords, identifiers, strings,
+// numbers, durations, a regex and a comment.
+const benchQuery = `SELECT mean(usage_idle) AS idle, max("usage user"), host::tag FROM telegraf.autogen.cpu ` +
+	`WHERE time > now() - 1h AND host =~ /^server[0-9]+\.example\.com$/ AND region = 'us-west' -- a comment` + "\n" +
+	`GROUP BY time(10m), datacenter_availability_zone fill(0) LIMIT 100 OFFSET 2.5`
+
+// BenchmarkScanner_Scan measures scanning a representative query.
+func BenchmarkScanner_Scan(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchQuery)))
+	for i := 0; i < b.N; i++ {
+		s := scanner.NewScanner(strings.NewReader(benchQuery))
+		for {
+			if _, tok, _ := s.Scan(); tok == token.EOF {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkScanner_ScanIdent measures scanning long identifiers.
+func BenchmarkScanner_ScanIdent(b *testing.B) {
+	in := strings.Repeat("measurement_name_with_a_long_suffix_0123456789 ", 20)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		s := scanner.NewScanner(strings.NewReader(in))
+		for {
+			if _, tok, _ := s.Scan(); tok == token.EOF {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkScanner_InternIdents measures scanning statements that repeat the
+// same names, with and without interning identifiers.
+func BenchmarkScanner_InternIdents(b *testing.B) {
+	in := strings.Repeat("SELECT mean(value), max(value) FROM cpu WHERE host = 'a' AND time > now() - 1h GROUP BY host;\n", 50)
+	for _, n := range []int{0, 64} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(in)))
+			for i := 0; i < b.N; i++ {
+				s := scanner.NewScanner(strings.NewReader(in))
+				s.InternIdents(n)
+				for {
+					if _, tok, _ := s.Scan(); tok == token.EOF {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkScanBareIdent measures reading a bare identifier from a rune reader.
+func BenchmarkScanBareIdent(b *testing.B) {
+	in := "measurement_name_with_a_long_suffix_0123456789"
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		scanner.ScanBareIdent(strings.NewReader(in))
+	}
+}
+
+// BenchmarkScanString measures reading a quoted string with escapes.
+func BenchmarkScanString(b *testing.B) {
+	in := `'a string with \'escaped\' quotes, a \n newline and some more text to read'`
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		if _, err := scanner.ScanString(strings.NewReader(in)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func errstring(err error) string {
 	if err != nil {
 		return err.Error()
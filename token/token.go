@@ -19,6 +19,7 @@ const (
 	literal_beg // Identifiers and basic type literals
 	IDENT       // main
 	BOUNDPARAM  // $param
+	SYSREF      // @timestamp
 	NUMBER      // 12345.67
 	INTEGER     // 12345i
 	DURATIONVAL // 13h
@@ -61,6 +62,8 @@ const (
 	DOUBLECOLON // ::
 	SEMICOLON   // ;
 	DOT         // .
+	ARROW       // ->
+	NOT         // !
 
 	keyword_beg // Keywords
 	ALL
@@ -98,6 +101,7 @@ var tokens = [...]string{
 	WS:      "WS",
 
 	IDENT:       "IDENT",
+	SYSREF:      "SYSREF",
 	NUMBER:      "NUMBER",
 	DURATIONVAL: "DURATIONVAL",
 	STRING:      "STRING",
@@ -135,6 +139,8 @@ var tokens = [...]string{
 	DOUBLECOLON: "::",
 	SEMICOLON:   ";",
 	DOT:         ".",
+	ARROW:       "->",
+	NOT:         "!",
 
 	ALL:      "ALL",
 	ANALYZE:  "ANALYZE",
@@ -193,7 +199,7 @@ func (tok Token) Precedence() int {
 		return 1
 	case AND:
 		return 2
-	case EQ, NEQ, EQREGEX, NEQREGEX, LT, LTE, GT, GTE:
+	case EQ, NEQ, EQREGEX, NEQREGEX, LT, LTE, GT, GTE, IN:
 		return 3
 	case ADD, SUB, BITOR, BITXOR:
 		return 4
@@ -208,6 +214,16 @@ func (tok Token) IsOperator() bool {
 	return tok > operator_beg && tok < operator_end
 }
 
+// IsKeyword returns true for tokens scanned from a keyword, which includes
+// the AND and OR operators and the TRUE and FALSE literals.
+func (tok Token) IsKeyword() bool {
+	switch tok {
+	case AND, OR, TRUE, FALSE:
+		return true
+	}
+	return tok > keyword_beg && tok < keyword_end
+}
+
 // IsRegexOp returns true if the operator accepts a regex operand.
 func (tok Token) IsRegexOp() bool {
 	return tok == EQREGEX || tok == NEQREGEX
@@ -223,6 +239,8 @@ func Lookup(ident string) Token {
 
 // Pos specifies the line and character position of a token.
 // The Char and Line are both zero-based indexes.
+// Char counts runes, not bytes, from the start of the line.
+// "\n", "\r\n" and a lone "\r" each end a line.
 type Pos struct {
 	Line int // line number, starting at 0
 	Char int // offset, starting at 0
@@ -1,16 +1,26 @@
 package tools
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"strings"
 	"time"
+	"unicode"
 
 	"sql/token"
 )
 
-// IsWhitespace returns true if the rune is a space, tab, or newline.
-func IsWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' || ch == '\n' }
+// IsWhitespace returns true if the rune is a space, tab, newline, vertical tab,
+// form feed, or a non-ASCII Unicode space such as the non-breaking space.
+func IsWhitespace(ch rune) bool {
+	switch ch {
+	case ' ', '\t', '\n', '\v', '\f':
+		return true
+	}
+	return ch > unicode.MaxASCII && unicode.IsSpace(ch)
+}
 
 // IsLetter returns true if the rune is a letter.
 func IsLetter(ch rune) bool { return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') }
@@ -18,6 +28,11 @@ func IsLetter(ch rune) bool { return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && c
 // IsDigit returns true if the rune is a digit.
 func IsDigit(ch rune) bool { return (ch >= '0' && ch <= '9') }
 
+// IsHexDigit returns true if the rune is a hexadecimal digit.
+func IsHexDigit(ch rune) bool {
+	return IsDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
 // IsIdentChar returns true if the rune can be used in an unquoted identifier.
 func IsIdentChar(ch rune) bool { return IsLetter(ch) || IsDigit(ch) || ch == '_' }
 
@@ -26,10 +41,10 @@ func IsIdentFirstChar(ch rune) bool { return IsLetter(ch) || ch == '_' }
 
 var (
 	// Quote String replacer.
-	qsReplacer = strings.NewReplacer("\n", `\n`, `\`, `\\`, `'`, `\'`)
+	qsReplacer = strings.NewReplacer("\n", `\n`, "\t", `\t`, "\r", `\r`, "\x00", `\0`, `\`, `\\`, `'`, `\'`)
 
 	// Quote Ident replacer.
-	qiReplacer = strings.NewReplacer("\n", `\n`, `\`, `\\`, `"`, `\"`)
+	qiReplacer = strings.NewReplacer("\n", `\n`, "\t", `\t`, "\r", `\r`, "\x00", `\0`, `\`, `\\`, `"`, `\"`)
 )
 
 // QuoteString returns a quoted string.
@@ -64,9 +79,10 @@ func QuoteIdent(segments ...string) string {
 
 // IdentNeedsQuotes returns true if the ident string given would require quotes.
 func IdentNeedsQuotes(ident string) bool {
-	// check if this identifier is a keyword
+	// check if this identifier is a keyword, or the word UNION, which would
+	// end a list of sources or dimensions that it is the last of
 	tok := token.Lookup(ident)
-	if tok != token.IDENT {
+	if tok != token.IDENT || strings.EqualFold(ident, "union") {
 		return true
 	}
 	for i, r := range ident {
@@ -112,3 +128,107 @@ func FormatDuration(d time.Duration) string {
 	}
 	return fmt.Sprintf("%dns", d)
 }
+
+// ErrInvalidDuration is returned when parsing a malformed duration.
+var ErrInvalidDuration = errors.New("invalid duration")
+
+// ParseDuration parses a time duration from a string.
+// This is needed instead of time.ParseDuration because this will support
+// the full syntax that CnosQL supports for specifying durations
+// including weeks and days. It is the inverse of FormatDuration.
+func ParseDuration(s string) (time.Duration, error) {
+	return parseDuration(s)
+}
+
+// ParseDurationBytes is like ParseDuration, but parses a byte slice, such as
+// a token read from a buffer. A short duration is parsed without allocating.
+// The parser uses ParseDuration instead, since the scanner returns the text of
+// a duration token as a string, which ParseDuration reads without a copy.
+func ParseDurationBytes(b []byte) (time.Duration, error) {
+	return parseDuration(string(b))
+}
+
+// parseDuration implements ParseDuration. s must not escape, so that the
+// conversion in ParseDurationBytes does not need to allocate.
+func parseDuration(s string) (time.Duration, error) {
+	// Return an error if the string is blank or one character
+	if len(s) < 2 {
+		return 0, ErrInvalidDuration
+	}
+
+	// Start with a zero duration.
+	var d time.Duration
+	i := 0
+
+	// Check for a negative.
+	isNegative := false
+	if s[i] == '-' {
+		isNegative = true
+		i++
+	}
+
+	// Parsing loop.
+	for i < len(s) {
+		// Parse the number portion.
+		start := i
+		var n int64
+		for ; i < len(s) && IsDigit(rune(s[i])); i++ {
+			digit := int64(s[i] - '0')
+			if n > (math.MaxInt64-digit)/10 {
+				return 0, ErrInvalidDuration
+			}
+			n = n*10 + digit
+		}
+
+		// Check if we reached the end of the string prematurely.
+		if i >= len(s) || i == start {
+			return 0, ErrInvalidDuration
+		}
+
+		// Extract the unit of measure.
+		// If the next two characters are "ms" then parse as milliseconds.
+		// Otherwise just use the next character as the unit of measure.
+		var unit time.Duration
+		var name string
+		switch s[i] {
+		case 'n':
+			if !strings.HasPrefix(s[i:], "ns") {
+				return 0, ErrInvalidDuration
+			}
+			unit, name = time.Nanosecond, "ns"
+		case 'u':
+			unit, name = time.Microsecond, "u"
+		case 'm':
+			if strings.HasPrefix(s[i:], "ms") {
+				unit, name = time.Millisecond, "ms"
+			} else {
+				unit, name = time.Minute, "m"
+			}
+		case 's':
+			unit, name = time.Second, "s"
+		case 'h':
+			unit, name = time.Hour, "h"
+		case 'd':
+			unit, name = 24*time.Hour, "d"
+		case 'w':
+			unit, name = 7*24*time.Hour, "w"
+		default:
+			if !strings.HasPrefix(s[i:], "µ") {
+				return 0, ErrInvalidDuration
+			}
+			unit, name = time.Microsecond, "µ"
+		}
+		i += len(name)
+
+		// Check to see if we overflowed a duration
+		if n > int64(math.MaxInt64/unit) || d > math.MaxInt64-time.Duration(n)*unit {
+			return 0, fmt.Errorf("overflowed duration %d%s: choose a smaller duration or INF", n, name)
+		}
+		d += time.Duration(n) * unit
+	}
+
+	if isNegative {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,136 @@
+package tools_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"sql/tools"
+)
+
+// Ensure durations are parsed, including weeks, days and microseconds as "µ".
+func TestParseDuration(t *testing.T) {
+	var tests = []struct {
+		s   string
+		d   time.Duration
+		err string
+	}{
+		{s: `10ns`, d: 10},
+		{s: `10u`, d: 10 * time.Microsecond},
+		{s: `10µ`, d: 10 * time.Microsecond},
+		{s: `15ms`, d: 15 * time.Millisecond},
+		{s: `100s`, d: 100 * time.Second},
+		{s: `2m`, d: 2 * time.Minute},
+		{s: `2h`, d: 2 * time.Hour},
+		{s: `2d`, d: 2 * 24 * time.Hour},
+		{s: `2w`, d: 2 * 7 * 24 * time.Hour},
+		{s: `1h30m`, d: 90 * time.Minute},
+		{s: `-1h30m`, d: -90 * time.Minute},
+		{s: `9223372036854775807ns`, d: math.MaxInt64},
+
+		{s: ``, err: `invalid duration`},
+		{s: `3`, err: `invalid duration`},
+		{s: `1000`, err: `invalid duration`},
+		{s: `w`, err: `invalid duration`},
+		{s: `ms`, err: `invalid duration`},
+		{s: `1.2w`, err: `invalid duration`},
+		{s: `10x`, err: `invalid duration`},
+		{s: `10n`, err: `invalid duration`},
+		{s: `1h-1m`, err: `invalid duration`},
+		{s: `99999999999999999999ns`, err: `invalid duration`},
+		{s: `9223372036854775807ns1ns`, err: `overflowed duration 1ns: choose a smaller duration or INF`},
+		{s: `20000w`, err: `overflowed duration 20000w: choose a smaller duration or INF`},
+	}
+
+	for i, tt := range tests {
+		d, err := tools.ParseDuration(tt.s)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %q: error mismatch:\n  exp=%s\n  got=%s", i, tt.s, tt.err, errstring(err))
+		} else if d != tt.d {
+			t.Errorf("%d. %q: duration mismatch: exp=%s got=%s", i, tt.s, tt.d, d)
+		}
+
+		if bd, berr := tools.ParseDurationBytes([]byte(tt.s)); bd != d || errstring(berr) != errstring(err) {
+			t.Errorf("%d. %q: ParseDurationBytes mismatch: exp=%s, %v got=%s, %v", i, tt.s, d, err, bd, berr)
+		}
+	}
+}
+
+// Ensure formatting a duration and parsing it back returns the same duration,
+// and that parsing a canonical duration and formatting it returns the same text.
+func TestFormatDuration_RoundTrip(t *testing.T) {
+	for _, d := range []time.Duration{
+		0, 1, -1, 999, time.Microsecond, 1500 * time.Microsecond, time.Millisecond,
+		time.Second, 90 * time.Second, time.Minute, time.Hour, 36 * time.Hour,
+		24 * time.Hour, 7 * 24 * time.Hour, -7 * 24 * time.Hour, math.MaxInt64, -math.MaxInt64,
+	} {
+		s := tools.FormatDuration(d)
+		if got, err := tools.ParseDuration(s); err != nil {
+			t.Errorf("%d: cannot parse %q: %s", d, s, err)
+		} else if got != d {
+			t.Errorf("%d: %q parsed as %d", d, s, got)
+		}
+	}
+
+	for _, s := range []string{`0s`, `1ns`, `-1ns`, `10u`, `1500u`, `1ms`, `90s`, `1m`, `1h`, `36h`, `1d`, `6d`, `1w`, `-2w`} {
+		d, err := tools.ParseDuration(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", s, err)
+		} else if got := tools.FormatDuration(d); got != s {
+			t.Errorf("%q: formatted as %q", s, got)
+		}
+	}
+}
+
+// FuzzParseDuration ensures that a parsed duration is formatted as a duration
+// that parses back to the same value.
+func FuzzParseDuration(f *testing.F) {
+	for _, s := range []string{`10ns`, `10µ`, `15ms`, `1h30m`, `-2w`, `9223372036854775807ns`} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		d, err := tools.ParseDuration(s)
+		if bd, berr := tools.ParseDurationBytes([]byte(s)); bd != d || errstring(berr) != errstring(err) {
+			t.Fatalf("%q: ParseDurationBytes mismatch: exp=%s, %v got=%s, %v", s, d, err, bd, berr)
+		}
+		if err != nil {
+			return
+		}
+
+		formatted := tools.FormatDuration(d)
+		if got, err := tools.ParseDuration(formatted); err != nil {
+			t.Fatalf("%q: cannot parse %q: %s", s, formatted, err)
+		} else if got != d {
+			t.Fatalf("%q: %q parsed as %d, expected %d", s, formatted, got, d)
+		}
+	})
+}
+
+func BenchmarkParseDuration(b *testing.B) {
+	s := "1w2d3h4m5s6ms7u8ns"
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := tools.ParseDuration(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Bytes", func(b *testing.B) {
+		buf := []byte(s)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := tools.ParseDurationBytes(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func errstring(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}